@@ -0,0 +1,150 @@
+package lsmart
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrAutoBatcherClosed 自动批量提交器已关闭
+var ErrAutoBatcherClosed = errors.New("auto batcher is closed")
+
+// AutoBatcher 自动批量提交器. 在 WriteBatch 之上按照时间间隔与数据量自动提交，
+// 面向遥测等高频写入场景，使用方无需自行管理批量写入的生命周期. 并发安全.
+// 提交失败时累积的操作不会丢弃，留待下一次提交时重试. 后台提交失败时，错误会在下一次调用 Put、Delete、Flush 或者 Close 时返回
+type AutoBatcher struct {
+	tree     *Tree
+	interval time.Duration // 定时提交的时间间隔，不大于 0 时只按照数据量提交
+	maxBytes int           // 累积数据量达到该值时立即提交，单位 byte
+
+	mu     sync.Mutex
+	batch  *WriteBatch // 尚未提交的批量写入
+	err    error       // 后台提交遇到的错误
+	closed bool
+
+	stopc chan struct{}
+	done  chan struct{}
+}
+
+// NewAutoBatcher 构造自动批量提交器. 每隔 interval 或者累积数据量达到 maxBytes 时提交一次.
+// interval 不大于 0 时不启用定时提交，只在累积数据量达到 maxBytes 以及调用 Flush、Close 时提交
+func (t *Tree) NewAutoBatcher(interval time.Duration, maxBytes int) *AutoBatcher {
+	a := AutoBatcher{
+		tree:     t,
+		interval: interval,
+		maxBytes: maxBytes,
+		batch:    NewWriteBatch(),
+		stopc:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go a.run()
+	return &a
+}
+
+// Put 追加一条写入操作. key、value 会被拷贝，调用方可以复用
+func (a *AutoBatcher) Put(key, value []byte) error {
+	return a.append(OpPut, key, value)
+}
+
+// Delete 追加一条删除操作. key 会被拷贝，调用方可以复用
+func (a *AutoBatcher) Delete(key []byte) error {
+	return a.append(OpDelete, key, nil)
+}
+
+// Flush 立即提交所有累积的操作
+func (a *AutoBatcher) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.flushLocked()
+}
+
+// Close 提交所有累积的操作，并停止后台定时提交
+func (a *AutoBatcher) Close() error {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return ErrAutoBatcherClosed
+	}
+	a.closed = true
+	err := a.flushLocked()
+	a.mu.Unlock()
+
+	close(a.stopc)
+	<-a.done
+	return err
+}
+
+func (a *AutoBatcher) append(op OpType, key, value []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return ErrAutoBatcherClosed
+	}
+	if err := a.takeErrLocked(); err != nil {
+		return err
+	}
+
+	key = append([]byte(nil), key...)
+	if op == OpDelete {
+		a.batch.Delete(key)
+	} else {
+		a.batch.Put(key, append([]byte(nil), value...))
+	}
+
+	// 累积数据量达到阈值，立即提交
+	if a.batch.Size() >= a.maxBytes {
+		return a.flushLocked()
+	}
+	return nil
+}
+
+// 提交累积的操作，并返回此前后台提交遇到的错误. 提交失败时保留累积的操作
+func (a *AutoBatcher) flushLocked() error {
+	if err := a.takeErrLocked(); err != nil {
+		return err
+	}
+	return a.commitLocked()
+}
+
+// 提交累积的操作，成功后清空. 失败时保留累积的操作，留待下一次提交时重试
+func (a *AutoBatcher) commitLocked() error {
+	if a.batch.Len() == 0 {
+		return nil
+	}
+	if err := a.tree.Write(a.batch); err != nil {
+		return err
+	}
+	a.batch.Reset()
+	return nil
+}
+
+// 取出并清除后台提交遇到的错误
+func (a *AutoBatcher) takeErrLocked() error {
+	err := a.err
+	a.err = nil
+	return err
+}
+
+// 后台定时提交协程
+func (a *AutoBatcher) run() {
+	defer close(a.done)
+	// 不启用定时提交时只需等待停止信号
+	var tick <-chan time.Time
+	if a.interval > 0 {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-a.stopc:
+			return
+		case <-tick:
+			a.mu.Lock()
+			if err := a.commitLocked(); err != nil {
+				a.err = err
+			}
+			a.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package lsmart
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// ErrBackground 后台溢写、compact 等任务在重试耗尽之后仍然失败. 可以通过 errors.Is 判断
+var ErrBackground = errors.New("background job failed")
+
+// BackgroundError 后台任务失败的错误，包含任务名称以及最后一次执行返回的错误
+type BackgroundError struct {
+	Job string // 任务名称
+	Err error  // 最后一次执行返回的错误
+}
+
+func (e *BackgroundError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ErrBackground, e.Job, e.Err)
+}
+
+// Is 使得 errors.Is(err, ErrBackground) 成立
+func (e *BackgroundError) Is(target error) bool {
+	return target == ErrBackground
+}
+
+// Unwrap 返回最后一次执行返回的错误
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy 后台溢写、compact 遇到暂时性 IO 错误时的重试策略. 每次重试之前按照指数退避等待
+type RetryPolicy struct {
+	MaxAttempts    int                  // 最多执行次数，包含首次执行. 不大于 1 时不重试
+	InitialBackoff time.Duration        // 首次重试之前的等待时间
+	MaxBackoff     time.Duration        // 等待时间的上限. 为 0 时不设上限
+	Multiplier     float64              // 每次重试后等待时间的放大倍数. 小于 1 时视为 1
+	Retryable      func(err error) bool // 判断错误是否值得重试. 为空时使用 IsTransientIOError
+}
+
+// DefaultRetryPolicy 默认的重试策略：最多执行 5 次，等待时间从 10ms 开始翻倍，至多 1s
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+}
+
+// IsTransientIOError 是否为暂时性的 IO 错误，例如系统调用被信号中断、资源暂时不可用，以及网络文件系统的超时
+func IsTransientIOError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EINTR, syscall.EAGAIN, syscall.EBUSY, syscall.ETIMEDOUT, syscall.ESTALE} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	var timeout interface{ Timeout() bool }
+	return errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// BackgroundErrorHandler 后台任务失败时的回调，job 为任务名称. 暂时性错误在重试耗尽之后才会回调
+type BackgroundErrorHandler func(job string, err error)
+
+// 后台任务的名称
+const (
+	backgroundJobFlush      = "flush"
+	backgroundJobCompaction = "compaction"
+	backgroundJobWALArchive = "wal archive"
+)
+
+// 按照重试策略执行后台任务. 遇到暂时性错误时退避重试，重试耗尽、遇到非暂时性错误或者 lsm tree 关闭时返回错误，
+// 并回调 BackgroundErrorHandler
+func (t *Tree) runBackground(job string, fn func() error) error {
+	policy := t.conf.BackgroundRetry
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsTransientIOError
+	}
+
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if attempt >= policy.MaxAttempts || !retryable(err) {
+			t.handleBackgroundErr(job, err)
+			return err
+		}
+
+		// 退避等待期间 lsm tree 关闭时，放弃重试
+		select {
+		case <-t.stopc:
+			t.handleBackgroundErr(job, err)
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// 记录后台任务的错误，并交给使用方注入的回调
+func (t *Tree) handleBackgroundErr(job string, err error) {
+	t.healthLock.Lock()
+	if t.backgroundErrs == nil {
+		t.backgroundErrs = make(map[string]*BackgroundError)
+	}
+	t.backgroundErrs[job] = &BackgroundError{Job: job, Err: err}
+	t.lastBackgroundJob = job
+	t.healthLock.Unlock()
+	t.notifyProgress()
+
+	if t.conf.BackgroundErrorHandler != nil {
+		t.conf.BackgroundErrorHandler(job, err)
+	}
+}
+
+// 后台任务执行成功，清除此前记录的错误
+func (t *Tree) clearBackgroundErr(job string) {
+	t.healthLock.Lock()
+	delete(t.backgroundErrs, job)
+	t.healthLock.Unlock()
+}
+
+// BackgroundError 获取最近一次失败且尚未恢复的后台任务的错误，满足 errors.Is(err, ErrBackground). 没有时返回 nil.
+// 重试耗尽的溢写、compact 会在稍后重新执行，执行成功后错误随之清除
+func (t *Tree) BackgroundError() error {
+	t.healthLock.Lock()
+	defer t.healthLock.Unlock()
+	if err, ok := t.backgroundErrs[t.lastBackgroundJob]; ok {
+		return err
+	}
+	for _, err := range t.backgroundErrs {
+		return err
+	}
+	return nil
+}
+
+// 重试耗尽之后，等待一段时间重新执行后台任务. 等待时间取重试策略中的最大退避时间，未设置时取首次退避时间，
+// 均未设置时等待 1s. 等待期间 lsm tree 关闭时放弃
+func (t *Tree) retryBackgroundLater(fn func()) {
+	delay := t.conf.BackgroundRetry.MaxBackoff
+	if delay <= 0 {
+		delay = t.conf.BackgroundRetry.InitialBackoff
+	}
+	if delay <= 0 {
+		delay = time.Second
+	}
+	go func() {
+		select {
+		case <-t.stopc:
+		case <-time.After(delay):
+			fn()
+		}
+	}()
+}
@@ -8,6 +8,9 @@ import (
 	"github.com/cccccxxy/lsmart/util"
 )
 
+// 数据块中每隔多少笔 kv 对设置一个重启点
+const blockRestartInterval = 16
+
 // Block sst 文件中的数据块，和索引、过滤器为一一对应关系
 type Block struct {
 	conf       *Config       // lsm tree 配置文件
@@ -15,6 +18,9 @@ type Block struct {
 	record     *bytes.Buffer // 用于复制溢写数据的缓冲区
 	entriesCnt int           // kv 对数量
 	prevKey    []byte        // 最晚一笔写入的数据的 key
+
+	restartInterval int      // 每隔多少笔 kv 对设置一个重启点，重启点处的 key 不做前缀压缩. 为 0 时不设置重启点
+	restarts        []uint32 // 各重启点在块中的 offset
 }
 
 // NewBlock 数据块构造器
@@ -25,6 +31,13 @@ func NewBlock(conf *Config) *Block {
 	}
 }
 
+// NewDataBlock 带重启点的数据块构造器. 重启点 offset 追加在块的尾部，使得块内检索可以基于重启点二分查找
+func NewDataBlock(conf *Config) *Block {
+	b := NewBlock(conf)
+	b.restartInterval = blockRestartInterval
+	return b
+}
+
 // Append 追加一组kv对到数据块中
 func (b *Block) Append(key, value []byte) {
 	// 兜底执行：设置 prevKey 为当前写入的 key；累加 entriesCnt 数量
@@ -33,6 +46,12 @@ func (b *Block) Append(key, value []byte) {
 		b.entriesCnt++
 	}()
 
+	// 到达重启点时，记录重启点的 offset，且当前 key 不和之前的 key 共享前缀
+	if b.restartInterval > 0 && b.entriesCnt%b.restartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(b.record.Len()))
+		b.prevKey = b.prevKey[:0]
+	}
+
 	// 获取和之前 key 的共享key前缀长度
 	sharedPrefixLen := util.SharedPrefixLen(b.prevKey, key)
 
@@ -50,16 +69,34 @@ func (b *Block) Append(key, value []byte) {
 
 // Size 获取数据块的大小，单位 byte
 func (b *Block) Size() int {
-	return b.record.Len()
+	if b.restartInterval == 0 {
+		return b.record.Len()
+	}
+	// 尾部需要追加各重启点的 offset 以及重启点个数
+	return b.record.Len() + 4*(len(b.restarts)+1)
 }
 
 // FlushTo 把块中的数据溢写到 dest writer 中
 func (b *Block) FlushTo(dest io.Writer) (uint64, error) {
 	defer b.clear()
+	if b.restartInterval > 0 {
+		b.writeRestarts()
+	}
 	n, err := dest.Write(b.ToBytes())
 	return uint64(n), err
 }
 
+// 将各重启点的 offset 以及重启点个数追加到块的尾部
+func (b *Block) writeRestarts() {
+	var buf [4]byte
+	for _, restart := range b.restarts {
+		binary.LittleEndian.PutUint32(buf[:], restart)
+		b.record.Write(buf[:])
+	}
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(b.restarts)))
+	b.record.Write(buf[:])
+}
+
 // ToBytes 将数据块中的数据转为 byte 数组
 func (b *Block) ToBytes() []byte {
 	return b.record.Bytes()
@@ -69,5 +106,6 @@ func (b *Block) ToBytes() []byte {
 func (b *Block) clear() {
 	b.entriesCnt = 0
 	b.prevKey = b.prevKey[:0]
+	b.restarts = b.restarts[:0]
 	b.record.Reset()
 }
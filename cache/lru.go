@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+// BlockType 缓存块的类型
+type BlockType uint8
+
+const (
+	BlockData   BlockType = iota // 数据块
+	BlockIndex                   // 索引块
+	BlockFilter                  // 过滤器块
+	numBlockTypes
+)
+
+// BlockTypes 所有的缓存块类型
+var BlockTypes = []BlockType{BlockData, BlockIndex, BlockFilter}
+
+func (t BlockType) String() string {
+	switch t {
+	case BlockData:
+		return "data"
+	case BlockIndex:
+		return "index"
+	case BlockFilter:
+		return "filter"
+	default:
+		return "unknown"
+	}
+}
+
+// Key 缓存的 key，对应 sstable 文件中的一个块
+type Key struct {
+	File   string    // sstable 文件名
+	Offset uint64    // 块起始位置在 sstable 中的 offset
+	Type   BlockType // 块的类型
+}
+
+// TypeStats 某一类型缓存块的统计信息
+type TypeStats struct {
+	Hits      uint64 // 命中次数
+	Misses    uint64 // 未命中次数
+	Evictions uint64 // 因容量不足被淘汰的块个数，不含 sstable 文件删除时的淘汰
+	Entries   int    // 已缓存的块个数
+	Size      int    // 已缓存的数据量，单位 byte
+}
+
+// FileStats 某个 sstable 文件的缓存统计信息
+type FileStats struct {
+	File   string // sstable 文件名
+	Hits   uint64 // 命中次数
+	Misses uint64 // 未命中次数
+	Size   int    // 已缓存的数据量，单位 byte
+}
+
+// 缓存中的一个条目
+type entry struct {
+	key   Key
+	value []byte
+}
+
+// LRU 按照数据量限制容量的 lru 缓存，并发安全
+type LRU struct {
+	mu       sync.Mutex
+	capacity int                   // 缓存容量，单位 byte
+	size     int                   // 已缓存的数据量，单位 byte
+	ll       *list.List            // 按照访问时间排列的条目，越靠前越近被访问
+	items    map[Key]*list.Element // key 到条目的映射
+
+	types [numBlockTypes]TypeStats // 各类型块的统计信息
+	files map[string]*FileStats    // 各 sstable 文件的统计信息
+}
+
+// NewLRU lru 缓存构造器，capacity 为缓存容量，单位 byte
+func NewLRU(capacity int) *LRU {
+	return &LRU{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[Key]*list.Element),
+		files:    make(map[string]*FileStats),
+	}
+}
+
+// Get 读取缓存，命中时将条目移动到最近访问的位置
+func (l *LRU) Get(key Key) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	elem, ok := l.items[key]
+	if !ok {
+		l.types[key.Type].Misses++
+		l.file(key.File).Misses++
+		return nil, false
+	}
+	l.types[key.Type].Hits++
+	l.file(key.File).Hits++
+	l.ll.MoveToFront(elem)
+	return elem.Value.(*entry).value, true
+}
+
+// Put 写入缓存. 数据量超出容量时，淘汰最久未被访问的条目
+func (l *LRU) Put(key Key, value []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(value) > l.capacity {
+		return
+	}
+	if elem, ok := l.items[key]; ok {
+		l.resize(key, len(value)-len(elem.Value.(*entry).value))
+		elem.Value.(*entry).value = value
+		l.ll.MoveToFront(elem)
+	} else {
+		l.items[key] = l.ll.PushFront(&entry{key: key, value: value})
+		l.types[key.Type].Entries++
+		l.resize(key, len(value))
+	}
+
+	for l.size > l.capacity {
+		evicted := l.removeElement(l.ll.Back())
+		l.types[evicted.Type].Evictions++
+	}
+}
+
+// EvictFile 淘汰某个 sstable 文件的所有块，在 sstable 文件被删除时调用
+func (l *LRU) EvictFile(file string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, elem := range l.items {
+		if key.File == file {
+			l.removeElement(elem)
+		}
+	}
+	delete(l.files, file)
+}
+
+// Size 已缓存的数据量，单位 byte
+func (l *LRU) Size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+// Capacity 缓存容量，单位 byte
+func (l *LRU) Capacity() int {
+	return l.capacity
+}
+
+// TypeStats 某一类型缓存块的统计信息
+func (l *LRU) TypeStats(t BlockType) TypeStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t >= numBlockTypes {
+		return TypeStats{}
+	}
+	return l.types[t]
+}
+
+// HotFiles 按照命中次数从高到低返回前 n 个 sstable 文件的缓存统计信息，n 小于等于 0 时返回全部
+func (l *LRU) HotFiles(n int) []FileStats {
+	l.mu.Lock()
+	files := make([]FileStats, 0, len(l.files))
+	for _, stats := range l.files {
+		files = append(files, *stats)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Hits != files[j].Hits {
+			return files[i].Hits > files[j].Hits
+		}
+		return files[i].File < files[j].File
+	})
+	if n > 0 && n < len(files) {
+		files = files[:n]
+	}
+	return files
+}
+
+// 获取 sstable 文件的统计信息，不存在时创建
+func (l *LRU) file(file string) *FileStats {
+	stats, ok := l.files[file]
+	if !ok {
+		stats = &FileStats{File: file}
+		l.files[file] = stats
+	}
+	return stats
+}
+
+// 调整已缓存的数据量
+func (l *LRU) resize(key Key, delta int) {
+	l.size += delta
+	l.types[key.Type].Size += delta
+	l.file(key.File).Size += delta
+}
+
+func (l *LRU) removeElement(elem *list.Element) Key {
+	e := l.ll.Remove(elem).(*entry)
+	delete(l.items, e.key)
+	l.types[e.key.Type].Entries--
+	l.resize(e.key, -len(e.value))
+	return e.key
+}
@@ -0,0 +1,208 @@
+// lsmart-cli 是面向运维的 lsm tree 命令行工具.
+//
+//	lsmart-cli verify <dir>               检查 sstable 的 key 范围结构以及健康状态
+//	lsmart-cli verify --deep <dir>        逐个校验所有数据块，并归并遍历全部数据
+//	lsmart-cli verify --deep --json <dir> 以 json 格式输出校验结果
+//	lsmart-cli wal <file>                 按照写入顺序输出 wal 文件中的每一笔 kv 对
+//	lsmart-cli wal --json <file>          每笔 kv 对输出一行 json，共享 wal 以 .log 结尾
+//
+// 校验发现问题或者 wal 尾部存在不完整的记录时以退出码 1 退出，命令本身执行失败时以退出码 2 退出
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/wal"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "verify":
+		os.Exit(verify(os.Args[2:]))
+	case "wal":
+		os.Exit(dumpWAL(os.Args[2:]))
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: lsmart-cli verify [--deep] [--json] <dir>")
+	fmt.Fprintln(os.Stderr, "       lsmart-cli wal [--json] <file>")
+	os.Exit(2)
+}
+
+// verify 子命令的结果
+type verifyResult struct {
+	Dir    string               `json:"dir"`
+	OK     bool                 `json:"ok"`
+	Health *lsmart.Health       `json:"health"`
+	Ranges *lsmart.RangeReport  `json:"ranges"`
+	Deep   *lsmart.VerifyReport `json:"deep,omitempty"`
+}
+
+func verify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	deep := flags.Bool("deep", false, "read every block and iterate every key")
+	asJSON := flags.Bool("json", false, "print the result as json")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	dir := flags.Arg(0)
+
+	conf, err := lsmart.NewConfig(dir, lsmart.WithOpenMode(lsmart.MustExist))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "load config: %v\n", err)
+		return 2
+	}
+	tree, err := lsmart.NewTree(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "open %s: %v\n", dir, err)
+		return 2
+	}
+	defer tree.Close()
+
+	result := verifyResult{
+		Dir:    dir,
+		Ranges: tree.CheckRanges(),
+	}
+	if *deep {
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer cancel()
+
+		var progress func(verified, total uint64)
+		if !*asJSON {
+			progress = func(verified, total uint64) {
+				fmt.Fprintf(os.Stderr, "\rverified %d/%d bytes", verified, total)
+			}
+		}
+		if result.Deep, err = tree.DeepVerify(ctx, progress); err != nil {
+			fmt.Fprintf(os.Stderr, "\ndeep verify: %v\n", err)
+			return 2
+		}
+		if progress != nil {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+	// 深度校验读取过程中发现的损坏同样会反映在健康状态中
+	result.Health = tree.Health()
+	result.OK = result.Ranges.Healthy() && result.Health.Live() && (result.Deep == nil || result.Deep.OK())
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(&result)
+	} else {
+		printResult(&result)
+	}
+	if !result.OK {
+		return 1
+	}
+	return 0
+}
+
+func printResult(result *verifyResult) {
+	fmt.Printf("health: %s\n", result.Health.Status)
+	for _, reason := range result.Health.Reasons {
+		fmt.Printf("  %s\n", reason)
+	}
+	fmt.Printf("range overlaps: %d\n", len(result.Ranges.Overlaps))
+	for _, overlap := range result.Ranges.Overlaps {
+		fmt.Printf("  level %d %v [%q, %q]\n", overlap.Level, overlap.Files, overlap.Start, overlap.End)
+	}
+	if deep := result.Deep; deep != nil {
+		fmt.Printf("deep: %d files, %d bytes, %d blocks, %d records, %d keys in %s\n",
+			deep.Files, deep.Bytes, deep.Blocks, deep.Records, deep.Keys, deep.Elapsed)
+		for _, issue := range deep.Issues {
+			fmt.Printf("  level %d %s %q: %s\n", issue.Level, issue.File, issue.Key, issue.Err)
+		}
+	}
+	if result.OK {
+		fmt.Println("ok")
+	} else {
+		fmt.Println("FAILED")
+	}
+}
+
+// wal 子命令输出的一笔 kv 对. 检查点记录输出为一条没有 key 的条目
+type walEntry struct {
+	Offset int64  `json:"offset"` // 所在记录在文件中的起始位置
+	Type   string `json:"type"`   // 所在记录的类型
+	Tag    int    `json:"tag"`    // 共享 wal 中所属 memtable 的 index
+	Op     string `json:"op"`
+	Seq    uint64 `json:"seq"`
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value"`
+}
+
+func dumpWAL(args []string) int {
+	flags := flag.NewFlagSet("wal", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print one json object per key")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	file := flags.Arg(0)
+
+	newReader := wal.NewWALReader
+	if strings.HasSuffix(file, ".log") {
+		newReader = wal.NewSharedWALReader
+	}
+	reader, err := newReader(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "open %s: %v\n", file, err)
+		return 2
+	}
+	defer reader.Close()
+
+	encoder := json.NewEncoder(os.Stdout)
+	emit := func(entry *walEntry) {
+		if *asJSON {
+			_ = encoder.Encode(entry)
+		} else {
+			fmt.Printf("%d\t%s\t%d\t%s\t%d\t%q\t%q\n", entry.Offset, entry.Type, entry.Tag, entry.Op, entry.Seq, entry.Key, entry.Value)
+		}
+	}
+	it := reader.NewIterator()
+	for it.Next() {
+		record := it.Record()
+		if record.Type == wal.RecordCheckpoint {
+			emit(&walEntry{Offset: record.Offset, Type: record.Type.String(), Tag: record.Tag, Seq: record.Seq})
+			continue
+		}
+		for _, kv := range record.KVs {
+			entry := walEntry{Offset: record.Offset, Type: record.Type.String(), Tag: record.Tag, Op: lsmart.OpPut.String(), Key: kv.Key, Value: kv.Value}
+			// 版本 1 的 wal 文件中存放的是用户 value，之后的版本中存放的是内部记录
+			if reader.Version() >= 2 {
+				op, seq, value, err := lsmart.DecodeInternalValue(kv.Value)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "offset %d key %q: %v\n", record.Offset, kv.Key, err)
+					return 2
+				}
+				entry.Op, entry.Seq, entry.Value = op.String(), seq, value
+			}
+			emit(&entry)
+		}
+	}
+	if err = it.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "read %s: %v\n", file, err)
+		return 2
+	}
+	if reader.Truncated() {
+		fmt.Fprintf(os.Stderr, "incomplete record at offset %d\n", reader.ValidSize())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package lsmart
+
+// CompactionFilter compact 时对每个 key 的最新版本调用的过滤函数，key、value 均为用户数据.
+// 返回 keep 为 false 时删除该记录；keep 为 true 且 newValue 非空时以 newValue 替换原有 value，保留原有的 seq 与过期时间
+type CompactionFilter func(key, value []byte) (keep bool, newValue []byte)
+
+// compact 时对记录应用用户配置的过滤函数. 墓碑记录不参与过滤. 被删除的记录与按条件删除一致，
+// 改写为相同 seq 的墓碑记录而不是直接丢弃，避免更深层级中的老版本数据重新可见
+func (t *Tree) applyCompactionFilter(key, internalValue []byte) []byte {
+	if t.conf.CompactionFilter == nil {
+		return internalValue
+	}
+
+	op, seq, value, err := DecodeInternalValue(internalValue)
+	if err != nil || op == OpDelete {
+		return internalValue
+	}
+	userKey, err := t.decodeKey(key)
+	if err != nil {
+		return internalValue
+	}
+	keep, newValue := t.conf.CompactionFilter(userKey, value)
+	switch {
+	case !keep:
+		return EncodeInternalValue(OpDelete, seq, nil)
+	case newValue == nil:
+		return internalValue
+	case op == OpPutTTL:
+		return encodeTTLValue(seq, internalExpireAt(internalValue), newValue)
+	default:
+		return EncodeInternalValue(op, seq, newValue)
+	}
+}
@@ -0,0 +1,68 @@
+package compress
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Type 数据块的压缩类型，写在每个数据块的尾部
+type Type byte
+
+// 内置以及预留的压缩类型. Snappy、Zstd 需要使用方通过 Register 注入实现，预留的类型保证不同实现写出的文件可以互相读取
+const (
+	None   Type = 0 // 不压缩
+	Flate  Type = 1 // deflate，基于标准库 compress/flate
+	Snappy Type = 2 // 预留给 snappy
+	Zstd   Type = 3 // 预留给 zstd
+)
+
+func (t Type) String() string {
+	switch t {
+	case None:
+		return "none"
+	case Flate:
+		return "flate"
+	case Snappy:
+		return "snappy"
+	case Zstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("Type(%d)", byte(t))
+	}
+}
+
+// Codec 数据块压缩算法
+type Codec interface {
+	// Type 压缩类型，写在数据块尾部，读取时据此找到对应的 Codec
+	Type() Type
+	// Encode 压缩 src，结果追加到 dst[:0] 之后返回
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode 解压 src，结果追加到 dst[:0] 之后返回
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[Type]Codec{
+		Flate: NewFlate(DefaultFlateLevel),
+	}
+)
+
+// Register 注册压缩算法，读取数据块时按照尾部的压缩类型查找. 同一类型重复注册时后者覆盖前者，None 不允许注册
+func Register(codec Codec) error {
+	if codec.Type() == None {
+		return fmt.Errorf("compress: type %s is reserved", None)
+	}
+	codecsLock.Lock()
+	codecs[codec.Type()] = codec
+	codecsLock.Unlock()
+	return nil
+}
+
+// Lookup 根据压缩类型查找已注册的压缩算法
+func Lookup(t Type) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, ok := codecs[t]
+	return codec, ok
+}
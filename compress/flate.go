@@ -0,0 +1,65 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultFlateLevel flate 默认的压缩级别，偏向压缩速度
+const DefaultFlateLevel = flate.BestSpeed
+
+// FlateCodec 基于标准库 compress/flate 的压缩算法，无需引入第三方依赖
+type FlateCodec struct {
+	level   int       // 压缩级别
+	writers sync.Pool // 复用 *flate.Writer，避免每个数据块重复申请压缩状态
+}
+
+// NewFlate flate 压缩算法构造器. level 取值范围与 compress/flate 一致，不合法时使用 DefaultFlateLevel
+func NewFlate(level int) *FlateCodec {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		level = DefaultFlateLevel
+	}
+	return &FlateCodec{level: level}
+}
+
+// Type 压缩类型
+func (f *FlateCodec) Type() Type {
+	return Flate
+}
+
+// Encode 压缩 src
+func (f *FlateCodec) Encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst[:0])
+	w, _ := f.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(buf, f.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer f.writers.Put(w)
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode 解压 src
+func (f *FlateCodec) Decode(dst, src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	buf := bytes.NewBuffer(dst[:0])
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, fmt.Errorf("compress: flate decode: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -1,35 +1,113 @@
 package lsmart
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path"
 	"strings"
+	"time"
 
+	"github.com/cccccxxy/lsmart/cache"
+	"github.com/cccccxxy/lsmart/compress"
 	"github.com/cccccxxy/lsmart/filter"
+	"github.com/cccccxxy/lsmart/format"
 	"github.com/cccccxxy/lsmart/memtable"
+	"github.com/cccccxxy/lsmart/transform"
 )
 
 // Config lsm tree 配置项聚合
 type Config struct {
-	Dir      string // sst 文件存放的目录
-	MaxLevel int    // lsm tree 总共多少层
+	Dir      string   // sst 文件存放的目录
+	OpenMode OpenMode // 打开时对目录现状的要求. 默认为 CreateIfMissing
+	MaxLevel int      // lsm tree 总共多少层
 
 	// sst 相关
-	SSTSize          uint64 // 每个 sst table 大小，默认 4M
-	SSTNumPerLevel   int    // 每层多少个 sstable，默认 10 个
-	SSTDataBlockSize int    // sst table 中 block 大小 默认 16KB
-	SSTFooterSize    int    // sst table 中 footer 部分大小. 固定为 32B
+	SSTSize            uint64 // 每个 sst table 大小，默认 4M
+	SSTTargetFileSize  uint64 // compact 产出的 sst table 大小阈值，每加深一层放大 10 倍. 默认与 SSTSize 一致
+	SSTNumPerLevel     int    // 每层多少个 sstable，默认 10 个
+	SSTDataBlockSize   int    // sst table 中 block 大小 默认 16KB
+	SSTFooterSize      int    // sst table 中 footer 部分大小. 固定为 152B
+	BlockAlignment     int    // sst table 中数据块的对齐边界，单位 byte. 默认为 0，即不对齐
+	VerifySST          bool   // 溢写、compact 产出的 sst table 是否在注册前重新读取校验. 默认为 false
+	ParanoidChecks     bool   // 启动时是否校验所有 sst table 的 footer、索引以及全部块的校验和. 默认为 false
+	BlockCacheSize     int    // 数据块缓存的容量，单位 byte. 默认为 0，即不缓存数据块
+	MmapReads          bool   // 是否通过 mmap 读取 sstable. 默认为 false，即通过 pread 读取
+	IndexPartitionSize int    // 分区索引中每个分区的大小，单位 byte. 默认为 0，即不分区，完整的索引常驻内存
+	MaxOpenFiles       int    // 同时打开的 sstable 文件个数上限. 默认为 0，即不限制，每个 sstable 的文件句柄常驻
+	LazyMetadata       bool   // 是否延迟加载 sstable 的过滤器与索引. 默认为 false，即启动时全部读取并常驻内存
+	MetadataBudget     int    // 延迟加载时常驻内存的过滤器与索引的预算，单位 byte. 默认为 0，即加载之后不淘汰
+	DirectIO           bool   // 是否以直接 IO 读写 sstable，绕过操作系统的页缓存. 默认为 false
+	ReadaheadSize      int    // 顺序遍历 sstable 时单次预读的字节数. 默认为 256KB，小于 0 时关闭预读
+	SyncWrites         bool   // 每次写入返回之前是否 fsync 预写日志. 默认为 false，由操作系统决定刷盘时机
+
+	Durability Durability // 写入成功之后数据的持久化程度. 默认为 DurabilityProcess，开启 SyncWrites 时至少为 DurabilitySync
+
+	// 写入阻塞相关
+	MaxReadOnlyMemTables int  // 等待溢写的只读 memtable 个数上限，达到上限时写入等待溢写追上. 默认为 0，即不限制
+	WriteStallFailFast   bool // 只读 memtable 个数达到上限时是否直接返回 ErrWriteStall，而不是等待. 默认为 false
+
+	TableFormat format.Version // 写入 sstable 使用的格式版本. 默认为当前内置格式的版本
+
+	Compression         compress.Codec // 数据块的压缩算法. 默认为空，即不压缩
+	MetadataCompression compress.Codec // 过滤器块与索引块的压缩算法，独立于数据块. 默认为空，即不压缩
+
+	// compact 相关
+	CompactionCPUFraction  float64 // 后台 compact 最多占用的 cpu 比例，按照 GOMAXPROCS 折算 worker 个数. 默认为 0.5
+	MaxCompactionWorkers   int     // 单轮 compact 并发写入 sst 文件的 worker 个数上限. 默认为 0，即仅受 cpu 比例限制
+	MaxParallelCompactions int     // 同时执行的 level 层 compact 个数上限. 默认为 1，即各层 compact 串行执行
+
+	CompactionFilter CompactionFilter // compact 时对每条记录调用的过滤函数. 默认为空，即不做过滤
+
+	TTLCompactionInterval time.Duration // 检查 sstable 中是否存在过期记录的间隔. 默认为 10 分钟，小于 0 时关闭检查
+
+	// 加密相关
+	EncryptionKeyID       uint32            // 写入 sstable 时使用的密钥 id. 默认为 0，即不加密
+	EncryptionKey         []byte            // 写入 sstable 时使用的 AES 密钥，长度为 16、24 或 32 byte
+	RetiredEncryptionKeys map[uint32][]byte // 已经轮换下来的密钥，只用于读取此前写入的 sstable
+
+	// 后台任务相关
+	BackgroundRetry        RetryPolicy            // 溢写、compact 遇到暂时性 IO 错误时的重试策略. 默认为 DefaultRetryPolicy
+	BackgroundErrorHandler BackgroundErrorHandler // 溢写、compact 最终失败时的回调. 默认为空
+
+	blockCache     *cache.LRU              // 数据块缓存，BlockCacheSize 大于 0 时构造
+	tableCache     *tableCache             // sstable 文件句柄缓存，MaxOpenFiles 大于 0 时构造
+	metaCache      *metaCache              // 延迟加载的过滤器与索引的缓存，开启延迟加载且 MetadataBudget 大于 0 时构造
+	ciphers        map[uint32]cipher.Block // 全部密钥对应的 AES 实例，按照密钥 id 索引，在 check 中构造
+	budgetedFilter bool                    // 是否按照内存预算为每层分配默认布隆过滤器的假阳性率
 
 	Filter              filter.Filter                // 过滤器. 默认使用布隆过滤器
+	FilterKeysPerBlock  int                          // 默认布隆过滤器预期每个数据块中的 key 个数. 默认按照每条记录 64B 由数据块大小折算
+	FilterFPRate        float64                      // 默认布隆过滤器期望的假阳性率. 默认为 0.01
+	FilterMemoryBudget  int                          // 各层过滤器总的内存预算，单位 byte. 默认为 0，即各层使用相同的假阳性率
+	TableFilter         bool                         // 是否为每个 sstable 额外写入覆盖全部 key 的整表过滤器. 默认为 false
 	MemTableConstructor memtable.MemTableConstructor // memtable 构造器，默认为跳表
+	KeyTransformer      transform.KeyTransformer     // key 变换器，读写时透明地变换 key. 默认为空，即不做变换
+	KeyValidator        KeyValidator                 // key 校验函数，每次写入时调用. 默认为空，即不做校验
+
+	// wal 相关
+	SharedWAL         bool                        // 是否所有 memtable 共用一个 wal 文件. 默认为 false，即每个 memtable 独占一个 wal 文件
+	WALSegmentSize    int64                       // 单个 wal 分段文件的大小阈值，单位 byte. 默认为 0，即每个 memtable 只写一个 wal 文件，共享 wal 模式下为 SSTSize 的 4 倍
+	WALArchive        *WALArchive                 // wal 归档策略. 默认为空，即 memtable 落盘后直接删除 wal 文件
+	WALFallback       bool                        // wal 创建失败时是否降级为不写 wal 继续运行. 默认为 false，即返回错误
+	WALPreallocate    bool                        // 新建 wal 文件时是否预分配一个 memtable 的磁盘空间. 默认为 false
+	WALRecycleFiles   int                         // 保留用于复用的已落盘 wal 文件个数. 默认为 0，即落盘后直接删除
+	WALBufferSize     int                         // wal 写入缓冲区的大小，单位 byte. 默认为 0，即每次写入直接写到文件
+	WALStreams        int                         // 每个 memtable 并发写入的 wal 文件路数. 默认为 1
+	WALReplayRate     int64                       // 启动时回放 wal 的速率上限，单位 byte/s. 默认为 0，即不限速
+	WALRecoveryMode   WALRecoveryMode             // 启动时回放 wal 遇到异常记录的处理方式. 默认为 WALRecoveryTolerateTail
+	WALRecoverySeq    uint64                      // WALRecoveryPointInTime 模式下回放的最大 seq
+	WALReplayProgress func(replayed, total int64) // 启动时回放 wal 的进度回调，单位 byte. 默认为空
 }
 
 // NewConfig 配置文件构造器.
 func NewConfig(dir string, opts ...ConfigOption) (*Config, error) {
 	c := Config{
-		Dir:           dir, // sstable 文件所在的目录路径
-		SSTFooterSize: 32,  // 对应 4 个 uint64，共 32 byte
+		Dir:           dir,           // sstable 文件所在的目录路径
+		SSTFooterSize: sstFooterSize, // 对应 14 个 uvarint、version 以及 magic number，共 152 byte
 	}
 
 	// 加载配置项
@@ -45,6 +123,67 @@ func NewConfig(dir string, opts ...ConfigOption) (*Config, error) {
 
 // 校验一下配置是否合法，主要是 check 存放 sst 文件和 wal 文件的目录，如果有缺失则进行目录创建
 func (c *Config) check() error {
+	// 过滤器配置错误时直接报错，而不是在读取时才暴露问题
+	if err := c.checkFilter(); err != nil {
+		return err
+	}
+
+	// 密钥配置错误时直接报错
+	if err := c.checkEncryption(); err != nil {
+		return err
+	}
+
+	// 写入使用的格式需要已经注册. 内置格式中只有当前版本可以写入，老版本仅用于读取
+	if current := format.Current(format.KindSST); c.TableFormat != current {
+		if _, ok := LookupTableFormat(c.TableFormat); !ok || c.TableFormat < current {
+			return fmt.Errorf("%w: cannot write sstable version %d", format.ErrUnsupportedVersion, c.TableFormat)
+		}
+	}
+
+	// 压缩算法需要注册，读取块时才能按照尾部的压缩类型找到
+	for _, codec := range []compress.Codec{c.Compression, c.MetadataCompression} {
+		if codec == nil {
+			continue
+		}
+		if _, ok := compress.Lookup(codec.Type()); !ok {
+			if err := compress.Register(codec); err != nil {
+				return err
+			}
+		}
+	}
+
+	// 共享 wal 通过截断水位回收日志，不存在可以归档的完整文件
+	if c.SharedWAL && c.WALArchive != nil {
+		return errors.New("wal archive is not supported in shared wal mode")
+	}
+
+	// 多路 wal 按照 key 分派到各路文件，共享 wal 只有一个文件，分段则需要各路分别切换
+	if c.WALStreams > 1 && (c.SharedWAL || c.WALSegmentSize > 0) {
+		return errors.New("multiple wal streams are not supported in shared wal mode or with wal segments")
+	}
+
+	switch c.WALRecoveryMode {
+	case WALRecoveryTolerateTail, WALRecoveryStrict, WALRecoveryPermissive, WALRecoveryPointInTime:
+	default:
+		return fmt.Errorf("invalid wal recovery mode %s", c.WALRecoveryMode)
+	}
+
+	// 落盘后的 wal 文件要么归档，要么复用
+	if c.WALRecycleFiles > 0 && (c.SharedWAL || c.WALArchive != nil) {
+		return errors.New("wal recycling is not supported in shared wal mode or with wal archive")
+	}
+
+	switch c.Durability {
+	case DurabilityProcess, DurabilitySync, DurabilityFull:
+	default:
+		return fmt.Errorf("invalid durability %s", c.Durability)
+	}
+
+	// 按照打开模式校验目录现状，避免误用错误的目录
+	if err := c.checkOpenMode(); err != nil {
+		return err
+	}
+
 	// sstable 文件目录确保存在
 	if _, err := os.ReadDir(c.Dir); err != nil {
 		_, ok := err.(*fs.PathError)
@@ -66,14 +205,104 @@ func (c *Config) check() error {
 		if err = os.Mkdir(walDir, os.ModePerm); err != nil {
 			return err
 		}
+		if c.Durability >= DurabilityFull {
+			if err = syncDir(c.Dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	// wal 归档目录确保存在
+	if c.WALArchive != nil {
+		if err := os.MkdirAll(c.WALArchive.Dir, os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 校验过滤器配置. 未注入过滤器时按照容量参数构造默认的布隆过滤器.
+// 注入的过滤器需要通过自检：添加的 key 必须全部能够被判定为存在，否则读取时会漏掉数据
+func (c *Config) checkFilter() error {
+	if c.Filter == nil {
+		bf, err := filter.NewBloomFilterFor(c.FilterKeysPerBlock, c.FilterFPRate)
+		if err != nil {
+			return err
+		}
+		c.Filter = bf
+		c.budgetedFilter = c.FilterMemoryBudget > 0
+		return nil
+	}
+
+	if validator, ok := c.Filter.(filter.Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// 自检使用独立的实例，支持复制的过滤器不影响注入的实例
+	probe := c.Filter
+	if cloner, ok := probe.(filter.Cloner); ok {
+		probe = cloner.Clone()
+	}
+	defer probe.Reset()
+
+	keys := make([][]byte, 0, 64)
+	for i := 0; i < cap(keys); i++ {
+		keys = append(keys, []byte(fmt.Sprintf("lsmart-filter-probe-%d", i)))
+		probe.Add(keys[i])
+	}
+	if probe.KeyLen() != len(keys) {
+		return fmt.Errorf("filter: added %d keys but filter reports %d", len(keys), probe.KeyLen())
+	}
+	bitmap := probe.Hash()
+	if len(bitmap) == 0 {
+		return errors.New("filter: generated an empty bitmap")
+	}
+	for _, key := range keys {
+		if !probe.Exist(bitmap, key) {
+			return fmt.Errorf("filter: added key %q is reported as absent", key)
+		}
+	}
+	return nil
+}
+
+// 校验加密配置，并为当前密钥以及轮换下来的密钥构造 AES 实例. 密钥 id 0 保留给没有加密的 sstable
+func (c *Config) checkEncryption() error {
+	keys := make(map[uint32][]byte, len(c.RetiredEncryptionKeys)+1)
+	for id, key := range c.RetiredEncryptionKeys {
+		keys[id] = key
+	}
+	if c.EncryptionKeyID != 0 || len(c.EncryptionKey) > 0 {
+		keys[c.EncryptionKeyID] = c.EncryptionKey
 	}
 
+	c.ciphers = make(map[uint32]cipher.Block, len(keys))
+	for id, key := range keys {
+		if id == 0 {
+			return errors.New("encryption: key id 0 is reserved for unencrypted sstables")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("encryption: key %d: %w", id, err)
+		}
+		c.ciphers[id] = block
+	}
 	return nil
 }
 
 // ConfigOption 配置项
 type ConfigOption func(*Config)
 
+// WithOpenMode 打开时对目录现状的要求. 默认为 CreateIfMissing，即目录缺失时创建、已有数据时沿用.
+// MustExist 要求目录下已有数据，ErrorIfExists 要求目录下没有数据，不满足时 NewConfig 分别返回 ErrTreeNotExist、ErrTreeExists.
+func WithOpenMode(mode OpenMode) ConfigOption {
+	return func(c *Config) {
+		c.OpenMode = mode
+	}
+}
+
 // WithMaxLevel lsm tree 最大层数. 默认为 7 层.
 func WithMaxLevel(maxLevel int) ConfigOption {
 	return func(c *Config) {
@@ -82,13 +311,23 @@ func WithMaxLevel(maxLevel int) ConfigOption {
 }
 
 // WithSSTSize level0层每个 sstable 文件的大小，单位 byte. 默认为 1 MB.
-// 且每加深一层，sstable 文件大小限制阈值放大 10 倍.
+// memtable 达到该大小时溢写为 level0 层的 sstable，每层的容量同样以此为基准，每加深一层放大 10 倍.
+// compact 产出的 sstable 文件大小默认同样以此为基准，可以通过 WithSSTTargetFileSize 单独调整.
 func WithSSTSize(sstSize uint64) ConfigOption {
 	return func(c *Config) {
 		c.SSTSize = sstSize
 	}
 }
 
+// WithSSTTargetFileSize compact 产出的 sstable 文件的大小阈值，单位 byte，写入 level 层时阈值为 size 乘以 10 的 level 次方.
+// 默认与 WithSSTSize 一致. 与 memtable 的大小解耦之后，可以在保持较小 memtable 的同时产出较大的 sstable 以减少文件个数，
+// 或者产出较小的 sstable 以降低单次 compact 的粒度.
+func WithSSTTargetFileSize(size uint64) ConfigOption {
+	return func(c *Config) {
+		c.SSTTargetFileSize = size
+	}
+}
+
 // WithSSTDataBlockSize sstable 中每个 block 块的大小限制. 默认为 16KB.
 func WithSSTDataBlockSize(sstDataBlockSize int) ConfigOption {
 	return func(c *Config) {
@@ -97,12 +336,222 @@ func WithSSTDataBlockSize(sstDataBlockSize int) ConfigOption {
 }
 
 // WithSSTNumPerLevel 每个 level 层预期最多存放的 sstable 文件个数. 默认为 10 个.
+// level0 层的文件个数超过该值时，即便文件总大小没有超过阈值也会触发 compact，避免大量较小的溢写文件拖慢读取
 func WithSSTNumPerLevel(sstNumPerLevel int) ConfigOption {
 	return func(c *Config) {
 		c.SSTNumPerLevel = sstNumPerLevel
 	}
 }
 
+// WithBlockAlignment sstable 中数据块的对齐边界，单位 byte. 默认为 0，即不对齐.
+// 开启后每个数据块都从边界的整数倍处开始，块之间以 0 填充，便于 O_DIRECT 读取以及 ZFS 等存储后端的去重与压缩.
+func WithBlockAlignment(alignment int) ConfigOption {
+	return func(c *Config) {
+		c.BlockAlignment = alignment
+	}
+}
+
+// WithSyncWrites 每次写入返回之前 fsync 预写日志，写入成功的数据在机器掉电后同样能够恢复. 默认不 fsync，
+// 进程崩溃时数据不会丢失，但是机器掉电时可能丢失最近的写入，可以通过 Tree.Sync 手动建立持久化点.
+// 并发写入时，同时等待写锁的写入会被合并提交，一组写入只需要一次写操作以及一次 fsync.
+func WithSyncWrites() ConfigOption {
+	return func(c *Config) {
+		c.SyncWrites = true
+	}
+}
+
+// WithDurability 写入成功之后数据的持久化程度. DurabilitySync 等价于 WithSyncWrites；DurabilityFull 在此基础上，
+// 创建、删除 wal 文件之后额外 fsync 预写日志目录，保证掉电后 wal 文件的有无与宕机前一致，每次切换 memtable 多一次目录 fsync.
+func WithDurability(level Durability) ConfigOption {
+	return func(c *Config) {
+		c.Durability = level
+	}
+}
+
+// WithParanoidChecks 启动时逐个读取所有 sstable 的 footer、属性块、过滤器、索引以及每一个数据块，校验其校验和与内容，
+// 发现损坏时 NewTree 直接返回带有文件名的错误，而不是等到 Get 读到损坏的数据块时才暴露问题. 启动耗时与一次全量扫描相当.
+func WithParanoidChecks() ConfigOption {
+	return func(c *Config) {
+		c.ParanoidChecks = true
+	}
+}
+
+// WithSSTVerification 开启 sstable 落盘校验. 溢写以及 compact 产出的 sstable 会被重新读取校验，
+// 校验无误后才会注册到 lsm tree 并释放数据源，以额外的读 IO 为代价尽早发现写入流程中的问题.
+func WithSSTVerification() ConfigOption {
+	return func(c *Config) {
+		c.VerifySST = true
+	}
+}
+
+// WithBlockCacheSize 数据块缓存的容量，单位 byte. 默认为 0，即每次读取都直接访问 sstable 文件.
+// 过滤器和索引在节点加载时已常驻内存，缓存只针对数据块.
+func WithBlockCacheSize(blockCacheSize int) ConfigOption {
+	return func(c *Config) {
+		c.BlockCacheSize = blockCacheSize
+	}
+}
+
+// WithMmapReads 通过 mmap 读取 sstable. 读取数据块时直接引用映射的内存，省去 pread 系统调用以及块的拷贝，适用于读多写少的场景.
+// 映射的内存计入进程的虚拟地址空间，由操作系统的页缓存按需换入换出. 平台不支持或者映射失败时退回 pread 读取.
+func WithMmapReads() ConfigOption {
+	return func(c *Config) {
+		c.MmapReads = true
+	}
+}
+
+// WithDirectIO 以直接 IO（O_DIRECT）读写 sstable，溢写、compact 产生的大量读写不再挤占操作系统的页缓存，读取延迟也更加稳定.
+// 数据块不再经由页缓存，建议配合 WithBlockCacheSize 使用. 开启 mmap 读取时读取不受影响，仅写入使用直接 IO.
+// 平台或者文件系统不支持时退回普通 IO.
+func WithDirectIO() ConfigOption {
+	return func(c *Config) {
+		c.DirectIO = true
+	}
+}
+
+// WithReadahead 顺序遍历 sstable 时单次预读的字节数，默认为 256KB. compact 以及迭代器逐个数据块顺序读取时，
+// 一次读取后续若干个相邻的数据块，以较少的大块读取代替逐个数据块的 pread，避免 compact 受限于磁盘寻道.
+// 传入负数时关闭预读. 通过 mmap 读取时由操作系统负责预读，不受该配置影响.
+func WithReadahead(size int) ConfigOption {
+	return func(c *Config) {
+		c.ReadaheadSize = size
+	}
+}
+
+// WithEncryptionKey 使用 AES-CTR 加密 sstable 的各个块，包括数据块、过滤器块、索引块以及属性块，footer 以明文记录密钥 id.
+// id 不能为 0，key 的长度为 16、24 或 32 byte，分别对应 AES-128、AES-192、AES-256. wal 文件不加密.
+// 轮换密钥时换用新的 id 与密钥，并通过 WithRetiredEncryptionKey 保留老的密钥：溢写以及 compact 改写产生的 sstable 使用新的密钥，
+// 老的 sstable 仍然可以读取，随着 compact 逐步改写为新的密钥. 每个 sstable 使用的密钥 id 可以通过 NodeStats 查看.
+func WithEncryptionKey(id uint32, key []byte) ConfigOption {
+	return func(c *Config) {
+		c.EncryptionKeyID = id
+		c.EncryptionKey = key
+	}
+}
+
+// WithRetiredEncryptionKey 保留一个已经轮换下来的密钥，只用于读取此前使用该密钥写入的 sstable. 可以多次调用保留多个密钥.
+func WithRetiredEncryptionKey(id uint32, key []byte) ConfigOption {
+	return func(c *Config) {
+		if c.RetiredEncryptionKeys == nil {
+			c.RetiredEncryptionKeys = make(map[uint32][]byte)
+		}
+		c.RetiredEncryptionKeys[id] = key
+	}
+}
+
+// WithMaxOpenFiles 同时打开的 sstable 文件个数上限. 默认为 0，即每个 sstable 的文件句柄常驻，文件个数不受限制.
+// 超出上限时关闭最久未访问的文件，再次读取时重新打开，以额外的 open 系统调用为代价控制文件描述符的占用.
+// 通过 mmap 读取的 sstable 在映射建立后即关闭文件，不计入上限.
+func WithMaxOpenFiles(maxOpenFiles int) ConfigOption {
+	return func(c *Config) {
+		c.MaxOpenFiles = maxOpenFiles
+	}
+}
+
+// WithLazyMetadata 延迟加载 sstable 的过滤器与索引. 启动时只读取属性块中记录的 key 范围，过滤器与索引在首次访问时读取，
+// 避免 sstable 较多时启动缓慢、内存占用过高. budget 为常驻内存的过滤器与索引的预算，单位 byte，超出时淘汰最久未访问的 sstable 的元数据，
+// 再次访问时重新读取. budget 为 0 时加载之后不淘汰.
+func WithLazyMetadata(budget int) ConfigOption {
+	return func(c *Config) {
+		c.LazyMetadata = true
+		c.MetadataBudget = budget
+	}
+}
+
+// WithPartitionedIndex 开启两层的分区索引，partitionSize 为每个分区的大小，单位 byte. 默认不分区.
+// 索引超过一个分区的 sstable 只有顶层索引常驻内存，检索时按需读取分区，开启数据块缓存时分区同样会被缓存.
+// 适用于 sstable 较大、数据块较小，完整索引占用内存过多的场景.
+func WithPartitionedIndex(partitionSize int) ConfigOption {
+	return func(c *Config) {
+		c.IndexPartitionSize = partitionSize
+	}
+}
+
+// WithCompression 数据块的压缩算法. 默认不压缩. 内置 compress.NewFlate，snappy、zstd 等算法可以通过实现 compress.Codec 注入.
+// 压缩率不足 12.5% 的数据块按原样存放. 块缓存中存放解压后的数据块，命中缓存时无需重复解压.
+func WithCompression(codec compress.Codec) ConfigOption {
+	return func(c *Config) {
+		c.Compression = codec
+	}
+}
+
+// WithTableFormat 写入 sstable 使用的格式版本，默认为当前内置格式的版本. 需要先通过 RegisterTableFormat 注册对应的格式，
+// 例如实验性的 footer 布局或者块校验方式. 不同格式写出的 sstable 可以共存于同一个目录，读取时按照 footer 中的版本号查找格式，
+// 因此切换格式之后此前写入的 sstable 仍然可以读取，随着 compact 逐步改写为新的格式.
+func WithTableFormat(version format.Version) ConfigOption {
+	return func(c *Config) {
+		c.TableFormat = version
+	}
+}
+
+// WithMetadataCompression 过滤器块、整表过滤器块以及索引块的压缩算法，独立于 WithCompression 配置的数据块压缩. 默认不压缩.
+// value 较小时索引在 sstable 中的占比较高，可以单独为索引开启压缩，而数据块保持不压缩以节省读取时的解压开销.
+// 元数据在加载时解压，常驻内存以及缓存中的都是解压后的内容，压缩率不足 12.5% 的块按原样存放.
+func WithMetadataCompression(codec compress.Codec) ConfigOption {
+	return func(c *Config) {
+		c.MetadataCompression = codec
+	}
+}
+
+// WithCompactionCPUFraction 后台 compact 最多占用的 cpu 比例，取值范围 (0, 1]. 默认为 0.5.
+// 单轮 compact 的 worker 个数为 GOMAXPROCS 乘以该比例，至少为 1 个，避免存储引擎在高负载下挤占宿主应用的 cpu.
+func WithCompactionCPUFraction(fraction float64) ConfigOption {
+	return func(c *Config) {
+		c.CompactionCPUFraction = fraction
+	}
+}
+
+// WithMaxCompactionWorkers 单轮 compact 并发写入 sst 文件的 worker 个数上限. 默认为 0，即仅受 cpu 比例限制.
+func WithMaxCompactionWorkers(maxWorkers int) ConfigOption {
+	return func(c *Config) {
+		c.MaxCompactionWorkers = maxWorkers
+	}
+}
+
+// WithMaxParallelCompactions 允许至多 n 个 level 层的 compact 同时执行. 一轮 compact 占用 level 以及 level+1 两层，
+// 只有互不相邻的层可以同时 compact，例如 level0 与 level2. 多层同时超出阈值时不必排队等待，但是每轮 compact 各自按照
+// CompactionCPUFraction 折算 worker 个数，cpu 占用随之叠加. 全量 compact 以及导入外部 sstable 仍然独占执行.
+func WithMaxParallelCompactions(n int) ConfigOption {
+	return func(c *Config) {
+		c.MaxParallelCompactions = n
+	}
+}
+
+// WithTTLCompactionInterval 每隔 interval 检查一次各层 sstable 中最早的过期时间，存在过期记录的 sstable 主动下沉一层，
+// 归并时清理过期记录，使得不再被写入触发 compact 的数据也能按时从磁盘上清理. 默认为 10 分钟，传入负数时关闭检查.
+// 最深一层的 sstable 没有可以下沉的层，不做处理.
+func WithTTLCompactionInterval(interval time.Duration) ConfigOption {
+	return func(c *Config) {
+		c.TTLCompactionInterval = interval
+	}
+}
+
+// WithCompactionFilter 注入 compact 时调用的过滤函数，用于清理过期、已迁移的数据或者改写 value.
+// 只作用于 compact 产出的 sstable，溢写不调用. 同一条记录每下沉一层都会再次经过过滤函数，改写需要保证幂等；
+// 过滤函数可能在多个 worker 中并发调用，需要保证并发安全.
+// 过滤结果只在 compact 之后生效，此前读取到的仍是原有数据.
+func WithCompactionFilter(filter CompactionFilter) ConfigOption {
+	return func(c *Config) {
+		c.CompactionFilter = filter
+	}
+}
+
+// WithBackgroundRetry 溢写、compact 遇到暂时性 IO 错误时的重试策略. 默认为 DefaultRetryPolicy.
+// 最多执行次数设置为 1 即可关闭重试.
+func WithBackgroundRetry(policy RetryPolicy) ConfigOption {
+	return func(c *Config) {
+		c.BackgroundRetry = policy
+	}
+}
+
+// WithBackgroundErrorHandler 注入溢写、compact 最终失败时的回调. 暂时性错误在重试耗尽之后才会回调.
+// 失败的溢写会保留只读 memtable 以及 wal，失败的 compact 会保留参与归并的老节点，数据不会丢失.
+func WithBackgroundErrorHandler(handler BackgroundErrorHandler) ConfigOption {
+	return func(c *Config) {
+		c.BackgroundErrorHandler = handler
+	}
+}
+
 // WithFilter 注入过滤器的具体实现. 默认使用本项目下实现的布隆过滤器 bloom filter.
 func WithFilter(filter filter.Filter) ConfigOption {
 	return func(c *Config) {
@@ -110,6 +559,34 @@ func WithFilter(filter filter.Filter) ConfigOption {
 	}
 }
 
+// WithFilterSizing 默认布隆过滤器的容量参数：预期每个数据块中的 key 个数以及期望的假阳性率，据此推算 bitmap 长度与 hash 函数个数.
+// 传入 0 时使用默认值，参数不合法时 NewConfig 返回错误. 通过 WithFilter 注入了过滤器时不生效.
+func WithFilterSizing(keysPerBlock int, fpRate float64) ConfigOption {
+	return func(c *Config) {
+		c.FilterKeysPerBlock = keysPerBlock
+		c.FilterFPRate = fpRate
+	}
+}
+
+// WithFilterMemoryBudget 各层过滤器总的内存预算，单位 byte. 默认为 0，即各层使用 WithFilterSizing 配置的相同假阳性率.
+// 写入 sstable 时按照各层当前的数据量在预算之内分配假阳性率：较浅的层数据较新、读取频繁，每个 key 分配更多的 bit；
+// 较深的层数据量大，每个 key 分配更少的 bit，整体上使点查不存在的 key 时无效的数据块读取最少.
+// 已经写入的 sstable 保留写入时的过滤器，随着 compact 逐步收敛. 通过 WithFilter 注入了过滤器时不生效.
+func WithFilterMemoryBudget(budget int) ConfigOption {
+	return func(c *Config) {
+		c.FilterMemoryBudget = budget
+	}
+}
+
+// WithTableFilter 为每个 sstable 额外写入一个覆盖全部 key 的整表布隆过滤器，假阳性率与 WithFilterSizing 配置的一致.
+// 点查不存在的 key 时，整表过滤器即可排除整个 sstable，省去索引的二分查找以及数据块过滤器的判断，适用于点查未命中居多的场景.
+// 整表过滤器在首次检索 sstable 时读取并常驻内存.
+func WithTableFilter() ConfigOption {
+	return func(c *Config) {
+		c.TableFilter = true
+	}
+}
+
 // WithMemtableConstructor 注入有序表构造器. 默认使用本项目下实现的跳表 skiplist.
 func WithMemtableConstructor(memtableConstructor memtable.MemTableConstructor) ConfigOption {
 	return func(c *Config) {
@@ -117,6 +594,138 @@ func WithMemtableConstructor(memtableConstructor memtable.MemTableConstructor) C
 	}
 }
 
+// WithKeyTransformer 注入 key 变换器，例如通过哈希前缀打散单调递增的 key. 默认不做变换.
+// 变换器需要在 lsm tree 的整个生命周期内保持一致，更换变换器后无法读取此前写入的数据.
+func WithKeyTransformer(keyTransformer transform.KeyTransformer) ConfigOption {
+	return func(c *Config) {
+		c.KeyTransformer = keyTransformer
+	}
+}
+
+// WithMaxReadOnlyMemTables 限制等待溢写的只读 memtable 个数. 溢写跟不上写入时，个数达到 n 之后的写入阻塞等待，
+// 直至有只读 memtable 落盘，避免内存无限增长. 通过 PutContext 写入时可以借助 ctx 设置等待的超时时间. 默认为 0，即不限制.
+func WithMaxReadOnlyMemTables(n int) ConfigOption {
+	return func(c *Config) {
+		c.MaxReadOnlyMemTables = n
+	}
+}
+
+// WithWriteStallFailFast 只读 memtable 个数达到 MaxReadOnlyMemTables 时，写入直接返回 ErrWriteStall 而不是等待，
+// 由使用方自行决定重试或者降级.
+func WithWriteStallFailFast() ConfigOption {
+	return func(c *Config) {
+		c.WriteStallFailFast = true
+	}
+}
+
+// WithKeyValidator 注入 key 校验函数，在每次 Put、Delete 时调用，例如校验 key 的格式、拒绝保留前缀.
+// 校验失败时写入返回 *KeyValidationError，可以通过 errors.Is(err, ErrInvalidKey) 判断.
+func WithKeyValidator(keyValidator KeyValidator) ConfigOption {
+	return func(c *Config) {
+		c.KeyValidator = keyValidator
+	}
+}
+
+// WithSharedWAL 开启共享 wal 模式. 所有 memtable 共用一组 wal 分段文件，每条记录标识所属 memtable 的 index，
+// 并通过截断水位回收已落盘 memtable 的日志：分段写满后切换到新的分段，记录全部位于水位之下的分段整体删除. 适用于 sstable 阈值较小、memtable 切换频繁的场景，减少 wal 文件的创建与删除.
+func WithSharedWAL() ConfigOption {
+	return func(c *Config) {
+		c.SharedWAL = true
+	}
+}
+
+// WithWALSegmentSize 设置 wal 分段文件的大小阈值，单位 byte. 当前 wal 文件写满后切换到新的分段文件继续写入，
+// 各个分段仍归属于同一个 memtable，溢写落盘后一同回收. 避免 sstable 阈值较大时单个 wal 文件膨胀到 GB 级别.
+// 共享 wal 模式下一个分段包含多个 memtable 的记录，截断水位超过分段中所有记录所属的 memtable 之后整体删除.
+func WithWALSegmentSize(size int64) ConfigOption {
+	return func(c *Config) {
+		c.WALSegmentSize = size
+	}
+}
+
+// WithWALArchive 开启 wal 归档. memtable 落盘后对应的 wal 文件移动到归档目录中，并按照保留时间以及总大小上限淘汰，
+// 可以基于归档的 wal 做按时间点恢复，或者交由下游的复制链路消费. 不支持共享 wal 模式.
+func WithWALArchive(archive WALArchive) ConfigOption {
+	return func(c *Config) {
+		c.WALArchive = &archive
+	}
+}
+
+// WithWALFallback wal 文件创建失败时，例如文件系统变为只读，降级为不写 wal 继续提供读写服务，直到下一次切换 memtable 时重新创建成功.
+// 降级期间写入的数据只存在于 memtable 中，宕机后丢失，Tree.Sync 返回 ErrWALDisabled，Health 返回 HealthWALDisabled.
+// 默认不降级，NewTree 以及写入直接返回创建 wal 的错误.
+func WithWALFallback() ConfigOption {
+	return func(c *Config) {
+		c.WALFallback = true
+	}
+}
+
+// WithWALPreallocation 新建 wal 文件时预分配一个 memtable 的磁盘空间，开启分段时为一个分段的大小.
+// 写入时不再需要分配数据块，减少 ext4、xfs 等文件系统 fsync 时的元数据开销，降低写入的长尾延迟. 仅在 linux 上生效.
+func WithWALPreallocation() ConfigOption {
+	return func(c *Config) {
+		c.WALPreallocate = true
+	}
+}
+
+// WithWALBufferSize 为 wal 开启 size 大小的写入缓冲区，小批量的写入在缓冲区中积累，写满时才写到文件，减少写系统调用的次数.
+// 缓冲区中的记录在进程崩溃时同样会丢失：开启 SyncWrites 时每次写入都会刷出缓冲区，持久化语义不变；
+// 否则可以通过 Tree.FlushWAL 或者 Tree.Sync 显式地建立边界.
+func WithWALBufferSize(size int) ConfigOption {
+	return func(c *Config) {
+		c.WALBufferSize = size
+	}
+}
+
+// WithWALStreams 每个 memtable 同时写入 n 路 wal 文件，每批记录按照首个 key 的 hash 值分派到其中一路，
+// 合并提交时各路并发写入以及 fsync，避免所有写入串行于同一个文件. 重启时各路按照 seq 合并还原，
+// 最后一个 memtable 不再继续追加写入，而是作为只读 memtable 落盘. 不支持共享 wal 模式以及 wal 分段.
+func WithWALStreams(n int) ConfigOption {
+	return func(c *Config) {
+		c.WALStreams = n
+	}
+}
+
+// WithWALRecoveryMode 启动时回放 wal 遇到不完整或者校验失败的记录的处理方式. 默认为 WALRecoveryTolerateTail，
+// 即视为宕机时写了一半的尾部，回放在此停止. 回放结果可以通过 Tree.WALRecoveryReport 获取.
+func WithWALRecoveryMode(mode WALRecoveryMode) ConfigOption {
+	return func(c *Config) {
+		c.WALRecoveryMode = mode
+	}
+}
+
+// WithWALPointInTimeRecovery 启动时 wal 只回放到 seq 为止，seq 更大的记录以及其后的全部记录被丢弃，并从 wal 文件中截断.
+// 只作用于 wal 回放，已经落盘到 sstable 的数据不受影响. 早期不带 seq 的 wal 记录照常回放.
+func WithWALPointInTimeRecovery(seq uint64) ConfigOption {
+	return func(c *Config) {
+		c.WALRecoveryMode = WALRecoveryPointInTime
+		c.WALRecoverySeq = seq
+	}
+}
+
+// WithWALRecycling memtable 落盘后保留至多 n 个 wal 文件，切换 memtable 或者 wal 分段时复用，从头覆盖写入，
+// 避免创建文件以及分配磁盘空间. 复用的文件中上一代遗留的记录在回放时被忽略. 不支持共享 wal 模式以及 wal 归档.
+func WithWALRecycling(n int) ConfigOption {
+	return func(c *Config) {
+		c.WALRecycleFiles = n
+	}
+}
+
+// WithWALReplayRate 限制启动时回放 wal 的速率，单位 byte/s. wal 积压较多时，避免重启的服务占满共享磁盘的 IO.
+func WithWALReplayRate(bytesPerSecond int64) ConfigOption {
+	return func(c *Config) {
+		c.WALReplayRate = bytesPerSecond
+	}
+}
+
+// WithWALReplayProgress 注入启动时回放 wal 的进度回调，参数为已回放的字节数与需要回放的总字节数.
+// 回调在 NewTree 的执行过程中被调用，可用于对外暴露恢复进度.
+func WithWALReplayProgress(progress func(replayed, total int64)) ConfigOption {
+	return func(c *Config) {
+		c.WALReplayProgress = progress
+	}
+}
+
 func repaire(c *Config) {
 	// lsm tree 默认为 7 层.
 	if c.MaxLevel <= 1 {
@@ -129,6 +738,11 @@ func repaire(c *Config) {
 		c.SSTSize = 1024 * 1024
 	}
 
+	// compact 产出的 sstable 文件大小默认与 level0 层一致.
+	if c.SSTTargetFileSize <= 0 {
+		c.SSTTargetFileSize = c.SSTSize
+	}
+
 	// sstable 中每个 block 块的大小限制. 默认为 16KB.
 	if c.SSTDataBlockSize <= 0 {
 		c.SSTDataBlockSize = 16 * 1024 // 16KB
@@ -139,9 +753,103 @@ func repaire(c *Config) {
 		c.SSTNumPerLevel = 10
 	}
 
-	// 注入过滤器的具体实现. 默认使用本项目下实现的布隆过滤器 bloom filter.
-	if c.Filter == nil {
-		c.Filter, _ = filter.NewBloomFilter(1024)
+	// 数据块默认不对齐.
+	if c.BlockAlignment < 0 {
+		c.BlockAlignment = 0
+	}
+
+	// 默认使用当前内置格式写入 sstable.
+	if c.TableFormat == 0 {
+		c.TableFormat = format.Current(format.KindSST)
+	}
+
+	// 顺序遍历时默认预读 256KB，小于 0 时关闭预读.
+	if c.ReadaheadSize == 0 {
+		c.ReadaheadSize = 256 * 1024
+	}
+	if c.ReadaheadSize < 0 {
+		c.ReadaheadSize = 0
+	}
+
+	// 索引默认不分区.
+	if c.IndexPartitionSize < 0 {
+		c.IndexPartitionSize = 0
+	}
+
+	// 后台 compact 默认最多占用一半的 cpu.
+	if c.CompactionCPUFraction <= 0 || c.CompactionCPUFraction > 1 {
+		c.CompactionCPUFraction = 0.5
+	}
+
+	// compact worker 个数默认不设上限.
+	if c.MaxCompactionWorkers < 0 {
+		c.MaxCompactionWorkers = 0
+	}
+
+	// SyncWrites 与持久化级别保持一致.
+	if c.SyncWrites && c.Durability < DurabilitySync {
+		c.Durability = DurabilitySync
+	}
+	if c.Durability >= DurabilitySync {
+		c.SyncWrites = true
+	}
+
+	// 默认每 10 分钟检查一次过期记录，小于 0 时关闭检查.
+	if c.TTLCompactionInterval == 0 {
+		c.TTLCompactionInterval = 10 * time.Minute
+	}
+	if c.TTLCompactionInterval < 0 {
+		c.TTLCompactionInterval = 0
+	}
+
+	// level 层 compact 默认串行执行.
+	if c.MaxParallelCompactions <= 0 {
+		c.MaxParallelCompactions = 1
+	}
+
+	// 默认只有一路 wal.
+	if c.WALStreams <= 0 {
+		c.WALStreams = 1
+	}
+
+	// wal 归档目录默认位于数据目录下.
+	if c.WALArchive != nil && c.WALArchive.Dir == "" {
+		c.WALArchive.Dir = path.Join(c.Dir, "walarchive")
+	}
+
+	// 后台任务默认使用 DefaultRetryPolicy 进行重试.
+	if c.BackgroundRetry.MaxAttempts == 0 {
+		c.BackgroundRetry = DefaultRetryPolicy()
+	}
+	if c.BackgroundRetry.Multiplier < 1 {
+		c.BackgroundRetry.Multiplier = 1
+	}
+
+	// 数据块缓存. 默认不缓存数据块.
+	if c.BlockCacheSize > 0 {
+		c.blockCache = cache.NewLRU(c.BlockCacheSize)
+	}
+
+	// sstable 文件句柄缓存. 默认不限制打开的文件个数.
+	if c.MaxOpenFiles > 0 {
+		c.tableCache = newTableCache(c.MaxOpenFiles)
+	}
+
+	// 延迟加载的过滤器与索引的缓存. 默认加载之后不淘汰.
+	if c.LazyMetadata && c.MetadataBudget > 0 {
+		c.metaCache = newMetaCache(c.MetadataBudget)
+	}
+
+	// 默认布隆过滤器的容量参数. 预期 key 个数默认按照每条记录 64B 由数据块大小折算，假阳性率默认为 1%.
+	// 非法的参数保留原值，由 check 返回错误
+	if c.FilterKeysPerBlock == 0 {
+		c.FilterKeysPerBlock = c.SSTDataBlockSize / 64
+		if c.FilterKeysPerBlock < 1 {
+			c.FilterKeysPerBlock = 1
+		}
+	}
+	if c.FilterFPRate == 0 {
+		c.FilterFPRate = 0.01
 	}
 
 	// 注入有序表构造器. 默认使用本项目下实现的跳表 skiplist.
@@ -0,0 +1,40 @@
+package lsmart
+
+import (
+	"fmt"
+	"path"
+)
+
+// Durability 写入成功之后数据的持久化程度
+type Durability int
+
+const (
+	// DurabilityProcess 写入预写日志后即返回，由操作系统决定刷盘时机. 进程崩溃不会丢失数据，机器掉电可能丢失最近的写入. 默认级别
+	DurabilityProcess Durability = iota
+	// DurabilitySync 每次写入返回之前 fsync 预写日志，与 SyncWrites 一致
+	DurabilitySync
+	// DurabilityFull 在 DurabilitySync 的基础上，创建、删除 wal 文件之后 fsync 预写日志目录，
+	// 避免掉电后新建的 wal 文件丢失，或者已经删除的 wal 文件重新出现
+	DurabilityFull
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DurabilityProcess:
+		return "process"
+	case DurabilitySync:
+		return "sync"
+	case DurabilityFull:
+		return "full"
+	default:
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+}
+
+// DurabilityFull 级别下 fsync 预写日志目录，使得 wal 文件的创建、删除落盘
+func (t *Tree) syncWALDir() error {
+	if t.conf.Durability < DurabilityFull {
+		return nil
+	}
+	return syncDir(path.Join(t.conf.Dir, "walfile"))
+}
@@ -0,0 +1,7 @@
+package lsmart
+
+// LockData 持有 lsm tree 的写锁，模拟溢写切换 memtable 等操作长时间占用写锁，返回释放写锁的函数
+func LockData(t *Tree) (unlock func()) {
+	t.dataLock.Lock()
+	return t.dataLock.Unlock
+}
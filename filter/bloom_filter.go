@@ -2,13 +2,22 @@ package filter
 
 import (
 	"errors"
+	"fmt"
+	"math"
 
 	"github.com/spaolacci/murmur3"
 )
 
+const (
+	maxHashes = 30      // hash 函数个数的上限
+	maxBits   = 1 << 31 // bitmap 长度的上限，单位 bit. bit 位通过 uint32 计算
+)
+
 // BloomFilter 布隆过滤器
 type BloomFilter struct {
 	m          int      // bitmap 的长度，单位 bit
+	k          uint8    // hash 函数个数. 为 0 时根据 m 和实际添加的 key 个数推算
+	bitsPerKey float64  // 每个 key 占用的 bit 数. 大于 0 时 bitmap 长度随实际添加的 key 个数伸缩，忽略 m
 	hashedKeys []uint32 // 添加到布隆过滤器的一系列 key 的 hash 值
 }
 
@@ -22,6 +31,71 @@ func NewBloomFilter(m int) (*BloomFilter, error) {
 	}, nil
 }
 
+// NewBloomFilterFor 根据每个数据块预期的 key 个数以及期望的假阳性率构造布隆过滤器.
+// bitmap 长度 m = -n * ln(p) / ln2^2，hash 函数个数 k = m / n * ln2
+func NewBloomFilterFor(expectedKeys int, fpRate float64) (*BloomFilter, error) {
+	if expectedKeys <= 0 {
+		return nil, fmt.Errorf("bloom filter: expected keys per block must be positive, got %d", expectedKeys)
+	}
+	if !(fpRate > 0 && fpRate < 1) {
+		return nil, fmt.Errorf("bloom filter: false positive rate must be in (0, 1), got %v", fpRate)
+	}
+
+	m := math.Ceil(-float64(expectedKeys) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	if m > maxBits {
+		return nil, fmt.Errorf("bloom filter: %d keys at false positive rate %v need %.0f bits, exceeding the limit of %d", expectedKeys, fpRate, m, maxBits)
+	}
+	k := math.Round(m / float64(expectedKeys) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	if k > maxHashes {
+		k = maxHashes
+	}
+	return &BloomFilter{
+		m: int(m),
+		k: uint8(k),
+	}, nil
+}
+
+// NewBloomFilterWithRate 根据期望的假阳性率构造布隆过滤器，bitmap 长度随实际添加的 key 个数伸缩.
+// 适用于事先不知道 key 个数的场景，例如覆盖整个 sstable 的过滤器. 每个 key 占用 -ln(p) / ln2^2 bit，hash 函数个数 k = -log2(p)
+func NewBloomFilterWithRate(fpRate float64) (*BloomFilter, error) {
+	if !(fpRate > 0 && fpRate < 1) {
+		return nil, fmt.Errorf("bloom filter: false positive rate must be in (0, 1), got %v", fpRate)
+	}
+
+	bitsPerKey := -math.Log(fpRate) / (math.Ln2 * math.Ln2)
+	k := math.Round(bitsPerKey * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	if k > maxHashes {
+		k = maxHashes
+	}
+	return &BloomFilter{
+		k:          uint8(k),
+		bitsPerKey: bitsPerKey,
+	}, nil
+}
+
+// Validate 校验布隆过滤器的参数，避免配置错误的过滤器在读取时才暴露问题
+func (bf *BloomFilter) Validate() error {
+	if bf == nil {
+		return errors.New("bloom filter: filter is nil")
+	}
+	if bf.bitsPerKey > 0 {
+		return nil
+	}
+	if bf.m <= 0 || bf.m > maxBits {
+		return fmt.Errorf("bloom filter: bitmap length must be in (0, %d] bits, got %d", maxBits, bf.m)
+	}
+	if bf.k > maxHashes {
+		return fmt.Errorf("bloom filter: hash count must be at most %d, got %d", maxHashes, bf.k)
+	}
+	return nil
+}
+
 // Add 添加一个 key 到布隆过滤器
 func (bf *BloomFilter) Add(key []byte) {
 	bf.hashedKeys = append(bf.hashedKeys, murmur3.Sum32(key))
@@ -33,8 +107,14 @@ func (bf *BloomFilter) Exist(bitmap, key []byte) bool {
 	if bitmap == nil {
 		bitmap = bf.Hash()
 	}
+	// 没有 bit 位的 bitmap 无法判定，视为可能存在
+	if len(bitmap) < 2 {
+		return true
+	}
 	// 获取hash 函数的个数 k
 	k := bitmap[len(bitmap)-1]
+	// 最后一个 byte 存放的是 k，不参与 bit 位的映射
+	bits := uint32(len(bitmap)-1) << 3
 
 	// 第一个基准 hash 函数 h1 = murmur3.Sum32
 	// 第二个基准 hash 函数 h2 = h1 >> 17 | h2 << 15
@@ -47,7 +127,7 @@ func (bf *BloomFilter) Exist(bitmap, key []byte) bool {
 	delta := (hashedKey >> 17) | (hashedKey << 15)
 	for i := uint32(0); i < uint32(k); i++ {
 		// gi = h1 + i * h2
-		targetBit := (hashedKey + i*delta) % uint32(len(bitmap)<<3)
+		targetBit := (hashedKey + i*delta) % bits
 		// 找到对应的 bit 位，如果值为 1，则继续判断；如果值为 0，则 key 肯定不存在
 		if bitmap[targetBit>>3]&(1<<(targetBit&7)) == 0 {
 			return false
@@ -64,6 +144,8 @@ func (bf *BloomFilter) Hash() []byte {
 	k := bf.bestK()
 	// 获取出一个空的 bitmap，最后一个 byte 位值设置为 k
 	bitmap := bf.bitmap(k)
+	// 最后一个 byte 存放的是 k，不参与 bit 位的映射
+	bits := uint32(len(bitmap)-1) << 3
 
 	// 第一个基准 hash 函数 h1 = murmur3.Sum32
 	// 第二个基准 hash 函数 h2 = h1 >> 17 | h2 << 15
@@ -76,7 +158,7 @@ func (bf *BloomFilter) Hash() []byte {
 		for i := uint32(0); i < uint32(k); i++ {
 			// 第 i 个 hash 函数 gi = h1 + i * h2
 			// 需要标记为 1 的 bit 位
-			targetBit := (hashedKey + i*delta) % uint32(len(bitmap)<<3)
+			targetBit := (hashedKey + i*delta) % bits
 			bitmap[targetBit>>3] |= (1 << (targetBit & 7))
 		}
 	}
@@ -84,6 +166,15 @@ func (bf *BloomFilter) Hash() []byte {
 	return bitmap
 }
 
+// Clone 复制出一个 bitmap 长度相同、不含任何 key 的布隆过滤器
+func (bf *BloomFilter) Clone() Filter {
+	return &BloomFilter{
+		m:          bf.m,
+		k:          bf.k,
+		bitsPerKey: bf.bitsPerKey,
+	}
+}
+
 // Reset 重置过滤器
 func (bf *BloomFilter) Reset() {
 	bf.hashedKeys = bf.hashedKeys[:0]
@@ -94,26 +185,47 @@ func (bf *BloomFilter) KeyLen() int {
 	return len(bf.hashedKeys)
 }
 
+// bitmap 的长度，单位 bit. 按照每个 key 占用的 bit 数伸缩时由实际添加的 key 个数推算
+func (bf *BloomFilter) bits() int {
+	if bf.bitsPerKey <= 0 {
+		return bf.m
+	}
+	m := math.Ceil(bf.bitsPerKey * float64(len(bf.hashedKeys)))
+	if m < 8 {
+		m = 8
+	}
+	if m > maxBits {
+		m = maxBits
+	}
+	return int(m)
+}
+
 // 生成一个空的 bitmap
 func (bf *BloomFilter) bitmap(k uint8) []byte {
 	// bytes = bits / 8 (向上取整)
-	bitmapLen := (bf.m + 7) >> 3
+	bitmapLen := (bf.bits() + 7) >> 3
 	bitmap := make([]byte, bitmapLen+1)
 	// 最后一位标识 k 的信息
 	bitmap[bitmapLen] = k
 	return bitmap
 }
 
-// 根据 m 和 n 推算出最佳的 k
+// 根据 m 和 n 推算出最佳的 k. 构造时指定了 k 则直接使用
 func (bf *BloomFilter) bestK() uint8 {
+	if bf.k > 0 {
+		return bf.k
+	}
+	if len(bf.hashedKeys) == 0 {
+		return 1
+	}
 	// k 最佳计算公式：k = ln2 * m / n  m——bitmap 长度 n——key个数
-	k := uint8(69 * bf.m / 100 / len(bf.hashedKeys))
-	// k ∈ [1,30]
+	k := 69 * bf.m / 100 / len(bf.hashedKeys)
+	// k ∈ [1,30]. 先截断再转换为 uint8，避免溢出
 	if k < 1 {
 		k = 1
 	}
-	if k > 30 {
-		k = 30
+	if k > maxHashes {
+		k = maxHashes
 	}
-	return k
+	return uint8(k)
 }
@@ -8,3 +8,13 @@ type Filter interface {
 	Reset()                        // 重置过滤器
 	KeyLen() int                   // 存在多少个 key
 }
+
+// Validator 能够自行校验参数的过滤器. 配置过滤器时调用，参数不合法时返回描述性的错误
+type Validator interface {
+	Validate() error
+}
+
+// Cloner 能够复制出独立实例的过滤器. 多个 sstable 并发写入时，每个 sstWriter 需要独占一个过滤器实例
+type Cloner interface {
+	Clone() Filter // 复制出一个参数相同、不含任何 key 的过滤器
+}
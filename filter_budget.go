@@ -0,0 +1,88 @@
+package lsmart
+
+import (
+	"math"
+
+	"github.com/cccccxxy/lsmart/filter"
+)
+
+const (
+	maxBudgetFPRate = 0.5  // 按照内存预算分配过滤器时，单层假阳性率的上限. 超出上限的层按照上限分配
+	minBudgetFPRate = 1e-6 // 按照内存预算分配过滤器时，单层假阳性率的下限. 预算充裕时避免 bitmap 过长
+)
+
+// 按照过滤器的内存预算为每一层分配假阳性率（Monkey），keys 为各层的 key 个数，budget 为 bitmap 总长度，单位 bit.
+// 各层 bitmap 总长度 Σ -n_i * ln(p_i) / ln2^2 不超过预算时，使各层假阳性率之和，
+// 即一次点查不存在的 key 时预期的无效数据块读取次数最小的解为 p_i ∝ n_i：
+// 数据量小、数据较新、访问频繁的浅层分配更多的 bit，数据量大的深层分配更少的 bit. 没有数据的层假阳性率为 0
+func monkeyFPRates(keys []float64, budget float64) []float64 {
+	// 乘以 ln2^2 便于直接与 -n * ln(p) 比较
+	budget *= math.Ln2 * math.Ln2
+	rates := make([]float64, len(keys))
+	capped := make([]bool, len(keys))
+	for {
+		// 未封顶的层 p_i = λ * n_i，由 Σ -n_i * (ln λ + ln n_i) = budget 解出 ln λ
+		var sumKeys, sumKeysLog float64
+		for level, n := range keys {
+			if !capped[level] && n > 0 {
+				sumKeys += n
+				sumKeysLog += n * math.Log(n)
+			}
+		}
+		if sumKeys == 0 {
+			return rates
+		}
+		lnLambda := -(budget + sumKeysLog) / sumKeys
+
+		// 假阳性率超出上限的层按照上限分配，余下的预算在其他层之间重新求解
+		done := true
+		for level, n := range keys {
+			if capped[level] || n <= 0 {
+				continue
+			}
+			rates[level] = math.Exp(lnLambda) * n
+			if rates[level] > maxBudgetFPRate {
+				rates[level] = maxBudgetFPRate
+				capped[level] = true
+				budget += n * math.Log(maxBudgetFPRate)
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+	for level := range rates {
+		if keys[level] > 0 {
+			rates[level] = math.Max(rates[level], minBudgetFPRate)
+		}
+	}
+	return rates
+}
+
+// 写入 level 层的 sstable 使用的过滤器. 配置了过滤器的内存预算时，按照各层当前的数据量分配假阳性率，
+// 每层的 key 个数按照每条记录 64B 由 sstable 大小折算，写入的目标层至少计入一个 sstable. 否则返回 nil，使用统一的过滤器
+func (t *Tree) levelFilter(level int) filter.Filter {
+	if !t.conf.budgetedFilter {
+		return nil
+	}
+
+	keys := make([]float64, len(t.nodes))
+	for l := range t.nodes {
+		t.levelLocks[l].RLock()
+		for _, node := range t.nodes[l] {
+			keys[l] += float64(node.size) / 64
+		}
+		t.levelLocks[l].RUnlock()
+	}
+	if minKeys := float64(t.conf.SSTSize) * math.Pow10(level) / 64; keys[level] < minKeys {
+		keys[level] = minKeys
+	}
+
+	rates := monkeyFPRates(keys, float64(t.conf.FilterMemoryBudget)*8)
+	bf, err := filter.NewBloomFilterFor(t.conf.FilterKeysPerBlock, rates[level])
+	if err != nil {
+		return nil
+	}
+	return bf
+}
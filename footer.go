@@ -0,0 +1,149 @@
+package lsmart
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/cccccxxy/lsmart/format"
+)
+
+const (
+	// 带版本号的 footer 尾部的 magic number，对应 "LSMARTSS"
+	sstMagic uint64 = 0x4c534d4152545353
+	// 老版本 footer 的大小，仅包含 4 个 uvarint，没有 version 和 magic number
+	legacySSTFooterSize = 32
+	// 当前版本 footer 的大小. 14 个 uvarint 占 140 byte || version 占 4 byte || magic number 占 8 byte
+	sstFooterSize = 152
+)
+
+// 各版本 footer 的大小
+func footerSizeOf(version format.Version) int {
+	switch version {
+	case 1:
+		return legacySSTFooterSize
+	case 2:
+		return 48
+	case 3:
+		return 64
+	case 4:
+		return 72
+	case 5, 6, 7, 8:
+		return 92
+	case 9:
+		return 102
+	case 10:
+		return 122
+	default:
+		return sstFooterSize
+	}
+}
+
+// Footer sstable 尾部的 footer，记录格式版本以及各个块的位置. 由 TableFormat 负责编码与解析
+type Footer struct {
+	Version      format.Version // sstable 的格式版本
+	FilterOffset uint64         // 过滤器块起始位置在 sstable 的 offset
+	FilterSize   uint64         // 过滤器块的大小，单位 byte
+	IndexOffset  uint64         // 索引块起始位置在 sstable 的 offset
+	IndexSize    uint64         // 索引块的大小，单位 byte
+	MaxSeq       uint64         // sstable 中记录的最大 seq. 自版本 3 起记录
+	Alignment    uint64         // 数据块的对齐边界，单位 byte，0 表示不对齐. 自版本 4 起记录
+	PropsOffset  uint64         // 属性块起始位置在 sstable 的 offset. 自版本 5 起记录
+	PropsSize    uint64         // 属性块的大小，单位 byte. 自版本 5 起记录
+
+	IndexPartitions uint64 // 分区索引的分区个数，0 表示单层索引. 自版本 9 起记录
+
+	TableFilterOffset uint64 // 整表过滤器块起始位置在 sstable 的 offset. 自版本 10 起记录
+	TableFilterSize   uint64 // 整表过滤器块的大小，单位 byte，0 表示没有整表过滤器. 自版本 10 起记录
+
+	EncryptionKeyID uint64 // 加密各个块使用的密钥 id，0 表示不加密. 自版本 11 起记录
+	IVHigh          uint64 // 文件随机 iv 的高 64 位. 自版本 11 起记录
+	IVLow           uint64 // 文件随机 iv 的低 64 位. 自版本 11 起记录
+}
+
+// 从 sstable 尾部的字节数组中识别格式版本. 尾部不是 magic number 时为老版本的 footer，版本为 1
+func footerVersion(tail []byte) format.Version {
+	if len(tail) >= 12 && binary.LittleEndian.Uint64(tail[len(tail)-8:]) == sstMagic {
+		return format.Version(binary.LittleEndian.Uint32(tail[len(tail)-12:]))
+	}
+	return 1
+}
+
+// 将 footer 按照内置格式编码为 footer 大小的字节数组
+func (f *Footer) encode() []byte {
+	size := footerSizeOf(f.Version)
+	buf := make([]byte, size)
+	n := 0
+	for _, field := range f.fields() {
+		n += binary.PutUvarint(buf[n:], *field)
+	}
+	binary.LittleEndian.PutUint32(buf[size-12:], uint32(f.Version))
+	binary.LittleEndian.PutUint64(buf[size-8:], sstMagic)
+	return buf
+}
+
+// footer 中以 uvarint 形式编码的各个字段，不同版本包含的字段数量不同
+func (f *Footer) fields() []*uint64 {
+	fields := []*uint64{&f.FilterOffset, &f.FilterSize, &f.IndexOffset, &f.IndexSize}
+	if f.Version >= 3 {
+		fields = append(fields, &f.MaxSeq)
+	}
+	if f.Version >= 4 {
+		fields = append(fields, &f.Alignment)
+	}
+	if f.Version >= 5 {
+		fields = append(fields, &f.PropsOffset, &f.PropsSize)
+	}
+	if f.Version >= 9 {
+		fields = append(fields, &f.IndexPartitions)
+	}
+	if f.Version >= 10 {
+		fields = append(fields, &f.TableFilterOffset, &f.TableFilterSize)
+	}
+	if f.Version >= 11 {
+		fields = append(fields, &f.EncryptionKeyID, &f.IVHigh, &f.IVLow)
+	}
+	return fields
+}
+
+// 从 sstable 尾部的字节数组中按照内置格式解析出 version 版本的 footer
+func decodeFooter(tail []byte, version format.Version) (*Footer, error) {
+	f := Footer{Version: version}
+	size := footerSizeOf(f.Version)
+	if len(tail) < size {
+		return nil, errors.New("sstable footer too short")
+	}
+	tail = tail[len(tail)-size:]
+
+	var n int
+	for _, field := range f.fields() {
+		v, m := binary.Uvarint(tail[n:])
+		if m <= 0 {
+			return nil, errors.New("invalid sstable footer")
+		}
+		*field = v
+		n += m
+	}
+	return &f, nil
+}
+
+// 校验 footer 中记录的各个块与文件布局吻合，fileSize 为 sstable 文件的大小，footerSize 为 footer 的大小.
+// 过滤器块、整表过滤器块依次位于索引块之前，最后一个块（版本 5 起为属性块，否则为索引块）紧邻 footer
+func (f *Footer) validate(fileSize, footerSize uint64) error {
+	if fileSize < footerSize {
+		return errors.New("sstable footer too short")
+	}
+	body := fileSize - footerSize
+
+	lastOffset, lastSize := f.IndexOffset, f.IndexSize
+	if f.Version >= 5 {
+		lastOffset, lastSize = f.PropsOffset, f.PropsSize
+	}
+	if f.FilterOffset > f.IndexOffset || f.FilterSize > f.IndexOffset-f.FilterOffset ||
+		lastOffset > body || lastSize != body-lastOffset ||
+		f.TableFilterSize > 0 && (f.TableFilterOffset < f.FilterOffset+f.FilterSize ||
+			f.TableFilterOffset > f.IndexOffset || f.TableFilterSize > f.IndexOffset-f.TableFilterOffset) {
+		return fmt.Errorf("invalid sstable footer (version %d): blocks do not match the file size %d", f.Version, fileSize)
+	}
+	return nil
+}
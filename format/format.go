@@ -0,0 +1,96 @@
+package format
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// ErrUnsupportedVersion 文件的格式版本超出了当前代码能够读取的范围，通常是由更新版本的 lsmart 写入的.
+// 可以通过 errors.Is 判断
+var ErrUnsupportedVersion = errors.New("unsupported format version")
+
+// Kind 持久化文件的种类
+type Kind string
+
+const (
+	KindSST       Kind = "sst"        // sstable 文件
+	KindWAL       Kind = "wal"        // 每个 memtable 独占的 wal 文件
+	KindSharedWAL Kind = "shared_wal" // 所有 memtable 共用的 wal 文件
+	KindManifest  Kind = "manifest"   // 记录存活 sstable 的清单文件
+)
+
+// Version 文件格式版本号. 从 1 开始单调递增，每次磁盘格式发生变化时加 1
+type Version uint32
+
+// 各类文件当前写入时使用的格式版本
+//
+// sstable 版本演进：
+//
+//	1 初始格式，footer 只包含过滤器块、索引块的 offset 与 size
+//	2 数据块尾部追加重启点 offset，footer 追加 version 与 magic number
+//	3 value 编码为内部记录（操作类型 || seq || 用户 value），footer 追加最大 seq
+//	4 数据块之间允许填充对齐，footer 追加数据块的对齐边界
+//	5 索引块之后追加属性块，记录文件的创建时间、产生方式以及写入版本，footer 追加属性块的 offset 与 size
+//	6 布隆过滤器的 bit 位只映射到 bitmap 中存放 k 的末尾 byte 之前，老版本的布隆过滤器可能产生假阴性，读取时不再使用
+//	7 数据块尾部追加 1 byte 的压缩类型，数据块可以按块压缩
+//	8 数据块、过滤器块、索引块以及属性块尾部追加 4 byte 的 CRC32C 校验和
+//	9 索引可以按分区存放，footer 指向常驻内存的顶层索引，并追加分区个数
+//	10 过滤器块之后可以追加覆盖整个 sstable 的整表过滤器块，footer 追加整表过滤器块的 offset 与 size
+//	11 各个块的内容可以使用 AES-CTR 加密，校验和针对密文计算，footer 追加密钥 id 与文件的随机 iv
+//	12 过滤器块、整表过滤器块以及索引块尾部追加 1 byte 的压缩类型，可以独立于数据块压缩
+//
+// wal 版本演进：
+//
+//	1 初始格式，文件中只有 kv 记录
+//	2 文件头部追加 magic number 与 version，value 编码为内部记录
+//	3 每条记录以 kv 对个数开头，一条记录可以包含一批 kv 对
+//	4 每条记录之前追加 4 byte 的 CRC32C 校验和与 4 byte 的记录长度，回放在首条不完整或者校验失败的记录处停止
+//	5 文件头部以及每条记录的头部追加 4 byte 的文件代数，wal 文件可以回收覆盖写入，上一代遗留的记录在回放时被忽略.
+//	  共享 wal 不回收，文件代数恒为 1
+//	6 每条记录的内容以 1 byte 的记录类型开头（写入、删除、批量、检查点），单笔写入、删除的记录省略 kv 对个数，
+//	  检查点记录只包含 seq
+//
+// manifest 版本演进：
+//
+//	1 初始格式，文件头部为 magic number 与 version，之后为带 CRC32C 校验和的编辑记录
+var current = map[Kind]Version{
+	KindSST:       12,
+	KindWAL:       6,
+	KindSharedWAL: 6,
+	KindManifest:  1,
+}
+
+// Kinds 返回所有持久化文件的种类
+func Kinds() []Kind {
+	return []Kind{KindSST, KindWAL, KindSharedWAL, KindManifest}
+}
+
+// Current 返回某类文件当前写入时使用的格式版本
+func Current(kind Kind) Version {
+	return current[kind]
+}
+
+// Versions 返回某类文件所有存在过的格式版本. 新版本的代码必须能够读取其中的每一个版本
+func Versions(kind Kind) []Version {
+	versions := make([]Version, 0, current[kind])
+	for v := Version(1); v <= current[kind]; v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// MustSupportAll 校验读取方是否覆盖了某类文件的全部历史版本，readable 对无法读取的版本返回 false.
+// 读取方需要在 init 阶段调用，一旦升级格式时遗漏了对老版本的兼容，程序启动即 panic
+func MustSupportAll(kind Kind, readable func(Version) bool) {
+	for _, v := range Versions(kind) {
+		if !readable(v) {
+			panic(fmt.Sprintf("format: %s version %d is no longer readable", kind, v))
+		}
+	}
+}
+
+// GoldenFile 某类文件某个版本对应的 golden 文件名，位于 golden 文件目录下
+func GoldenFile(dir string, kind Kind, v Version) string {
+	return path.Join(dir, fmt.Sprintf("%s_v%d.golden", kind, v))
+}
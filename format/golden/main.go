@@ -0,0 +1,592 @@
+// golden 用于生成并校验各版本文件格式的 golden 文件.
+//
+//	go run ./format/golden -gen   为当前格式版本生成 golden 文件（已存在的版本不会被覆盖）
+//	go run ./format/golden        使用当前代码读取全部历史版本的 golden 文件，校验数据是否完整还原
+//	go test ./format/golden       与不带参数运行相同，逐个校验 golden 文件，随 go test ./... 一同执行
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/compress"
+	"github.com/cccccxxy/lsmart/format"
+	"github.com/cccccxxy/lsmart/memtable"
+	"github.com/cccccxxy/lsmart/wal"
+)
+
+func main() {
+	gen := flag.Bool("gen", false, "generate golden files for current format versions")
+	dir := flag.String("dir", "format/testdata", "golden file directory")
+	flag.Parse()
+
+	if *gen {
+		if err := generate(*dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := verify(*dir); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// 版本 11 起 golden 文件中的 sstable 使用固定的密钥加密. 读取没有加密的老版本文件时，密钥不起作用.
+// 版本 12 起过滤器块与索引块同样经过压缩
+var goldenEncryptionKey = []byte("lsmart-golden-encryption-key-32b")
+
+// golden 文件中写入的固定数据集
+func goldenKVs() []*memtable.KV {
+	kvs := make([]*memtable.KV, 0, 300)
+	for i := 0; i < 300; i++ {
+		kvs = append(kvs, &memtable.KV{
+			Key:   []byte(fmt.Sprintf("golden-key-%05d", i)),
+			Value: []byte(fmt.Sprintf("golden-value-%05d", i)),
+		})
+	}
+	return kvs
+}
+
+// 为各类文件的当前格式版本生成 golden 文件
+func generate(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	generators := map[format.Kind]func(file string) error{
+		format.KindSST:       generateSST,
+		format.KindWAL:       generateWAL,
+		format.KindSharedWAL: generateSharedWAL,
+		format.KindManifest:  generateManifest,
+	}
+	for _, kind := range format.Kinds() {
+		file := format.GoldenFile(dir, kind, format.Current(kind))
+		if _, err := os.Stat(file); err == nil {
+			continue
+		}
+		if err := generators[kind](file); err != nil {
+			return fmt.Errorf("generate %s: %w", file, err)
+		}
+		log.Printf("generated %s", file)
+	}
+	return nil
+}
+
+// 各类文件 golden 文件的校验函数
+var verifiers = map[format.Kind]func(file string) error{
+	format.KindSST:       verifySST,
+	format.KindWAL:       verifyWAL,
+	format.KindSharedWAL: verifySharedWAL,
+	format.KindManifest:  verifyManifest,
+}
+
+// 使用当前代码读取各类文件全部历史版本的 golden 文件
+func verify(dir string) error {
+	for _, kind := range format.Kinds() {
+		for _, v := range format.Versions(kind) {
+			file := format.GoldenFile(dir, kind, v)
+			if err := verifiers[kind](file); err != nil {
+				return fmt.Errorf("verify %s: %w", file, err)
+			}
+			log.Printf("verified %s", file)
+		}
+	}
+	return nil
+}
+
+func generateSST(file string) error {
+	tmp, err := os.MkdirTemp("", "lsmart-golden")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	conf, err := lsmart.NewConfig(tmp, lsmart.WithSSTDataBlockSize(256), lsmart.WithBlockAlignment(512),
+		lsmart.WithCompression(compress.NewFlate(compress.DefaultFlateLevel)), lsmart.WithPartitionedIndex(64),
+		lsmart.WithTableFilter(), lsmart.WithEncryptionKey(1, goldenEncryptionKey),
+		lsmart.WithMetadataCompression(compress.NewFlate(compress.DefaultFlateLevel)))
+	if err != nil {
+		return err
+	}
+	sstWriter, err := lsmart.NewSSTWriter("golden.sst", conf)
+	if err != nil {
+		return err
+	}
+	sstWriter.SetOrigin(lsmart.SSTOriginFlush, []string{"golden.wal"})
+	defer sstWriter.Close()
+	for i, kv := range goldenKVs() {
+		if err = sstWriter.Append(kv.Key, lsmart.EncodeInternalValue(lsmart.OpPut, uint64(i+1), kv.Value)); err != nil {
+			return err
+		}
+	}
+	if _, _, _, err = sstWriter.Finish(); err != nil {
+		return err
+	}
+
+	return copyFile(path.Join(tmp, "golden.sst"), file)
+}
+
+func verifySST(file string) error {
+	tmp, err := os.MkdirTemp("", "lsmart-golden")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err = copyFile(file, path.Join(tmp, "golden.sst")); err != nil {
+		return err
+	}
+	conf, err := lsmart.NewConfig(tmp, lsmart.WithRetiredEncryptionKey(1, goldenEncryptionKey))
+	if err != nil {
+		return err
+	}
+	sstReader, err := lsmart.NewSSTReader("golden.sst", conf)
+	if err != nil {
+		return err
+	}
+	defer sstReader.Close()
+
+	filters, err := sstReader.ReadFilter()
+	if err != nil {
+		return err
+	}
+	if sstReader.Version() >= 5 {
+		props, err := sstReader.ReadProperties()
+		if err != nil {
+			return err
+		}
+		if props.CreatedAt.IsZero() || props.Origin != lsmart.SSTOriginFlush {
+			return fmt.Errorf("unexpected sstable properties %+v", props)
+		}
+		// 版本 7 起数据块按块压缩
+		if sstReader.Version() >= 7 && props.Compression != compress.Flate.String() {
+			return fmt.Errorf("unexpected sstable compression %q", props.Compression)
+		}
+	}
+	index, err := sstReader.ReadIndex()
+	if err != nil {
+		return err
+	}
+	// 版本 9 起索引可以按分区存放
+	if sstReader.Version() >= 9 && sstReader.IndexPartitions() == 0 {
+		return errors.New("expect a partitioned index")
+	}
+	for i := 1; i < len(index); i++ {
+		if bytes.Compare(index[i-1].Key, index[i].Key) >= 0 {
+			return errors.New("index keys out of order")
+		}
+	}
+
+	kvs, err := sstReader.ReadData()
+	if err != nil {
+		return err
+	}
+	// 版本 8 起块尾部带有校验和，数据块中翻转的 bit 必须被发现
+	if sstReader.Version() >= 8 {
+		if err = verifySSTChecksum(tmp, conf, file, index); err != nil {
+			return err
+		}
+	}
+	// 版本 6 起布隆过滤器不会产生假阴性，每个 key 都必须能够通过所在数据块的过滤器
+	if sstReader.Version() >= 6 {
+		for _, kv := range kvs {
+			i := sort.Search(len(index), func(i int) bool { return bytes.Compare(index[i].Key, kv.Key) >= 0 })
+			if i == len(index) || !conf.Filter.Exist(filters[index[i].PrevBlockOffset], kv.Key) {
+				return fmt.Errorf("key %q is rejected by its block filter", kv.Key)
+			}
+		}
+	}
+	// 版本 10 起可以带有整表过滤器，每个 key 都必须能够通过
+	if sstReader.Version() >= 10 {
+		tableFilter, err := sstReader.ReadTableFilter()
+		if err != nil {
+			return err
+		}
+		if tableFilter == nil {
+			return errors.New("expect a table filter")
+		}
+		for _, kv := range kvs {
+			if !conf.Filter.Exist(tableFilter, kv.Key) {
+				return fmt.Errorf("key %q is rejected by the table filter", kv.Key)
+			}
+		}
+	}
+	// 版本 11 起各个块加密存放，没有配置密钥时无法读取
+	if sstReader.Version() >= 11 {
+		if sstReader.EncryptionKeyID() != 1 {
+			return errors.New("expect an encrypted sstable")
+		}
+		plain, err := lsmart.NewConfig(tmp)
+		if err != nil {
+			return err
+		}
+		if _, err = lsmart.NewSSTReader("golden.sst", plain); !errors.Is(err, lsmart.ErrEncryptionKeyMissing) {
+			return fmt.Errorf("encrypted sstable is opened without the key: %v", err)
+		}
+	}
+	got := make([]*memtable.KV, 0, len(kvs))
+	for _, kv := range kvs {
+		got = append(got, &memtable.KV{Key: kv.Key, Value: kv.Value})
+	}
+	if got, err = userKVs(got); err != nil {
+		return err
+	}
+	return compareKVs(goldenKVs(), got)
+}
+
+// 翻转 sstable 首个数据块中的一个 bit，校验读取时返回数据损坏的错误
+func verifySSTChecksum(tmp string, conf *lsmart.Config, file string, index []*lsmart.Index) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	for _, idx := range index {
+		if idx.PrevBlockSize == 0 {
+			continue
+		}
+		data[idx.PrevBlockOffset] ^= 1
+		if err = os.WriteFile(path.Join(tmp, "corrupt.sst"), data, 0644); err != nil {
+			return err
+		}
+		sstReader, err := lsmart.NewSSTReader("corrupt.sst", conf)
+		if err != nil {
+			return err
+		}
+		defer sstReader.Close()
+		if _, err = sstReader.ReadDataBlock(idx.PrevBlockOffset, idx.PrevBlockSize); !errors.Is(err, lsmart.ErrCorruption) {
+			return fmt.Errorf("flipped bit in data block is not detected: %v", err)
+		}
+		return nil
+	}
+	return errors.New("no data block found")
+}
+
+// wal golden 文件中每条批量记录包含的 kv 对个数
+const goldenWALBatch = 10
+
+func generateWAL(file string) error {
+	walWriter, err := wal.NewWALWriter(file)
+	if err != nil {
+		return err
+	}
+	defer walWriter.Close()
+	walWriter.SetTombstoneFunc(func(value []byte) bool {
+		return len(value) > 0 && lsmart.OpType(value[0]) == lsmart.OpDelete
+	})
+
+	// 版本 6 起以检查点开头，随后是首个 key 的墓碑记录，被之后的写入覆盖
+	kvs := goldenKVs()
+	if err = walWriter.WriteCheckpoint(0); err != nil {
+		return err
+	}
+	if err = walWriter.Write(kvs[0].Key, lsmart.EncodeInternalValue(lsmart.OpDelete, 0, nil)); err != nil {
+		return err
+	}
+
+	// 前一半数据逐笔写入，后一半数据以批量记录写入
+	for i, kv := range kvs[:len(kvs)/2] {
+		if err = walWriter.Write(kv.Key, lsmart.EncodeInternalValue(lsmart.OpPut, uint64(i+1), kv.Value)); err != nil {
+			return err
+		}
+	}
+	for i := len(kvs) / 2; i < len(kvs); i += goldenWALBatch {
+		batch := make([]*memtable.KV, 0, goldenWALBatch)
+		for j := i; j < i+goldenWALBatch && j < len(kvs); j++ {
+			batch = append(batch, &memtable.KV{Key: kvs[j].Key, Value: lsmart.EncodeInternalValue(lsmart.OpPut, uint64(j+1), kvs[j].Value)})
+		}
+		if err = walWriter.WriteBatch(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifyWAL(file string) error {
+	walReader, err := wal.NewWALReader(file)
+	if err != nil {
+		return err
+	}
+	defer walReader.Close()
+
+	memTable := memtable.NewSkiplist()
+	if err = walReader.RestoreToMemtable(memTable); err != nil {
+		return err
+	}
+	got := memTable.All()
+	if walReader.Version() >= 2 {
+		if got, err = userKVs(got); err != nil {
+			return err
+		}
+	}
+	if err = compareKVs(goldenKVs(), got); err != nil {
+		return err
+	}
+	if walReader.Version() < 4 {
+		return nil
+	}
+	if walReader.Truncated() {
+		return errors.New("intact wal reported as truncated")
+	}
+	if err = verifyCorruptWAL(file); err != nil {
+		return err
+	}
+	// 只有当前版本的 wal 文件才能被回收
+	if walReader.Version() == format.Current(format.KindWAL) {
+		if err = verifyRecycledWAL(file); err != nil {
+			return err
+		}
+	}
+	if walReader.Version() < 6 {
+		return nil
+	}
+	return verifyWALRecordTypes(file)
+}
+
+// 版本 6 起每条记录带有类型：检查点 || 墓碑记录 || 逐笔写入 || 批量写入
+func verifyWALRecordTypes(file string) error {
+	walReader, err := wal.NewWALReader(file)
+	if err != nil {
+		return err
+	}
+	defer walReader.Close()
+
+	kvs := goldenKVs()
+	want := []wal.RecordType{wal.RecordCheckpoint, wal.RecordDelete}
+	for i := 0; i < len(kvs)/2; i++ {
+		want = append(want, wal.RecordPut)
+	}
+	for i := len(kvs) / 2; i < len(kvs); i += goldenWALBatch {
+		want = append(want, wal.RecordBatch)
+	}
+
+	var got []wal.RecordType
+	it := walReader.NewIterator()
+	for it.Next() {
+		got = append(got, it.Record().Type)
+	}
+	if err = it.Err(); err != nil {
+		return err
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("want %d records, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			return fmt.Errorf("record %d: want type %s, got %s", i, want[i], got[i])
+		}
+	}
+	return nil
+}
+
+// 版本 5 起当前版本的 wal 文件可以回收覆盖写入，上一代遗留的记录不会被回放
+func verifyRecycledWAL(file string) error {
+	tmp, err := os.MkdirTemp("", "lsmart-golden")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	old, recycled := path.Join(tmp, "old.wal"), path.Join(tmp, "recycled.wal")
+	if err = copyFile(file, old); err != nil {
+		return err
+	}
+	walWriter, err := wal.RecycleWALWriter(old, recycled)
+	if err != nil {
+		return err
+	}
+	kvs := goldenKVs()[:goldenWALBatch]
+	for i, kv := range kvs {
+		if err = walWriter.Write(kv.Key, lsmart.EncodeInternalValue(lsmart.OpPut, uint64(i+1), kv.Value)); err != nil {
+			walWriter.Close()
+			return err
+		}
+	}
+	walWriter.Close()
+
+	walReader, err := wal.NewWALReader(recycled)
+	if err != nil {
+		return err
+	}
+	defer walReader.Close()
+	memTable := memtable.NewSkiplist()
+	if err = walReader.RestoreToMemtable(memTable); err != nil {
+		return err
+	}
+	got, err := userKVs(memTable.All())
+	if err != nil {
+		return err
+	}
+	return compareKVs(kvs, got)
+}
+
+// 版本 4 起校验失败的尾部记录被丢弃，之前的记录完整还原
+func verifyCorruptWAL(file string) error {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp("", "lsmart-golden")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	corrupt := path.Join(tmp, "corrupt.wal")
+	body[len(body)-1] ^= 0xff
+	if err = os.WriteFile(corrupt, body, 0644); err != nil {
+		return err
+	}
+	walReader, err := wal.NewWALReader(corrupt)
+	if err != nil {
+		return err
+	}
+	defer walReader.Close()
+
+	memTable := memtable.NewSkiplist()
+	if err = walReader.RestoreToMemtable(memTable); err != nil {
+		return err
+	}
+	if !walReader.Truncated() {
+		return errors.New("corrupt wal record was not detected")
+	}
+	got, err := userKVs(memTable.All())
+	if err != nil {
+		return err
+	}
+	kvs := goldenKVs()
+	return compareKVs(kvs[:len(kvs)-goldenWALBatch], got)
+}
+
+// 共享 wal 的 golden 文件中，前一半数据归属 memtable 1，后一半数据归属 memtable 2
+func generateSharedWAL(file string) error {
+	walWriter, err := wal.NewSharedWALWriter(file, 1)
+	if err != nil {
+		return err
+	}
+	defer walWriter.Close()
+
+	kvs := goldenKVs()
+	for i, kv := range kvs {
+		if i == len(kvs)/2 {
+			walWriter.Retag(2)
+		}
+		if err = walWriter.Write(kv.Key, lsmart.EncodeInternalValue(lsmart.OpPut, uint64(i+1), kv.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func verifySharedWAL(file string) error {
+	walReader, err := wal.NewSharedWALReader(file)
+	if err != nil {
+		return err
+	}
+	defer walReader.Close()
+
+	indexes, memTables, err := walReader.RestoreToMemtables(0, memtable.NewSkiplist)
+	if err != nil {
+		return err
+	}
+	if len(indexes) != 2 || indexes[0] != 1 || indexes[1] != 2 {
+		return fmt.Errorf("unexpected memtable indexes %v", indexes)
+	}
+
+	var got [2][]*memtable.KV
+	for i := range got {
+		got[i] = memTables[i].All()
+		if walReader.Version() < 2 {
+			continue
+		}
+		if got[i], err = userKVs(got[i]); err != nil {
+			return err
+		}
+	}
+
+	kvs := goldenKVs()
+	if err = compareKVs(kvs[:len(kvs)/2], got[0]); err != nil {
+		return err
+	}
+	return compareKVs(kvs[len(kvs)/2:], got[1])
+}
+
+// golden 文件中写入的固定清单. 各层已经分配的 seq 大于存活文件的 seq，对应已经被 compact 移除的文件
+func goldenManifest() *lsmart.Manifest {
+	return &lsmart.Manifest{
+		Files: []*lsmart.ManifestFile{
+			{Level: 0, Seq: 7, Size: 4096},
+			{Level: 0, Seq: 9, Size: 8192},
+			{Level: 1, Seq: 3, Size: 1 << 20},
+			{Level: 6, Seq: 1, Size: 1 << 30},
+		},
+		LevelSeqs: []int32{9, 5, 0, 0, 0, 0, 1},
+	}
+}
+
+func generateManifest(file string) error {
+	return lsmart.WriteManifest(file, goldenManifest())
+}
+
+func verifyManifest(file string) error {
+	m, err := lsmart.ReadManifest(file)
+	if err != nil {
+		return err
+	}
+	if m.Truncated {
+		return errors.New("manifest unexpectedly truncated")
+	}
+
+	expected := goldenManifest()
+	if len(m.Files) != len(expected.Files) {
+		return fmt.Errorf("expected %d files, got %d", len(expected.Files), len(m.Files))
+	}
+	for i, f := range expected.Files {
+		if *m.Files[i] != *f {
+			return fmt.Errorf("file %d: expected %+v, got %+v", i, *f, *m.Files[i])
+		}
+	}
+	if fmt.Sprint(m.LevelSeqs) != fmt.Sprint(expected.LevelSeqs) {
+		return fmt.Errorf("expected level seqs %v, got %v", expected.LevelSeqs, m.LevelSeqs)
+	}
+	return nil
+}
+
+// 将内部记录的 value 解码为用户 value
+func userKVs(kvs []*memtable.KV) ([]*memtable.KV, error) {
+	decoded := make([]*memtable.KV, 0, len(kvs))
+	for _, kv := range kvs {
+		_, _, value, err := lsmart.DecodeInternalValue(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, &memtable.KV{Key: kv.Key, Value: value})
+	}
+	return decoded, nil
+}
+
+func compareKVs(want, got []*memtable.KV) error {
+	if len(want) != len(got) {
+		return fmt.Errorf("want %d kvs, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !bytes.Equal(want[i].Key, got[i].Key) || !bytes.Equal(want[i].Value, got[i].Value) {
+			return fmt.Errorf("kv %d mismatch: want %q=%q, got %q=%q", i, want[i].Key, want[i].Value, got[i].Key, got[i].Value)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dest string) error {
+	body, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dest, body, 0644)
+}
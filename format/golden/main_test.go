@@ -0,0 +1,23 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cccccxxy/lsmart/format"
+)
+
+// 使用当前代码读取各类文件全部历史版本的 golden 文件. 缺少当前版本的 golden 文件时同样失败，需要先执行 go run ./format/golden -gen
+func TestGolden(t *testing.T) {
+	dir := filepath.Join("..", "testdata")
+	for _, kind := range format.Kinds() {
+		for _, v := range format.Versions(kind) {
+			file := format.GoldenFile(dir, kind, v)
+			t.Run(filepath.Base(file), func(t *testing.T) {
+				if err := verifiers[kind](file); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
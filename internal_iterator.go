@@ -0,0 +1,145 @@
+package lsmart
+
+import "bytes"
+
+// InternalIterator 遍历整棵 lsm tree 内部记录的迭代器，面向一致性校验、复制追赶等调试场景.
+// 记录按照存储 key 升序排列（配置了 key 变换器时，与用户 key 的顺序可能不一致），同一个 key 的多个版本按照由新到老的顺序排列，墓碑记录同样会被返回.
+// 迭代器基于构造时刻的 memtable 快照以及 sstable 节点集合，使用完毕后需要调用 Close 释放节点
+type InternalIterator struct {
+	tree    *Tree
+	iter    *mergeIterator
+	sources []*InternalRecord // 各数据源对应的 level 以及文件名
+	record  *InternalRecord   // 当前记录
+	err     error
+}
+
+// NewInternalIterator 构造一个遍历内部记录的迭代器，初始指向首条记录
+func (t *Tree) NewInternalIterator() *InternalIterator {
+	iters, sources := t.sourceIterators(nil, nil)
+	it := InternalIterator{
+		tree:    t,
+		iter:    newMergeIterator(iters),
+		sources: sources,
+	}
+	it.parse()
+	return &it
+}
+
+// Seek 定位到首条 key >= 目标 key 的记录
+func (it *InternalIterator) Seek(key []byte) {
+	it.iter.Seek(it.tree.encodeKey(key))
+	it.parse()
+}
+
+// Valid 当前是否指向一条有效记录
+func (it *InternalIterator) Valid() bool {
+	return it.err == nil && it.record != nil
+}
+
+// Next 移动到下一条记录
+func (it *InternalIterator) Next() {
+	prev := it.record
+	it.iter.Next()
+	it.parse()
+	// 只读 memtable 溢写、sstable 合并期间，同一条记录可能同时出现在新老两个数据源中，需要去重
+	for it.Valid() && it.record.Seq > 0 && it.record.Seq == prev.Seq && bytes.Equal(it.record.Key, prev.Key) {
+		it.iter.Next()
+		it.parse()
+	}
+}
+
+// Record 当前指向的记录
+func (it *InternalIterator) Record() *InternalRecord {
+	return it.record
+}
+
+// Err 迭代过程中遇到的错误
+func (it *InternalIterator) Err() error {
+	return it.err
+}
+
+// Close 关闭迭代器，释放持有的 sstable 节点
+func (it *InternalIterator) Close() {
+	it.iter.Close()
+}
+
+// 解析多路归并迭代器当前指向的记录
+func (it *InternalIterator) parse() {
+	it.record = nil
+	if it.err = it.iter.Err(); it.err != nil || !it.iter.Valid() {
+		return
+	}
+
+	op, seq, value, err := DecodeInternalValue(it.iter.Value())
+	if err != nil {
+		it.err = err
+		return
+	}
+	key, err := it.tree.decodeKey(it.iter.Key())
+	if err != nil {
+		it.err = err
+		return
+	}
+	source := it.sources[it.iter.Source()]
+	it.record = &InternalRecord{
+		Key:      key,
+		Value:    value,
+		Seq:      seq,
+		Op:       op,
+		ExpireAt: expireTime(internalExpireAt(it.iter.Value())),
+		Level:    source.Level,
+		File:     source.File,
+	}
+}
+
+// 构造整棵树各个数据源的迭代器，按照由新到老的顺序排列：读写 memtable、只读 memtable、level0 ~ levelk 层的 sstable.
+// 各迭代器均定位到首个存储 key >= start 的记录，key 范围与 [start, end) 没有重叠的 sstable 直接跳过，start、end 为空时表示不设边界.
+// 同时返回各数据源对应的 level 以及文件名
+func (t *Tree) sourceIterators(start, end []byte) ([]recordIterator, []*InternalRecord) {
+	var (
+		iters   []recordIterator
+		sources []*InternalRecord
+	)
+
+	// 1 对 memtable 做快照. 在持有 dataLock 的情况下获取各层节点，保证只读 memtable 溢写期间数据不会遗漏
+	t.dataLock.RLock()
+	defer t.dataLock.RUnlock()
+	memTables := []*memTableCompactItem{{memTable: t.memTable}}
+	for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
+		memTables = append(memTables, t.rOnlyMemTable[i])
+	}
+	for _, item := range memTables {
+		iter := newMemTableIterator(item.memTable)
+		iter.Seek(start)
+		iters = append(iters, iter)
+		sources = append(sources, &InternalRecord{Level: -1})
+	}
+
+	// 2 获取各层节点. level0 层节点之间可能存在重叠，需要按照 seq 倒序排列
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+	}
+	defer func() {
+		for level := 0; level < len(t.nodes); level++ {
+			t.levelLocks[level].RUnlock()
+		}
+	}()
+	for level := 0; level < len(t.nodes); level++ {
+		for i := range t.nodes[level] {
+			node := t.nodes[level][i]
+			if level == 0 {
+				node = t.nodes[level][len(t.nodes[level])-1-i]
+			}
+			// 节点的 Start 不大于其最小 key，End 不小于其最大 key，据此跳过不存在重叠的节点
+			if len(start) > 0 && bytes.Compare(node.End(), start) < 0 {
+				continue
+			}
+			if len(end) > 0 && bytes.Compare(node.Start(), end) >= 0 {
+				continue
+			}
+			iters = append(iters, newNodeIteratorAt(node, start))
+			sources = append(sources, &InternalRecord{Level: level, File: node.file})
+		}
+	}
+	return iters, sources
+}
@@ -0,0 +1,120 @@
+package lsmart
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// OpType 内部记录的操作类型
+type OpType uint8
+
+const (
+	OpPut    OpType = 1 // 写入
+	OpDelete OpType = 2 // 删除，对应的记录为墓碑记录
+	OpPutTTL OpType = 3 // 带过期时间的写入
+)
+
+func (o OpType) String() string {
+	switch o {
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	case OpPutTTL:
+		return "put_ttl"
+	default:
+		return "unknown"
+	}
+}
+
+// EncodeInternalValue 将用户 value 编码为内部记录的 value. memtable、wal 以及 sstable 中存放的都是内部记录的 value.
+// 编码格式为 操作类型 1 byte || seq uvarint || 用户 value
+func EncodeInternalValue(op OpType, seq uint64, value []byte) []byte {
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(value))
+	buf[0] = byte(op)
+	n := 1 + binary.PutUvarint(buf[1:], seq)
+	n += copy(buf[n:], value)
+	return buf[:n]
+}
+
+// 编码带过期时间的写入记录. 编码格式为 操作类型 1 byte || seq uvarint || 过期时间 unix 纳秒 uvarint || 用户 value
+func encodeTTLValue(seq uint64, expireAt int64, value []byte) []byte {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64+len(value))
+	buf[0] = byte(OpPutTTL)
+	n := 1 + binary.PutUvarint(buf[1:], seq)
+	n += binary.PutUvarint(buf[n:], uint64(expireAt))
+	n += copy(buf[n:], value)
+	return buf[:n]
+}
+
+// DecodeInternalValue 将内部记录的 value 解码为操作类型、seq 以及用户 value
+func DecodeInternalValue(raw []byte) (op OpType, seq uint64, value []byte, err error) {
+	if len(raw) == 0 {
+		return 0, 0, nil, fmt.Errorf("%w: empty internal value", ErrCorruption)
+	}
+
+	op = OpType(raw[0])
+	if op != OpPut && op != OpDelete && op != OpPutTTL {
+		return 0, 0, nil, fmt.Errorf("%w: invalid internal value op type", ErrCorruption)
+	}
+
+	seq, n := binary.Uvarint(raw[1:])
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("%w: invalid internal value seq", ErrCorruption)
+	}
+
+	switch op {
+	case OpPut:
+		value = raw[1+n:]
+	case OpPutTTL:
+		_, m := binary.Uvarint(raw[1+n:])
+		if m <= 0 {
+			return 0, 0, nil, fmt.Errorf("%w: invalid internal value expiration", ErrCorruption)
+		}
+		value = raw[1+n+m:]
+	}
+	return op, seq, value, nil
+}
+
+// 获取内部记录 value 中的过期时间，unix 纳秒. 不带过期时间或解析失败时返回 0
+func internalExpireAt(raw []byte) int64 {
+	if len(raw) == 0 || OpType(raw[0]) != OpPutTTL {
+		return 0
+	}
+	_, n := binary.Uvarint(raw[1:])
+	if n <= 0 {
+		return 0
+	}
+	expireAt, m := binary.Uvarint(raw[1+n:])
+	if m <= 0 {
+		return 0
+	}
+	return int64(expireAt)
+}
+
+// 内部记录是否已在 now 时刻过期
+func internalExpired(raw []byte, now int64) bool {
+	expireAt := internalExpireAt(raw)
+	return expireAt > 0 && expireAt <= now
+}
+
+// 获取内部记录 value 中的 seq，解析失败时返回 0
+func internalSeq(raw []byte) uint64 {
+	if len(raw) == 0 {
+		return 0
+	}
+	seq, _ := binary.Uvarint(raw[1:])
+	return seq
+}
+
+// InternalRecord lsm tree 中的一条内部记录
+type InternalRecord struct {
+	Key      []byte    // 用户 key
+	Value    []byte    // 用户 value. 墓碑记录的 value 为 nil
+	Seq      uint64    // 写入时分配的序列号. 老版本文件中的记录没有序列号，统一为 0
+	Op       OpType    // 操作类型
+	ExpireAt time.Time // 过期时间. 不带过期时间的记录为零值
+	Level    int       // 记录所在的 level 层. 位于 memtable 中时为 -1
+	File     string    // 记录所在的 sstable 文件名. 位于 memtable 中时为空
+}
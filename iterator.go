@@ -0,0 +1,208 @@
+package lsmart
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+
+	"github.com/cccccxxy/lsmart/memtable"
+)
+
+// 有序记录迭代器，是 memtable、sstable 以及多路归并迭代器的统一抽象. Value 返回的是内部记录的 value
+type recordIterator interface {
+	Seek(key []byte) // 定位到首个 key >= 目标 key 的记录
+	Valid() bool     // 当前是否指向一条有效记录
+	Next()           // 移动到下一条记录
+	Key() []byte     // 当前记录的 key
+	Value() []byte   // 当前记录的内部 value
+	Err() error      // 迭代过程中遇到的错误
+	Close()          // 释放迭代器持有的资源
+}
+
+// memtable 迭代器. 构造时对 memtable 中的数据做一次快照，需要在持有 dataLock 的情况下构造
+type memTableIterator struct {
+	kvs []*memtable.KV
+	pos int
+}
+
+func newMemTableIterator(memTable memtable.MemTable) *memTableIterator {
+	return &memTableIterator{
+		kvs: memTable.All(),
+	}
+}
+
+func (m *memTableIterator) Seek(key []byte) {
+	m.pos = sort.Search(len(m.kvs), func(i int) bool {
+		return bytes.Compare(m.kvs[i].Key, key) >= 0
+	})
+}
+
+func (m *memTableIterator) Valid() bool {
+	return m.pos < len(m.kvs)
+}
+
+func (m *memTableIterator) Next() {
+	m.pos++
+}
+
+func (m *memTableIterator) Key() []byte {
+	return m.kvs[m.pos].Key
+}
+
+func (m *memTableIterator) Value() []byte {
+	return m.kvs[m.pos].Value
+}
+
+func (m *memTableIterator) Err() error {
+	return nil
+}
+
+func (m *memTableIterator) Close() {}
+
+// sstable 节点迭代器. 基于 sstable 迭代器逐个读取数据块，同一时刻只有一个数据块的数据驻留在内存中.
+// 构造时会登记为节点的读者，节点在读者全部关闭前不会被销毁，需要在持有对应 level 读锁的情况下构造
+type nodeIterator struct {
+	*SSTIterator
+	node *Node
+}
+
+func newNodeIterator(node *Node) *nodeIterator {
+	return newNodeIteratorAt(node, nil)
+}
+
+// 构造节点迭代器，并借助索引直接定位到首个 key >= start 的记录，跳过之前的数据块
+func newNodeIteratorAt(node *Node, start []byte) *nodeIterator {
+	node.readers.Add(1)
+	n := nodeIterator{node: node}
+
+	// 索引按分区存放时需要读取全部分区，读取失败时迭代器直接失效
+	index, err := node.blockIndex()
+	if err != nil {
+		n.SSTIterator = &SSTIterator{reader: node.sstReader, err: err}
+		return &n
+	}
+	n.SSTIterator = newSSTIterator(node.sstReader, index)
+	n.Seek(start)
+	return &n
+}
+
+func (n *nodeIterator) Close() {
+	if n.node == nil {
+		return
+	}
+	n.SSTIterator.Close()
+	n.node.readers.Done()
+	n.node = nil
+}
+
+// 多路归并迭代器. 将多个有序迭代器归并为一个按 key 升序排列的记录流.
+// key 相同时，seq 越大的记录越优先输出；seq 相同时，位于 iters 中越靠前的迭代器越优先输出，因此构造时需要将越新的数据源放在越靠前的位置
+type mergeIterator struct {
+	iters []recordIterator
+	h     mergeHeap
+}
+
+func newMergeIterator(iters []recordIterator) *mergeIterator {
+	m := mergeIterator{
+		iters: iters,
+		h:     mergeHeap{iters: iters},
+	}
+	m.rebuild()
+	return &m
+}
+
+func (m *mergeIterator) Seek(key []byte) {
+	for _, iter := range m.iters {
+		iter.Seek(key)
+	}
+	m.rebuild()
+}
+
+func (m *mergeIterator) Valid() bool {
+	return len(m.h.items) > 0 && m.Err() == nil
+}
+
+func (m *mergeIterator) Next() {
+	iter := m.iters[m.h.items[0]]
+	iter.Next()
+	if iter.Valid() {
+		heap.Fix(&m.h, 0)
+		return
+	}
+	heap.Pop(&m.h)
+}
+
+func (m *mergeIterator) Key() []byte {
+	return m.iters[m.h.items[0]].Key()
+}
+
+func (m *mergeIterator) Value() []byte {
+	return m.iters[m.h.items[0]].Value()
+}
+
+// Source 当前记录所属的迭代器在 iters 中的位置
+func (m *mergeIterator) Source() int {
+	return m.h.items[0]
+}
+
+func (m *mergeIterator) Err() error {
+	for _, iter := range m.iters {
+		if err := iter.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mergeIterator) Close() {
+	for _, iter := range m.iters {
+		iter.Close()
+	}
+}
+
+// 基于所有有效的迭代器重建小顶堆
+func (m *mergeIterator) rebuild() {
+	m.h.items = m.h.items[:0]
+	for i, iter := range m.iters {
+		if iter.Valid() {
+			m.h.items = append(m.h.items, i)
+		}
+	}
+	heap.Init(&m.h)
+}
+
+// 多路归并使用的小顶堆，元素为迭代器在 iters 中的位置
+type mergeHeap struct {
+	iters []recordIterator
+	items []int
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h.iters[h.items[i]].Key(), h.iters[h.items[j]].Key()); c != 0 {
+		return c < 0
+	}
+	// key 相同时，seq 越大数据越新，越优先输出. 老版本文件中的记录 seq 均为 0，此时越靠前的迭代器越优先输出
+	seqI, seqJ := internalSeq(h.iters[h.items[i]].Value()), internalSeq(h.iters[h.items[j]].Value())
+	if seqI != seqJ {
+		return seqI > seqJ
+	}
+	return h.items[i] < h.items[j]
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(int))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
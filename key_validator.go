@@ -0,0 +1,44 @@
+package lsmart
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidKey key 未通过校验. 可以通过 errors.Is 判断写入是否因 key 校验失败而被拒绝
+var ErrInvalidKey = errors.New("invalid key")
+
+// KeyValidator key 校验函数，在每次 Put、Delete 时调用. 返回非空 error 时拒绝本次写入
+type KeyValidator func(key []byte) error
+
+// KeyValidationError key 校验失败的错误，包含被拒绝的 key、操作类型以及校验函数返回的原因
+type KeyValidationError struct {
+	Key []byte // 被拒绝的 key
+	Op  OpType // 被拒绝的操作类型
+	Err error  // 校验函数返回的原因
+}
+
+func (e *KeyValidationError) Error() string {
+	return fmt.Sprintf("%s %q: %v: %v", e.Op, e.Key, ErrInvalidKey, e.Err)
+}
+
+// Is 使得 errors.Is(err, ErrInvalidKey) 成立
+func (e *KeyValidationError) Is(target error) bool {
+	return target == ErrInvalidKey
+}
+
+// Unwrap 返回校验函数返回的原因
+func (e *KeyValidationError) Unwrap() error {
+	return e.Err
+}
+
+// 使用配置的校验函数校验 key. 未配置校验函数时直接通过
+func (t *Tree) validateKey(key []byte, op OpType) error {
+	if t.conf.KeyValidator == nil {
+		return nil
+	}
+	if err := t.conf.KeyValidator(key); err != nil {
+		return &KeyValidationError{Key: key, Op: op, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// Package keys 提供保序的组合 key 编码. 编码结果按字节序比较的顺序与各字段依次比较的顺序一致，
+// 便于在迭代器之上构建二级索引等有序结构.
+package keys
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// 变长字段的转义规则：字段中的 0x00 编码为 0x00 0xff，字段以 0x00 0x01 结尾.
+// 结尾标记小于任何转义后的内容，使得较短的字段总是排在以其为前缀的较长字段之前
+const (
+	escapeByte     byte = 0x00
+	escapedZero    byte = 0xff
+	terminatorByte byte = 0x01
+)
+
+// ErrInvalidEncoding 待解码的数据不是合法的编码结果
+var ErrInvalidEncoding = errors.New("keys: invalid encoding")
+
+// AppendBytes 将字节数组以保序的方式编码后追加到 dst
+func AppendBytes(dst, b []byte) []byte {
+	for _, c := range b {
+		if c == escapeByte {
+			dst = append(dst, escapeByte, escapedZero)
+			continue
+		}
+		dst = append(dst, c)
+	}
+	return append(dst, escapeByte, terminatorByte)
+}
+
+// AppendString 将字符串以保序的方式编码后追加到 dst
+func AppendString(dst []byte, s string) []byte {
+	return AppendBytes(dst, []byte(s))
+}
+
+// AppendUint64 将 uint64 以大端序编码为定长 8 byte 后追加到 dst
+func AppendUint64(dst []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(dst, buf[:]...)
+}
+
+// AppendInt64 将 int64 翻转符号位后以大端序编码，使得负数排在正数之前
+func AppendInt64(dst []byte, v int64) []byte {
+	return AppendUint64(dst, uint64(v)^(1<<63))
+}
+
+// AppendTime 将时间编码为纳秒精度的 unix 时间戳后追加到 dst. 时区信息不参与编码
+func AppendTime(dst []byte, t time.Time) []byte {
+	return AppendInt64(dst, t.UnixNano())
+}
+
+// DecodeBytes 从 src 头部解码出一个字节数组，返回解码结果以及剩余的数据
+func DecodeBytes(src []byte) ([]byte, []byte, error) {
+	var b []byte
+	for i := 0; i < len(src); i++ {
+		if src[i] != escapeByte {
+			b = append(b, src[i])
+			continue
+		}
+		if i+1 >= len(src) {
+			return nil, nil, ErrInvalidEncoding
+		}
+		switch src[i+1] {
+		case escapedZero:
+			b = append(b, escapeByte)
+			i++
+		case terminatorByte:
+			if b == nil {
+				b = []byte{}
+			}
+			return b, src[i+2:], nil
+		default:
+			return nil, nil, ErrInvalidEncoding
+		}
+	}
+	return nil, nil, ErrInvalidEncoding
+}
+
+// DecodeString 从 src 头部解码出一个字符串，返回解码结果以及剩余的数据
+func DecodeString(src []byte) (string, []byte, error) {
+	b, rest, err := DecodeBytes(src)
+	return string(b), rest, err
+}
+
+// DecodeUint64 从 src 头部解码出一个 uint64，返回解码结果以及剩余的数据
+func DecodeUint64(src []byte) (uint64, []byte, error) {
+	if len(src) < 8 {
+		return 0, nil, ErrInvalidEncoding
+	}
+	return binary.BigEndian.Uint64(src), src[8:], nil
+}
+
+// DecodeInt64 从 src 头部解码出一个 int64，返回解码结果以及剩余的数据
+func DecodeInt64(src []byte) (int64, []byte, error) {
+	v, rest, err := DecodeUint64(src)
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(v ^ (1 << 63)), rest, nil
+}
+
+// DecodeTime 从 src 头部解码出一个时间，返回解码结果以及剩余的数据
+func DecodeTime(src []byte) (time.Time, []byte, error) {
+	nanos, rest, err := DecodeInt64(src)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	return time.Unix(0, nanos), rest, nil
+}
@@ -0,0 +1,14 @@
+package keys
+
+import "github.com/cccccxxy/lsmart/util"
+
+// PrefixSuccessor 返回大于所有以 prefix 为前缀的 key 的最小 key. prefix 为空或者全部由 0xff 组成时不存在这样的 key，返回 nil
+func PrefixSuccessor(prefix []byte) []byte {
+	return util.PrefixSuccessor(prefix)
+}
+
+// PrefixRange 返回以 prefix 为前缀的所有 key 所在的左闭右开区间 [start, end)，可以直接作为 Tree.NewIterator 的参数.
+// 以若干字段编码得到的 prefix 能够匹配这些字段取值相同的所有组合 key
+func PrefixRange(prefix []byte) (start, end []byte) {
+	return prefix, PrefixSuccessor(prefix)
+}
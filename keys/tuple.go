@@ -0,0 +1,38 @@
+package keys
+
+import (
+	"fmt"
+	"time"
+)
+
+// Encode 依次编码一组字段，得到保序的组合 key. 支持的字段类型为 string、[]byte、uint64、int64 以及 time.Time.
+// 解码时需要按照相同的字段类型依次调用 DecodeXxx
+func Encode(fields ...interface{}) ([]byte, error) {
+	var key []byte
+	for i, field := range fields {
+		switch v := field.(type) {
+		case string:
+			key = AppendString(key, v)
+		case []byte:
+			key = AppendBytes(key, v)
+		case uint64:
+			key = AppendUint64(key, v)
+		case int64:
+			key = AppendInt64(key, v)
+		case time.Time:
+			key = AppendTime(key, v)
+		default:
+			return nil, fmt.Errorf("keys: unsupported field type %T at %d", field, i)
+		}
+	}
+	return key, nil
+}
+
+// MustEncode 同 Encode，遇到不支持的字段类型时 panic. 适用于字段类型在编译期即可确定的场景
+func MustEncode(fields ...interface{}) []byte {
+	key, err := Encode(fields...)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
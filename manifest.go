@@ -0,0 +1,286 @@
+package lsmart
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/cccccxxy/lsmart/format"
+)
+
+func init() {
+	// 新版本必须能够读取全部老版本的 manifest 文件
+	format.MustSupportAll(format.KindManifest, manifestReadable)
+}
+
+// 当前代码能够读取的 manifest 格式版本
+func manifestReadable(v format.Version) bool {
+	return v == 1
+}
+
+const (
+	// manifest 文件名，位于数据目录下
+	manifestFileName = "MANIFEST"
+	// manifest 文件头部的 magic number，对应 "LSMARTMF"
+	manifestMagic uint64 = 0x4c534d4152544d46
+	// manifest 文件头部大小. magic number 占 8 byte || version 占 4 byte
+	manifestHeaderSize = 12
+	// 每条编辑记录的头部大小. 校验和占 4 byte || 记录长度占 4 byte
+	manifestRecordHeaderSize = 8
+)
+
+// 编辑记录中的条目类型
+const (
+	manifestAddFile  byte = 1 // 新增存活的 sstable：level || seq || size
+	manifestDelFile  byte = 2 // 移除 sstable：level || seq
+	manifestLevelSeq byte = 3 // level 层已经分配的最大 seq：level || seq
+)
+
+// ManifestFile manifest 中记录的一个存活的 sstable，文件名为 level_seq.sst
+type ManifestFile struct {
+	Level int    // 所在的 level 层
+	Seq   int32  // level 层内的 seq
+	Size  uint64 // 文件大小，单位 byte
+}
+
+// Manifest lsm tree 的文件清单，记录各层存活的 sstable 以及已经分配的 seq. 启动时以 manifest 为准还原整棵树，
+// 目录下不在清单中的 sstable，例如宕机时写了一半的文件或者外来的文件，均被忽略
+type Manifest struct {
+	Version   format.Version  // manifest 的格式版本
+	Files     []*ManifestFile // 存活的 sstable，按照 level、seq 升序排列
+	LevelSeqs []int32         // 下标为 level 层级，值为该层已经分配的最大 seq，包含已被移除的文件
+	Truncated bool            // 读取时是否在尾部遇到了不完整或者校验失败的编辑记录，该记录没有生效
+}
+
+// 一次原子生效的变更. 一条编辑记录要么整体生效，要么整体丢弃
+type manifestEdit struct {
+	added     []*ManifestFile
+	deleted   []*ManifestFile
+	levelSeqs []int32
+}
+
+// 将编辑记录编码为 校验和 || 记录长度 || 条目...
+func (e *manifestEdit) encode() []byte {
+	buf := make([]byte, manifestRecordHeaderSize)
+	for _, f := range e.added {
+		buf = append(buf, manifestAddFile)
+		buf = binary.AppendUvarint(buf, uint64(f.Level))
+		buf = binary.AppendUvarint(buf, uint64(f.Seq))
+		buf = binary.AppendUvarint(buf, f.Size)
+	}
+	for _, f := range e.deleted {
+		buf = append(buf, manifestDelFile)
+		buf = binary.AppendUvarint(buf, uint64(f.Level))
+		buf = binary.AppendUvarint(buf, uint64(f.Seq))
+	}
+	for level, seq := range e.levelSeqs {
+		buf = append(buf, manifestLevelSeq)
+		buf = binary.AppendUvarint(buf, uint64(level))
+		buf = binary.AppendUvarint(buf, uint64(seq))
+	}
+	binary.LittleEndian.PutUint32(buf[4:], uint32(len(buf)-manifestRecordHeaderSize))
+	binary.LittleEndian.PutUint32(buf[0:], crc32.Checksum(buf[4:], castagnoliTable))
+	return buf
+}
+
+// 解析编辑记录中的条目
+func decodeManifestEdit(body []byte) (*manifestEdit, error) {
+	var (
+		edit   manifestEdit
+		reader = bytes.NewReader(body)
+	)
+	for reader.Len() > 0 {
+		typ, _ := reader.ReadByte()
+		level, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		seq, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case manifestAddFile:
+			size, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return nil, err
+			}
+			edit.added = append(edit.added, &ManifestFile{Level: int(level), Seq: int32(seq), Size: size})
+		case manifestDelFile:
+			edit.deleted = append(edit.deleted, &ManifestFile{Level: int(level), Seq: int32(seq)})
+		case manifestLevelSeq:
+			for len(edit.levelSeqs) <= int(level) {
+				edit.levelSeqs = append(edit.levelSeqs, 0)
+			}
+			edit.levelSeqs[level] = int32(seq)
+		default:
+			return nil, fmt.Errorf("unknown manifest entry type %d", typ)
+		}
+	}
+	return &edit, nil
+}
+
+// 回放编辑记录时维护的清单状态
+type manifestState struct {
+	files     map[[2]int64]*ManifestFile
+	levelSeqs []int32
+}
+
+// 在清单状态上应用一条编辑记录. 新增文件的 seq 同样推进所在 level 层已经分配的最大 seq
+func (s *manifestState) apply(edit *manifestEdit) {
+	bump := func(level int, seq int32) {
+		for len(s.levelSeqs) <= level {
+			s.levelSeqs = append(s.levelSeqs, 0)
+		}
+		if seq > s.levelSeqs[level] {
+			s.levelSeqs[level] = seq
+		}
+	}
+	for _, f := range edit.deleted {
+		delete(s.files, [2]int64{int64(f.Level), int64(f.Seq)})
+	}
+	for _, f := range edit.added {
+		s.files[[2]int64{int64(f.Level), int64(f.Seq)}] = f
+		bump(f.Level, f.Seq)
+	}
+	for level, seq := range edit.levelSeqs {
+		bump(level, seq)
+	}
+}
+
+// ReadManifest 读取 manifest 文件，回放全部编辑记录，返回存活的 sstable 以及各层已经分配的 seq.
+// 尾部写了一半或者校验失败的编辑记录被丢弃，不视为错误
+func ReadManifest(file string) (*Manifest, error) {
+	body, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < manifestHeaderSize || binary.LittleEndian.Uint64(body) != manifestMagic {
+		return nil, fmt.Errorf("%w: %s is not a manifest file", ErrCorruption, file)
+	}
+	version := format.Version(binary.LittleEndian.Uint32(body[8:]))
+	if !manifestReadable(version) {
+		return nil, fmt.Errorf("%w: manifest version %d, supported up to %d", format.ErrUnsupportedVersion, version, format.Current(format.KindManifest))
+	}
+
+	m := Manifest{Version: version}
+	state := manifestState{files: make(map[[2]int64]*ManifestFile)}
+	for rest := body[manifestHeaderSize:]; len(rest) > 0; {
+		if len(rest) < manifestRecordHeaderSize {
+			m.Truncated = true
+			break
+		}
+		length := binary.LittleEndian.Uint32(rest[4:])
+		if int64(length) > int64(len(rest)-manifestRecordHeaderSize) {
+			m.Truncated = true
+			break
+		}
+		record := rest[:manifestRecordHeaderSize+int(length)]
+		if crc32.Checksum(record[4:], castagnoliTable) != binary.LittleEndian.Uint32(record) {
+			m.Truncated = true
+			break
+		}
+		edit, err := decodeManifestEdit(record[manifestRecordHeaderSize:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: manifest %s: %v", ErrCorruption, file, err)
+		}
+		state.apply(edit)
+		rest = rest[len(record):]
+	}
+
+	for _, f := range state.files {
+		m.Files = append(m.Files, f)
+	}
+	sortManifestFiles(m.Files)
+	m.LevelSeqs = state.levelSeqs
+	return &m, nil
+}
+
+// WriteManifest 将清单写为只包含一条快照记录的 manifest 文件. 先写入临时文件并 fsync，再原子替换 file
+func WriteManifest(file string, m *Manifest) error {
+	tmp := file + ".tmp"
+	dest, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, manifestHeaderSize)
+	binary.LittleEndian.PutUint64(header[0:], manifestMagic)
+	binary.LittleEndian.PutUint32(header[8:], uint32(format.Current(format.KindManifest)))
+	edit := manifestEdit{added: m.Files, levelSeqs: m.LevelSeqs}
+	if _, err = dest.Write(append(header, edit.encode()...)); err == nil {
+		err = dest.Sync()
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return syncDir(path.Dir(file))
+}
+
+// 按照 level、seq 升序排列
+func sortManifestFiles(files []*ManifestFile) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Level != files[j].Level {
+			return files[i].Level < files[j].Level
+		}
+		return files[i].Seq < files[j].Seq
+	})
+}
+
+// manifest 写入口. 每条编辑记录追加写入后立即 fsync，保证记录生效之后才对外可见
+type manifestWriter struct {
+	dest *os.File
+	size int64
+}
+
+// 以追加模式打开 manifest 文件
+func openManifestWriter(file string) (*manifestWriter, error) {
+	dest, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := dest.Stat()
+	if err != nil {
+		_ = dest.Close()
+		return nil, err
+	}
+	return &manifestWriter{dest: dest, size: info.Size()}, nil
+}
+
+// 追加一条编辑记录并 fsync
+func (w *manifestWriter) append(edit *manifestEdit) error {
+	record := edit.encode()
+	n, err := w.dest.Write(record)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.dest.Sync()
+}
+
+func (w *manifestWriter) close() {
+	_ = w.dest.Close()
+}
+
+// errManifestNotExist 目录下没有 manifest 文件，需要从文件名还原
+var errManifestNotExist = errors.New("manifest does not exist")
+
+// 读取目录下的 manifest 文件. 文件不存在时返回 errManifestNotExist
+func readDirManifest(dir string) (*Manifest, error) {
+	m, err := ReadManifest(path.Join(dir, manifestFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errManifestNotExist
+	}
+	return m, err
+}
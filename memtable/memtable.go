@@ -12,6 +12,11 @@ type MemTable interface {
 	EntriesCnt() int               // kv 对数量
 }
 
+// Seeker 支持按 key 定位的有序表. 实现该 interface 的 memtable 在范围检查时无需拷贝全部数据
+type Seeker interface {
+	Seek(key []byte) (*KV, bool) // 返回首个 key >= 目标 key 的 kv 对，不存在时第二个 bool flag 为 false
+}
+
 type KV struct {
 	Key, Value []byte
 }
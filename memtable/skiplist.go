@@ -98,6 +98,21 @@ func (s *Skiplist) All() []*KV {
 	return kvs
 }
 
+// Seek 获取跳表中首个 key >= 目标 key 的 kv 对
+func (s *Skiplist) Seek(key []byte) (*KV, bool) {
+	move := s.head
+	// 层数自高向低，逐层向右移动，直到右侧为空或者右侧节点 key >= 检索 key
+	for level := len(s.head.nexts) - 1; level >= 0; level-- {
+		for move.nexts[level] != nil && bytes.Compare(move.nexts[level].key, key) < 0 {
+			move = move.nexts[level]
+		}
+	}
+	if len(move.nexts) == 0 || move.nexts[0] == nil {
+		return nil, false
+	}
+	return &KV{Key: move.nexts[0].key, Value: move.nexts[0].value}, true
+}
+
 // Size 跳表数据量大小，单位 byte
 func (s *Skiplist) Size() int {
 	return s.size
@@ -0,0 +1,74 @@
+package lsmart
+
+import (
+	"container/list"
+	"sync"
+)
+
+// 延迟加载的索引与过滤器的缓存，按照数据量限制常驻内存的元数据. 超出预算时淘汰最久未访问的节点的元数据，再次访问时重新读取
+type metaCache struct {
+	mu       sync.Mutex
+	capacity int                     // 元数据的内存预算，单位 byte
+	size     int                     // 已加载的元数据总量，单位 byte
+	lru      *list.List              // 已加载元数据的节点，越靠前越近被访问
+	elems    map[*Node]*list.Element // 节点 -> lru 中的节点
+	sizes    map[*Node]int           // 节点 -> 元数据的大小，单位 byte
+}
+
+func newMetaCache(capacity int) *metaCache {
+	return &metaCache{
+		capacity: capacity,
+		lru:      list.New(),
+		elems:    make(map[*Node]*list.Element),
+		sizes:    make(map[*Node]int),
+	}
+}
+
+// 登记节点刚刚加载的元数据，超出预算时淘汰其他节点的元数据
+func (c *metaCache) add(n *Node, size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[n]; ok {
+		c.size -= c.sizes[n]
+		c.lru.MoveToFront(elem)
+	} else {
+		c.elems[n] = c.lru.PushFront(n)
+	}
+	c.sizes[n] = size
+	c.size += size
+	c.evictLocked()
+}
+
+// 节点的元数据被访问
+func (c *metaCache) touch(n *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[n]; ok {
+		c.lru.MoveToFront(elem)
+	}
+}
+
+// 节点销毁时移出缓存
+func (c *metaCache) remove(n *Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[n]; ok {
+		c.lru.Remove(elem)
+		delete(c.elems, n)
+		c.size -= c.sizes[n]
+		delete(c.sizes, n)
+	}
+}
+
+// 从最久未访问的一端开始淘汰，直至不超过预算. 最近访问的节点即便单独超出预算也保留，避免加载后立即被淘汰
+func (c *metaCache) evictLocked() {
+	for c.size > c.capacity && c.lru.Len() > 1 {
+		elem := c.lru.Back()
+		n := elem.Value.(*Node)
+		c.lru.Remove(elem)
+		delete(c.elems, n)
+		c.size -= c.sizes[n]
+		delete(c.sizes, n)
+		n.unloadMetadata()
+	}
+}
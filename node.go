@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"os"
 	"path"
+	"sync"
+
+	"github.com/cccccxxy/lsmart/cache"
+	"github.com/cccccxxy/lsmart/filter"
 )
 
 // Node lsm tree 中的一个节点. 对应一个 sstables
@@ -13,13 +17,30 @@ type Node struct {
 	level         int               // sstable 所在 level 层级
 	seq           int32             // sstable 的 seq 序列号. 对应为文件名中的 level_seq.sst 中的 seq
 	size          uint64            // sstable 的大小，单位 byte
-	blockToFilter map[uint64][]byte // 各 block 对应的 filter bitmap
-	index         []*Index          // 各 block 对应的索引
+	blockToFilter map[uint64][]byte // 各 block 对应的 filter bitmap. 延迟加载时通过 metadata 访问
+	index         []*Index          // 常驻内存的索引. 索引按分区存放时为顶层索引，否则为各 block 对应的索引. 延迟加载时通过 metadata 访问
+	lazy          bool              // 过滤器与索引是否延迟加载，可能被淘汰
+	metaMu        sync.Mutex        // 延迟加载时保护过滤器与索引
+	partitioned   bool              // 索引是否按分区存放
 	startKey      []byte            // sstable 中最小的 key
 	endKey        []byte            // sstable 中最大的 key
 	sstReader     *SSTReader        // 读取 sst 文件的 reader 入口
+	readers       sync.WaitGroup    // 正在遍历节点的迭代器. 节点需要等待所有迭代器关闭后才能销毁
+
+	countOnce  sync.Once // 记录个数只在首次访问时统计
+	entries    uint64    // 记录总数，包含墓碑记录
+	tombstones uint64    // 墓碑记录个数
+
+	expiryOnce     sync.Once // 最早的过期时间只在首次访问时读取
+	earliestExpiry int64     // 带过期时间的记录中最早的过期时间，unix 纳秒. 没有带过期时间的记录时为 0
+
+	tableFilterOnce sync.Once // 整表过滤器只在首次检索时读取
+	tableFilter     []byte    // 整表过滤器的 bitmap，读取后常驻内存. 没有整表过滤器时为空
 }
 
+// 整表过滤器固定使用布隆过滤器，判定时只依赖 bitmap 本身
+var tableFilterProbe = &filter.BloomFilter{}
+
 func NewNode(conf *Config, file string, sstReader *SSTReader, level int, seq int32, size uint64, blockToFilter map[uint64][]byte, index []*Index) *Node {
 	return &Node{
 		conf:          conf,
@@ -30,6 +51,7 @@ func NewNode(conf *Config, file string, sstReader *SSTReader, level int, seq int
 		size:          size,
 		blockToFilter: blockToFilter,
 		index:         index,
+		partitioned:   sstReader != nil && sstReader.IndexPartitions() > 0,
 		startKey:      index[0].Key,
 		endKey:        index[len(index)-1].Key,
 	}
@@ -41,37 +63,146 @@ func (n *Node) GetAll() ([]*KV, error) {
 
 // 查看是否在节点中
 func (n *Node) Get(key []byte) ([]byte, bool, error) {
+	value, result, err := n.probe(key)
+	return value, result == probeHit, err
+}
+
+// 单个节点的检索结果
+type probeResult int
+
+const (
+	probeOutOfRange probeResult = iota // key 不在节点的索引范围内
+	probeFiltered                      // 过滤器判定 key 不存在，没有读取数据块
+	probeMiss                          // 读取了数据块，但 key 不存在
+	probeHit                           // 检索到 key
+)
+
+// 在节点中检索 key，并返回检索在哪一步结束
+func (n *Node) probe(key []byte) ([]byte, probeResult, error) {
+	// 整表过滤器判定 key 不存在时，省去索引的二分查找以及数据块过滤器的判断
+	if !n.tableMayContain(key) {
+		return nil, probeFiltered, nil
+	}
+
 	// 通过索引定位到具体的块
-	index, ok := n.binarySearchIndex(key, 0, len(n.index)-1)
+	index, ok, err := n.findBlock(key)
+	if err != nil {
+		return nil, probeMiss, err
+	}
 	if !ok {
-		return nil, false, nil
+		return nil, probeOutOfRange, nil
 	}
 
 	// 布隆过滤器辅助判断 key 是否存在
-	bitmap := n.blockToFilter[index.PrevBlockOffset]
-	if ok = n.conf.Filter.Exist(bitmap, key); !ok {
-		return nil, false, nil
+	if ok = n.mayContain(index, key); !ok {
+		return nil, probeFiltered, nil
 	}
 
 	// 读取对应的块
-	block, err := n.sstReader.ReadBlock(index.PrevBlockOffset, index.PrevBlockSize)
+	block, err := n.readBlock(index)
 	if err != nil {
-		return nil, false, err
+		return nil, probeMiss, err
 	}
 
-	// 将块数据转为对应的 kv 对
-	kvs, err := n.sstReader.ReadBlockData(block)
+	// 在块中检索首个 >= key 的 kv 对
+	kv, ok, err := n.sstReader.SeekBlock(block, key)
 	if err != nil {
-		return nil, false, err
+		return nil, probeMiss, err
+	}
+	if ok && bytes.Equal(kv.Key, key) {
+		return kv.Value, probeHit, nil
+	}
+
+	return nil, probeMiss, nil
+}
+
+// 批量检索一组升序排列的 key，返回各 key 对应的内部 value 以及是否存在. 落在同一个数据块中的相邻 key 只读取一次数据块
+func (n *Node) multiGet(keys [][]byte) ([][]byte, []bool, error) {
+	var (
+		values    = make([][]byte, len(keys))
+		found     = make([]bool, len(keys))
+		lastIndex *Index
+		lastBlock []byte
+	)
+	for i, key := range keys {
+		if !n.tableMayContain(key) {
+			continue
+		}
+
+		// 通过索引定位到具体的块，并借助布隆过滤器辅助判断 key 是否存在
+		index, ok, err := n.findBlock(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok || !n.mayContain(index, key) {
+			continue
+		}
+
+		// 与前一个 key 位于同一个数据块时，复用已读取的块
+		if index != lastIndex {
+			block, err := n.readBlock(index)
+			if err != nil {
+				return nil, nil, err
+			}
+			lastIndex, lastBlock = index, block
+		}
+
+		kv, ok, err := n.sstReader.SeekBlock(lastBlock, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok && bytes.Equal(kv.Key, key) {
+			values[i], found[i] = kv.Value, true
+		}
 	}
+	return values, found, nil
+}
 
-	for _, kv := range kvs {
-		if bytes.Equal(kv.Key, key) {
-			return kv.Value, true, nil
+// 通过过滤器判断 key 是否可能存在于索引对应的数据块中. 版本 6 之前的 sstable 中，
+// 布隆过滤器的 bit 位会覆盖 bitmap 末尾存放的 k，可能产生假阴性，因此不再使用，直到 compact 重写为新版本
+func (n *Node) mayContain(index *Index, key []byte) bool {
+	if _, ok := n.conf.Filter.(*filter.BloomFilter); ok && n.sstReader.Version() < 6 {
+		return true
+	}
+	blockToFilter, _, err := n.metadata()
+	if err != nil {
+		return true
+	}
+	return n.conf.Filter.Exist(blockToFilter[index.PrevBlockOffset], key)
+}
+
+// 通过整表过滤器判断 key 是否可能存在于 sstable 中. 没有整表过滤器或者读取失败时视为可能存在
+func (n *Node) tableMayContain(key []byte) bool {
+	n.tableFilterOnce.Do(func() {
+		if n.sstReader != nil {
+			n.tableFilter, _ = n.sstReader.ReadTableFilter()
 		}
+	})
+	return n.tableFilter == nil || tableFilterProbe.Exist(n.tableFilter, key)
+}
+
+// 读取索引对应的数据块，开启数据块缓存时优先从缓存中读取
+func (n *Node) readBlock(index *Index) ([]byte, error) {
+	// 首个索引之前没有数据块，其 offset 与首个数据块相同，不能缓存
+	blockCache := n.conf.blockCache
+	if blockCache == nil || index.PrevBlockSize == 0 {
+		return n.sstReader.ReadDataBlock(index.PrevBlockOffset, index.PrevBlockSize)
 	}
 
-	return nil, false, nil
+	key := cache.Key{File: n.file, Offset: index.PrevBlockOffset, Type: cache.BlockData}
+	if block, ok := blockCache.Get(key); ok {
+		return block, nil
+	}
+	block, err := n.sstReader.ReadDataBlock(index.PrevBlockOffset, index.PrevBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	// 缓存中的块可能在文件关闭之后仍被访问，不能引用映射的内存
+	if n.sstReader.Mapped() {
+		block = append([]byte(nil), block...)
+	}
+	blockCache.Put(key, block)
+	return block, nil
 }
 
 func (n *Node) Size() uint64 {
@@ -86,13 +217,82 @@ func (n *Node) End() []byte {
 	return n.endKey
 }
 
+// 读取 sstable 中真实的最小 key. 优先取自属性块，早期写入的属性块中没有时读取首个数据块. 读取失败时返回 Start
+func (n *Node) firstKey() []byte {
+	if props, err := n.Properties(); err == nil && len(props.SmallestKey) > 0 {
+		return props.SmallestKey
+	}
+	blocks, err := n.blockIndex()
+	if err != nil {
+		return n.startKey
+	}
+	for _, index := range blocks {
+		if index.PrevBlockSize == 0 {
+			continue
+		}
+		block, err := n.sstReader.ReadDataBlock(index.PrevBlockOffset, index.PrevBlockSize)
+		if err != nil {
+			return n.startKey
+		}
+		if kv, ok, err := n.sstReader.SeekBlock(block, nil); err == nil && ok {
+			return kv.Key
+		}
+	}
+	return n.startKey
+}
+
+// Properties 读取 sstable 的属性，包括创建时间、产生方式、写入版本、记录个数、数据大小以及 key 的范围
+func (n *Node) Properties() (*SSTProperties, error) {
+	return n.sstReader.ReadProperties()
+}
+
+// 记录总数以及其中墓碑记录的个数. 优先读取属性块中的统计，早期写入的 sstable 中没有时遍历一次数据统计.
+// 统计结果在首次访问后缓存，读取失败时返回 0
+func (n *Node) counts() (entries, tombstones uint64) {
+	n.countOnce.Do(func() {
+		if props, err := n.Properties(); err == nil && props.hasCounts {
+			n.entries, n.tombstones = props.Entries, props.Tombstones
+			return
+		}
+		kvs, err := n.GetAll()
+		if err != nil {
+			return
+		}
+		for _, kv := range kvs {
+			n.entries++
+			if op, _, _, err := DecodeInternalValue(kv.Value); err == nil && op == OpDelete {
+				n.tombstones++
+			}
+		}
+	})
+	return n.entries, n.tombstones
+}
+
+// 带过期时间的记录中最早的过期时间，unix 纳秒. 取自属性块，首次访问后缓存. 早期写入的属性块中没有，
+// 或者读取失败时返回 0，即视为不带过期时间
+func (n *Node) expireAt() int64 {
+	n.expiryOnce.Do(func() {
+		if props, err := n.Properties(); err == nil && !props.EarliestExpiry.IsZero() {
+			n.earliestExpiry = props.EarliestExpiry.UnixNano()
+		}
+	})
+	return n.earliestExpiry
+}
+
 func (n *Node) Index() (level int, seq int32) {
 	level, seq = n.level, n.seq
 	return
 }
 
 func (n *Node) Destroy() {
+	n.readers.Wait()
 	n.sstReader.Close()
+	if n.conf.blockCache != nil {
+		n.conf.blockCache.EvictFile(n.file)
+	}
+	if n.conf.metaCache != nil {
+		n.conf.metaCache.remove(n)
+	}
 	_ = os.Remove(path.Join(n.conf.Dir, n.file))
 }
 
@@ -100,17 +300,82 @@ func (n *Node) Close() {
 	n.sstReader.Close()
 }
 
-// 二分查找，key 可能从属的 block index
-func (n *Node) binarySearchIndex(key []byte, start, end int) (*Index, bool) {
+// 在索引中二分查找首个 key >= 目标 key 的索引
+func searchIndex(index []*Index, key []byte, start, end int) (*Index, bool) {
 	if start == end {
-		return n.index[start], bytes.Compare(n.index[start].Key, key) >= 0
+		return index[start], bytes.Compare(index[start].Key, key) >= 0
 	}
 
 	// 目标块，保证 key <= index[i].key && key > index[i-1].key
 	mid := start + (end-start)>>1
-	if bytes.Compare(n.index[mid].Key, key) < 0 {
-		return n.binarySearchIndex(key, mid+1, end)
+	if bytes.Compare(index[mid].Key, key) < 0 {
+		return searchIndex(index, key, mid+1, end)
+	}
+
+	return searchIndex(index, key, start, mid)
+}
+
+// 定位 key 所在数据块的索引. 索引按分区存放时，先在顶层索引中定位分区，再在分区中定位数据块
+func (n *Node) findBlock(key []byte) (*Index, bool, error) {
+	_, pinned, err := n.metadata()
+	if err != nil {
+		return nil, false, err
+	}
+	index, ok := searchIndex(pinned, key, 0, len(pinned)-1)
+	if !ok || !n.partitioned {
+		return index, ok, nil
+	}
+
+	// 顶层索引的首个索引之前没有分区，说明 key 不大于 sstable 的起始 key
+	if index.PrevBlockSize == 0 {
+		return nil, false, nil
+	}
+	entries, err := n.readPartition(index)
+	if err != nil {
+		return nil, false, err
 	}
+	// 分区中最后一个索引的 key 与顶层索引一致，必然能够找到
+	index, ok = searchIndex(entries, key, 0, len(entries)-1)
+	return index, ok, nil
+}
 
-	return n.binarySearchIndex(key, start, mid)
+// 完整的数据块索引，用于遍历数据块. 索引按分区存放时读取全部分区拼接而成，不会常驻内存
+func (n *Node) blockIndex() ([]*Index, error) {
+	_, pinned, err := n.metadata()
+	if err != nil || !n.partitioned {
+		return pinned, err
+	}
+
+	blocks := []*Index{pinned[0]}
+	for _, partition := range pinned[1:] {
+		entries, err := n.readPartition(partition)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, entries...)
+	}
+	return blocks, nil
+}
+
+// 读取一个索引分区，开启数据块缓存时优先从缓存中读取
+func (n *Node) readPartition(partition *Index) ([]*Index, error) {
+	blockCache := n.conf.blockCache
+	if blockCache == nil {
+		return n.sstReader.ReadIndexPartition(partition)
+	}
+
+	key := cache.Key{File: n.file, Offset: partition.PrevBlockOffset, Type: cache.BlockIndex}
+	block, ok := blockCache.Get(key)
+	if !ok {
+		var err error
+		if block, err = n.sstReader.readMetaBlock(partition.PrevBlockOffset, partition.PrevBlockSize); err != nil {
+			return nil, err
+		}
+		// 缓存中的块可能在文件关闭之后仍被访问，不能引用映射的内存
+		if n.sstReader.Mapped() {
+			block = append([]byte(nil), block...)
+		}
+		blockCache.Put(key, block)
+	}
+	return n.sstReader.readIndex(block)
 }
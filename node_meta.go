@@ -0,0 +1,81 @@
+package lsmart
+
+// 构造延迟加载元数据的节点. 过滤器与索引在首次访问时才从 sstable 读取，startKey、endKey 取自属性块中记录的 key 范围
+func newLazyNode(conf *Config, file string, sstReader *SSTReader, level int, seq int32, size uint64, startKey, endKey []byte) *Node {
+	return &Node{
+		conf:        conf,
+		file:        file,
+		sstReader:   sstReader,
+		level:       level,
+		seq:         seq,
+		size:        size,
+		partitioned: sstReader.IndexPartitions() > 0,
+		startKey:    startKey,
+		endKey:      endKey,
+		lazy:        true,
+	}
+}
+
+// 常驻内存的过滤器与索引. 开启延迟加载时首次访问才从 sstable 读取，超出内存预算被淘汰后再次访问时重新读取.
+// 返回的过滤器与索引不会被修改，淘汰之后调用方仍然可以继续使用
+func (n *Node) metadata() (map[uint64][]byte, []*Index, error) {
+	if !n.lazy {
+		return n.blockToFilter, n.index, nil
+	}
+
+	n.metaMu.Lock()
+	blockToFilter, index := n.blockToFilter, n.index
+	loaded := index != nil
+	if !loaded {
+		var err error
+		if blockToFilter, err = n.sstReader.ReadFilter(); err != nil {
+			n.metaMu.Unlock()
+			return nil, nil, err
+		}
+		if index, err = n.sstReader.ReadPinnedIndex(); err != nil {
+			n.metaMu.Unlock()
+			return nil, nil, err
+		}
+		n.blockToFilter, n.index = blockToFilter, index
+	}
+	n.metaMu.Unlock()
+
+	// 淘汰其他节点时需要获取其元数据锁，因此在释放本节点的锁之后再登记
+	if metaCache := n.conf.metaCache; metaCache != nil {
+		if loaded {
+			metaCache.touch(n)
+		} else {
+			indexSize, filterSize := metadataSize(blockToFilter, index)
+			metaCache.add(n, int(indexSize+filterSize))
+		}
+	}
+	return blockToFilter, index, nil
+}
+
+// 淘汰节点的元数据，再次访问时重新读取
+func (n *Node) unloadMetadata() {
+	n.metaMu.Lock()
+	n.blockToFilter, n.index = nil, nil
+	n.metaMu.Unlock()
+}
+
+// 节点当前常驻内存的索引与过滤器数据量，单位 byte. 延迟加载尚未读取或者已被淘汰时为 0
+func (n *Node) pinnedSize() (indexSize, filterSize uint64) {
+	if !n.lazy {
+		return metadataSize(n.blockToFilter, n.index)
+	}
+	n.metaMu.Lock()
+	defer n.metaMu.Unlock()
+	return metadataSize(n.blockToFilter, n.index)
+}
+
+// 索引与过滤器的数据量，单位 byte. 索引按照 key 以及块 offset、size 计算
+func metadataSize(blockToFilter map[uint64][]byte, index []*Index) (indexSize, filterSize uint64) {
+	for _, idx := range index {
+		indexSize += uint64(len(idx.Key)) + 16
+	}
+	for _, bitmap := range blockToFilter {
+		filterSize += uint64(len(bitmap))
+	}
+	return
+}
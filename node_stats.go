@@ -0,0 +1,69 @@
+package lsmart
+
+// NodeStats 单个 sstable 的统计信息，供监控使用
+type NodeStats struct {
+	Level           int    // 所在 level 层
+	File            string // sstable 文件名，不含目录路径
+	Size            uint64 // 文件大小，单位 byte
+	Blocks          int    // 非空数据块个数
+	Entries         uint64 // 记录总数，包含墓碑记录
+	Tombstones      uint64 // 墓碑记录个数
+	FilterSize      uint64 // 各数据块过滤器所在块的大小，单位 byte
+	TableFilterSize uint64 // 整表过滤器所在块的大小，单位 byte. 没有整表过滤器时为 0
+	SmallestKey     []byte // sstable 中最小的 key
+	LargestKey      []byte // sstable 中最大的 key
+	EncryptionKeyID uint32 // 加密使用的密钥 id，没有加密时为 0. 轮换密钥后可以据此观察老密钥的 sstable 是否已被改写
+}
+
+// File sstable 对应的文件名，不含目录路径
+func (n *Node) File() string {
+	return n.file
+}
+
+// Stats 统计 sstable 的数据块个数、记录个数、过滤器大小以及 key 的范围.
+// 数据块个数需要读取完整的索引，记录个数与 key 范围优先取自属性块，早期写入的 sstable 中没有时读取数据统计
+func (n *Node) Stats() (*NodeStats, error) {
+	index, err := n.blockIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := NodeStats{
+		Level:           n.level,
+		File:            n.file,
+		Size:            n.size,
+		FilterSize:      n.sstReader.filterSize,
+		TableFilterSize: n.sstReader.tableFilterSize,
+		SmallestKey:     n.firstKey(),
+		LargestKey:      n.endKey,
+		EncryptionKeyID: n.sstReader.EncryptionKeyID(),
+	}
+	for _, idx := range index {
+		if idx.PrevBlockSize > 0 {
+			stats.Blocks++
+		}
+	}
+	stats.Entries, stats.Tombstones = n.counts()
+	if props, err := n.Properties(); err == nil && len(props.LargestKey) > 0 {
+		stats.LargestKey = props.LargestKey
+	}
+	return &stats, nil
+}
+
+// NodeStats 按照 level 层由浅到深的顺序，统计全部 sstable 的信息. 需要读取每个 sstable 的完整索引以及属性块
+func (t *Tree) NodeStats() ([]*NodeStats, error) {
+	var all []*NodeStats
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			stats, err := node.Stats()
+			if err != nil {
+				t.levelLocks[level].RUnlock()
+				return nil, err
+			}
+			all = append(all, stats)
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return all, nil
+}
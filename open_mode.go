@@ -0,0 +1,94 @@
+package lsmart
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	// ErrTreeNotExist 以 MustExist 模式打开时，目录下不存在 lsm tree 数据
+	ErrTreeNotExist = errors.New("lsm tree does not exist")
+	// ErrTreeExists 以 ErrorIfExists 模式打开时，目录下已经存在 lsm tree 数据
+	ErrTreeExists = errors.New("lsm tree already exists")
+)
+
+// OpenMode 打开 lsm tree 时对目录现状的要求
+type OpenMode int
+
+const (
+	// CreateIfMissing 目录缺失时进行创建，已有数据时沿用. 默认模式
+	CreateIfMissing OpenMode = iota
+	// MustExist 目录下必须已经存在 lsm tree 数据，否则报错，且不会创建任何目录
+	MustExist
+	// ErrorIfExists 目录下已经存在 lsm tree 数据时报错，用于确保从零开始构建
+	ErrorIfExists
+)
+
+func (m OpenMode) String() string {
+	switch m {
+	case CreateIfMissing:
+		return "create_if_missing"
+	case MustExist:
+		return "must_exist"
+	case ErrorIfExists:
+		return "error_if_exists"
+	default:
+		return fmt.Sprintf("OpenMode(%d)", int(m))
+	}
+}
+
+// 按照打开模式校验目录现状
+func (c *Config) checkOpenMode() error {
+	switch c.OpenMode {
+	case CreateIfMissing:
+		return nil
+	case MustExist, ErrorIfExists:
+	default:
+		return fmt.Errorf("invalid open mode %s", c.OpenMode)
+	}
+
+	exists, err := treeExists(c.Dir)
+	if err != nil {
+		return err
+	}
+	if c.OpenMode == MustExist && !exists {
+		return fmt.Errorf("%w: %s", ErrTreeNotExist, c.Dir)
+	}
+	if c.OpenMode == ErrorIfExists && exists {
+		return fmt.Errorf("%w: %s", ErrTreeExists, c.Dir)
+	}
+	return nil
+}
+
+// 目录下是否存在 lsm tree 数据，即 sstable 文件或者预写日志. 仅包含空目录时视为不存在
+func treeExists(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && (strings.HasSuffix(entry.Name(), ".sst") || entry.Name() == manifestFileName) {
+			return true, nil
+		}
+	}
+
+	walEntries, err := os.ReadDir(path.Join(dir, "walfile"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range walEntries {
+		if !entry.IsDir() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
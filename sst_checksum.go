@@ -0,0 +1,72 @@
+package lsmart
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// 块尾部校验和的大小，单位 byte
+const blockChecksumSize = 4
+
+// 块校验和使用 CRC32C，现代 cpu 上有硬件指令加速
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruption 读取到的数据未通过校验. 可以通过 errors.Is 判断读取是否因数据损坏而失败
+var ErrCorruption = errors.New("data corruption")
+
+// CorruptionError sstable 中的块未通过校验和校验，包含出问题的文件以及块的位置
+type CorruptionError struct {
+	File   string // sstable 文件名
+	Offset uint64 // 块起始位置在 sstable 中的 offset
+	Size   uint64 // 块的大小，包含尾部的校验和，单位 byte
+	Want   uint32 // 块尾部记录的校验和
+	Got    uint32 // 根据块内容计算出的校验和
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%v: %s block at %d size %d: checksum mismatch: want %08x, got %08x",
+		ErrCorruption, e.File, e.Offset, e.Size, e.Want, e.Got)
+}
+
+// Is 使得 errors.Is(err, ErrCorruption) 成立
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+// 计算块内容的校验和
+func blockChecksum(block []byte) uint32 {
+	return crc32.Checksum(block, castagnoliTable)
+}
+
+// 在块尾部追加校验和
+func appendChecksum(block []byte) []byte {
+	return binary.LittleEndian.AppendUint32(block, blockChecksum(block))
+}
+
+// 校验块尾部的校验和，返回剥离校验和之后的块内容. 返回的 *CorruptionError 中不包含文件名与 offset
+func verifyChecksum(block []byte) ([]byte, error) {
+	corruption := &CorruptionError{Size: uint64(len(block))}
+	if len(block) < blockChecksumSize {
+		return nil, corruption
+	}
+
+	content := block[:len(block)-blockChecksumSize]
+	corruption.Want = binary.LittleEndian.Uint32(block[len(content):])
+	corruption.Got = blockChecksum(content)
+	if corruption.Want != corruption.Got {
+		return nil, corruption
+	}
+	return content, nil
+}
+
+// 按照 sstable 的格式校验并剥离原始块的附加信息，offset 为块在 sstable 中的位置. 校验失败时在错误中补齐文件名与 offset
+func (s *SSTReader) parseBlock(raw []byte, offset uint64) ([]byte, error) {
+	block, err := s.format.ParseBlock(raw)
+	var corruption *CorruptionError
+	if errors.As(err, &corruption) {
+		corruption.File, corruption.Offset = s.path, offset
+	}
+	return block, err
+}
@@ -0,0 +1,112 @@
+package lsmart
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// 直接 IO 要求读写的内存地址、文件偏移量以及长度均按照该边界对齐，取常见的页大小
+	directIOAlignment = 4096
+	// 直接 IO 写入时缓冲区的大小，写满后整块写入文件
+	directWriteBufferSize = 1 << 20
+)
+
+// 打开 sstable 文件. direct 为 true 时尝试以 O_DIRECT 方式打开，平台或者文件系统（例如 tmpfs）不支持时退回普通 IO.
+// 返回的 bool 标识直接 IO 是否生效
+func openSSTFile(name string, flag int, direct bool) (*os.File, bool, error) {
+	if direct && directIOFlag != 0 {
+		f, err := os.OpenFile(name, flag|directIOFlag, 0644)
+		if err == nil {
+			return f, true, nil
+		}
+		if !errors.Is(err, syscall.EINVAL) {
+			return nil, false, err
+		}
+	}
+	f, err := os.OpenFile(name, flag, 0644)
+	return f, false, err
+}
+
+// 分配起始地址按照 directIOAlignment 对齐的缓冲区
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	var shift int
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1)); rem != 0 {
+		shift = directIOAlignment - rem
+	}
+	return buf[shift : shift+size : shift+size]
+}
+
+// 按照对齐边界向上取整
+func alignUp(n uint64) uint64 {
+	return (n + directIOAlignment - 1) &^ (directIOAlignment - 1)
+}
+
+// 以直接 IO 读取 offset 处 size 大小的内容. 实际读取的范围向两端扩展到对齐边界，再从中截取所需的部分
+func readDirectAt(src *os.File, offset, size uint64) ([]byte, error) {
+	start := offset &^ (directIOAlignment - 1)
+	buf := alignedBuffer(int(alignUp(offset+size) - start))
+	n, err := src.ReadAt(buf, int64(start))
+	if from := offset - start; uint64(n) >= from+size {
+		return buf[from : from+size : from+size], nil
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// 直接 IO 的写入器. 写入内容攒在对齐的缓冲区中，写满后整块写入文件. Flush 时将尾部补齐到对齐边界后写入，
+// 再将文件截断为有效数据的大小
+type directWriter struct {
+	dest    *os.File
+	buf     []byte // 对齐的缓冲区
+	n       int    // 缓冲区中尚未写入文件的字节数
+	written int64  // 已经写入文件的有效字节数
+}
+
+func newDirectWriter(dest *os.File) *directWriter {
+	return &directWriter{
+		dest: dest,
+		buf:  alignedBuffer(directWriteBufferSize),
+	}
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		copied := copy(w.buf[w.n:], p)
+		w.n += copied
+		p = p[copied:]
+		if w.n < len(w.buf) {
+			continue
+		}
+		if _, err := w.dest.Write(w.buf); err != nil {
+			return total - len(p) - w.n, err
+		}
+		w.written += int64(w.n)
+		w.n = 0
+	}
+	return total, nil
+}
+
+// Flush 写入缓冲区中剩余的内容，补齐的部分随后被截断
+func (w *directWriter) Flush() error {
+	if w.n == 0 {
+		return nil
+	}
+	padded := int(alignUp(uint64(w.n)))
+	for i := w.n; i < padded; i++ {
+		w.buf[i] = 0
+	}
+	if _, err := w.dest.Write(w.buf[:padded]); err != nil {
+		return err
+	}
+	w.written += int64(w.n)
+	w.n = 0
+	return w.dest.Truncate(w.written)
+}
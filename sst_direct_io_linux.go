@@ -0,0 +1,8 @@
+//go:build linux
+
+package lsmart
+
+import "syscall"
+
+// 以 O_DIRECT 方式打开文件，读写绕过操作系统的页缓存
+const directIOFlag = syscall.O_DIRECT
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package lsmart
+
+// 当前平台不支持 O_DIRECT，sstable 退回普通 IO
+const directIOFlag = 0
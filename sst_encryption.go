@@ -0,0 +1,93 @@
+package lsmart
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrEncryptionKeyMissing 读取加密的 sstable 时，没有配置写入时使用的密钥
+var ErrEncryptionKeyMissing = errors.New("encryption key is missing")
+
+// sstable 块的加解密器. 使用 AES-CTR 加密，密文与明文等长，因此块的 offset 与 size 不受影响.
+// 每个文件随机生成 128 位的 iv，块的计数器初始值为 (iv 高 64 位 ^ 块的 offset) || iv 低 64 位，
+// 同一个文件中的不同块、以及不同文件之间的 keystream 互不重叠
+type blockCipher struct {
+	keyID  uint32       // 密钥 id，记录在 footer 中
+	block  cipher.Block // 密钥对应的 AES 实例
+	ivHigh uint64       // 文件随机 iv 的高 64 位
+	ivLow  uint64       // 文件随机 iv 的低 64 位
+}
+
+// 为新写入的 sstable 构造加密器，使用当前的密钥并随机生成 iv. 没有配置加密密钥时返回 nil
+func newWriterCipher(conf *Config) (*blockCipher, error) {
+	if conf.EncryptionKeyID == 0 {
+		return nil, nil
+	}
+	block, ok := conf.ciphers[conf.EncryptionKeyID]
+	if !ok {
+		return nil, ErrEncryptionKeyMissing
+	}
+	var iv [aes.BlockSize]byte
+	if _, err := rand.Read(iv[:]); err != nil {
+		return nil, err
+	}
+	return &blockCipher{
+		keyID:  conf.EncryptionKeyID,
+		block:  block,
+		ivHigh: binary.BigEndian.Uint64(iv[:8]),
+		ivLow:  binary.BigEndian.Uint64(iv[8:]),
+	}, nil
+}
+
+// 按照 footer 中记录的密钥 id 与 iv 构造读取时使用的解密器. 没有加密的 sstable 返回 nil
+func newReaderCipher(conf *Config, f *Footer) (*blockCipher, error) {
+	if f.EncryptionKeyID == 0 {
+		return nil, nil
+	}
+	block, ok := conf.ciphers[uint32(f.EncryptionKeyID)]
+	if !ok {
+		return nil, ErrEncryptionKeyMissing
+	}
+	return &blockCipher{
+		keyID:  uint32(f.EncryptionKeyID),
+		block:  block,
+		ivHigh: f.IVHigh,
+		ivLow:  f.IVLow,
+	}, nil
+}
+
+// 对 offset 处的块内容进行加密或者解密，结果写入 dst. dst 与 src 可以是同一个切片
+func (c *blockCipher) xor(dst, src []byte, offset uint64) {
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(iv[:8], c.ivHigh^offset)
+	binary.BigEndian.PutUint64(iv[8:], c.ivLow)
+	cipher.NewCTR(c.block, iv[:]).XORKeyStream(dst, src)
+}
+
+// 解密 offset 处的块内容. 块可能引用 mmap 映射的只读内存，因此解密到新的缓冲区中
+func (s *SSTReader) decrypt(block []byte, offset uint64) []byte {
+	if s.cipher == nil || len(block) == 0 {
+		return block
+	}
+	plain := make([]byte, len(block))
+	s.cipher.xor(plain, block, offset)
+	return plain
+}
+
+// EncryptionKeyID 加密 sstable 使用的密钥 id. 没有加密以及老版本的 sstable 返回 0
+func (s *SSTReader) EncryptionKeyID() uint32 {
+	if s.cipher == nil {
+		return 0
+	}
+	return s.cipher.keyID
+}
+
+// 开启加密时原地加密 offset 处的块内容. 校验和在加密之后针对密文计算，不需要密钥即可校验
+func (s *SSTWriter) encrypt(block []byte, offset uint64) {
+	if s.cipher != nil {
+		s.cipher.xor(block, block, offset)
+	}
+}
@@ -0,0 +1,155 @@
+package lsmart
+
+import (
+	"bytes"
+	"sort"
+)
+
+// SSTIterator 单个 sstable 文件的迭代器. 借助索引逐个读取数据块，同一时刻只有一个数据块的数据驻留在内存中，
+// 使得较大的 sstable 能够以有限的内存完成归并以及排查. Value 返回的是内部记录的 value
+type SSTIterator struct {
+	reader   *SSTReader
+	blocks   []*Index // 所有非空数据块对应的索引
+	blockPos int      // 当前数据块在 blocks 中的位置
+	kvs      []*KV    // 当前数据块中的 kv 对
+	pos      int      // 当前 kv 对在 kvs 中的位置
+	err      error
+
+	ahead       []byte // 预读的原始数据，包含当前数据块以及其后相邻的若干个数据块
+	aheadOffset uint64 // 预读数据在 sstable 中的起始位置
+}
+
+// NewIterator 构造 sstable 的迭代器，并定位到首条记录. 索引按分区存放时读取全部分区，读取失败时迭代器直接失效
+func (s *SSTReader) NewIterator() *SSTIterator {
+	// 老版本的数据块之间紧密相连且没有重启点，整个数据区域作为一个数据块读取
+	if s.version < 2 {
+		it := newSSTIterator(s, []*Index{{PrevBlockOffset: 0, PrevBlockSize: s.filterOffset}})
+		it.Seek(nil)
+		return it
+	}
+
+	index, err := s.ReadIndex()
+	if err != nil {
+		return &SSTIterator{reader: s, err: err}
+	}
+	it := newSSTIterator(s, index)
+	it.Seek(nil)
+	return it
+}
+
+// 基于完整的数据块索引构造迭代器，尚未定位
+func newSSTIterator(reader *SSTReader, index []*Index) *SSTIterator {
+	it := SSTIterator{reader: reader, blocks: make([]*Index, 0, len(index))}
+	for _, idx := range index {
+		if idx.PrevBlockSize > 0 {
+			it.blocks = append(it.blocks, idx)
+		}
+	}
+	return &it
+}
+
+// Seek 定位到首个 key >= 目标 key 的记录，跳过之前的数据块
+func (it *SSTIterator) Seek(key []byte) {
+	if it.err != nil && it.blocks == nil {
+		return
+	}
+	it.err = nil
+
+	// 索引 key >= 对应数据块中的最大 key，因此首个索引 key >= 目标 key 的数据块即为检索起点.
+	// 老版本的整个数据区域只有一个数据块，直接从头开始
+	blockPos := 0
+	if it.reader.version >= 2 {
+		blockPos = sort.Search(len(it.blocks), func(i int) bool {
+			return bytes.Compare(it.blocks[i].Key, key) >= 0
+		})
+	}
+	it.loadBlock(blockPos)
+	if !it.Valid() || it.blockPos != blockPos {
+		return
+	}
+
+	it.pos = sort.Search(len(it.kvs), func(i int) bool {
+		return bytes.Compare(it.kvs[i].Key, key) >= 0
+	})
+	if it.pos >= len(it.kvs) {
+		it.loadBlock(it.blockPos + 1)
+	}
+}
+
+// Valid 当前是否指向一条有效记录
+func (it *SSTIterator) Valid() bool {
+	return it.err == nil && it.blockPos < len(it.blocks) && it.pos < len(it.kvs)
+}
+
+// Next 移动到下一条记录
+func (it *SSTIterator) Next() {
+	it.pos++
+	if it.pos >= len(it.kvs) {
+		it.loadBlock(it.blockPos + 1)
+	}
+}
+
+// Key 当前记录的 key
+func (it *SSTIterator) Key() []byte {
+	return it.kvs[it.pos].Key
+}
+
+// Value 当前记录的内部 value
+func (it *SSTIterator) Value() []byte {
+	return it.kvs[it.pos].Value
+}
+
+// Err 迭代过程中遇到的错误
+func (it *SSTIterator) Err() error {
+	return it.err
+}
+
+// Close 释放迭代器持有的数据块. 不会关闭 reader
+func (it *SSTIterator) Close() {
+	it.blocks, it.kvs, it.ahead = nil, nil, nil
+}
+
+// 读取索引对应的数据块. 数据块不在预读范围内时，从数据块起始位置开始一次读取 ReadaheadSize 大小的内容，
+// 后续相邻的数据块直接从预读的数据中截取，不再发起 pread. 预读范围不超过数据区域的末尾
+func (it *SSTIterator) readBlock(index *Index) ([]byte, error) {
+	offset, size := index.PrevBlockOffset, index.PrevBlockSize
+	readahead := uint64(it.reader.conf.ReadaheadSize)
+	if it.reader.mapped != nil || readahead <= size {
+		return it.reader.ReadDataBlock(offset, size)
+	}
+
+	if offset < it.aheadOffset || offset+size > it.aheadOffset+uint64(len(it.ahead)) {
+		n := readahead
+		if end := it.reader.filterOffset; end > offset && offset+n > end {
+			n = end - offset
+		}
+		if n < size {
+			n = size
+		}
+		raw, err := it.reader.readAt(offset, n)
+		if err != nil {
+			return nil, err
+		}
+		it.ahead, it.aheadOffset = raw, offset
+	}
+	from := offset - it.aheadOffset
+	return it.reader.parseDataBlock(it.ahead[from:from+size:from+size], offset)
+}
+
+// 从第 blockPos 个数据块开始，加载首个包含数据的数据块
+func (it *SSTIterator) loadBlock(blockPos int) {
+	it.kvs, it.pos = nil, 0
+	for it.blockPos = blockPos; it.blockPos < len(it.blocks); it.blockPos++ {
+		block, err := it.readBlock(it.blocks[it.blockPos])
+		if err != nil {
+			it.err = err
+			return
+		}
+		if it.kvs, it.err = it.reader.ReadBlockData(block); it.err != nil {
+			return
+		}
+		if len(it.kvs) > 0 {
+			return
+		}
+	}
+}
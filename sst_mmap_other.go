@@ -0,0 +1,17 @@
+//go:build !unix
+
+package lsmart
+
+import (
+	"errors"
+	"os"
+)
+
+// 当前平台不支持内存映射，sstReader 退回 pread 读取
+func mmapFile(f *os.File) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
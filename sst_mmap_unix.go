@@ -0,0 +1,26 @@
+//go:build unix
+
+package lsmart
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// 以只读方式将整个 sstable 文件映射到内存
+func mmapFile(f *os.File) ([]byte, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		return nil, errors.New("cannot mmap an empty file")
+	}
+	return syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// 解除内存映射
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
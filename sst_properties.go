@@ -0,0 +1,177 @@
+package lsmart
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// sstable 的产生方式
+const (
+	SSTOriginFlush      = "flush"      // 由只读 memtable 溢写产生
+	SSTOriginCompaction = "compaction" // 由 level 层 compact 产生
+	SSTOriginBackup     = "backup"     // 由热备份时的 memtable 快照产生
+)
+
+// 属性块中各属性的 key，按照字典序写入
+const (
+	sstPropCompressedSize = "lsmart.compressed_size"
+	sstPropCompression    = "lsmart.compression"
+	sstPropCreatedAt      = "lsmart.created_at"
+	sstPropEarliestExpiry = "lsmart.earliest_expiry"
+	sstPropEngineVersion  = "lsmart.engine_version"
+	sstPropEntries        = "lsmart.entries"
+	sstPropInputs         = "lsmart.inputs"
+	sstPropLargestKey     = "lsmart.largest_key"
+	sstPropOrigin         = "lsmart.origin"
+	sstPropRawSize        = "lsmart.raw_size"
+	sstPropSmallestKey    = "lsmart.smallest_key"
+	sstPropTombstones     = "lsmart.tombstones"
+)
+
+// 本模块的 module path，用于从构建信息中获取版本号
+const modulePath = "github.com/cccccxxy/lsmart"
+
+// SSTProperties sstable 的属性，记录文件的来历，便于排查问题时还原任意一个文件是如何产生的. 自版本 5 起记录
+type SSTProperties struct {
+	CreatedAt     time.Time // 文件的创建时间
+	Origin        string    // 文件的产生方式，SSTOriginFlush 或者 SSTOriginCompaction
+	Inputs        []string  // 产生该文件的数据源. 溢写时为 wal 文件名，compact 时为参与归并的 sstable 文件名
+	EngineVersion string    // 写入该文件的 lsmart 版本
+	Entries       uint64    // 记录总数，包含墓碑记录
+	Tombstones    uint64    // 墓碑记录个数
+	Compression   string    // 数据块的压缩算法. 早期写入的属性块中没有，为空
+
+	// 以下属性早期写入的属性块中没有，为零值
+	RawSize        uint64 // 数据块压缩前的总大小，单位 byte
+	CompressedSize uint64 // 数据块落盘的总大小，包含压缩类型与校验和，不含对齐填充，单位 byte
+	SmallestKey    []byte // sstable 中最小的 key
+	LargestKey     []byte // sstable 中最大的 key
+
+	EarliestExpiry time.Time // 带过期时间的记录中最早的过期时间. 没有带过期时间的记录时为零值，早期写入的属性块中同样没有
+
+	hasCounts bool // 属性块中是否记录了记录个数. 早期写入的属性块中没有
+}
+
+// 将属性编码为属性块
+func (p *SSTProperties) encode(conf *Config) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	block := NewBlock(conf)
+	n := binary.PutUvarint(scratch[:], p.CompressedSize)
+	block.Append([]byte(sstPropCompressedSize), scratch[:n])
+	block.Append([]byte(sstPropCompression), []byte(p.Compression))
+	n = binary.PutVarint(scratch[:], p.CreatedAt.UnixNano())
+	block.Append([]byte(sstPropCreatedAt), scratch[:n])
+	var earliestExpiry int64
+	if !p.EarliestExpiry.IsZero() {
+		earliestExpiry = p.EarliestExpiry.UnixNano()
+	}
+	n = binary.PutVarint(scratch[:], earliestExpiry)
+	block.Append([]byte(sstPropEarliestExpiry), scratch[:n])
+	block.Append([]byte(sstPropEngineVersion), []byte(p.EngineVersion))
+	n = binary.PutUvarint(scratch[:], p.Entries)
+	block.Append([]byte(sstPropEntries), scratch[:n])
+	block.Append([]byte(sstPropInputs), []byte(strings.Join(p.Inputs, ",")))
+	block.Append([]byte(sstPropLargestKey), p.LargestKey)
+	block.Append([]byte(sstPropOrigin), []byte(p.Origin))
+	n = binary.PutUvarint(scratch[:], p.RawSize)
+	block.Append([]byte(sstPropRawSize), scratch[:n])
+	block.Append([]byte(sstPropSmallestKey), p.SmallestKey)
+	n = binary.PutUvarint(scratch[:], p.Tombstones)
+	block.Append([]byte(sstPropTombstones), scratch[:n])
+	return block.ToBytes()
+}
+
+// 从属性块中解析出属性. 不认识的属性直接忽略，便于后续版本追加新的属性
+func (s *SSTReader) readProperties(block []byte) (*SSTProperties, error) {
+	var (
+		props   SSTProperties
+		prevKey []byte
+	)
+	buf := bytes.NewBuffer(block)
+	for {
+		key, value, err := s.ReadRecord(prevKey, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch string(key) {
+		case sstPropCompressedSize:
+			size, n := binary.Uvarint(value)
+			if n <= 0 {
+				return nil, errors.New("invalid sstable property " + sstPropCompressedSize)
+			}
+			props.CompressedSize = size
+		case sstPropCompression:
+			props.Compression = string(value)
+		case sstPropCreatedAt:
+			nanos, n := binary.Varint(value)
+			if n <= 0 {
+				return nil, errors.New("invalid sstable property " + sstPropCreatedAt)
+			}
+			props.CreatedAt = time.Unix(0, nanos)
+		case sstPropEarliestExpiry:
+			nanos, n := binary.Varint(value)
+			if n <= 0 {
+				return nil, errors.New("invalid sstable property " + sstPropEarliestExpiry)
+			}
+			props.EarliestExpiry = expireTime(nanos)
+		case sstPropEngineVersion:
+			props.EngineVersion = string(value)
+		case sstPropEntries:
+			entries, n := binary.Uvarint(value)
+			if n <= 0 {
+				return nil, errors.New("invalid sstable property " + sstPropEntries)
+			}
+			props.Entries, props.hasCounts = entries, true
+		case sstPropInputs:
+			if len(value) > 0 {
+				props.Inputs = strings.Split(string(value), ",")
+			}
+		case sstPropLargestKey:
+			props.LargestKey = append([]byte(nil), value...)
+		case sstPropOrigin:
+			props.Origin = string(value)
+		case sstPropRawSize:
+			size, n := binary.Uvarint(value)
+			if n <= 0 {
+				return nil, errors.New("invalid sstable property " + sstPropRawSize)
+			}
+			props.RawSize = size
+		case sstPropSmallestKey:
+			props.SmallestKey = append([]byte(nil), value...)
+		case sstPropTombstones:
+			tombstones, n := binary.Uvarint(value)
+			if n <= 0 {
+				return nil, errors.New("invalid sstable property " + sstPropTombstones)
+			}
+			props.Tombstones = tombstones
+		}
+		prevKey = key
+	}
+	return &props, nil
+}
+
+// 当前运行的 lsmart 版本. 取自构建信息中本模块的版本号，本地开发构建时为 (devel)
+func engineVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "(devel)"
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "(devel)"
+}
@@ -1,15 +1,29 @@
 package lsmart
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
+
+	"github.com/cccccxxy/lsmart/compress"
+	"github.com/cccccxxy/lsmart/format"
 )
 
+func init() {
+	// 新版本必须能够读取全部老版本的 sstable 文件
+	format.MustSupportAll(format.KindSST, sstReadable)
+}
+
+// 当前代码能够读取的 sstable 格式版本，即注册了对应格式的版本
+func sstReadable(v format.Version) bool {
+	_, ok := LookupTableFormat(v)
+	return ok
+}
+
 // KV kv 对
 type KV struct {
 	Key   []byte
@@ -18,27 +32,63 @@ type KV struct {
 
 // SSTReader 对应于 lsm tree 中的一个 sstable. 这是读取流程的视角
 type SSTReader struct {
-	conf         *Config       // 配置文件
-	src          *os.File      // 对应的文件
-	reader       *bufio.Reader // 读取文件的 reader
-	filterOffset uint64        // 过滤器块起始位置在 sstable 的 offset
-	filterSize   uint64        // 过滤器块的大小，单位 byte
-	indexOffset  uint64        // 索引块起始位置在 sstable 的 offset
-	indexSize    uint64        // 索引块的大小，单位 byte
+	conf              *Config        // 配置文件
+	path              string         // 对应的文件，包含目录在内的路径
+	src               *os.File       // 对应的文件句柄. 开启文件句柄缓存时可能已被关闭，读取时重新打开；通过 mmap 读取时为空
+	version           format.Version // sstable 的格式版本
+	format            TableFormat    // 版本对应的 sstable 格式，负责解析 footer 以及块尾部的附加信息
+	filterOffset      uint64         // 过滤器块起始位置在 sstable 的 offset
+	filterSize        uint64         // 过滤器块的大小，单位 byte
+	indexOffset       uint64         // 索引块起始位置在 sstable 的 offset
+	indexSize         uint64         // 索引块的大小，单位 byte
+	maxSeq            uint64         // sstable 中记录的最大 seq
+	alignment         uint64         // 数据块的对齐边界，单位 byte，0 表示不对齐
+	propsOffset       uint64         // 属性块起始位置在 sstable 的 offset
+	propsSize         uint64         // 属性块的大小，单位 byte
+	partitions        uint64         // 分区索引的分区个数，0 表示单层索引
+	tableFilterOffset uint64         // 整表过滤器块起始位置在 sstable 的 offset
+	tableFilterSize   uint64         // 整表过滤器块的大小，单位 byte，0 表示没有整表过滤器
+	mapped            []byte         // 开启 mmap 读取时整个文件的只读映射，读取块时直接切片，不发起系统调用也不拷贝
+	direct            bool           // 是否以直接 IO 读取，读取范围需要按照 directIOAlignment 对齐
+	cipher            *blockCipher   // 各个块的解密器. 没有加密的 sstable 为空
 }
 
 // NewSSTReader sstReader 构造器
 func NewSSTReader(file string, conf *Config) (*SSTReader, error) {
-	src, err := os.OpenFile(path.Join(conf.Dir, file), os.O_RDONLY, 0644)
+	return openSSTReader(path.Join(conf.Dir, file), conf)
+}
+
+// 基于完整的文件路径构造 sstReader，文件可以位于 lsm tree 目录之外
+func openSSTReader(filePath string, conf *Config) (*SSTReader, error) {
+	// 开启 mmap 读取时由映射的内存提供数据，不使用直接 IO
+	src, direct, err := openSSTFile(filePath, os.O_RDONLY, conf.DirectIO && !conf.MmapReads)
 	if err != nil {
 		return nil, err
 	}
 
-	return &SSTReader{
+	s := SSTReader{
 		conf:   conf,
+		path:   filePath,
 		src:    src,
-		reader: bufio.NewReader(src),
-	}, nil
+		direct: direct,
+	}
+	// 开启 mmap 读取时映射整个文件. 映射建立之后不再需要文件句柄. 映射失败，例如平台不支持时，退回 pread 读取
+	if conf.MmapReads {
+		if s.mapped, _ = mmapFile(src); s.mapped != nil {
+			_ = src.Close()
+			s.src = nil
+		}
+	}
+	// 开启文件句柄缓存时，由缓存管理文件句柄的关闭与重新打开
+	if s.src != nil && conf.tableCache != nil {
+		conf.tableCache.add(&s)
+	}
+	// 读取 footer，获取 sstable 的格式版本以及各个块的位置
+	if err = s.ReadFooter(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &s, nil
 }
 
 // Size sstable 数据大小，单位 byte
@@ -48,41 +98,142 @@ func (s *SSTReader) Size() (uint64, error) {
 			return 0, err
 		}
 	}
+	if s.propsSize > 0 {
+		return s.propsOffset + s.propsSize, nil
+	}
 	return s.indexOffset + s.indexSize, nil
 }
 
+// Version sstable 的格式版本
+func (s *SSTReader) Version() format.Version {
+	return s.version
+}
+
+// MaxSeq sstable 中记录的最大 seq. 老版本的 sstable 没有记录 seq，返回 0
+func (s *SSTReader) MaxSeq() uint64 {
+	return s.maxSeq
+}
+
+// Alignment 数据块的对齐边界，单位 byte. 未对齐或者老版本的 sstable 返回 0
+func (s *SSTReader) Alignment() uint64 {
+	return s.alignment
+}
+
+// Mapped 是否通过 mmap 读取. 此时读取到的块直接引用映射的内存，关闭之后不能再访问
+func (s *SSTReader) Mapped() bool {
+	return s.mapped != nil
+}
+
 func (s *SSTReader) Close() {
-	s.reader.Reset(s.src)
+	if s.mapped != nil {
+		_ = munmap(s.mapped)
+		s.mapped = nil
+		return
+	}
+	if s.conf.tableCache != nil {
+		s.conf.tableCache.remove(s)
+		return
+	}
 	_ = s.src.Close()
 }
 
+// 获取文件句柄，使用完毕后调用返回的 release. 开启文件句柄缓存时文件可能需要重新打开
+func (s *SSTReader) acquire() (*os.File, func(), error) {
+	tables := s.conf.tableCache
+	if tables == nil {
+		return s.src, func() {}, nil
+	}
+	src, err := tables.acquire(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, func() { tables.release(s) }, nil
+}
+
+// sstable 文件的大小，单位 byte
+func (s *SSTReader) fileSize() (int64, error) {
+	if s.mapped != nil {
+		return int64(len(s.mapped)), nil
+	}
+	src, release, err := s.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	stat, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
 // ReadFooter 读取 sstable footer 信息，赋给 sstreader 的成员属性
 func (s *SSTReader) ReadFooter() error {
-	// 从尾部开始倒退 sst footer size 大小的偏移量
-	if _, err := s.src.Seek(-int64(s.conf.SSTFooterSize), io.SeekEnd); err != nil {
+	// 从尾部开始倒退至多当前版本 footer 大小的偏移量，识别出格式版本. 老版本的 footer 更短，没有 magic number 时按照版本 1 解析
+	fileSize, err := s.fileSize()
+	if err != nil {
 		return err
 	}
-
-	s.reader.Reset(s.src)
-
-	var err error
-	if s.filterOffset, err = binary.ReadUvarint(s.reader); err != nil {
+	tail, err := s.readTail(fileSize, sstFooterSize)
+	if err != nil {
 		return err
 	}
+	version := footerVersion(tail)
+	tf, ok := LookupTableFormat(version)
+	if !ok {
+		return fmt.Errorf("%w: sstable version %d, supported up to %d", format.ErrUnsupportedVersion, version, format.Current(format.KindSST))
+	}
+	// 注册的格式的 footer 可能比当前内置格式更大，需要重新读取
+	if footerSize := tf.FooterSize(); footerSize > len(tail) && int64(footerSize) <= fileSize {
+		if tail, err = s.readTail(fileSize, footerSize); err != nil {
+			return err
+		}
+	}
 
-	if s.filterSize, err = binary.ReadUvarint(s.reader); err != nil {
+	f, err := tf.DecodeFooter(tail)
+	if err != nil {
 		return err
 	}
+	// 没有 magic number 的文件按照老版本解析，各个块的范围必须落在文件之内，否则说明这不是一个 sstable 文件
+	if err = f.validate(uint64(fileSize), uint64(tf.FooterSize())); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+	// 加密的 sstable 需要配置写入时使用的密钥
+	if s.cipher, err = newReaderCipher(s.conf, f); err != nil {
+		return fmt.Errorf("%s: %w %d", s.path, err, f.EncryptionKeyID)
+	}
 
-	if s.indexOffset, err = binary.ReadUvarint(s.reader); err != nil {
-		return err
+	s.version, s.format = f.Version, tf
+	s.filterOffset, s.filterSize = f.FilterOffset, f.FilterSize
+	s.indexOffset, s.indexSize = f.IndexOffset, f.IndexSize
+	s.maxSeq = f.MaxSeq
+	s.alignment = f.Alignment
+	s.propsOffset, s.propsSize = f.PropsOffset, f.PropsSize
+	s.partitions = f.IndexPartitions
+	s.tableFilterOffset, s.tableFilterSize = f.TableFilterOffset, f.TableFilterSize
+	return nil
+}
+
+// 读取文件尾部至多 size 大小的内容
+func (s *SSTReader) readTail(fileSize int64, size int) ([]byte, error) {
+	tailSize := int64(size)
+	if fileSize < tailSize {
+		tailSize = fileSize
 	}
+	return s.readAt(uint64(fileSize-tailSize), uint64(tailSize))
+}
 
-	if s.indexSize, err = binary.ReadUvarint(s.reader); err != nil {
-		return err
+// ReadProperties 读取 sstable 的属性. 老版本的 sstable 没有属性块，返回零值的属性
+func (s *SSTReader) ReadProperties() (*SSTProperties, error) {
+	if s.propsSize == 0 {
+		return &SSTProperties{}, nil
 	}
 
-	return nil
+	propsBlock, err := s.ReadBlock(s.propsOffset, s.propsSize)
+	if err != nil {
+		return nil, err
+	}
+	return s.readProperties(propsBlock)
 }
 
 // ReadFilter 读取过滤器
@@ -95,7 +246,7 @@ func (s *SSTReader) ReadFilter() (map[uint64][]byte, error) {
 	}
 
 	// 读取 filter block 块的内容
-	filterBlock, err := s.ReadBlock(s.filterOffset, s.filterSize)
+	filterBlock, err := s.readMetaBlock(s.filterOffset, s.filterSize)
 	if err != nil {
 		return nil, err
 	}
@@ -104,8 +255,48 @@ func (s *SSTReader) ReadFilter() (map[uint64][]byte, error) {
 	return s.readFilter(filterBlock)
 }
 
-// ReadIndex 读取索引块
+// ReadTableFilter 读取整表过滤器的 bitmap. 没有开启整表过滤器以及老版本的 sstable 返回 nil
+func (s *SSTReader) ReadTableFilter() ([]byte, error) {
+	if s.tableFilterSize == 0 {
+		return nil, nil
+	}
+	bitmap, err := s.readMetaBlock(s.tableFilterOffset, s.tableFilterSize)
+	if err != nil {
+		return nil, err
+	}
+	// 通过 mmap 读取时 bitmap 引用映射的内存，常驻节点之前需要拷贝
+	if s.mapped != nil {
+		bitmap = append([]byte(nil), bitmap...)
+	}
+	return bitmap, nil
+}
+
+// IndexPartitions 分区索引的分区个数. 单层索引以及老版本的 sstable 返回 0
+func (s *SSTReader) IndexPartitions() uint64 {
+	return s.partitions
+}
+
+// ReadIndex 读取完整的索引. 索引按分区存放时，读取全部分区拼接为完整的索引
 func (s *SSTReader) ReadIndex() ([]*Index, error) {
+	index, err := s.ReadPinnedIndex()
+	if err != nil || s.partitions == 0 {
+		return index, err
+	}
+
+	// 顶层索引中首个索引之前没有数据块，与完整索引的首个索引一致
+	full := []*Index{index[0]}
+	for _, partition := range index[1:] {
+		entries, err := s.ReadIndexPartition(partition)
+		if err != nil {
+			return nil, err
+		}
+		full = append(full, entries...)
+	}
+	return full, nil
+}
+
+// ReadPinnedIndex 读取 footer 指向的索引块，即常驻内存的索引. 索引按分区存放时为顶层索引，否则为完整的索引
+func (s *SSTReader) ReadPinnedIndex() ([]*Index, error) {
 	// 如果 footer 信息还没读取，则先完成 footer 信息加载
 	if s.indexOffset == 0 || s.indexSize == 0 {
 		if err := s.ReadFooter(); err != nil {
@@ -114,7 +305,7 @@ func (s *SSTReader) ReadIndex() ([]*Index, error) {
 	}
 
 	// 读取 index block 块的内容
-	indexBlock, err := s.ReadBlock(s.indexOffset, s.indexSize)
+	indexBlock, err := s.readMetaBlock(s.indexOffset, s.indexSize)
 	if err != nil {
 		return nil, err
 	}
@@ -123,6 +314,15 @@ func (s *SSTReader) ReadIndex() ([]*Index, error) {
 	return s.readIndex(indexBlock)
 }
 
+// ReadIndexPartition 读取顶层索引指向的一个索引分区
+func (s *SSTReader) ReadIndexPartition(partition *Index) ([]*Index, error) {
+	block, err := s.readMetaBlock(partition.PrevBlockOffset, partition.PrevBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return s.readIndex(block)
+}
+
 // ReadData 读取 sstable 下的全量 kv 数据
 func (s *SSTReader) ReadData() ([]*KV, error) {
 	// 如果 footer 信息还没读取，则先完成 footer 信息加载
@@ -132,30 +332,126 @@ func (s *SSTReader) ReadData() ([]*KV, error) {
 		}
 	}
 
-	// 读取所有 data block 的内容
-	dataBlock, err := s.ReadBlock(0, s.filterOffset)
+	// 老版本的数据块之间紧密相连，可以一次性读取所有 data block 的内容进行解析
+	if s.version < 2 {
+		dataBlock, err := s.ReadBlock(0, s.filterOffset)
+		if err != nil {
+			return nil, err
+		}
+		return s.ReadBlockData(dataBlock)
+	}
+
+	// 数据块尾部带有重启点信息，需要借助索引逐个解析 data block 的内容
+	index, err := s.ReadIndex()
 	if err != nil {
 		return nil, err
 	}
-
-	// 解析所有 data block 的内容
-	return s.ReadBlockData(dataBlock)
+	var data []*KV
+	for _, idx := range index {
+		if idx.PrevBlockSize == 0 {
+			continue
+		}
+		block, err := s.ReadDataBlock(idx.PrevBlockOffset, idx.PrevBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		kvs, err := s.ReadBlockData(block)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, kvs...)
+	}
+	return data, nil
 }
 
-// ReadBlock 读取一个 block 块的内容
+// ReadBlock 读取一个 block 块的内容. 基于 ReadAt 实现，可以被多个协程并发调用.
+// 由 sstable 的格式校验并剥离块尾部的附加信息，例如自版本 8 起的校验和，校验失败时返回 *CorruptionError
 func (s *SSTReader) ReadBlock(offset, size uint64) ([]byte, error) {
-	// 根据起始偏移量，设置文件的 offset
-	if _, err := s.src.Seek(int64(offset), io.SeekStart); err != nil {
+	block, err := s.readAt(offset, size)
+	if err != nil || size == 0 {
+		return block, err
+	}
+	if block, err = s.parseBlock(block, offset); err != nil {
+		return nil, err
+	}
+	return s.decrypt(block, offset), nil
+}
+
+// 从文件的 offset 处读取 size 大小的原始内容. 开启 mmap 读取时返回映射内存的切片，调用方不能修改
+func (s *SSTReader) readAt(offset, size uint64) ([]byte, error) {
+	if s.mapped != nil {
+		if offset > uint64(len(s.mapped)) || size > uint64(len(s.mapped))-offset {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return s.mapped[offset : offset+size : offset+size], nil
+	}
+
+	src, release, err := s.acquire()
+	if err != nil {
 		return nil, err
 	}
-	s.reader.Reset(s.src)
+	defer release()
+	if s.direct {
+		return readDirectAt(src, offset, size)
+	}
 
-	// 读取指定 size 的内容
+	// 从起始偏移量开始，读取指定 size 的内容
 	buf := make([]byte, size)
-	_, err := io.ReadFull(s.reader, buf)
+	n, err := src.ReadAt(buf, int64(offset))
+	if n == len(buf) {
+		return buf, nil
+	}
 	return buf, err
 }
 
+// ReadDataBlock 读取一个数据块，校验并剥离尾部的校验和以及压缩类型，返回解压后可供 ReadBlockData、SeekBlock 解析的内容.
+// 老版本的数据块没有压缩类型，原样返回
+func (s *SSTReader) ReadDataBlock(offset, size uint64) ([]byte, error) {
+	block, err := s.ReadBlock(offset, size)
+	if err != nil || s.version < 7 || len(block) == 0 {
+		return block, err
+	}
+	return decodeBlock(block)
+}
+
+// 读取一个过滤器块、整表过滤器块或者索引块. 自版本 12 起块尾部带有压缩类型，剥离之后按照压缩类型解压
+func (s *SSTReader) readMetaBlock(offset, size uint64) ([]byte, error) {
+	block, err := s.ReadBlock(offset, size)
+	if err != nil || s.version < 12 || len(block) == 0 {
+		return block, err
+	}
+	return decodeBlock(block)
+}
+
+// 解析已经读取到内存中的原始数据块，处理流程与 ReadDataBlock 一致. offset 为数据块在 sstable 中的位置，用于错误信息
+func (s *SSTReader) parseDataBlock(raw []byte, offset uint64) ([]byte, error) {
+	block := raw
+	if len(raw) > 0 {
+		var err error
+		if block, err = s.parseBlock(raw, offset); err != nil {
+			return nil, err
+		}
+		block = s.decrypt(block, offset)
+	}
+	if s.version < 7 || len(block) == 0 {
+		return block, nil
+	}
+	return decodeBlock(block)
+}
+
+// 剥离块尾部的压缩类型，并按照压缩类型解压
+func decodeBlock(block []byte) ([]byte, error) {
+	typ, payload := compress.Type(block[len(block)-1]), block[:len(block)-1]
+	if typ == compress.None {
+		return payload, nil
+	}
+	codec, ok := compress.Lookup(typ)
+	if !ok {
+		return nil, fmt.Errorf("unknown block compression type %s", typ)
+	}
+	return codec.Decode(nil, payload)
+}
+
 // 解析 filter block 块的内容
 func (s *SSTReader) readFilter(block []byte) (map[uint64][]byte, error) {
 	blockToFilter := make(map[uint64][]byte)
@@ -214,10 +510,16 @@ func (s *SSTReader) readIndex(block []byte) ([]*Index, error) {
 
 // ReadBlockData 读取某个 block 的数据
 func (s *SSTReader) ReadBlockData(block []byte) ([]*KV, error) {
+	// 剥离数据块尾部的重启点信息
+	records, _, err := s.splitDataBlock(block)
+	if err != nil {
+		return nil, err
+	}
+
 	// 需要临时记录前一个 key 的内容
 	var prevKey []byte
 	// block 数据封装成 buffer
-	buf := bytes.NewBuffer(block)
+	buf := bytes.NewBuffer(records)
 	var data []*KV
 
 	for {
@@ -232,7 +534,7 @@ func (s *SSTReader) ReadBlockData(block []byte) ([]*KV, error) {
 
 		data = append(data, &KV{
 			Key:   key,
-			Value: value,
+			Value: s.internalValue(value),
 		})
 		// 对 prevKey 进行更新
 		prevKey = key
@@ -240,6 +542,82 @@ func (s *SSTReader) ReadBlockData(block []byte) ([]*KV, error) {
 	return data, nil
 }
 
+// SeekBlock 在数据块中检索首个 key >= 目标 key 的 kv 对.
+// 借助重启点进行二分查找，定位到目标所在的重启区间后，只需要解码该区间内的记录
+func (s *SSTReader) SeekBlock(block, key []byte) (*KV, bool, error) {
+	records, restarts, err := s.splitDataBlock(block)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// 二分查找最后一个 key < 目标 key 的重启点. 重启点处的 key 不做前缀压缩，可以直接解码
+	var start uint32
+	left, right := 0, len(restarts)-1
+	for left <= right {
+		mid := left + (right-left)>>1
+		restartKey, _, err := s.ReadRecord(nil, bytes.NewBuffer(records[restarts[mid]:]))
+		if err != nil {
+			return nil, false, err
+		}
+		if bytes.Compare(restartKey, key) < 0 {
+			start = restarts[mid]
+			left = mid + 1
+		} else {
+			right = mid - 1
+		}
+	}
+
+	// 从重启点开始顺序解码，直到遇到首个 key >= 目标 key 的记录
+	var prevKey []byte
+	buf := bytes.NewBuffer(records[start:])
+	for {
+		k, v, err := s.ReadRecord(prevKey, buf)
+		if errors.Is(err, io.EOF) {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if bytes.Compare(k, key) >= 0 {
+			return &KV{Key: k, Value: s.internalValue(v)}, true, nil
+		}
+		prevKey = k
+	}
+}
+
+// 老版本的 sstable 中存放的是用户 value，统一转换为内部记录的 value
+func (s *SSTReader) internalValue(value []byte) []byte {
+	if s.version >= 3 {
+		return value
+	}
+	return EncodeInternalValue(OpPut, 0, value)
+}
+
+// 拆分数据块中的 kv 记录部分与尾部的重启点 offset. 老版本的数据块不包含重启点
+func (s *SSTReader) splitDataBlock(block []byte) ([]byte, []uint32, error) {
+	if s.version < 2 || len(block) == 0 {
+		return block, nil, nil
+	}
+
+	if len(block) < 4 {
+		return nil, nil, errors.New("data block too short")
+	}
+	restartsCnt := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	restartsOffset := len(block) - 4*(restartsCnt+1)
+	if restartsOffset < 0 {
+		return nil, nil, errors.New("invalid data block restarts")
+	}
+
+	restarts := make([]uint32, restartsCnt)
+	for i := range restarts {
+		restarts[i] = binary.LittleEndian.Uint32(block[restartsOffset+4*i:])
+		if int(restarts[i]) >= restartsOffset {
+			return nil, nil, errors.New("invalid data block restarts")
+		}
+	}
+	return block[:restartsOffset], restarts, nil
+}
+
 // ReadRecord 读取一条 kv 对数据
 func (s *SSTReader) ReadRecord(prevKey []byte, buf *bytes.Buffer) (key, value []byte, err error) {
 	// 获取当前 key 和 prevKey 的共享前缀长度
@@ -260,6 +638,14 @@ func (s *SSTReader) ReadRecord(prevKey []byte, buf *bytes.Buffer) (key, value []
 		return nil, nil, err
 	}
 
+	// 损坏的数据可能解码出超出范围的长度，提前校验，避免越界或者申请过大的内存
+	if sharedPrexLen > uint64(len(prevKey)) {
+		return nil, nil, errors.New("invalid record shared prefix length")
+	}
+	if keyLen > uint64(buf.Len()) || valLen > uint64(buf.Len())-keyLen {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+
 	// 读取 key 剩余部分
 	key = make([]byte, keyLen)
 	if _, err = io.ReadFull(buf, key); err != nil {
@@ -0,0 +1,105 @@
+package lsmart
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+)
+
+// 校验 sstable 时抽样检索的 key 个数
+const sstVerifySamples = 16
+
+// 重新读取刚刚落盘的 sstable，校验其内容是否完整可读，在新节点注册、数据源释放之前发现写入流程中的问题. 内容不符时返回 ErrCorruption. 校验内容包括：
+// 1 footer、过滤器块以及索引块能够正常解析，索引 key 严格递增
+// 2 每个数据块能够正常解码，块内 key 严格递增，且不超过对应索引 key 的范围
+// 3 记录总数与写入时一致
+// 4 抽样若干 key，经由过滤器、索引以及块内检索的完整读流程能够读到
+func (t *Tree) verifySST(file string, entries int) error {
+	sstReader, err := NewSSTReader(file, t.conf)
+	if err != nil {
+		return err
+	}
+	defer sstReader.Close()
+	return t.verifySSTReader(file, sstReader, entries)
+}
+
+// 基于已经打开的 reader 校验 sstable，file 仅用于错误信息以及抽样检索时的数据块缓存
+func (t *Tree) verifySSTReader(file string, sstReader *SSTReader, entries int) error {
+	blockToFilter, err := sstReader.ReadFilter()
+	if err != nil {
+		return err
+	}
+	index, err := sstReader.ReadIndex()
+	if err != nil {
+		return err
+	}
+	if len(index) == 0 {
+		return fmt.Errorf("%w: verify sstable %s: empty index", ErrCorruption, file)
+	}
+	size, err := sstReader.Size()
+	if err != nil {
+		return err
+	}
+
+	// 1 校验索引 key 严格递增
+	for i := 1; i < len(index); i++ {
+		if bytes.Compare(index[i-1].Key, index[i].Key) >= 0 {
+			return fmt.Errorf("%w: verify sstable %s: index keys out of order at %d", ErrCorruption, file, i)
+		}
+	}
+
+	// 2 逐个数据块解码，校验 key 的顺序以及所属范围. 第 i 个索引对应的是第 i - 1 个数据块
+	var (
+		prevKey []byte
+		keys    [][]byte
+	)
+	for i := 1; i < len(index); i++ {
+		block, err := sstReader.ReadDataBlock(index[i].PrevBlockOffset, index[i].PrevBlockSize)
+		if err != nil {
+			return err
+		}
+		kvs, err := sstReader.ReadBlockData(block)
+		if err != nil {
+			return fmt.Errorf("%w: verify sstable %s: decode block at %d: %v", ErrCorruption, file, index[i].PrevBlockOffset, err)
+		}
+		for _, kv := range kvs {
+			if prevKey != nil && bytes.Compare(prevKey, kv.Key) >= 0 {
+				return fmt.Errorf("%w: verify sstable %s: keys out of order at %q", ErrCorruption, file, kv.Key)
+			}
+			if bytes.Compare(kv.Key, index[i-1].Key) <= 0 || bytes.Compare(kv.Key, index[i].Key) > 0 {
+				return fmt.Errorf("%w: verify sstable %s: key %q outside of index range", ErrCorruption, file, kv.Key)
+			}
+			prevKey = kv.Key
+			keys = append(keys, kv.Key)
+		}
+	}
+
+	// 3 校验记录总数
+	if len(keys) != entries {
+		return fmt.Errorf("%w: verify sstable %s: expect %d entries, got %d", ErrCorruption, file, entries, len(keys))
+	}
+
+	// 4 抽样检索
+	pinned, err := sstReader.ReadPinnedIndex()
+	if err != nil {
+		return err
+	}
+	node := NewNode(t.conf, file, sstReader, -1, 0, size, blockToFilter, pinned)
+	step := len(keys)/sstVerifySamples + 1
+	for i := 0; i < len(keys); i += step {
+		if _, ok, err := node.Get(keys[i]); err != nil || !ok {
+			return fmt.Errorf("%w: verify sstable %s: sampled key %q not found, err: %v", ErrCorruption, file, keys[i], err)
+		}
+	}
+	return nil
+}
+
+// 校验未通过的 sstable 需要删除，保留数据源等待下一次重试
+func (t *Tree) discardSST(file string) {
+	_ = os.Remove(path.Join(t.conf.Dir, file))
+	// 校验过程中可能缓存了该文件的数据块，文件名后续会被复用，需要一并淘汰
+	if t.conf.blockCache != nil {
+		t.conf.blockCache.EvictFile(file)
+	}
+}
@@ -3,9 +3,16 @@ package lsmart
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path"
+	"time"
 
+	"github.com/cccccxxy/lsmart/compress"
+	"github.com/cccccxxy/lsmart/filter"
+	"github.com/cccccxxy/lsmart/format"
 	"github.com/cccccxxy/lsmart/util"
 )
 
@@ -19,13 +26,22 @@ type Index struct {
 // SSTWriter 对应于 lsm tree 中的一个 sstable. 这是写入流程的视角
 type SSTWriter struct {
 	conf          *Config           // 配置文件
-	dest          *os.File          // sstable 对应的磁盘文件
+	filter        filter.Filter     // 过滤器. 过滤器支持复制时，每个 sstWriter 独占一个实例
+	tableFilter   filter.Filter     // 整表过滤器，包含 sstable 中全部的 key. 未开启时为空
+	dest          *os.File          // 写入中的临时文件，Finish 落盘后重命名为 file
+	file          string            // sstable 最终的文件路径
+	direct        bool              // 是否以直接 IO 写入，写入内容需要按照 directIOAlignment 对齐
+	cipher        *blockCipher      // 各个块的加密器. 未开启加密时为空
+	format        TableFormat       // 写入使用的 sstable 格式，负责编码 footer 以及块尾部的附加信息
 	dataBuf       *bytes.Buffer     // 数据块缓冲区 key -> val
 	filterBuf     *bytes.Buffer     // 过滤器块缓冲区 prev block offset -> filter bit map
 	indexBuf      *bytes.Buffer     // 索引块缓冲区 index key -> prev block offset, prev block size
 	blockToFilter map[uint64][]byte // prev block offset -> filter bit map
 	index         []*Index          // index key -> prev block offset, prev block size
 
+	blockBuf    *bytes.Buffer // 单个数据块的缓冲区，压缩之后再追加到 dataBuf
+	compressBuf []byte        // 压缩数据块使用的缓冲区，在数据块之间复用
+
 	dataBlock     *Block   // 数据块
 	filterBlock   *Block   // 过滤器块
 	indexBlock    *Block   // 索引块
@@ -34,82 +50,265 @@ type SSTWriter struct {
 	prevKey         []byte // 前一笔数据的 key
 	prevBlockOffset uint64 // 前一个数据块的起始偏移位置
 	prevBlockSize   uint64 // 前一个数据块的大小
+	maxSeq          uint64 // 写入记录中的最大 seq
+
+	props *SSTProperties // sstable 的属性，在 Finish 时写入属性块
+
+	err       error // 写入过程中遇到的错误. 一旦出错，后续的 Append、Finish 均返回该错误
+	finished  bool  // 是否已经调用过 Finish
+	published bool  // 临时文件是否已经重命名为最终的文件
 }
 
-// NewSSTWriter sstWriter 构造器
+// sstable 写入过程中使用的临时文件后缀. 宕机时遗留的临时文件不会被当作 sstable 加载，启动时清理
+const sstTempSuffix = ".tmp"
+
+// ErrSSTWriterFinished sstWriter 已经完成写入，不能继续追加数据或者重复 Finish
+var ErrSSTWriterFinished = errors.New("sstable writer already finished")
+
+// NewSSTWriter sstWriter 构造器. 数据先写入 file 对应的临时文件，Finish 落盘之后才重命名为 file，
+// 写了一半的 sstable 不会以正式的文件名出现在目录下
 func NewSSTWriter(file string, conf *Config) (*SSTWriter, error) {
-	dest, err := os.OpenFile(path.Join(conf.Dir, file), os.O_CREATE|os.O_WRONLY, 0644)
+	file = path.Join(conf.Dir, file)
+	dest, direct, err := openSSTFile(file+sstTempSuffix, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, conf.DirectIO)
 	if err != nil {
 		return nil, err
 	}
 
+	// 过滤器支持复制时使用独立的实例，使得多个 sstWriter 能够并发写入
+	f := conf.Filter
+	if cloner, ok := f.(filter.Cloner); ok {
+		f = cloner.Clone()
+	}
+
+	// 开启整表过滤器时，按照期望的假阳性率构造 bitmap 长度随 key 个数伸缩的布隆过滤器
+	var tableFilter filter.Filter
+	if conf.TableFilter {
+		if tableFilter, err = filter.NewBloomFilterWithRate(conf.FilterFPRate); err != nil {
+			_ = dest.Close()
+			return nil, err
+		}
+	}
+
+	// 开启加密时，每个文件使用独立的随机 iv
+	blockCipher, err := newWriterCipher(conf)
+	if err != nil {
+		_ = dest.Close()
+		return nil, err
+	}
+
+	// 格式在配置校验时已经确认注册
+	tf, ok := LookupTableFormat(conf.TableFormat)
+	if !ok {
+		_ = dest.Close()
+		return nil, fmt.Errorf("%w: sstable version %d", format.ErrUnsupportedVersion, conf.TableFormat)
+	}
+
 	return &SSTWriter{
 		conf:          conf,
+		filter:        f,
+		tableFilter:   tableFilter,
 		dest:          dest,
+		file:          file,
+		direct:        direct,
+		cipher:        blockCipher,
+		format:        tf,
 		dataBuf:       bytes.NewBuffer([]byte{}),
 		filterBuf:     bytes.NewBuffer([]byte{}),
 		indexBuf:      bytes.NewBuffer([]byte{}),
+		blockBuf:      bytes.NewBuffer([]byte{}),
 		blockToFilter: make(map[uint64][]byte),
-		dataBlock:     NewBlock(conf),
+		dataBlock:     NewDataBlock(conf),
 		filterBlock:   NewBlock(conf),
 		indexBlock:    NewBlock(conf),
 		prevKey:       []byte{},
+		props: &SSTProperties{
+			CreatedAt:     time.Now(),
+			EngineVersion: engineVersion(),
+			Compression:   compressionName(conf.Compression),
+		},
 	}, nil
 }
 
-// Finish 完成 sstable 的全部处理流程，包括将其中的数据溢写到磁盘，并返回信息供上层的 lsm 获取缓存
-func (s *SSTWriter) Finish() (size uint64, blockToFilter map[uint64][]byte, index []*Index) {
+// SetFilter 替换 sstable 使用的过滤器，例如按层分配假阳性率的布隆过滤器. 需要在写入数据之前调用
+func (s *SSTWriter) SetFilter(f filter.Filter) {
+	s.filter = f
+}
+
+// SetOrigin 记录 sstable 的产生方式以及数据源，在 Finish 时写入属性块
+func (s *SSTWriter) SetOrigin(origin string, inputs []string) {
+	s.props.Origin = origin
+	s.props.Inputs = inputs
+}
+
+// Finish 完成 sstable 的全部处理流程，包括将其中的数据溢写到磁盘、落盘并重命名为正式的文件名，并返回信息供上层的 lsm 获取缓存.
+// 索引按分区存放时，返回的是常驻内存的顶层索引. 返回错误时文件内容不完整，调用方需要放弃并移除该文件
+func (s *SSTWriter) Finish() (size uint64, blockToFilter map[uint64][]byte, index []*Index, err error) {
+	if s.err != nil {
+		return 0, nil, nil, s.err
+	}
+	if s.finished {
+		return 0, nil, nil, ErrSSTWriterFinished
+	}
+	s.finished = true
+
 	// 完成最后一个块的处理
 	s.refreshBlock()
 	// 补齐最后一个 index
 	s.insertIndex(s.prevKey)
 
-	// 将布隆过滤器块写入缓冲区
+	// 将布隆过滤器块写入缓冲区，尾部追加校验和. 过滤器块紧随数据块之后
+	size = uint64(s.dataBuf.Len())
 	_, _ = s.filterBlock.FlushTo(s.filterBuf)
-	// 将索引块写入缓冲区
+	s.compressBufferedBlock(s.filterBuf, 0)
+	s.encrypt(s.filterBuf.Bytes(), size)
+	s.buildBlock(s.filterBuf, 0)
+
+	// 处理 footer，记录布隆过滤器块起始、大小、索引块起始、大小，以及格式版本
+	f := Footer{
+		Version:      s.format.Version(),
+		FilterOffset: size,
+		FilterSize:   uint64(s.filterBuf.Len()),
+		MaxSeq:       s.maxSeq,
+		Alignment:    uint64(s.conf.BlockAlignment),
+	}
+	if s.cipher != nil {
+		f.EncryptionKeyID, f.IVHigh, f.IVLow = uint64(s.cipher.keyID), s.cipher.ivHigh, s.cipher.ivLow
+	}
+	size += f.FilterSize
+
+	// 开启整表过滤器时，整表过滤器块紧随过滤器块之后，尾部追加校验和
+	var tableFilter []byte
+	if s.tableFilter != nil {
+		tableFilter = s.compressMetaBlock(s.tableFilter.Hash())
+		s.encrypt(tableFilter, size)
+		tableFilter = s.format.BuildBlock(tableFilter)
+		f.TableFilterOffset = size
+		f.TableFilterSize = uint64(len(tableFilter))
+		size += f.TableFilterSize
+	}
+
+	// 将索引块写入缓冲区，尾部追加校验和. 开启分区索引且索引超过一个分区时，先依次写入各个分区，再写入顶层索引，
+	// footer 指向顶层索引
+	index = s.index
+	if partitionSize := s.conf.IndexPartitionSize; partitionSize > 0 && s.indexBlock.Size() > partitionSize {
+		index = s.writeIndexPartitions(size)
+		f.IndexPartitions = uint64(len(index) - 1)
+		s.indexBlock.clear()
+		for _, idx := range index {
+			s.indexBlock.Append(idx.Key, s.encodeIndexValue(idx))
+		}
+	}
+	indexStart := s.indexBuf.Len()
 	_, _ = s.indexBlock.FlushTo(s.indexBuf)
+	s.compressBufferedBlock(s.indexBuf, indexStart)
+	s.encrypt(s.indexBuf.Bytes()[indexStart:], size+uint64(indexStart))
+	s.buildBlock(s.indexBuf, indexStart)
+	f.IndexOffset = size + uint64(indexStart)
+	f.IndexSize = uint64(s.indexBuf.Len() - indexStart)
+	size += uint64(s.indexBuf.Len())
+	// 处理属性块，位于索引块之后，尾部追加校验和
+	s.props.LargestKey = s.prevKey
+	props := s.props.encode(s.conf)
+	s.encrypt(props, size)
+	props = s.format.BuildBlock(props)
+	f.PropsOffset = size
+	f.PropsSize = uint64(len(props))
+	size += f.PropsSize
+	footer := s.format.EncodeFooter(&f)
 
-	// 处理 footer，记录布隆过滤器块起始、大小、索引块起始、大小
-	footer := make([]byte, s.conf.SSTFooterSize)
-	size = uint64(s.dataBuf.Len())
-	n := binary.PutUvarint(footer[0:], size)
-	filterBufLen := uint64(s.filterBuf.Len())
-	n += binary.PutUvarint(footer[n:], filterBufLen)
-	size += filterBufLen
-	n += binary.PutUvarint(footer[n:], size)
-	indexBufLen := uint64(s.indexBuf.Len())
-	n += binary.PutUvarint(footer[n:], indexBufLen)
-	size += indexBufLen
-
-	// 依次写入文件
-	_, _ = s.dest.Write(s.dataBuf.Bytes())
-	_, _ = s.dest.Write(s.filterBuf.Bytes())
-	_, _ = s.dest.Write(s.indexBuf.Bytes())
-	_, _ = s.dest.Write(footer)
+	// 依次写入文件，并确保落盘. 溢写完成后 wal 文件会被删除，数据必须已经持久化.
+	// 直接 IO 写入时经由对齐的缓冲区整块写入
+	var (
+		dest   io.Writer = s.dest
+		direct *directWriter
+	)
+	if s.direct {
+		direct = newDirectWriter(s.dest)
+		dest = direct
+	}
+	for _, buf := range [][]byte{s.dataBuf.Bytes(), s.filterBuf.Bytes(), tableFilter, s.indexBuf.Bytes(), props, footer} {
+		if _, err = dest.Write(buf); err != nil {
+			return 0, nil, nil, s.fail(err)
+		}
+	}
+	if direct != nil {
+		if err = direct.Flush(); err != nil {
+			return 0, nil, nil, s.fail(err)
+		}
+	}
+	if err = s.dest.Sync(); err != nil {
+		return 0, nil, nil, s.fail(err)
+	}
+
+	// 落盘后重命名为最终的文件，并 fsync 所在目录，保证重命名本身同样持久化
+	if err = os.Rename(s.dest.Name(), s.file); err != nil {
+		return 0, nil, nil, s.fail(err)
+	}
+	s.published = true
+	if err = syncDir(path.Dir(s.file)); err != nil {
+		return 0, nil, nil, s.fail(err)
+	}
 
 	blockToFilter = s.blockToFilter
-	index = s.index
-	return
+	return size, blockToFilter, index, nil
 }
 
-// Append 追加一笔数据到 sstable 中
-func (s *SSTWriter) Append(key, value []byte) {
+// 记录写入过程中遇到的错误. 文件 IO 的错误中已经包含了文件路径
+func (s *SSTWriter) fail(err error) error {
+	s.err = err
+	return s.err
+}
+
+// Append 追加一笔数据到 sstable 中. key 必须严格递增，否则返回错误，已经追加的数据不受影响
+func (s *SSTWriter) Append(key, value []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.finished {
+		return ErrSSTWriterFinished
+	}
+	if s.props.Entries > 0 && bytes.Compare(key, s.prevKey) <= 0 {
+		return fmt.Errorf("sstable: key %q appended after %q, keys must be strictly increasing", key, s.prevKey)
+	}
+
 	// 倘若开启一个新的数据块，需要添加索引
 	if s.dataBlock.entriesCnt == 0 {
 		s.insertIndex(key)
 	}
 
+	// 记录 sstable 中最小的 key
+	if s.props.Entries == 0 {
+		s.props.SmallestKey = append([]byte(nil), key...)
+	}
+
 	// 将数据写入到数据块中
 	s.dataBlock.Append(key, value)
 	// 将 key 添加到块的布隆过滤器中
-	s.conf.Filter.Add(key)
+	s.filter.Add(key)
+	if s.tableFilter != nil {
+		s.tableFilter.Add(key)
+	}
 	// 记录一下最新的 key
 	s.prevKey = key
+	// 记录一下最大的 seq，并统计记录个数
+	op, seq, _, err := DecodeInternalValue(value)
+	if err == nil && seq > s.maxSeq {
+		s.maxSeq = seq
+	}
+	s.props.Entries++
+	if err == nil && op == OpDelete {
+		s.props.Tombstones++
+	}
+	// 记录一下最早的过期时间
+	if expireAt := internalExpireAt(value); expireAt > 0 && (s.props.EarliestExpiry.IsZero() || expireAt < s.props.EarliestExpiry.UnixNano()) {
+		s.props.EarliestExpiry = expireTime(expireAt)
+	}
 
 	// 倘若数据块大小超限，则需要将其添加到 dataBuffer，并重置块
 	if s.dataBlock.Size() >= s.conf.SSTDataBlockSize {
 		s.refreshBlock()
 	}
+	return nil
 }
 
 func (s *SSTWriter) Size() uint64 {
@@ -118,6 +317,10 @@ func (s *SSTWriter) Size() uint64 {
 
 func (s *SSTWriter) Close() {
 	_ = s.dest.Close()
+	// 没有完成写入的临时文件直接移除
+	if !s.published {
+		_ = os.Remove(s.dest.Name())
+	}
 	s.dataBuf.Reset()
 	s.indexBuf.Reset()
 	s.filterBuf.Reset()
@@ -125,32 +328,137 @@ func (s *SSTWriter) Close() {
 
 func (s *SSTWriter) insertIndex(key []byte) {
 	// 获取索引的 key
-	indexKey := util.GetSeparatorBetween(s.prevKey, key)
-	n := binary.PutUvarint(s.assistScratch[0:], s.prevBlockOffset)
-	n += binary.PutUvarint(s.assistScratch[n:], s.prevBlockSize)
-
-	s.indexBlock.Append(indexKey, s.assistScratch[:n])
-	s.index = append(s.index, &Index{
-		Key:             indexKey,
+	index := &Index{
+		Key:             util.GetSeparatorBetween(s.prevKey, key),
 		PrevBlockOffset: s.prevBlockOffset,
 		PrevBlockSize:   s.prevBlockSize,
-	})
+	}
+	s.indexBlock.Append(index.Key, s.encodeIndexValue(index))
+	s.index = append(s.index, index)
+}
+
+// 编码索引的 value：前一个 block 的 offset 以及 size
+func (s *SSTWriter) encodeIndexValue(index *Index) []byte {
+	n := binary.PutUvarint(s.assistScratch[0:], index.PrevBlockOffset)
+	n += binary.PutUvarint(s.assistScratch[n:], index.PrevBlockSize)
+	return s.assistScratch[:n]
+}
+
+// 将索引按照分区大小切分写入缓冲区，base 为缓冲区在 sstable 中的起始 offset. 返回顶层索引：
+// 首个索引之前没有数据块，原样保留以记录 sstable 的起始 key；其后每个索引的 key 为分区中最后一个索引的 key，
+// offset 与 size 指向分区. 顶层索引与数据块索引的结构一致，第 i 个分区覆盖 (top[i-1].Key, top[i].Key] 范围内的数据块
+func (s *SSTWriter) writeIndexPartitions(base uint64) []*Index {
+	top := []*Index{s.index[0]}
+	partition := NewBlock(s.conf)
+	for i, index := range s.index[1:] {
+		partition.Append(index.Key, s.encodeIndexValue(index))
+		if partition.Size() < s.conf.IndexPartitionSize && i < len(s.index)-2 {
+			continue
+		}
+
+		start := s.indexBuf.Len()
+		_, _ = partition.FlushTo(s.indexBuf)
+		s.compressBufferedBlock(s.indexBuf, start)
+		s.encrypt(s.indexBuf.Bytes()[start:], base+uint64(start))
+		s.buildBlock(s.indexBuf, start)
+		top = append(top, &Index{
+			Key:             index.Key,
+			PrevBlockOffset: base + uint64(start),
+			PrevBlockSize:   uint64(s.indexBuf.Len() - start),
+		})
+	}
+	return top
 }
 
 func (s *SSTWriter) refreshBlock() {
-	if s.conf.Filter.KeyLen() == 0 {
+	if s.filter.KeyLen() == 0 {
 		return
 	}
 
 	s.prevBlockOffset = uint64(s.dataBuf.Len())
 	// 添加布隆过滤器 bitmap
-	filterBitmap := s.conf.Filter.Hash()
+	filterBitmap := s.filter.Hash()
 	s.blockToFilter[s.prevBlockOffset] = filterBitmap
 	n := binary.PutUvarint(s.assistScratch[0:], s.prevBlockOffset)
 	s.filterBlock.Append(s.assistScratch[:n], filterBitmap)
 	// 重置布隆过滤器
-	s.conf.Filter.Reset()
+	s.filter.Reset()
 
 	// 将 block 的数据添加到缓冲区
-	s.prevBlockSize, _ = s.dataBlock.FlushTo(s.dataBuf)
+	s.prevBlockSize = s.flushDataBlock()
+
+	// 开启对齐时，在块尾部填充 0，使得下一个块的起始位置对齐到边界. 填充部分不计入块的大小
+	if alignment := s.conf.BlockAlignment; alignment > 0 {
+		if remainder := s.dataBuf.Len() % alignment; remainder > 0 {
+			s.dataBuf.Write(make([]byte, alignment-remainder))
+		}
+	}
+}
+
+// 将数据块按需压缩后追加到 dataBuf，尾部依次写入 1 byte 的压缩类型以及校验和，返回写入的大小.
+// 压缩失败或者压缩率不足 12.5% 时按原样存放，节省读取时的解压开销
+func (s *SSTWriter) flushDataBlock() uint64 {
+	s.blockBuf.Reset()
+	_, _ = s.dataBlock.FlushTo(s.blockBuf)
+	raw := s.blockBuf.Bytes()
+
+	payload, typ := raw, compress.None
+	if codec := s.conf.Compression; codec != nil {
+		compressed, err := codec.Encode(s.compressBuf, raw)
+		if err == nil && worthCompressing(raw, compressed) {
+			payload, typ = compressed, codec.Type()
+		}
+		if cap(compressed) > cap(s.compressBuf) {
+			s.compressBuf = compressed[:0]
+		}
+	}
+
+	// payload 位于复用的缓冲区中，追加的内容在下一个数据块时被覆盖
+	block := append(payload, byte(typ))
+	s.encrypt(block, uint64(s.dataBuf.Len()))
+	block = s.format.BuildBlock(block)
+	s.dataBuf.Write(block)
+	s.props.RawSize += uint64(len(raw))
+	s.props.CompressedSize += uint64(len(block))
+	return uint64(len(block))
+}
+
+// 按照元数据的压缩算法压缩过滤器块、整表过滤器块或者索引块的内容，尾部追加 1 byte 的压缩类型，返回新申请的内存.
+// 与数据块一致，压缩失败或者压缩率不足 12.5% 时按原样存放
+func (s *SSTWriter) compressMetaBlock(raw []byte) []byte {
+	payload, typ := raw, compress.None
+	if codec := s.conf.MetadataCompression; codec != nil {
+		if compressed, err := codec.Encode(nil, raw); err == nil && worthCompressing(raw, compressed) {
+			payload, typ = compressed, codec.Type()
+		}
+	}
+	block := make([]byte, 0, len(payload)+1+blockChecksumSize)
+	return append(append(block, payload...), byte(typ))
+}
+
+// 将缓冲区中 start 之后的元数据块内容替换为 compressMetaBlock 的结果
+func (s *SSTWriter) compressBufferedBlock(buf *bytes.Buffer, start int) {
+	block := s.compressMetaBlock(buf.Bytes()[start:])
+	buf.Truncate(start)
+	buf.Write(block)
+}
+
+// 压缩之后的大小是否至少节省 12.5%，否则不值得付出读取时的解压开销
+func worthCompressing(raw, compressed []byte) bool {
+	return len(compressed) < len(raw)-len(raw)/8
+}
+
+// 按照 sstable 的格式在缓冲区中块内容的尾部追加附加信息，例如校验和，start 为块在缓冲区中的起始位置
+func (s *SSTWriter) buildBlock(buf *bytes.Buffer, start int) {
+	block := s.format.BuildBlock(buf.Bytes()[start:])
+	buf.Truncate(start)
+	buf.Write(block)
+}
+
+// 压缩算法的名称，记录在属性块中
+func compressionName(codec compress.Codec) string {
+	if codec == nil {
+		return compress.None.String()
+	}
+	return codec.Type().String()
 }
@@ -0,0 +1,100 @@
+package lsmart
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// 已打开的 sstable 文件句柄缓存，限制同时打开的文件个数. 超出上限时关闭最久未访问的文件，再次读取时重新打开.
+// 正在读取的文件不会被关闭，并发读取较多时打开的文件个数可能短暂超出上限
+type tableCache struct {
+	mu       sync.Mutex
+	capacity int                          // 同时打开的文件个数上限
+	lru      *list.List                   // 已打开文件的 reader，越靠前越近被访问
+	elems    map[*SSTReader]*list.Element // reader -> lru 中的节点
+	inUse    map[*SSTReader]int           // reader -> 正在进行的读取个数
+	opens    uint64                       // 重新打开文件的累计次数
+}
+
+func newTableCache(capacity int) *tableCache {
+	return &tableCache{
+		capacity: capacity,
+		lru:      list.New(),
+		elems:    make(map[*SSTReader]*list.Element),
+		inUse:    make(map[*SSTReader]int),
+	}
+}
+
+// 登记刚刚打开文件的 reader
+func (c *tableCache) add(s *SSTReader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.elems[s] = c.lru.PushFront(s)
+	c.evictLocked()
+}
+
+// 获取 reader 的文件句柄，文件已被关闭时重新打开. 读取完成后需要调用 release
+func (c *tableCache) acquire(s *SSTReader) (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[s]; ok {
+		c.lru.MoveToFront(elem)
+	} else {
+		src, _, err := openSSTFile(s.path, os.O_RDONLY, s.direct)
+		if err != nil {
+			return nil, err
+		}
+		s.src = src
+		c.elems[s] = c.lru.PushFront(s)
+		c.opens++
+	}
+	c.inUse[s]++
+	src := s.src
+	c.evictLocked()
+	return src, nil
+}
+
+// 读取完成，释放 reader 的文件句柄
+func (c *tableCache) release(s *SSTReader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inUse[s]--; c.inUse[s] <= 0 {
+		delete(c.inUse, s)
+	}
+	c.evictLocked()
+}
+
+// reader 关闭时移出缓存并关闭文件
+func (c *tableCache) remove(s *SSTReader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.elems[s]; ok {
+		c.lru.Remove(elem)
+		delete(c.elems, s)
+		_ = s.src.Close()
+		s.src = nil
+	}
+}
+
+// 打开的文件个数以及重新打开文件的累计次数
+func (c *tableCache) stats() (open int, reopens uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len(), c.opens
+}
+
+// 从最久未访问的一端开始关闭文件，直至不超过上限. 跳过正在读取的文件
+func (c *tableCache) evictLocked() {
+	for elem := c.lru.Back(); elem != nil && c.lru.Len() > c.capacity; {
+		prev := elem.Prev()
+		s := elem.Value.(*SSTReader)
+		if c.inUse[s] == 0 {
+			c.lru.Remove(elem)
+			delete(c.elems, s)
+			_ = s.src.Close()
+			s.src = nil
+		}
+		elem = prev
+	}
+}
@@ -0,0 +1,104 @@
+package lsmart
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cccccxxy/lsmart/format"
+)
+
+// TableFormat sstable 的块格式与 footer 布局. 每个格式对应 footer 尾部记录的一个版本号，读取时按照版本号查找已注册的格式，
+// 因此不同格式写出的 sstable 可以共存于同一个目录. 内置格式覆盖 format.Versions(format.KindSST) 中的全部版本，
+// 列式数据块、压缩索引等实验性的格式可以通过 RegisterTableFormat 使用更大的版本号注册，并通过 WithTableFormat 写入
+type TableFormat interface {
+	// Version 格式版本号，写在 footer 尾部，读取时据此找到对应的 TableFormat
+	Version() format.Version
+	// FooterSize footer 的大小，单位 byte. footer 尾部依次为 4 byte 的版本号以及 8 byte 的 magic number
+	FooterSize() int
+	// EncodeFooter 将 footer 编码为 FooterSize 大小的字节数组
+	EncodeFooter(f *Footer) []byte
+	// DecodeFooter 从 FooterSize 大小的字节数组中解析出 footer
+	DecodeFooter(tail []byte) (*Footer, error)
+	// BuildBlock 在块内容尾部追加格式需要的附加信息，例如校验和，返回写入文件的原始块. 块内容已经完成压缩与加密，
+	// 结果可以复用 block 的底层数组
+	BuildBlock(block []byte) []byte
+	// ParseBlock 校验原始块并剥离 BuildBlock 追加的附加信息，返回块内容. 校验失败时返回 *CorruptionError，
+	// 其中的文件名与 offset 由调用方补齐
+	ParseBlock(raw []byte) ([]byte, error)
+}
+
+var (
+	tableFormatsLock sync.RWMutex
+	tableFormats     = builtinTableFormats()
+)
+
+// 内置格式，覆盖 sstable 全部的历史版本. 在包级变量初始化阶段构造，早于各个 init 中的版本兼容校验
+func builtinTableFormats() map[format.Version]TableFormat {
+	formats := make(map[format.Version]TableFormat)
+	for _, v := range format.Versions(format.KindSST) {
+		formats[v] = builtinTableFormat(v)
+	}
+	return formats
+}
+
+// RegisterTableFormat 注册 sstable 格式，读取时按照 footer 中的版本号查找. 内置格式的版本号保留，不允许覆盖；
+// 其余版本号重复注册时后者覆盖前者
+func RegisterTableFormat(tf TableFormat) error {
+	if v := tf.Version(); v <= format.Current(format.KindSST) {
+		return fmt.Errorf("table format: version %d is reserved for builtin formats", v)
+	}
+	if tf.FooterSize() < 12 {
+		return fmt.Errorf("table format: footer size %d is too small to hold the version and magic number", tf.FooterSize())
+	}
+	tableFormatsLock.Lock()
+	tableFormats[tf.Version()] = tf
+	tableFormatsLock.Unlock()
+	return nil
+}
+
+// LookupTableFormat 根据版本号查找已注册的 sstable 格式
+func LookupTableFormat(v format.Version) (TableFormat, bool) {
+	tableFormatsLock.RLock()
+	defer tableFormatsLock.RUnlock()
+	tf, ok := tableFormats[v]
+	return tf, ok
+}
+
+// 内置格式，按照版本号决定 footer 中的字段以及块尾部是否带有校验和
+type builtinTableFormat format.Version
+
+// Version 格式版本号
+func (b builtinTableFormat) Version() format.Version {
+	return format.Version(b)
+}
+
+// FooterSize footer 的大小
+func (b builtinTableFormat) FooterSize() int {
+	return footerSizeOf(format.Version(b))
+}
+
+// EncodeFooter 编码 footer
+func (b builtinTableFormat) EncodeFooter(f *Footer) []byte {
+	return f.encode()
+}
+
+// DecodeFooter 解析 footer
+func (b builtinTableFormat) DecodeFooter(tail []byte) (*Footer, error) {
+	return decodeFooter(tail, format.Version(b))
+}
+
+// BuildBlock 自版本 8 起在块尾部追加 4 byte 的 CRC32C 校验和
+func (b builtinTableFormat) BuildBlock(block []byte) []byte {
+	if b < 8 {
+		return block
+	}
+	return appendChecksum(block)
+}
+
+// ParseBlock 自版本 8 起校验并剥离块尾部的校验和
+func (b builtinTableFormat) ParseBlock(raw []byte) ([]byte, error) {
+	if b < 8 || len(raw) == 0 {
+		return raw, nil
+	}
+	return verifyChecksum(raw)
+}
@@ -0,0 +1,74 @@
+package testutil
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// SSTFiles 返回目录下所有 sstable 文件的路径，按照文件名排序
+func SSTFiles(tb testing.TB, dir string) []string {
+	tb.Helper()
+	return glob(tb, path.Join(dir, "*.sst"))
+}
+
+// WALFiles 返回目录下所有 wal 文件的路径，包括共享 wal 文件，按照文件名排序
+func WALFiles(tb testing.TB, dir string) []string {
+	tb.Helper()
+	return append(glob(tb, path.Join(dir, "walfile", "*.wal")), glob(tb, path.Join(dir, "walfile", "*.log"))...)
+}
+
+// FlipBytes 将文件中 offset 起的 n 个 byte 按位取反，模拟静默的数据损坏. offset 为负数时表示从文件尾部倒数
+func FlipBytes(tb testing.TB, file string, offset int64, n int) {
+	tb.Helper()
+	f, err := os.OpenFile(file, os.O_RDWR, 0644)
+	if err != nil {
+		tb.Fatalf("open %s: %v", file, err)
+	}
+	defer f.Close()
+
+	if offset < 0 {
+		stat, err := f.Stat()
+		if err != nil {
+			tb.Fatalf("stat %s: %v", file, err)
+		}
+		offset += stat.Size()
+	}
+	buf := make([]byte, n)
+	if _, err = f.ReadAt(buf, offset); err != nil {
+		tb.Fatalf("read %s: %v", file, err)
+	}
+	for i := range buf {
+		buf[i] = ^buf[i]
+	}
+	if _, err = f.WriteAt(buf, offset); err != nil {
+		tb.Fatalf("write %s: %v", file, err)
+	}
+}
+
+// TruncateTail 截掉文件尾部的 n 个 byte，模拟写入过程中宕机导致的残缺文件
+func TruncateTail(tb testing.TB, file string, n int64) {
+	tb.Helper()
+	stat, err := os.Stat(file)
+	if err != nil {
+		tb.Fatalf("stat %s: %v", file, err)
+	}
+	size := stat.Size() - n
+	if size < 0 {
+		size = 0
+	}
+	if err = os.Truncate(file, size); err != nil {
+		tb.Fatalf("truncate %s: %v", file, err)
+	}
+}
+
+func glob(tb testing.TB, pattern string) []string {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		tb.Fatalf("glob %s: %v", pattern, err)
+	}
+	sort.Strings(files)
+	return files
+}
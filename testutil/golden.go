@@ -0,0 +1,147 @@
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cccccxxy/lsmart"
+)
+
+// 执行测试时指定 -lsmart.update-golden 参数，重新生成 golden 文件
+var update = flag.Bool("lsmart.update-golden", false, "update lsmart golden files")
+
+// Contents 通过内部迭代器读取 lsm tree 中所有有效的 kv 对，被删除的 key 不包含在内
+func Contents(tb testing.TB, tree *lsmart.Tree) map[string]string {
+	tb.Helper()
+	it := tree.NewInternalIterator()
+	defer it.Close()
+
+	contents := make(map[string]string)
+	var prevKey []byte
+	for ; it.Valid(); it.Next() {
+		record := it.Record()
+		// 同一个 key 只取最新的一条记录
+		if prevKey != nil && bytes.Equal(prevKey, record.Key) {
+			continue
+		}
+		prevKey = record.Key
+		if record.Op == lsmart.OpPut {
+			contents[string(record.Key)] = string(record.Value)
+		}
+	}
+	if err := it.Err(); err != nil {
+		tb.Fatalf("iterate tree: %v", err)
+	}
+	return contents
+}
+
+// AssertContents 校验 lsm tree 中的数据与预期完全一致，同时通过内部迭代器和 Get 两条读路径进行校验
+func AssertContents(tb testing.TB, tree *lsmart.Tree, want map[string]string) {
+	tb.Helper()
+	if diff := Diff(want, Contents(tb, tree)); diff != "" {
+		tb.Fatalf("tree contents mismatch (-want +got):\n%s", diff)
+	}
+	for k, v := range want {
+		got, ok, err := tree.Get([]byte(k))
+		if err != nil || !ok || string(got) != v {
+			tb.Fatalf("get %q: want %q, got %q, exist: %v, err: %v", k, v, got, ok, err)
+		}
+	}
+}
+
+// AssertGolden 将 lsm tree 中的数据与 golden 文件进行比较. 指定 -lsmart.update-golden 参数时，以当前数据重写 golden 文件
+func AssertGolden(tb testing.TB, tree *lsmart.Tree, file string) {
+	tb.Helper()
+	got := Contents(tb, tree)
+	if *update {
+		if err := os.WriteFile(file, encodeGolden(got), 0644); err != nil {
+			tb.Fatalf("write golden %s: %v", file, err)
+		}
+		return
+	}
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		tb.Fatalf("read golden %s: %v", file, err)
+	}
+	want, err := decodeGolden(raw)
+	if err != nil {
+		tb.Fatalf("decode golden %s: %v", file, err)
+	}
+	if diff := Diff(want, got); diff != "" {
+		tb.Fatalf("golden %s mismatch (-want +got):\n%s", file, diff)
+	}
+}
+
+// Diff 比较两组 kv 对，返回按 key 排序的差异描述. 没有差异时返回空串
+func Diff(want, got map[string]string) string {
+	keys := make([]string, 0, len(want)+len(got))
+	for k := range want {
+		keys = append(keys, k)
+	}
+	for k := range got {
+		if _, ok := want[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var diff strings.Builder
+	for _, k := range keys {
+		w, inWant := want[k]
+		g, inGot := got[k]
+		if inWant && inGot && w == g {
+			continue
+		}
+		if inWant {
+			fmt.Fprintf(&diff, "- %q: %q\n", k, w)
+		}
+		if inGot {
+			fmt.Fprintf(&diff, "+ %q: %q\n", k, g)
+		}
+	}
+	return diff.String()
+}
+
+// golden 文件每行一个 kv 对，key 与 value 以十六进制编码，使用空格分隔，按照 key 排序
+func encodeGolden(kvs map[string]string) []byte {
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "%s %s\n", hex.EncodeToString([]byte(k)), hex.EncodeToString([]byte(kvs[k])))
+	}
+	return buf.Bytes()
+}
+
+func decodeGolden(raw []byte) (map[string]string, error) {
+	kvs := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid golden line: %q", scanner.Text())
+		}
+		k, err := hex.DecodeString(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		v, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		kvs[string(k)] = string(v)
+	}
+	return kvs, scanner.Err()
+}
@@ -0,0 +1,61 @@
+package testutil
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/cccccxxy/lsmart"
+)
+
+// NewTree 在临时目录下构造一棵 lsm tree，测试结束时等待后台任务完成并关闭. 返回 lsm tree 以及所在目录
+func NewTree(tb testing.TB, opts ...lsmart.ConfigOption) (*lsmart.Tree, string) {
+	tb.Helper()
+	dir := tb.TempDir()
+	return OpenTree(tb, dir, opts...), dir
+}
+
+// OpenTree 基于指定目录构造一棵 lsm tree，测试结束时等待后台任务完成并关闭
+func OpenTree(tb testing.TB, dir string, opts ...lsmart.ConfigOption) *lsmart.Tree {
+	tb.Helper()
+	conf, err := lsmart.NewConfig(dir, opts...)
+	if err != nil {
+		tb.Fatalf("new config: %v", err)
+	}
+	tree, err := lsmart.NewTree(conf)
+	if err != nil {
+		tb.Fatalf("new tree: %v", err)
+	}
+
+	tb.Cleanup(func() {
+		CloseTree(tree)
+		closedTrees.Delete(tree)
+	})
+	return tree
+}
+
+// ReopenTree 关闭 lsm tree 后基于相同目录重新构造，用于模拟重启
+func ReopenTree(tb testing.TB, tree *lsmart.Tree, dir string, opts ...lsmart.ConfigOption) *lsmart.Tree {
+	tb.Helper()
+	CloseTree(tree)
+	return OpenTree(tb, dir, opts...)
+}
+
+// 已经关闭的 lsm tree，避免重复关闭. OpenTree 构造的 lsm tree 在测试结束时移除，避免关闭的 lsm tree 常驻到整个测试进程结束
+var closedTrees sync.Map
+
+// CloseTree 等待后台溢写、compact 任务完成后关闭 lsm tree，避免后台协程在临时目录清理后继续访问文件. 重复调用时直接返回
+func CloseTree(tree *lsmart.Tree) {
+	if _, closed := closedTrees.LoadOrStore(tree, struct{}{}); closed {
+		return
+	}
+	_ = tree.WaitIdle()
+	tree.Close()
+}
+
+// Step 确定性地推进一步：将读写 memtable 溢写落盘，并等待由此触发的 compact 全部执行完毕. 溢写、compact 最终失败时返回错误
+func Step(tree *lsmart.Tree) error {
+	if err := tree.Flush(); err != nil {
+		return err
+	}
+	return tree.WaitIdle()
+}
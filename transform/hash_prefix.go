@@ -0,0 +1,41 @@
+package transform
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/spaolacci/murmur3"
+)
+
+// HashPrefix 哈希前缀变换器. 在用户 key 前追加 key 哈希值的前若干个 byte，将相邻的 key 打散到不同的 key 区间.
+// 变换后存储 key 的顺序与用户 key 的顺序无关，范围遍历的结果不再按照用户 key 有序
+type HashPrefix struct {
+	prefixLen int // 哈希前缀的长度，单位 byte
+}
+
+// NewHashPrefix 哈希前缀变换器构造器. prefixLen 取值范围为 1~4
+func NewHashPrefix(prefixLen int) (*HashPrefix, error) {
+	if prefixLen <= 0 || prefixLen > 4 {
+		return nil, errors.New("prefix len must be in range [1,4]")
+	}
+	return &HashPrefix{
+		prefixLen: prefixLen,
+	}, nil
+}
+
+// Encode 在用户 key 前追加哈希前缀
+func (h *HashPrefix) Encode(key []byte) []byte {
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], murmur3.Sum32(key))
+	encoded := make([]byte, 0, h.prefixLen+len(key))
+	encoded = append(encoded, prefix[:h.prefixLen]...)
+	return append(encoded, key...)
+}
+
+// Decode 去除哈希前缀，还原出用户 key
+func (h *HashPrefix) Decode(key []byte) ([]byte, error) {
+	if len(key) < h.prefixLen {
+		return nil, errors.New("key shorter than hash prefix")
+	}
+	return key[h.prefixLen:], nil
+}
@@ -0,0 +1,8 @@
+package transform
+
+// KeyTransformer key 变换器. 写入时将用户 key 变换为实际存储的 key，读取时再还原为用户 key，对使用方透明.
+// 用于对单调递增等分布集中的 key 做打散，避免顺序写入洪峰下的数据倾斜
+type KeyTransformer interface {
+	Encode(key []byte) []byte          // 将用户 key 变换为存储 key
+	Decode(key []byte) ([]byte, error) // 将存储 key 还原为用户 key
+}
@@ -2,8 +2,10 @@ package lsmart
 
 import (
 	"bytes"
+	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cccccxxy/lsmart/memtable"
 	"github.com/cccccxxy/lsmart/wal"
@@ -18,6 +20,12 @@ type Tree struct {
 	// 读写数据时使用的锁
 	dataLock sync.RWMutex
 
+	// 等待合并提交的写入请求，受 commitLock 保护
+	commitLock  sync.Mutex
+	commitQueue []*commitRequest
+	// 提交令牌，容量为 1. 写入方持有令牌才能作为 leader 加写锁提交队列，以 channel 实现，等待期间可以响应 ctx
+	commitSem chan struct{}
+
 	// 每层 node 节点使用的读写锁
 	levelLocks []sync.RWMutex
 
@@ -27,8 +35,24 @@ type Tree struct {
 	// 只读 memtable
 	rOnlyMemTable []*memTableCompactItem
 
-	// 预写日志写入口
+	// 只读 memtable 落盘时关闭并替换，用于唤醒因积压而等待的写入请求
+	memTableFlushed chan struct{}
+
+	// 预写日志写入口. 创建失败时为空，walErr 记录失败的原因
 	walWriter *wal.WALWriter
+	walErr    error
+
+	// 开启多路 wal 时除首路之外的各路写入口，首路即 walWriter. 与 walWriter 同时创建、同时关闭
+	walStreams []*wal.WALWriter
+
+	// 切换 memtable 时老 wal 刷盘失败的错误，由下一次 Sync 返回
+	walSyncErr error
+
+	// 预写日志的写入统计，跨越 memtable 切换以及分段累计
+	walMetrics wal.Metrics
+
+	// 启动时回放 wal 的结果
+	walRecovery WALRecoveryReport
 
 	// lsm树状数据结构
 	nodes [][]*Node
@@ -39,27 +63,107 @@ type Tree struct {
 	// 某层 sst 文件大小达到阈值时，通过该 chan 传递信号，进行溢写工作
 	levelCompactC chan int
 
+	// 手动触发全量 compact 时，通过该 chan 传递任务，执行完毕后通过任务中的 chan 返回结果
+	fullCompactC chan *fullCompactTask
+
+	// 导入外部 sstable 时通过该 chan 传递导入任务，由 compact 协程执行
+	ingestC chan *ingestTask
+
 	// lsm tree 停止时通过该 chan 传递信号
 	stopc chan struct{}
 
+	// compact 协程退出时关闭该 chan
+	compactDone chan struct{}
+
 	// memtable index，需要与 wal 文件一一对应
 	memTableIndex int
 
+	// 独立 wal 模式下，读写 memtable 当前写入的 wal 分段序号，以及此前已经写满的分段文件
+	walSegment  int
+	walSegments []string
+
+	// 共享 wal 模式下当前写入的分段序号，受 dataLock 保护. 已经写满、等待回收的分段受 sharedSegmentsLock 保护
+	sharedSegment      int
+	sharedSegmentsLock sync.Mutex
+	sharedSegments     []*sharedWALSegment
+
+	// 独立 wal 模式下等待复用的 wal 文件，以及回收池文件命名使用的 seq. 受 dataLock 保护
+	walRecycle    []string
+	walRecycleSeq int
+
+	// manifest 追加写入口. manifestLock 保证编辑记录的写入与节点的变更作为整体执行，改写快照时不会遗漏已经写入的编辑
+	manifest     *manifestWriter
+	manifestLock sync.Mutex
+
 	// 各层 sstable 文件 seq. sstable 文件命名为 level_seq.sst
 	levelToSeq []atomic.Int32
+
+	// 最近一笔写入记录分配的 seq，单调递增. 受 dataLock 保护
+	seq uint64
+
+	// 已触发但尚未执行完毕的 level 层 compact 个数
+	pendingCompactions atomic.Int32
+
+	// 后台溢写、compact 的 cpu 占用统计
+	startTime         time.Time     // lsm tree 的启动时间
+	compactionBusy    atomic.Int64  // 所有 worker 执行溢写、compact 的累计耗时，单位 ns
+	activeCompactions atomic.Int32  // 正在执行溢写、compact 的 worker 个数
+	putsWritten       atomic.Uint64 // 打开以来写入的记录个数，包含带过期时间的写入
+	deletesWritten    atomic.Uint64 // 打开以来写入的墓碑记录个数
+
+	// 溢写、compact 时清理过期记录的统计
+	expiredReclaimed      atomic.Uint64 // 打开以来清理的过期记录个数
+	expiredBytesReclaimed atomic.Uint64 // 打开以来清理过期记录释放的字节数
+
+	// 只读 memtable 积压导致的写入阻塞统计
+	writeStalls    atomic.Uint64 // 打开以来写入因积压而阻塞的次数
+	writeStallTime atomic.Int64  // 打开以来写入因积压而阻塞的累计耗时，单位 ns
+
+	// level 层 compact 的累计统计以及最近若干轮的明细
+	compactionMetrics compactionMetrics
+
+	// 启动时回放 wal 使用的限速器，记录回放进度
+	replay *wal.ReplayLimiter
+
+	// 按条件删除的规则，受 deleteRulesLock 保护
+	deleteRulesLock sync.RWMutex
+	deleteRules     []*deleteRule
+
+	// 变更订阅者，受 watchersLock 保护
+	watchersLock sync.RWMutex
+	watchers     []*Watcher
+
+	// 健康检查相关的错误记录，受 healthLock 保护
+	healthLock sync.Mutex
+	writeErr   error // 最近一次写入失败的错误
+	corruptErr error // 首次读取到损坏数据的错误
+
+	backgroundErrs    map[string]*BackgroundError // 各后台任务最近一次失败且尚未恢复的错误
+	lastBackgroundJob string                      // 最近一次失败的后台任务
+
+	// 后台任务有进展时关闭并替换，用于唤醒等待后台任务的 Flush、WaitIdle，受 progressLock 保护
+	progressLock sync.Mutex
+	progress     chan struct{}
 }
 
 // NewTree 构建出一棵 lsm tree
 func NewTree(conf *Config) (*Tree, error) {
 	// 1 构造 lsm tree 实例
 	t := Tree{
-		conf:          conf,
-		memCompactC:   make(chan *memTableCompactItem),
-		levelCompactC: make(chan int),
-		stopc:         make(chan struct{}),
-		levelToSeq:    make([]atomic.Int32, conf.MaxLevel),
-		nodes:         make([][]*Node, conf.MaxLevel),
-		levelLocks:    make([]sync.RWMutex, conf.MaxLevel),
+		conf:            conf,
+		memCompactC:     make(chan *memTableCompactItem),
+		levelCompactC:   make(chan int),
+		fullCompactC:    make(chan *fullCompactTask),
+		ingestC:         make(chan *ingestTask),
+		commitSem:       make(chan struct{}, 1),
+		stopc:           make(chan struct{}),
+		compactDone:     make(chan struct{}),
+		memTableFlushed: make(chan struct{}),
+		progress:        make(chan struct{}),
+		levelToSeq:      make([]atomic.Int32, conf.MaxLevel),
+		nodes:           make([][]*Node, conf.MaxLevel),
+		levelLocks:      make([]sync.RWMutex, conf.MaxLevel),
+		startTime:       time.Now(),
 	}
 
 	// 2 读取 sst 文件，还原出整棵树
@@ -67,20 +171,54 @@ func NewTree(conf *Config) (*Tree, error) {
 		return nil, err
 	}
 
-	// 3 运行 lsm tree 压缩调整协程
+	// 3 运行 lsm tree 压缩调整协程. 回放 wal 时由其溢写只读 memtable，因此需要先于回放启动，后续步骤失败时先停止协程再释放资源
 	go t.compact()
 
 	// 4 读取 wal 还原出 memtable
 	if err := t.constructMemtable(); err != nil {
+		t.abort()
 		return nil, err
 	}
 
-	// 5 返回 lsm tree 实例
+	// 5 还原出最近一笔写入记录的 seq
+	if err := t.restoreSeq(); err != nil {
+		t.abort()
+		return nil, err
+	}
+
+	// 6 返回 lsm tree 实例
 	return &t, nil
 }
 
+// Close 关闭 lsm tree. 关闭之前将读写 memtable 溢写落盘，并等待已触发的溢写、compact 执行完毕，
+// 避免留下尚未回收的预写日志以及写了一半的 sstable 文件. 调用方需要保证 Close 期间以及之后不再读写
 func (t *Tree) Close() {
+	// 1 溢写读写 memtable，等待后台任务执行完毕
+	t.drain()
+
+	// 2 通知 compact 协程退出，并等待其完成手头的任务
+	close(t.stopc)
+	<-t.compactDone
+
+	// 3 释放订阅者、预写日志、manifest 以及 sstable 文件句柄
+	t.closeWatchers()
+	t.closeFiles()
+}
+
+// 启动过程中 compact 协程已经运行之后出错时，停止 compact 协程并释放已经打开的文件. 回放期间已经溢写落盘的数据保留，下次启动时无需重新回放
+func (t *Tree) abort() {
 	close(t.stopc)
+	<-t.compactDone
+	t.closeFiles()
+}
+
+// 释放预写日志、manifest 以及 sstable 文件句柄
+func (t *Tree) closeFiles() {
+	if t.walWriter != nil {
+		t.walWriter.Close()
+	}
+	t.closeWALStreams()
+	t.closeManifest()
 	for i := 0; i < len(t.nodes); i++ {
 		for j := 0; j < len(t.nodes[i]); j++ {
 			t.nodes[i][j].Close()
@@ -90,55 +228,210 @@ func (t *Tree) Close() {
 
 // Put 写入一组 kv 对到 lsm tree. 会直接写入到读写 memtable 中.
 func (t *Tree) Put(key, value []byte) error {
-	// 1 加写锁
-	t.dataLock.Lock()
-	defer t.dataLock.Unlock()
+	return t.write(context.Background(), key, value, OpPut)
+}
+
+// PutContext 写入一组 kv 对到 lsm tree. 排队等待提交以及等待写锁期间 ctx 被取消或者超时时放弃写入并立即返回 ctx 的错误，
+// 返回 ctx 的错误时保证数据没有写入. 写入已被 leader 取出提交时不再响应 ctx，等待提交完成后返回写入结果
+func (t *Tree) PutContext(ctx context.Context, key, value []byte) error {
+	return t.write(ctx, key, value, OpPut)
+}
+
+// Delete 从 lsm tree 中删除一个 key. 会写入一条墓碑记录，屏蔽掉该 key 更老版本的数据.
+func (t *Tree) Delete(key []byte) error {
+	return t.write(context.Background(), key, nil, OpDelete)
+}
 
-	// 2 数据预写入预写日志中，防止因宕机引起 memtable 数据丢失.
-	if err := t.walWriter.Write(key, value); err != nil {
+// 将用户 key 变换为存储 key
+func (t *Tree) encodeKey(key []byte) []byte {
+	if t.conf.KeyTransformer == nil {
+		return key
+	}
+	return t.conf.KeyTransformer.Encode(key)
+}
+
+// 将存储 key 还原为用户 key
+func (t *Tree) decodeKey(key []byte) ([]byte, error) {
+	if t.conf.KeyTransformer == nil {
+		return key, nil
+	}
+	return t.conf.KeyTransformer.Decode(key)
+}
+
+// 写入一条内部记录到 lsm tree.
+func (t *Tree) write(ctx context.Context, key, value []byte, op OpType) error {
+	// 校验 key
+	if err := t.validateKey(key, op); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	// 3 数据写入读写跳表
-	t.memTable.Put(key, value)
+	// 1 与并发的写入方合并提交. 等待提交期间 ctx 失效时放弃写入
+	return t.commit(ctx, []*batchEntry{{op: op, key: t.encodeKey(key), value: value}}, nil)
+}
+
+// 在持有写锁的情况下写入一批内部记录. 整批记录作为一条 wal 记录写入，宕机重启后要么全部还原，要么全部丢弃
+func (t *Tree) writeLocked(entries []*batchEntry) error {
+	return t.writeGroupLocked([]*commitRequest{{entries: entries}})
+}
+
+// 在持有写锁的情况下写入多批内部记录. 每批记录各自作为一条 wal 记录，所有记录通过一次写操作写入预写日志.
+// 开启 SyncWrites 时整组共用一次 fsync，fsync 失败时数据已经写入 memtable，但是不保证宕机后能够恢复，同样返回错误.
+// 跳过预写日志的批次只写入 memtable
+func (t *Tree) writeGroupLocked(group []*commitRequest) error {
+	// 2 依次分配 seq，将数据编码为内部记录
+	var (
+		seq        = t.seq
+		records    = make([][]*memtable.KV, 0, len(group))
+		walRecords = make([][]*memtable.KV, 0, len(group))
+	)
+	for _, req := range group {
+		kvs := make([]*memtable.KV, 0, len(req.entries))
+		for _, entry := range req.entries {
+			seq++
+			kvs = append(kvs, &memtable.KV{
+				Key:   entry.key,
+				Value: entry.internalValue(seq),
+			})
+		}
+		records = append(records, kvs)
+		if !req.disableWAL {
+			walRecords = append(walRecords, kvs)
+		}
+	}
+
+	// 3 数据预写入预写日志中，防止因宕机引起 memtable 数据丢失.
+	// 预写日志此前创建失败时先重试创建，仍然失败则拒绝写入；开启 WALFallback 时降级为不写预写日志
+	if len(walRecords) > 0 && t.walWriter == nil && !t.conf.WALFallback {
+		if err := t.openWALLocked(); err != nil {
+			t.recordWriteErr(err)
+			return err
+		}
+	}
+	var syncErr error
+	if len(walRecords) > 0 && t.walWriter != nil {
+		if err := t.writeWALLocked(walRecords); err != nil {
+			t.recordWriteErr(err)
+			return err
+		}
+		if t.conf.SyncWrites {
+			syncErr = t.syncWALLocked()
+		}
+	}
+	t.recordWriteErr(syncErr)
+	t.seq = seq
+	for _, req := range group {
+		for _, entry := range req.entries {
+			if entry.op == OpDelete {
+				t.deletesWritten.Add(1)
+			} else {
+				t.putsWritten.Add(1)
+			}
+		}
+	}
 
-	// 4 倘若读写跳表的大小未达到 level0 层 sstable 的大小阈值，则直接返回.
+	// 4 数据写入读写跳表，并通知变更的订阅者
+	for _, kvs := range records {
+		for _, kv := range kvs {
+			t.memTable.Put(kv.Key, kv.Value)
+		}
+		t.notifyWatchers(kvs)
+	}
+
+	// 5 倘若读写跳表的大小未达到 level0 层 sstable 的大小阈值，则直接返回.
 	// 考虑到溢写成 sstable 后，需要有一些辅助的元数据，预估容量放大为 5/4 倍
 	if uint64(t.memTable.Size()*5/4) <= t.conf.SSTSize {
-		return nil
+		t.rollWALLocked()
+		return syncErr
 	}
 
-	// 5 倘若读写跳表数据量达到上限，则需要切换跳表
+	// 6 倘若读写跳表数据量达到上限，则需要切换跳表
 	t.refreshMemTableLocked()
-	return nil
+	return syncErr
 }
 
 // Get 根据 key 读取数据
 func (t *Tree) Get(key []byte) ([]byte, bool, error) {
+	return t.GetContext(context.Background(), key)
+}
+
+// GetContext 根据 key 读取数据. 每读取一个 sstable 之前检查 ctx，ctx 被取消或者超时时放弃读取并返回 ctx 的错误
+func (t *Tree) GetContext(ctx context.Context, key []byte) ([]byte, bool, error) {
+	internalValue, ok, err := t.getInternal(ctx, t.encodeKey(key), nil)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	return t.userValue(key, internalValue)
+}
+
+// 将 key 最新的一条内部记录解码为用户 value
+func (t *Tree) userValue(key, internalValue []byte) ([]byte, bool, error) {
+	// 墓碑记录说明 key 已被删除，已过期的记录同样视为不存在
+	op, seq, value, err := DecodeInternalValue(internalValue)
+	if err != nil {
+		t.recordCorruption(err)
+		return nil, false, err
+	}
+	if op == OpDelete || internalExpired(internalValue, time.Now().UnixNano()) {
+		return nil, false, nil
+	}
+
+	// 命中按条件删除的规则，同样视为已被删除
+	if t.deletedByRule(key, seq, value) {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+// 根据 key 读取最新的一条内部记录. 依次检索 memtable 以及各层 sstable，检索到即返回
+func (t *Tree) getInternal(ctx context.Context, key []byte, meta *GetMeta) ([]byte, bool, error) {
 	t.dataLock.RLock()
-	// 1 首先读 active memtable.
-	value, ok := t.memTable.Get(key)
+	value, ok := t.getMemTableLocked(key, meta)
+	t.dataLock.RUnlock()
 	if ok {
-		t.dataLock.RUnlock()
 		return value, true, nil
 	}
+	return t.getSSTable(ctx, key, meta)
+}
+
+// 在持有 dataLock 的情况下，从 memtable 中读取 key 最新的一条内部记录. meta 不为空时记录命中的 memtable
+func (t *Tree) getMemTableLocked(key []byte, meta *GetMeta) ([]byte, bool) {
+	// 1 首先读 active memtable.
+	if value, ok := t.memTable.Get(key); ok {
+		meta.servedBy(memTableSource, -1, "")
+		return value, true
+	}
 
 	// 2 读 readOnly memtable.  按照 index 倒序遍历，因为 index 越大，数据越晚写入，实时性越强
 	for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
-		value, ok = t.rOnlyMemTable[i].memTable.Get(key)
-		if ok {
-			t.dataLock.RUnlock()
-			return value, true, nil
+		if value, ok := t.rOnlyMemTable[i].memTable.Get(key); ok {
+			meta.servedBy(readOnlyMemTableSource, -1, "")
+			return value, true
 		}
 	}
-	t.dataLock.RUnlock()
+	return nil, false
+}
+
+// 从各层 sstable 中读取 key 最新的一条内部记录. 每读取一个 sstable 之前检查 ctx，meta 不为空时记录检索路径
+func (t *Tree) getSSTable(ctx context.Context, key []byte, meta *GetMeta) ([]byte, bool, error) {
+	var (
+		value []byte
+		ok    bool
+		err   error
+	)
 
 	// 3 读 sstable level0 层. 按照 index 倒序遍历，因为 index 越大，数据越晚写入，实时性越强
-	var err error
 	t.levelLocks[0].RLock()
 	for i := len(t.nodes[0]) - 1; i >= 0; i-- {
-		if value, ok, err = t.nodes[0][i].Get(key); err != nil {
+		if err = ctx.Err(); err != nil {
+			t.levelLocks[0].RUnlock()
+			return nil, false, err
+		}
+		if value, ok, err = meta.probe(t.nodes[0][i], key); err != nil {
 			t.levelLocks[0].RUnlock()
+			t.recordCorruption(err)
 			return nil, false, err
 		}
 		if ok {
@@ -150,14 +443,18 @@ func (t *Tree) Get(key []byte) ([]byte, bool, error) {
 
 	// 4 依次读 sstable level 1 ~ i 层，每层至多只需要和一个 sstable 交互. 因为这些 level 层中的 sstable 都是无重复数据且全局有序的
 	for level := 1; level < len(t.nodes); level++ {
+		if err = ctx.Err(); err != nil {
+			return nil, false, err
+		}
 		t.levelLocks[level].RLock()
 		node, ok := t.levelBinarySearch(level, key, 0, len(t.nodes[level])-1)
 		if !ok {
 			t.levelLocks[level].RUnlock()
 			continue
 		}
-		if value, ok, err = node.Get(key); err != nil {
+		if value, ok, err = meta.probe(node, key); err != nil {
 			t.levelLocks[level].RUnlock()
+			t.recordCorruption(err)
 			return nil, false, err
 		}
 		if ok {
@@ -176,19 +473,85 @@ func (t *Tree) refreshMemTableLocked() {
 	// 辞旧
 	// 将读写跳表切换为只读跳表，追加到 slice 中，并通过 chan 发送给 compact 协程，由其负责进行溢写成为 level0 层 sst 文件的操作.
 	oldItem := memTableCompactItem{
-		walFile:  t.walFile(),
-		memTable: t.memTable,
+		walFile:       t.memTableWALFile(),
+		walSegments:   append(append([]string(nil), t.walSegments...), t.walStreamFiles()...),
+		memTableIndex: t.memTableIndex,
+		memTable:      t.memTable,
 	}
 	t.rOnlyMemTable = append(t.rOnlyMemTable, &oldItem)
-	t.walWriter.Close()
 	go func() {
 		t.memCompactC <- &oldItem
 	}()
 
 	// 迎新
-	// 构造一个新的读写 memtable，并构造与之相应的 wal 文件.
+	// 构造一个新的读写 memtable. 共享 wal 模式下沿用同一个 wal 文件，只需切换记录所属的 memtable index
 	t.memTableIndex++
-	t.newMemTable()
+	if t.conf.SharedWAL && t.walWriter != nil {
+		t.walWriter.Retag(t.memTableIndex)
+		t.memTable = t.conf.MemTableConstructor()
+		t.writeWALCheckpointLocked()
+		return
+	}
+
+	// 否则构造与之相应的 wal 文件. 数据已经写入，wal 创建失败时不影响本次写入，由下一次写入重试创建并返回错误
+	if t.walWriter != nil {
+		// 关闭之前先将各路老 wal 刷盘，保证 Sync 建立的持久化点同样覆盖尚未溢写的只读 memtable
+		if err := t.syncWALLocked(); err != nil {
+			t.walSyncErr = err
+		}
+		t.walWriter.Close()
+	}
+	t.closeWALStreams()
+	if t.newMemTable() == nil {
+		t.writeWALCheckpointLocked()
+	}
+}
+
+// 在新的读写 memtable 的 wal 开头写入检查点，记录切换时已经分配的最大 seq. 不写 wal 的写入在宕机后丢失，
+// 重启时 seq 仍然不小于检查点，不会回退. 检查点写入失败不影响数据的正确性，写入错误由下一次写入返回
+func (t *Tree) writeWALCheckpointLocked() {
+	if t.walWriter != nil {
+		_ = t.walWriter.WriteCheckpoint(t.seq)
+	}
+}
+
+// 读写 memtable 对应的 wal 文件. 独立 wal 模式下 wal 创建失败时，memtable 没有对应的 wal 文件，返回空.
+// 共享 wal 模式下 memtable 的记录可能跨越多个分段，统一以 sharedWALFile 标识
+func (t *Tree) memTableWALFile() string {
+	if t.conf.SharedWAL {
+		return t.sharedWALFile()
+	}
+	if t.walWriter == nil {
+		return ""
+	}
+	return t.walFile()
+}
+
+// 独立 wal 模式下，当前 wal 分段写满时切换到新的分段继续写入. 分段仍归属于读写 memtable，溢写落盘后一同回收
+func (t *Tree) rollWALLocked() {
+	if t.conf.SharedWAL {
+		t.rollSharedWALLocked()
+		return
+	}
+	if t.conf.WALSegmentSize <= 0 || t.walWriter == nil || t.walWriter.Size() < t.conf.WALSegmentSize {
+		return
+	}
+
+	// 切换之前先将写满的分段刷盘，保证 Sync 建立的持久化点覆盖此前所有的分段.
+	// 刷盘或者新分段创建失败时继续写入当前分段，下次写入时重试
+	if err := t.walWriter.Sync(); err != nil {
+		return
+	}
+	file := t.walFile()
+	t.walSegment++
+	walWriter, err := t.createWAL(t.walFile())
+	if err != nil {
+		t.walSegment--
+		return
+	}
+	t.walWriter.Close()
+	t.walWriter = walWriter
+	t.walSegments = append(t.walSegments, file)
 }
 
 func (t *Tree) levelBinarySearch(level int, key []byte, start, end int) (*Node, bool) {
@@ -197,18 +560,64 @@ func (t *Tree) levelBinarySearch(level int, key []byte, start, end int) (*Node,
 	}
 
 	mid := start + (end-start)>>1
-	if bytes.Compare(t.nodes[level][start].endKey, key) < 0 {
+	if bytes.Compare(t.nodes[level][mid].endKey, key) < 0 {
 		return t.levelBinarySearch(level, key, mid+1, end)
 	}
 
-	if bytes.Compare(t.nodes[level][start].startKey, key) > 0 {
-		return t.levelBinarySearch(level, key, start, mid-1)
+	// startKey 取自首个索引的分隔键，可能小于 sstable 中真实的最小 key，与前一个节点的 endKey 相同.
+	// 因此 key 可能落在的节点是 endKey 不小于 key 的第一个节点，需要继续向左查找
+	if node, ok := t.levelBinarySearch(level, key, start, mid-1); ok {
+		return node, true
+	}
+
+	if bytes.Compare(t.nodes[level][mid].startKey, key) > 0 {
+		return nil, false
 	}
 
 	return t.nodes[level][mid], true
 }
 
-func (t *Tree) newMemTable() {
-	t.walWriter, _ = wal.NewWALWriter(t.walFile())
+// 构造新的读写 memtable 以及与之对应的 wal 文件. wal 创建失败时返回错误，开启 WALFallback 时降级为不写 wal，返回空
+func (t *Tree) newMemTable() error {
+	t.walSegment, t.walSegments = 0, nil
 	t.memTable = t.conf.MemTableConstructor()
+	if err := t.openWALLocked(); err != nil && !t.conf.WALFallback {
+		return err
+	}
+	return nil
+}
+
+// 为读写 memtable 创建 wal 写入口. 创建失败时 walWriter 置空，并记录失败的原因
+func (t *Tree) openWALLocked() error {
+	var walWriter *wal.WALWriter
+	if t.conf.SharedWAL {
+		if walWriter, t.walErr = wal.NewSharedWALWriter(t.walFile(), t.memTableIndex); t.walErr == nil {
+			if t.walErr = t.syncWALDir(); t.walErr != nil {
+				walWriter.Close()
+				walWriter = nil
+			} else {
+				t.setupWAL(walWriter)
+			}
+		}
+	} else {
+		walWriter, t.walErr = t.createWAL(t.walFile())
+		// 开启多路 wal 时各路一并创建，任意一路失败均视为 wal 创建失败
+		if t.walErr == nil && t.conf.WALStreams > 1 {
+			if t.walErr = t.openWALStreamsLocked(); t.walErr != nil {
+				walWriter.Close()
+				walWriter = nil
+			}
+		}
+	}
+	t.walWriter = walWriter
+	return t.walErr
+}
+
+// 为新打开的 wal 写入口设置写入统计、写入缓冲区以及墓碑记录的判断方式
+func (t *Tree) setupWAL(walWriter *wal.WALWriter) {
+	walWriter.SetMetrics(&t.walMetrics)
+	walWriter.SetBufferSize(t.conf.WALBufferSize)
+	walWriter.SetTombstoneFunc(func(value []byte) bool {
+		return len(value) > 0 && OpType(value[0]) == OpDelete
+	})
 }
@@ -0,0 +1,76 @@
+package lsmart
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/cccccxxy/lsmart/memtable"
+)
+
+// ApproximateSize 估算 [start, end) 范围内数据占用的空间，单位 byte，start、end 为空时表示不设边界. 用于规划分片的拆分.
+// sstable 部分借助常驻内存的索引，累加与范围存在重叠的数据块在磁盘上的大小，不读取任何数据块；
+// memtable 部分累加范围内 kv 记录的大小. 同一个 key 的多个版本、墓碑记录均会计入.
+// 范围边界两端的数据块只有部分数据位于范围内，因此结果会偏大. 配置了 key 变换器时，范围针对的是变换后的存储 key
+func (t *Tree) ApproximateSize(start, end []byte) uint64 {
+	var size uint64
+
+	// 1 memtable 中范围内 kv 记录的大小
+	t.dataLock.RLock()
+	size += memTableRangeSize(t.memTable, start, end)
+	for _, item := range t.rOnlyMemTable {
+		size += memTableRangeSize(item.memTable, start, end)
+	}
+	t.dataLock.RUnlock()
+
+	// 2 各层 sstable 中与范围存在重叠的数据块大小
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			if len(start) > 0 && bytes.Compare(node.End(), start) < 0 {
+				continue
+			}
+			if len(end) > 0 && bytes.Compare(node.Start(), end) >= 0 {
+				continue
+			}
+			size += node.rangeSize(start, end)
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return size
+}
+
+// memtable 中 [start, end) 范围内 kv 记录的大小
+func memTableRangeSize(memTable memtable.MemTable, start, end []byte) uint64 {
+	kvs := memTable.All()
+	i := sort.Search(len(kvs), func(i int) bool { return bytes.Compare(kvs[i].Key, start) >= 0 })
+
+	var size uint64
+	for ; i < len(kvs); i++ {
+		if len(end) > 0 && bytes.Compare(kvs[i].Key, end) >= 0 {
+			break
+		}
+		size += uint64(len(kvs[i].Key) + len(kvs[i].Value))
+	}
+	return size
+}
+
+// 节点中与 [start, end) 范围存在重叠的数据块的大小.
+// 第 i 个索引对应第 i - 1 个数据块，数据块的 key 范围为 (index[i-1].Key, index[i].Key]. 读取索引分区失败时返回 0
+func (n *Node) rangeSize(start, end []byte) uint64 {
+	index, err := n.blockIndex()
+	if err != nil {
+		return 0
+	}
+
+	var size uint64
+	for i := 1; i < len(index); i++ {
+		if len(start) > 0 && bytes.Compare(index[i].Key, start) < 0 {
+			continue
+		}
+		if len(end) > 0 && bytes.Compare(index[i-1].Key, end) >= 0 {
+			break
+		}
+		size += index[i].PrevBlockSize
+	}
+	return size
+}
@@ -0,0 +1,215 @@
+package lsmart
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// BackupProgress 备份任务的进度
+type BackupProgress struct {
+	Files     int           // 需要备份的 sstable 文件个数
+	FilesDone int           // 已经备份的文件个数
+	Bytes     uint64        // 需要备份的总字节数
+	BytesDone uint64        // 已经备份的字节数
+	Elapsed   time.Duration // 已经执行的时间
+	ETA       time.Duration // 按照当前速度预估的剩余时间，尚无法估算时为 0
+	Done      bool          // 是否执行完毕
+}
+
+// BackupJob 一个正在执行的热备份任务
+type BackupJob struct {
+	dir   string
+	start time.Time
+
+	files     int
+	filesDone atomic.Int32
+	bytes     uint64
+	bytesDone atomic.Uint64
+
+	done chan struct{}
+	err  error
+}
+
+// 备份时固定下来的一个 sstable 节点
+type backupNode struct {
+	node  *Node
+	file  string
+	level int
+	seq   int32
+	size  uint64
+}
+
+// Backup 在写入持续进行的同时，将 lsm tree 某一时刻的一致性快照备份到 dir 目录下，dir 需要不存在或者为空目录.
+// 快照时刻的 memtable 数据被写成 level0 层的一个 sstable，已落盘的 sstable 通过硬链接备份，跨设备时退化为拷贝.
+// 快照涉及的 sstable 在备份完成之前不会被 compact 删除，每个文件建立链接之后立即释放. 备份目录可以直接通过 NewTree 打开
+func (t *Tree) Backup(dir string) (*BackupJob, error) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("backup dir %s is not empty", dir)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	// 1 在持有读锁的情况下固定 memtable 快照以及各层节点，期间写入被短暂阻塞
+	memKVs, nodes, memSeq := t.backupSnapshot()
+
+	job := BackupJob{
+		dir:   dir,
+		start: time.Now(),
+		files: len(nodes),
+		done:  make(chan struct{}),
+	}
+	for _, node := range nodes {
+		job.bytes += node.size
+	}
+
+	// 2 后台将快照写入备份目录
+	go func() {
+		defer close(job.done)
+		job.err = t.runBackup(&job, memKVs, memSeq, nodes)
+	}()
+	return &job, nil
+}
+
+// Wait 阻塞等待备份完成，返回备份过程中遇到的错误
+func (j *BackupJob) Wait() error {
+	<-j.done
+	return j.err
+}
+
+// Progress 备份任务的进度
+func (j *BackupJob) Progress() *BackupProgress {
+	progress := BackupProgress{
+		Files:     j.files,
+		FilesDone: int(j.filesDone.Load()),
+		Bytes:     j.bytes,
+		BytesDone: j.bytesDone.Load(),
+		Elapsed:   time.Since(j.start),
+	}
+	select {
+	case <-j.done:
+		progress.Done = true
+	default:
+	}
+	if !progress.Done && progress.BytesDone > 0 {
+		rate := float64(progress.BytesDone) / float64(progress.Elapsed)
+		progress.ETA = time.Duration(float64(progress.Bytes-progress.BytesDone) / rate)
+	}
+	return &progress
+}
+
+// 固定备份时刻的快照：由老到新合并所有 memtable 的数据，并登记为各层节点的读者，阻止其在备份完成之前被删除.
+// 同时返回 memtable 快照对应的 level0 层 sstable seq，需要大于所有已有 level0 层 sstable 的 seq
+func (t *Tree) backupSnapshot() ([]*KV, []*backupNode, int32) {
+	t.dataLock.RLock()
+	defer t.dataLock.RUnlock()
+
+	// 1 读写 memtable 的数据最新，放在最前面. 多路归并后同一个 key 只保留最新的记录，墓碑记录同样需要保留
+	iters := []recordIterator{newMemTableIterator(t.memTable)}
+	for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
+		iters = append(iters, newMemTableIterator(t.rOnlyMemTable[i].memTable))
+	}
+	iter := newMergeIterator(iters)
+	var memKVs []*KV
+	for ; iter.Valid(); iter.Next() {
+		if len(memKVs) > 0 && bytes.Equal(memKVs[len(memKVs)-1].Key, iter.Key()) {
+			continue
+		}
+		memKVs = append(memKVs, &KV{Key: iter.Key(), Value: iter.Value()})
+	}
+	iter.Close()
+
+	// 2 固定各层节点
+	var nodes []*backupNode
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			node.readers.Add(1)
+			nodes = append(nodes, &backupNode{node: node, file: node.file, level: node.level, seq: node.seq, size: node.size})
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return memKVs, nodes, t.levelToSeq[0].Load() + 1
+}
+
+// 执行备份：写入 memtable 快照，并逐个链接或者拷贝 sstable. 无论成功与否，所有节点都会被释放
+func (t *Tree) runBackup(job *BackupJob, memKVs []*KV, memSeq int32, nodes []*backupNode) error {
+	defer func() {
+		for _, node := range nodes {
+			if node.node != nil {
+				node.node.readers.Done()
+			}
+		}
+	}()
+
+	// 1 将 memtable 快照写为备份目录下 level0 层的 sstable
+	var m Manifest
+	if len(memKVs) > 0 {
+		conf := *t.conf
+		conf.Dir = job.dir
+		sstWriter, err := NewSSTWriter(t.sstFile(0, memSeq), &conf)
+		if err != nil {
+			return err
+		}
+		sstWriter.SetOrigin(SSTOriginBackup, nil)
+		for _, kv := range memKVs {
+			if err = sstWriter.Append(kv.Key, kv.Value); err != nil {
+				sstWriter.Close()
+				return err
+			}
+		}
+		size, _, _, err := sstWriter.Finish()
+		sstWriter.Close()
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, &ManifestFile{Level: 0, Seq: memSeq, Size: size})
+	}
+
+	// 2 逐个链接 sstable，完成后立即释放节点，使得被 compact 淘汰的文件能够及时删除
+	for _, node := range nodes {
+		if err := linkOrCopy(path.Join(t.conf.Dir, node.file), path.Join(job.dir, node.file)); err != nil {
+			return err
+		}
+		node.node.readers.Done()
+		node.node = nil
+		job.filesDone.Add(1)
+		job.bytesDone.Add(node.size)
+		m.Files = append(m.Files, &ManifestFile{Level: node.level, Seq: node.seq, Size: node.size})
+	}
+
+	// 3 最后写入 manifest，备份目录打开时只加载其中记录的文件
+	sortManifestFiles(m.Files)
+	return WriteManifest(path.Join(job.dir, manifestFileName), &m)
+}
+
+// 优先通过硬链接备份文件，跨设备等无法建立硬链接的情况下拷贝文件
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,66 @@
+package lsmart
+
+import (
+	"github.com/cccccxxy/lsmart/cache"
+)
+
+// BlockTypeStats 数据块缓存中某一类型块的统计信息
+type BlockTypeStats struct {
+	Type cache.BlockType
+	cache.TypeStats
+	HitRate float64 // 命中率，没有访问时为 0
+	Pinned  uint64  // 常驻内存、不经过缓存的数据量，单位 byte. 索引与过滤器在节点加载时常驻内存
+}
+
+// BlockCacheStats 数据块缓存的统计信息
+type BlockCacheStats struct {
+	Capacity int                // 缓存容量，单位 byte
+	Size     int                // 已缓存的数据量，单位 byte
+	Types    []*BlockTypeStats  // 按照块类型拆分的统计信息
+	HotFiles []*cache.FileStats // 命中次数最多的 sstable 文件
+}
+
+// BlockCacheStats 获取数据块缓存的统计信息，按照块类型拆分命中、未命中以及淘汰次数，
+// 并返回命中次数最多的 topN 个 sstable 文件，用于调整缓存容量以及常驻策略. topN 小于等于 0 时返回全部文件
+func (t *Tree) BlockCacheStats(topN int) (*BlockCacheStats, error) {
+	blockCache := t.conf.blockCache
+	if blockCache == nil {
+		return nil, ErrBlockCacheDisabled
+	}
+
+	stats := BlockCacheStats{
+		Capacity: blockCache.Capacity(),
+		Size:     blockCache.Size(),
+	}
+	for _, blockType := range cache.BlockTypes {
+		typeStats := BlockTypeStats{Type: blockType, TypeStats: blockCache.TypeStats(blockType)}
+		if total := typeStats.Hits + typeStats.Misses; total > 0 {
+			typeStats.HitRate = float64(typeStats.Hits) / float64(total)
+		}
+		stats.Types = append(stats.Types, &typeStats)
+	}
+
+	indexSize, filterSize := t.pinnedSize()
+	stats.Types[cache.BlockIndex].Pinned = indexSize
+	stats.Types[cache.BlockFilter].Pinned = filterSize
+
+	for _, file := range blockCache.HotFiles(topN) {
+		file := file
+		stats.HotFiles = append(stats.HotFiles, &file)
+	}
+	return &stats, nil
+}
+
+// 常驻内存的索引与过滤器数据量，单位 byte. 延迟加载时只统计已经加载的部分
+func (t *Tree) pinnedSize() (indexSize, filterSize uint64) {
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			nodeIndexSize, nodeFilterSize := node.pinnedSize()
+			indexSize += nodeIndexSize
+			filterSize += nodeFilterSize
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return
+}
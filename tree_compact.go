@@ -6,77 +6,212 @@ import (
 	"math"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cccccxxy/lsmart/memtable"
 )
 
 type memTableCompactItem struct {
-	walFile  string
-	memTable memtable.MemTable
+	walFile       string
+	walSegments   []string // 独立 wal 模式下 memtable 的其余 wal 文件：在 walFile 之前已经写满的分段，以及多路 wal 中的其余各路
+	memTableIndex int
+	memTable      memtable.MemTable
+}
+
+// level 层归并产出的一个 sst 文件
+type compactOutput struct {
+	seq           int32
+	size          uint64
+	entries       int
+	blockToFilter map[uint64][]byte
+	index         []*Index
+	sstReader     *SSTReader
 }
 
 // 运行 compact 协程.
 func (t *Tree) compact() {
+	defer close(t.compactDone)
+	scheduler := newCompactScheduler(t)
+	var ttlTick <-chan time.Time
+	if t.conf.TTLCompactionInterval > 0 {
+		ticker := time.NewTicker(t.conf.TTLCompactionInterval)
+		defer ticker.Stop()
+		ttlTick = ticker.C
+	}
 	for {
 		select {
-		// 接收到 lsm tree 终止信号，退出协程.
+		// 接收到 lsm tree 终止信号，等待正在执行的 compact 完成后退出协程.
 		case <-t.stopc:
-			// log
+			scheduler.wait()
 			return
 			// 接收到 read-only memtable，需要将其溢写到磁盘成为 level0 层 sstable 文件.
-		case memCompactItem := <-t.memCompactC:
-			t.compactMemTable(memCompactItem)
-			// 接收到 level 层 compact 指令，需要执行 level~level+1 之间的 level sorted merge 流程.
+		case <-t.memCompactC:
+			t.compactMemTable()
+			// 接收到 level 层 compact 指令，交由调度器执行 level~level+1 之间的 level sorted merge 流程.
 		case level := <-t.levelCompactC:
-			t.compactLevel(level)
+			scheduler.schedule(level)
+		case level := <-scheduler.done:
+			scheduler.finish(level)
+			// 接收到手动全量 compact 指令，等待正在执行的 compact 完成后，将所有数据归并到最底层.
+		case task := <-t.fullCompactC:
+			scheduler.wait()
+			task.done <- t.compactAllLevels(task.rules)
+			t.finishPendingCompaction()
+			scheduler.dispatch()
+			// 接收到导入外部 sstable 的任务，等待正在执行的 compact 完成后，注册为最深一层的节点.
+		case task := <-t.ingestC:
+			scheduler.wait()
+			task.done <- t.ingestFiles(task.files)
+			scheduler.dispatch()
+			// 定期检查过期记录，等待正在执行的 compact 完成后，将存在过期记录的 sstable 下沉一层.
+		case <-ttlTick:
+			scheduler.wait()
+			t.compactExpired()
+			scheduler.dispatch()
 		}
 	}
 }
 
 // 针对 level 层进行排序归并操作
 func (t *Tree) compactLevel(level int) {
-	// 获取到 level 和 level + 1 层内需要进行本次归并的节点
+	// 同一层可能被重复触发 compact，此前的 compact 完成后该层大小可能已回落到阈值之内，直接忽略
+	if !t.levelNeedsCompact(level) {
+		return
+	}
+
+	// 获取到 level 和 level + 1 层内需要进行本次归并的节点. 并发的溢写可能同时向 level0 层追加节点，挑选期间持有读锁
+	t.levelLocks[level].RLock()
+	t.levelLocks[level+1].RLock()
 	pickedNodes := t.pickCompactNodes(level)
+	t.levelLocks[level+1].RUnlock()
+	t.levelLocks[level].RUnlock()
+	// 失败时保留老节点，稍后重新触发本层的 compact
+	if err := t.compactNodes(level, pickedNodes); err != nil {
+		t.retryBackgroundLater(func() {
+			t.tryTriggerCompact(level)
+		})
+		return
+	}
 
-	// 插入到 level + 1 层对应的目标 sstWriter
-	seq := t.levelToSeq[level+1].Load() + 1
-	sstWriter, _ := NewSSTWriter(t.sstFile(level+1, seq), t.conf)
-	defer sstWriter.Close()
+	// 尝试触发下一层的 compact 操作
+	t.tryTriggerCompact(level + 1)
+}
 
-	// 获取 level + 1 层每个 sst 文件的大小阈值
-	sstLimit := t.conf.SSTSize * uint64(math.Pow10(level+1))
-	// 获取本次排序归并的节点涉及到的所有 kv 数据
-	pickedKVs := t.pickedNodesToKVs(pickedNodes)
-	// 遍历每笔需要归并的 kv 数据
-	for i := 0; i < len(pickedKVs); i++ {
-		// 倘若新生成的 level + 1 层 sst 文件大小已经超限
-		if sstWriter.Size() > sstLimit {
-			// 将 sst 文件溢写落盘
-			size, blockToFilter, index := sstWriter.Finish()
-			// 将 sst 文件对应 node 插入到 lsm tree 内存结构中
-			t.insertNode(level+1, seq, size, blockToFilter, index)
-			// 构造一个新的 level + 1 层 sstWriter
-			seq = t.levelToSeq[level+1].Load() + 1
-			sstWriter, _ = NewSSTWriter(t.sstFile(level+1, seq), t.conf)
-			defer sstWriter.Close()
+// 将 level 和 level + 1 层中挑选出的节点归并写入 level + 1 层. 最深一层的节点归并之后写回本层. 失败时保留老节点，并返回错误
+func (t *Tree) compactNodes(level int, pickedNodes []*Node) error {
+	outLevel := t.outputLevel(level)
+	stats := newCompactionStats(level, outLevel, pickedNodes)
+
+	// 所有 sst 文件落盘完成后再统一插入，因此需要自行推进 seq. 第 i 份数据写入 seq 为 baseSeq + i 的 sst 文件
+	baseSeq := t.levelToSeq[outLevel].Load() + 1
+	inputs := make([]string, 0, len(pickedNodes))
+	for _, node := range pickedNodes {
+		inputs = append(inputs, node.file)
+	}
+
+	// 流式归并各节点的数据，按照 sst 文件大小阈值切分，每攒满一份即交由 worker 写入一个 sst 文件
+	jobs, reclaim, err := t.streamCompactNodes(outLevel, baseSeq, pickedNodes, inputs)
+
+	// 归并读取失败或者任意一个 sst 文件写入失败时放弃本轮归并，保留老节点
+	if err != nil {
+		for _, job := range jobs {
+			if job.output != nil {
+				job.output.sstReader.Close()
+			}
+			t.discardSST(t.sstFile(outLevel, job.seq))
 		}
+		t.recordCorruption(err)
+		return err
+	}
+	outputs := make([]*compactOutput, 0, len(jobs))
+	for _, job := range jobs {
+		outputs = append(outputs, job.output)
+	}
 
-		// 将 kv 数据追加到 sstWriter
-		sstWriter.Append(pickedKVs[i].Key, pickedKVs[i].Value)
-		// 倘若这是最后一笔 kv 数据，需要负责把 sstWriter 溢写落盘并把对应 node 插入到 lsm tree 内存结构中
-		if i == len(pickedKVs)-1 {
-			size, blockToFilter, index := sstWriter.Finish()
-			t.insertNode(level+1, seq, size, blockToFilter, index)
+	// 开启校验时，所有产出的 sst 文件校验无误后才注册节点. 否则放弃本轮归并，保留老节点
+	if t.conf.VerifySST {
+		for _, output := range outputs {
+			if err := t.verifySST(t.sstFile(outLevel, output.seq), output.entries); err != nil {
+				for _, output := range outputs {
+					output.sstReader.Close()
+					t.discardSST(t.sstFile(outLevel, output.seq))
+				}
+				t.handleBackgroundErr(backgroundJobCompaction, err)
+				t.recordCorruption(err)
+				return err
+			}
+		}
+	}
+
+	// 新增与移除的文件作为一条编辑记录写入 manifest，写入失败时放弃本轮归并，保留老节点
+	edit := manifestEdit{}
+	for _, output := range outputs {
+		edit.added = append(edit.added, &ManifestFile{Level: outLevel, Seq: output.seq, Size: output.size})
+	}
+	for _, node := range pickedNodes {
+		edit.deleted = append(edit.deleted, &ManifestFile{Level: node.level, Seq: node.seq})
+	}
+	t.manifestLock.Lock()
+	defer t.manifestLock.Unlock()
+	if err := t.logManifest(&edit); err != nil {
+		for _, output := range outputs {
+			output.sstReader.Close()
+			t.discardSST(t.sstFile(outLevel, output.seq))
 		}
+		t.handleBackgroundErr(backgroundJobCompaction, err)
+		return err
 	}
 
-	// 移除这部分被合并的节点
-	t.removeNodes(level, pickedNodes)
+	// 以新节点替换这部分被合并的老节点
+	newNodes := make([]*Node, 0, len(outputs))
+	for _, output := range outputs {
+		newNodes = append(newNodes, NewNode(t.conf, t.sstFile(outLevel, output.seq), output.sstReader, outLevel, output.seq, output.size, output.blockToFilter, output.index))
+	}
+	t.replaceNodes(level, pickedNodes, newNodes)
+	t.recordExpiredReclaim(reclaim)
+	stats.finish(outputs)
+	t.compactionMetrics.record(stats)
+	t.clearBackgroundErr(backgroundJobCompaction)
+	return nil
+}
 
-	// 尝试触发下一层的 compact 操作
-	t.tryTriggerCompact(level + 1)
+// compact 时改写一条记录的 value：在 now 时刻已过期的记录以及命中按条件删除规则的记录改写为墓碑记录，之后交由用户配置的过滤函数处理
+func (t *Tree) compactValue(key, internalValue []byte, now int64) []byte {
+	return t.applyCompactionFilter(key, t.applyDeleteRules(key, dropExpired(internalValue, now)))
+}
+
+// 将一份归并后的有序数据写入 level 层 seq 对应的 sst 文件，inputs 为参与归并的 sst 文件
+func (t *Tree) writeCompactOutput(level int, seq int32, kvs []*KV, inputs []string) (*compactOutput, error) {
+	defer t.compactionWork()()
+
+	sstWriter, err := NewSSTWriter(t.sstFile(level, seq), t.conf)
+	if err != nil {
+		return nil, err
+	}
+	defer sstWriter.Close()
+	if f := t.levelFilter(level); f != nil {
+		sstWriter.SetFilter(f)
+	}
+	sstWriter.SetOrigin(SSTOriginCompaction, inputs)
+
+	for _, kv := range kvs {
+		if err = sstWriter.Append(kv.Key, kv.Value); err != nil {
+			return nil, err
+		}
+	}
+	size, blockToFilter, index, err := sstWriter.Finish()
+	if err != nil {
+		return nil, err
+	}
+	// 注册节点之前打开 reader，打开失败时与写入失败一样放弃该文件
+	sstReader, err := NewSSTReader(t.sstFile(level, seq), t.conf)
+	if err != nil {
+		return nil, err
+	}
+	return &compactOutput{seq: seq, size: size, entries: len(kvs), blockToFilter: blockToFilter, index: index, sstReader: sstReader}, nil
 }
 
 // 获取本轮 compact 流程涉及到的所有节点，范围涵盖 level 和 level+1 层
@@ -93,10 +228,42 @@ func (t *Tree) pickCompactNodes(level int) []*Node {
 	if bytes.Compare(t.nodes[level][mid].End(), endKey) > 0 {
 		endKey = t.nodes[level][mid].End()
 	}
+	return t.pickNodesInRange(level, startKey, endKey)
+}
+
+// level 层归并结果写入的层. 最深一层没有下一层，归并结果写回本层
+func (t *Tree) outputLevel(level int) int {
+	if level == len(t.nodes)-1 {
+		return level
+	}
+	return level + 1
+}
+
+// 获取 level 和 level+1 层中与 [startKey, endKey] 范围存在重叠的所有节点. level+1 层的节点在前，level 层的节点在后.
+// level 为最深一层时只挑选本层的节点
+func (t *Tree) pickNodesInRange(level int, startKey, endKey []byte) []*Node {
+	// 扩大归并范围直至覆盖两层中所有与之重叠的节点. level0 层的节点之间相互重叠，只挑选其中较新的节点时，
+	// 留在 level0 层的老版本数据会遮蔽下沉到 level1 层的新版本. level + 1 层中存在范围重叠的节点时，也使其在本轮归并中得到修复
+	for expanded := true; expanded; {
+		expanded = false
+		for i := t.outputLevel(level); i >= level; i-- {
+			for _, node := range t.nodes[i] {
+				if bytes.Compare(endKey, node.Start()) < 0 || bytes.Compare(startKey, node.End()) > 0 {
+					continue
+				}
+				if bytes.Compare(node.Start(), startKey) < 0 {
+					startKey, expanded = node.Start(), true
+				}
+				if bytes.Compare(node.End(), endKey) > 0 {
+					endKey, expanded = node.End(), true
+				}
+			}
+		}
+	}
 
 	var pickedNodes []*Node
 	// 将 level 层和 level + 1 层 和 [start,end] 范围有重叠的节点进行合并
-	for i := level + 1; i >= level; i-- {
+	for i := t.outputLevel(level); i >= level; i-- {
 		for j := 0; j < len(t.nodes[i]); j++ {
 			if bytes.Compare(endKey, t.nodes[i][j].Start()) < 0 || bytes.Compare(startKey, t.nodes[i][j].End()) > 0 {
 				continue
@@ -110,49 +277,32 @@ func (t *Tree) pickCompactNodes(level int) []*Node {
 	return pickedNodes
 }
 
-// 获取本轮 compact 流程涉及到的所有 kv 对. 这个过程中可能存在重复 k，保证只保留最新的 v
-func (t *Tree) pickedNodesToKVs(pickedNodes []*Node) []*KV {
-	// index 越小，数据越老. index 越大，数据越新
-	// 所以使用大 index 的数据覆盖小 index 数据，以久覆新
-	memtable := t.conf.MemTableConstructor()
-	for _, node := range pickedNodes {
-		kvs, _ := node.GetAll()
-		for _, kv := range kvs {
-			memtable.Put(kv.Key, kv.Value)
-		}
+// 以 compact 产出的新节点替换所有完成 compact 流程的老节点. 按照 level 从小到大的顺序同时持有涉及的各层写锁，一次性完成插入与移除，
+// 避免读请求观察到新老节点并存的中间状态：此时 level1 ~ levelk 层的节点范围存在重叠，只检索一个节点的 Get 可能读不到数据
+func (t *Tree) replaceNodes(level int, nodes, newNodes []*Node) {
+	outLevel := t.outputLevel(level)
+	for _, node := range newNodes {
+		t.prepareNode(node)
 	}
 
-	// 借助 memtable 实现有序排列
-	_kvs := memtable.All()
-	kvs := make([]*KV, 0, len(_kvs))
-	for _, kv := range _kvs {
-		kvs = append(kvs, &KV{
-			Key:   kv.Key,
-			Value: kv.Value,
-		})
+	// 并发的溢写可能同时向 level0 层追加节点，查找与移除均需持有写锁
+	for i := level; i <= outLevel; i++ {
+		t.levelLocks[i].Lock()
 	}
-
-	return kvs
-}
-
-// 移除所有完成 compact 流程的老节点
-func (t *Tree) removeNodes(level int, nodes []*Node) {
-	// 从 lsm tree 的 nodes 中移除老节点
-outer:
-	for k := 0; k < len(nodes); k++ {
-		node := nodes[k]
-		for i := level + 1; i >= level; i-- {
-			for j := 0; j < len(t.nodes[i]); j++ {
-				if node != t.nodes[i][j] {
-					continue
-				}
-
-				t.levelLocks[i].Lock()
-				t.nodes[i] = append(t.nodes[i][:j], t.nodes[i][j+1:]...)
-				t.levelLocks[i].Unlock()
-				continue outer
+	for i := level; i <= outLevel; i++ {
+		remaining := t.nodes[i][:0]
+		for _, node := range t.nodes[i] {
+			if !containsNode(nodes, node) {
+				remaining = append(remaining, node)
 			}
 		}
+		t.nodes[i] = remaining
+	}
+	for _, node := range newNodes {
+		t.addNodeLocked(outLevel, node)
+	}
+	for i := outLevel; i >= level; i-- {
+		t.levelLocks[i].Unlock()
 	}
 
 	go func() {
@@ -163,47 +313,157 @@ outer:
 	}()
 }
 
-// 将只读 memtable 溢写落盘成为 level0 层 sstable 文件
-func (t *Tree) compactMemTable(memCompactItem *memTableCompactItem) {
+// nodes 中是否包含 node
+func containsNode(nodes []*Node, node *Node) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// 将只读 memtable 溢写落盘成为 level0 层 sstable 文件.
+// 只读 memtable 需要按照切换的先后顺序落盘，保证 level0 层 sstable 的 seq 越大数据越新，因此每次溢写的总是最老的只读 memtable
+func (t *Tree) compactMemTable() {
+	// 溢写失败后重新发起的溢写可能晚于后续的溢写到达，此时只读 memtable 已经全部落盘
+	t.dataLock.RLock()
+	if len(t.rOnlyMemTable) == 0 {
+		t.dataLock.RUnlock()
+		return
+	}
+	memCompactItem := t.rOnlyMemTable[0]
+	t.dataLock.RUnlock()
+
 	// 处理 memtable 溢写工作:
-	// 1 memtable 溢写到 0 层 sstable 中
-	t.flushMemTable(memCompactItem.memTable)
+	// 1 memtable 溢写到 0 层 sstable 中. 暂时性 IO 错误按照重试策略重试，最终失败时保留只读 memtable 以及预写日志，避免数据丢失，
+	// 并在稍后重新发起溢写. 否则只读 memtable 只能等到下一次切换时才会落盘，且始终比切换的次数少落盘一个
+	if err := t.runBackground(backgroundJobFlush, func() error {
+		return t.flushMemTable(memCompactItem)
+	}); err != nil {
+		t.recordCorruption(err)
+		t.retryBackgroundLater(func() {
+			select {
+			case t.memCompactC <- memCompactItem:
+			case <-t.stopc:
+			}
+		})
+		return
+	}
+	t.clearBackgroundErr(backgroundJobFlush)
 
 	// 2 从 rOnly slice 中回收对应的 table
 	t.dataLock.Lock()
-	for i := 0; i < len(t.rOnlyMemTable); i++ {
-		if t.rOnlyMemTable[i].memTable != memCompactItem.memTable {
-			continue
-		}
-		t.rOnlyMemTable = t.rOnlyMemTable[i+1:]
-	}
+	t.rOnlyMemTable = t.rOnlyMemTable[1:]
+	t.notifyMemTableFlushedLocked()
 	t.dataLock.Unlock()
 
-	// 3 删除相应的预写日志. 因为 memtable 落盘后数据已经安全，不存在丢失风险
-	_ = os.Remove(memCompactItem.walFile)
+	// 3 wal 创建失败期间的 memtable 没有对应的 wal 文件，无需回收
+	if memCompactItem.walFile == "" {
+		return
+	}
+
+	// 4 共享 wal 模式下，推进 wal 的截断水位
+	if t.conf.SharedWAL && memCompactItem.walFile == t.sharedWALFile() {
+		t.truncateSharedWAL()
+		return
+	}
+
+	// 5 开启归档时，将相应的预写日志移动到归档目录中
+	if t.conf.WALArchive != nil {
+		t.archiveWAL(memCompactItem)
+		_ = t.syncWALDir()
+		return
+	}
+
+	// 6 删除相应的预写日志. 因为 memtable 落盘后数据已经安全，不存在丢失风险. 开启回收时移入回收池等待复用
+	for _, file := range append(append([]string(nil), memCompactItem.walSegments...), memCompactItem.walFile) {
+		if t.conf.WALRecycleFiles > 0 {
+			t.recycleWAL(file)
+		} else {
+			_ = os.Remove(file)
+		}
+	}
+	// 删除落盘失败时 wal 文件可能在掉电后重新出现，回放的数据已经存在于 sstable 中，不影响正确性
+	_ = t.syncWALDir()
 }
 
-// 将 memtable 的数据溢写落盘到 level0 层成为一个新的 sst 文件
-func (t *Tree) flushMemTable(memTable memtable.MemTable) {
+// 将只读 memtable 的数据溢写落盘到 level0 层成为一个新的 sst 文件
+func (t *Tree) flushMemTable(item *memTableCompactItem) error {
+	defer t.compactionWork()()
+
 	// memtable 写到 level 0 层 sstable 中
 	seq := t.levelToSeq[0].Load() + 1
 
 	// 创建 sst writer
-	sstWriter, _ := NewSSTWriter(t.sstFile(0, seq), t.conf)
+	sstWriter, err := NewSSTWriter(t.sstFile(0, seq), t.conf)
+	if err != nil {
+		return err
+	}
 	defer sstWriter.Close()
-
-	// 遍历 memtable 写入数据到 sst writer
-	for _, kv := range memTable.All() {
-		sstWriter.Append(kv.Key, kv.Value)
+	if f := t.levelFilter(0); f != nil {
+		sstWriter.SetFilter(f)
+	}
+	inputs := make([]string, 0, len(item.walSegments)+1)
+	for _, file := range item.walSegments {
+		inputs = append(inputs, path.Base(file))
+	}
+	if item.walFile != "" {
+		inputs = append(inputs, path.Base(item.walFile))
+	}
+	sstWriter.SetOrigin(SSTOriginFlush, inputs)
+
+	// 遍历 memtable 写入数据到 sst writer. 写入失败时移除写了一半的文件，只读 memtable 与 wal 保留，等待重试
+	kvs := item.memTable.All()
+	var reclaim expiredReclaim
+	for _, kv := range kvs {
+		now := time.Now().UnixNano()
+		value := t.applyDeleteRules(kv.Key, dropExpired(kv.Value, now))
+		if internalExpired(kv.Value, now) {
+			reclaim.add(kv.Key, kv.Value, value)
+		}
+		if err = sstWriter.Append(kv.Key, value); err != nil {
+			t.discardSST(t.sstFile(0, seq))
+			return err
+		}
 	}
 
 	// sstable 落盘
-	size, blockToFilter, index := sstWriter.Finish()
+	size, blockToFilter, index, err := sstWriter.Finish()
+	if err != nil {
+		t.discardSST(t.sstFile(0, seq))
+		return err
+	}
+
+	// 开启校验时，重新读取 sstable 校验无误后才注册节点
+	if t.conf.VerifySST {
+		if err := t.verifySST(t.sstFile(0, seq), len(kvs)); err != nil {
+			t.discardSST(t.sstFile(0, seq))
+			return err
+		}
+	}
 
-	// 构造节点添加到 tree 的 node 中
-	t.insertNode(0, seq, size, blockToFilter, index)
+	// 构造节点添加到 tree 的 node 中. reader 打开失败时放弃该文件，等待重试
+	sstReader, err := NewSSTReader(t.sstFile(0, seq), t.conf)
+	if err != nil {
+		t.discardSST(t.sstFile(0, seq))
+		return err
+	}
+	// 写入 manifest 后 sstable 才生效. 写入失败时放弃该文件，等待重试
+	t.manifestLock.Lock()
+	if err = t.logManifest(&manifestEdit{added: []*ManifestFile{{Level: 0, Seq: seq, Size: size}}}); err != nil {
+		t.manifestLock.Unlock()
+		sstReader.Close()
+		t.discardSST(t.sstFile(0, seq))
+		return err
+	}
+	t.insertNodeWithReader(sstReader, 0, seq, size, blockToFilter, index)
+	t.manifestLock.Unlock()
+	t.recordExpiredReclaim(&reclaim)
+	t.compactionMetrics.recordFlush(size)
 	// 尝试引发一轮 compact 操作
 	t.tryTriggerCompact(0)
+	return nil
 }
 
 func (t *Tree) tryTriggerCompact(level int) {
@@ -212,59 +472,90 @@ func (t *Tree) tryTriggerCompact(level int) {
 		return
 	}
 
-	var size uint64
-	for _, node := range t.nodes[level] {
-		size += node.size
-	}
-
-	if size <= t.conf.SSTSize*uint64(math.Pow10(level))*uint64(t.conf.SSTNumPerLevel) {
+	if !t.levelNeedsCompact(level) {
 		return
 	}
 
+	t.pendingCompactions.Add(1)
 	go func() {
 		t.levelCompactC <- level
 	}()
 }
 
+// level 层 sstable 文件总大小是否超过阈值. level0 层的文件之间相互重叠，读取时需要逐个检索，
+// 少量数据的溢写产生大量较小的文件时，文件个数超过 SSTNumPerLevel 即便总大小没有超过阈值也需要合并到下一层
+func (t *Tree) levelNeedsCompact(level int) bool {
+	t.levelLocks[level].RLock()
+	defer t.levelLocks[level].RUnlock()
+	return t.levelNeedsCompactLocked(level)
+}
+
+// 调用方需要持有 level 层的读锁
+func (t *Tree) levelNeedsCompactLocked(level int) bool {
+	if level == 0 && len(t.nodes[level]) > t.conf.SSTNumPerLevel {
+		return true
+	}
+	var size uint64
+	for _, node := range t.nodes[level] {
+		size += node.size
+	}
+	return size > t.levelSizeLimit(level)
+}
+
+// level 层 sstable 文件总大小的阈值，超过阈值时触发 compact
+func (t *Tree) levelSizeLimit(level int) uint64 {
+	return t.conf.SSTSize * uint64(math.Pow10(level)) * uint64(t.conf.SSTNumPerLevel)
+}
+
 // 插入一个 node 到指定 level 层
 func (t *Tree) insertNodeWithReader(sstReader *SSTReader, level int, seq int32, size uint64, blockToFilter map[uint64][]byte, index []*Index) {
 	file := t.sstFile(level, seq)
-	// 记录当前 level 层对应的 seq 号（单调递增）
-	t.levelToSeq[level].Store(seq)
+	t.registerNode(NewNode(t.conf, file, sstReader, level, seq, size, blockToFilter, index))
+}
 
-	// 创建一个 lsm node
-	newNode := NewNode(t.conf, file, sstReader, level, seq, size, blockToFilter, index)
-	// 对于 level0 而言，只需要 append 插入 node 即可
-	if level == 0 {
-		t.levelLocks[0].Lock()
-		t.nodes[level] = append(t.nodes[level], newNode)
-		t.levelLocks[0].Unlock()
-		return
-	}
+// 将构造好的 node 插入到所在的 level 层
+func (t *Tree) registerNode(node *Node) {
+	t.prepareNode(node)
+	t.addNode(node.level, node)
+}
 
-	// 对于 level1~levelk 层，需要根据 node 中 key 的大小，遵循顺序插入
-	for i := 0; i < len(t.nodes[level])-1; i++ {
-		// 遵循从小到大的遍历顺序，找到首个最小 key 比 newNode 最大 key 还大的 node，将 newNode 插入在其之前
-		if bytes.Compare(newNode.End(), t.nodes[level][i+1].Start()) < 0 {
-			t.levelLocks[level].Lock()
-			t.nodes[level] = append(t.nodes[level][:i+1], t.nodes[level][i:]...)
-			t.nodes[level][i+1] = newNode
-			t.levelLocks[level].Unlock()
-			return
+// 插入 node 之前的准备工作. 开启延迟加载时，已经读取的过滤器与索引同样计入内存预算，可以被淘汰
+func (t *Tree) prepareNode(node *Node) {
+	// 记录当前 level 层对应的 seq 号（单调递增）
+	t.levelToSeq[node.level].Store(node.seq)
+
+	if t.conf.LazyMetadata && !node.lazy {
+		node.lazy = true
+		if t.conf.metaCache != nil {
+			indexSize, filterSize := metadataSize(node.blockToFilter, node.index)
+			t.conf.metaCache.add(node, int(indexSize+filterSize))
 		}
 	}
+}
 
-	// 遍历完 level 层所有节点都还没插入 newNode，说明 newNode 是该层 key 值最大的节点，则 append 到最后即可
+// 将 node 按照 key 的顺序插入到指定 level 层
+func (t *Tree) addNode(level int, newNode *Node) {
 	t.levelLocks[level].Lock()
-	t.nodes[level] = append(t.nodes[level], newNode)
-	t.levelLocks[level].Unlock()
+	defer t.levelLocks[level].Unlock()
+	t.addNodeLocked(level, newNode)
 }
 
-func (t *Tree) insertNode(level int, seq int32, size uint64, blockToFilter map[uint64][]byte, index []*Index) {
-	file := t.sstFile(level, seq)
-	sstReader, _ := NewSSTReader(file, t.conf)
+// 在持有 level 层写锁的情况下插入 node
+func (t *Tree) addNodeLocked(level int, newNode *Node) {
+	// 对于 level0 而言，只需要 append 插入 node 即可
+	if level == 0 {
+		t.nodes[level] = append(t.nodes[level], newNode)
+		return
+	}
 
-	t.insertNodeWithReader(sstReader, level, seq, size, blockToFilter, index)
+	// 对于 level1~levelk 层，需要根据 node 中 key 的大小，遵循顺序插入.
+	// 找到首个最小 key 比 newNode 最小 key 还大的 node，将 newNode 插入在其之前. 不存在时说明 newNode 是该层 key 值最大的节点，append 到最后
+	i := sort.Search(len(t.nodes[level]), func(i int) bool {
+		return bytes.Compare(t.nodes[level][i].Start(), newNode.Start()) > 0
+	})
+	t.nodes[level] = append(t.nodes[level], nil)
+	copy(t.nodes[level][i+1:], t.nodes[level][i:])
+	t.nodes[level][i] = newNode
 }
 
 func (t *Tree) sstFile(level int, seq int32) string {
@@ -272,11 +563,31 @@ func (t *Tree) sstFile(level int, seq int32) string {
 }
 
 func (t *Tree) walFile() string {
+	if t.conf.SharedWAL {
+		return t.sharedWALSegmentFile(t.sharedSegment)
+	}
+	if t.walSegment > 0 {
+		return path.Join(t.conf.Dir, "walfile", fmt.Sprintf("%d_%d.wal", t.memTableIndex, t.walSegment))
+	}
 	return path.Join(t.conf.Dir, "walfile", fmt.Sprintf("%d.wal", t.memTableIndex))
 }
 
 func walFileToMemTableIndex(walFile string) int {
-	rawIndex := strings.Replace(walFile, ".wal", "", -1)
-	index, _ := strconv.Atoi(rawIndex)
+	index, _ := walFileToSegment(walFile)
 	return index
 }
+
+// 解析 wal 文件名中的 memtable index 以及分段序号. 首个分段命名为 index.wal，后续分段命名为 index_segment.wal.
+// 多路 wal 中除首路之外的文件命名为 index.s{stream}.wal，分段序号为 0
+func walFileToSegment(walFile string) (index, segment int) {
+	rawIndex := strings.Replace(walFile, ".wal", "", -1)
+	if i := strings.Index(rawIndex, walStreamInfix); i >= 0 {
+		rawIndex = rawIndex[:i]
+	}
+	if i := strings.IndexByte(rawIndex, '_'); i >= 0 {
+		segment, _ = strconv.Atoi(rawIndex[i+1:])
+		rawIndex = rawIndex[:i]
+	}
+	index, _ = strconv.Atoi(rawIndex)
+	return index, segment
+}
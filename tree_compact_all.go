@@ -0,0 +1,107 @@
+package lsmart
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrTreeClosed lsm tree 已关闭
+var ErrTreeClosed = errors.New("lsm tree is closed")
+
+// CompactAll 手动触发一轮全量 compact，立即返回，适用于批量导入数据之后. 可以通过 WaitIdle 等待执行完毕.
+// 需要等待执行结果时使用 CompactAllAndWait
+func (t *Tree) CompactAll() {
+	t.pendingCompactions.Add(1)
+	go func() {
+		_ = t.compactAll()
+	}()
+}
+
+// CompactAllAndWait 执行一轮全量 compact，并阻塞等待执行完毕，适用于备份之前. 执行流程：
+// 1 将所有 memtable 溢写落盘
+// 2 从 level0 层开始，将每一层的全部节点与下一层存在重叠的节点归并写入下一层，直至最深的非空层（至少为 level1 层）
+// 执行完毕后，除最深的非空层之外的各层均为空，数据以最少的 sstable 文件存放. 溢写失败时返回错误，任意一轮归并失败时保留老节点并返回错误
+func (t *Tree) CompactAllAndWait() error {
+	t.pendingCompactions.Add(1)
+	return t.compactAll()
+}
+
+// 全量 compact 任务
+type fullCompactTask struct {
+	rules []*deleteRule // 发起时已注册的按条件删除规则，执行完毕后尝试退役
+	done  chan error
+}
+
+// 溢写所有 memtable 后，交由 compact 协程执行全量 compact，与自动触发的 compact 串行执行. 调用前需要递增 pendingCompactions
+func (t *Tree) compactAll() error {
+	// 先取规则再溢写，保证规则作用的数据在全量 compact 开始之前均已落盘
+	task := fullCompactTask{rules: t.registeredDeleteRules(), done: make(chan error, 1)}
+	if err := t.Flush(); err != nil {
+		t.finishPendingCompaction()
+		return err
+	}
+
+	select {
+	case t.fullCompactC <- &task:
+	case <-t.stopc:
+		t.finishPendingCompaction()
+		return ErrTreeClosed
+	}
+
+	select {
+	case err := <-task.done:
+		return err
+	case <-t.stopc:
+		return ErrTreeClosed
+	}
+}
+
+// 在 compact 协程中将所有数据逐层归并到最深的非空层，完成后退役 rules 中已经不再需要的规则
+func (t *Tree) compactAllLevels(rules []*deleteRule) error {
+	old := t.liveNodes()
+	target := 1
+	for level := len(t.nodes) - 1; level > 1; level-- {
+		if len(t.nodes[level]) > 0 {
+			target = level
+			break
+		}
+	}
+
+	for level := 0; level < target; level++ {
+		if len(t.nodes[level]) == 0 {
+			continue
+		}
+		if err := t.compactNodes(level, t.pickAllNodes(level)); err != nil {
+			return err
+		}
+	}
+	t.retireDeleteRules(rules, old)
+	return nil
+}
+
+// 获取当前所有层级的节点
+func (t *Tree) liveNodes() map[*Node]struct{} {
+	nodes := make(map[*Node]struct{})
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			nodes[node] = struct{}{}
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return nodes
+}
+
+// 获取 level 层的全部节点，以及 level+1 层中与之存在重叠的节点
+func (t *Tree) pickAllNodes(level int) []*Node {
+	startKey, endKey := t.nodes[level][0].Start(), t.nodes[level][0].End()
+	for _, node := range t.nodes[level][1:] {
+		if bytes.Compare(node.Start(), startKey) < 0 {
+			startKey = node.Start()
+		}
+		if bytes.Compare(node.End(), endKey) > 0 {
+			endKey = node.End()
+		}
+	}
+	return t.pickNodesInRange(level, startKey, endKey)
+}
@@ -0,0 +1,67 @@
+package lsmart
+
+import (
+	"bytes"
+	"sort"
+)
+
+// level 层的 compact 得分，多个 level 层同时等待 compact 时，得分高的优先执行. 以文件总大小与阈值之比为基础，
+// level0 层同时考虑文件个数与预期个数之比，取两者中较大的一个. 墓碑记录占比以及层内范围重叠的节点占比越高，
+// 归并之后能够清理的数据以及读取时需要检查的节点越多，按比例提高得分. 最深一层不执行 compact，得分为 0
+func (t *Tree) compactScore(level int) float64 {
+	t.levelLocks[level].RLock()
+	defer t.levelLocks[level].RUnlock()
+	return t.compactScoreLocked(level)
+}
+
+// 调用方需要持有 level 层的读锁
+func (t *Tree) compactScoreLocked(level int) float64 {
+	nodes := t.nodes[level]
+	if level == len(t.nodes)-1 || len(nodes) == 0 {
+		return 0
+	}
+
+	var size, entries, tombstones uint64
+	for _, node := range nodes {
+		size += node.size
+		nodeEntries, nodeTombstones := node.counts()
+		entries += nodeEntries
+		tombstones += nodeTombstones
+	}
+	score := float64(size) / float64(t.levelSizeLimit(level))
+	if level == 0 {
+		if fileScore := float64(len(nodes)) / float64(t.conf.SSTNumPerLevel); fileScore > score {
+			score = fileScore
+		}
+	}
+
+	var tombstoneRatio float64
+	if entries > 0 {
+		tombstoneRatio = float64(tombstones) / float64(entries)
+	}
+	overlapRatio := float64(overlappingNodes(nodes)) / float64(len(nodes))
+	return score * (1 + tombstoneRatio + overlapRatio)
+}
+
+// 与同层其他节点范围重叠的节点个数. 按照起始 key 排序后，起始 key 不大于此前节点最大结束 key 的节点计为重叠
+func overlappingNodes(nodes []*Node) int {
+	sorted := make([]*Node, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Start(), sorted[j].Start()) < 0
+	})
+
+	var (
+		overlapped int
+		maxEnd     []byte
+	)
+	for i, node := range sorted {
+		if i > 0 && bytes.Compare(node.Start(), maxEnd) <= 0 {
+			overlapped++
+		}
+		if i == 0 || bytes.Compare(node.End(), maxEnd) > 0 {
+			maxEnd = node.End()
+		}
+	}
+	return overlapped
+}
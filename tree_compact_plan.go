@@ -0,0 +1,91 @@
+package lsmart
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// CompactionPlan 一轮 level 层 compact 的预演结果. 只读取数据做估算，不会真正执行归并
+type CompactionPlan struct {
+	Level         int      // 发起 compact 的 level 层，归并结果写入 level + 1 层
+	Triggered     bool     // level 层是否满足触发条件，即 compact 协程是否会自动执行这轮归并
+	Inputs        []string // 参与归并的 sstable 文件名，涵盖 level 和 level + 1 层
+	InputSize     uint64   // 参与归并的 sstable 文件总大小，单位 byte
+	InputRecords  int      // 参与归并的记录总数
+	OutputRecords int      // 归并去重后保留的记录数，不含丢弃的墓碑记录. 过期记录以及被过滤的记录按照改写后的结果计入
+	OutputSize    uint64   // 预估归并后生成的 sstable 文件总大小，单位 byte
+	ReclaimSize   uint64   // 预估归并后能够回收的磁盘空间，单位 byte
+}
+
+// PlanCompaction 预演 level 层的一轮 compact：报告将会参与归并的 sstable 文件、预估的产出大小以及能够回收的空间.
+// 挑选节点的规则与 compact 协程一致，便于在执行代价较高的归并之前进行评估
+func (t *Tree) PlanCompaction(level int) (*CompactionPlan, error) {
+	if level < 0 || level >= len(t.nodes)-1 {
+		return nil, fmt.Errorf("invalid compaction level: %d", level)
+	}
+
+	// 1 持有 level 和 level + 1 层的读锁挑选节点并构造迭代器. 迭代器登记为节点的读者，节点在迭代器关闭前不会被销毁，
+	// 因此扫描数据之前即可释放读锁，避免长时间阻塞溢写以及等待在写锁之后的读请求
+	t.levelLocks[level].RLock()
+	t.levelLocks[level+1].RLock()
+	plan := CompactionPlan{Level: level}
+	if len(t.nodes[level]) == 0 {
+		t.levelLocks[level+1].RUnlock()
+		t.levelLocks[level].RUnlock()
+		return &plan, nil
+	}
+	plan.Triggered = t.levelNeedsCompactLocked(level)
+
+	// 2 挑选参与归并的节点. pickedNodes 中越靠后的节点数据越新，因此倒序构造迭代器
+	pickedNodes := t.pickCompactNodes(level)
+	iters := make([]recordIterator, 0, len(pickedNodes))
+	for i := len(pickedNodes) - 1; i >= 0; i-- {
+		iters = append(iters, newNodeIterator(pickedNodes[i]))
+	}
+	t.levelLocks[level+1].RUnlock()
+	t.levelLocks[level].RUnlock()
+	for _, node := range pickedNodes {
+		plan.Inputs = append(plan.Inputs, node.file)
+		plan.InputSize += node.size
+	}
+
+	// 3 多路归并所有节点的数据，统计去重前后的记录数与数据量. 与真正的归并一样，每个 key 的最新版本按照 compactValue 改写，
+	// 更深层级中不存在老版本的墓碑记录不计入产出
+	iter := newMergeIterator(iters)
+	defer iter.Close()
+
+	var (
+		inputBytes, outputBytes uint64
+		prevKey                 []byte
+		deeper                  = t.deeperKeySpans(level + 1)
+	)
+	for ; iter.Valid(); iter.Next() {
+		plan.InputRecords++
+		inputBytes += uint64(len(iter.Key()) + len(iter.Value()))
+		// 同一个 key 只保留最新的一条记录
+		if prevKey != nil && bytes.Equal(prevKey, iter.Key()) {
+			continue
+		}
+		prevKey = iter.Key()
+		value := t.compactValue(iter.Key(), iter.Value(), time.Now().UnixNano())
+		if droppableTombstone(value, iter.Key(), deeper) {
+			continue
+		}
+		plan.OutputRecords++
+		outputBytes += uint64(len(iter.Key()) + len(value))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	// 4 按照保留数据量的占比，从输入文件大小折算出产出文件大小. 索引块、过滤器块等元数据与数据量近似成正比
+	if inputBytes > 0 {
+		plan.OutputSize = uint64(float64(plan.InputSize) * float64(outputBytes) / float64(inputBytes))
+	}
+	// 过滤函数可能将 value 改写得更大，此时没有可以回收的空间
+	if plan.InputSize > plan.OutputSize {
+		plan.ReclaimSize = plan.InputSize - plan.OutputSize
+	}
+	return &plan, nil
+}
@@ -0,0 +1,73 @@
+package lsmart
+
+import "sort"
+
+// level 层 compact 的调度器，只在 compact 协程中访问. 一轮 compact 占用 level 以及 level+1 两层，
+// 占用的层互不重叠的 compact 可以同时执行，个数受 MaxParallelCompactions 限制，其余的排队等待
+type compactScheduler struct {
+	t       *Tree
+	busy    map[int]bool // 正在执行的 compact 占用的层
+	running int          // 正在执行的 compact 个数
+	queued  []int        // 等待执行的 compact 对应的 level
+	done    chan int     // 执行完毕的 compact 对应的 level
+}
+
+func newCompactScheduler(t *Tree) *compactScheduler {
+	return &compactScheduler{t: t, busy: make(map[int]bool), done: make(chan int)}
+}
+
+// 提交一轮 level 层的 compact
+func (s *compactScheduler) schedule(level int) {
+	s.queued = append(s.queued, level)
+	s.dispatch()
+}
+
+// 按照 compact 得分从高到低启动可以执行的 compact，得分相同时按照提交的先后顺序
+func (s *compactScheduler) dispatch() {
+	if len(s.queued) > 1 && s.running < s.t.conf.MaxParallelCompactions {
+		scores := make(map[int]float64, len(s.queued))
+		for _, level := range s.queued {
+			if _, ok := scores[level]; !ok {
+				scores[level] = s.t.compactScore(level)
+			}
+		}
+		sort.SliceStable(s.queued, func(i, j int) bool {
+			return scores[s.queued[i]] > scores[s.queued[j]]
+		})
+	}
+
+	rest := s.queued[:0]
+	for _, level := range s.queued {
+		if s.running >= s.t.conf.MaxParallelCompactions || s.busy[level] || s.busy[level+1] {
+			rest = append(rest, level)
+			continue
+		}
+		s.busy[level], s.busy[level+1] = true, true
+		s.running++
+		go func(level int) {
+			s.t.compactLevel(level)
+			s.t.finishPendingCompaction()
+			s.done <- level
+		}(level)
+	}
+	s.queued = rest
+}
+
+// 一轮 compact 执行完毕，释放占用的层，并启动排队等待的 compact
+func (s *compactScheduler) finish(level int) {
+	s.release(level)
+	s.dispatch()
+}
+
+func (s *compactScheduler) release(level int) {
+	delete(s.busy, level)
+	delete(s.busy, level+1)
+	s.running--
+}
+
+// 等待正在执行的 compact 全部执行完毕，期间不启动新的 compact. 用于全量 compact、导入外部 sstable 等需要独占各层的任务
+func (s *compactScheduler) wait() {
+	for s.running > 0 {
+		s.release(<-s.done)
+	}
+}
@@ -0,0 +1,105 @@
+package lsmart
+
+import (
+	"sync"
+	"time"
+)
+
+// 保留最近多少轮 compact 的统计明细
+const compactionStatsHistory = 16
+
+// CompactionStats 一轮 compact 的统计信息
+type CompactionStats struct {
+	Level          int           // 参与归并的上层 level
+	OutputLevel    int           // 归并结果写入的 level，最深一层归并时与 Level 相同
+	StartTime      time.Time     // 开始时间
+	Duration       time.Duration // 从开始归并到新节点注册完毕的耗时
+	InputFiles     int           // 参与归并的 sstable 文件个数
+	OutputFiles    int           // 产出的 sstable 文件个数
+	BytesRead      uint64        // 参与归并的 sstable 文件总大小，单位 byte
+	BytesWritten   uint64        // 产出的 sstable 文件总大小，单位 byte
+	EntriesMerged  uint64        // 参与归并的记录个数，包含被更新版本覆盖的记录以及墓碑记录
+	EntriesDropped uint64        // 归并之后不再写入的记录个数，包括被覆盖的老版本、丢弃的墓碑记录以及过期记录
+}
+
+// compact 统计的累计值以及最近若干轮的明细，受 lock 保护. 同时累计溢写的数据量，作为计算写放大的基准
+type compactionMetrics struct {
+	lock           sync.Mutex
+	flushBytes     uint64
+	compactions    uint64
+	duration       time.Duration
+	outputFiles    uint64
+	bytesRead      uint64
+	bytesWritten   uint64
+	entriesMerged  uint64
+	entriesDropped uint64
+	recent         []*CompactionStats // 按照完成的先后顺序排列，至多保留 compactionStatsHistory 轮
+}
+
+// 记录一轮成功完成的 compact
+func (m *compactionMetrics) record(stats *CompactionStats) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.compactions++
+	m.duration += stats.Duration
+	m.outputFiles += uint64(stats.OutputFiles)
+	m.bytesRead += stats.BytesRead
+	m.bytesWritten += stats.BytesWritten
+	m.entriesMerged += stats.EntriesMerged
+	m.entriesDropped += stats.EntriesDropped
+	if len(m.recent) == compactionStatsHistory {
+		m.recent = append(m.recent[:0], m.recent[1:]...)
+	}
+	m.recent = append(m.recent, stats)
+}
+
+// 记录一次成功完成的溢写
+func (m *compactionMetrics) recordFlush(size uint64) {
+	m.lock.Lock()
+	m.flushBytes += size
+	m.lock.Unlock()
+}
+
+// 将累计值以及最近若干轮的明细填入 stats
+func (m *compactionMetrics) fill(stats *Stats) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stats.FlushBytesWritten = m.flushBytes
+	stats.Compactions = m.compactions
+	stats.CompactionTime = m.duration
+	stats.CompactionOutputFiles = m.outputFiles
+	stats.CompactionBytesRead = m.bytesRead
+	stats.CompactionBytesWritten = m.bytesWritten
+	stats.CompactionEntriesMerged = m.entriesMerged
+	stats.CompactionEntriesDropped = m.entriesDropped
+	stats.RecentCompactions = make([]*CompactionStats, 0, len(m.recent))
+	for _, recent := range m.recent {
+		snapshot := *recent
+		stats.RecentCompactions = append(stats.RecentCompactions, &snapshot)
+	}
+}
+
+// 根据参与归并的节点构造一轮 compact 的统计信息，产出以及耗时在归并完成后由 finish 补齐
+func newCompactionStats(level, outLevel int, pickedNodes []*Node) *CompactionStats {
+	stats := CompactionStats{Level: level, OutputLevel: outLevel, StartTime: time.Now(), InputFiles: len(pickedNodes)}
+	for _, node := range pickedNodes {
+		entries, _ := node.counts()
+		stats.BytesRead += node.size
+		stats.EntriesMerged += entries
+	}
+	return &stats
+}
+
+// 补齐本轮 compact 的产出以及耗时
+func (s *CompactionStats) finish(outputs []*compactOutput) {
+	s.Duration = time.Since(s.StartTime)
+	s.OutputFiles = len(outputs)
+	var written uint64
+	for _, output := range outputs {
+		s.BytesWritten += output.size
+		written += uint64(output.entries)
+	}
+	if s.EntriesMerged > written {
+		s.EntriesDropped = s.EntriesMerged - written
+	}
+}
@@ -0,0 +1,116 @@
+package lsmart
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 归并产出的一个 sst 文件的写入任务
+type compactJob struct {
+	seq    int32
+	output *compactOutput
+	err    error
+}
+
+// 流式归并 pickedNodes 中的数据，写入 level 层 seq 从 baseSeq 开始的一系列 sst 文件. 归并结果按照 sst 文件大小阈值切分，
+// 每攒满一份即交由 worker 并发写入，内存中至多保留 worker 个数加 1 份数据，与参与归并的数据总量无关.
+// 归并时按照 compactValue 改写每个 key 的最新版本，更深层级中不存在老版本的墓碑记录不再写入.
+// 返回已经派发的全部任务以及清理的过期记录，归并读取失败或者任意一个任务失败时同时返回错误，由调用方清理已经产出的文件
+func (t *Tree) streamCompactNodes(level int, baseSeq int32, pickedNodes []*Node, inputs []string) ([]*compactJob, *expiredReclaim, error) {
+	// index 越小，数据越老. index 越大，数据越新
+	// 归并迭代器在 seq 相同时优先输出靠前的迭代器，因此按照从新到老的顺序排列
+	iters := make([]recordIterator, 0, len(pickedNodes))
+	for i := len(pickedNodes) - 1; i >= 0; i-- {
+		iters = append(iters, newNodeIterator(pickedNodes[i]))
+	}
+	iter := newMergeIterator(iters)
+	defer iter.Close()
+
+	var (
+		jobs   []*compactJob
+		wg     sync.WaitGroup
+		failed atomic.Bool
+		// 由多个 worker 并发写入 sst 文件，worker 个数受 cpu 占用比例限制
+		sem = make(chan struct{}, t.compactionWorkers())
+	)
+	dispatch := func(chunk []*KV) {
+		job := compactJob{seq: baseSeq + int32(len(jobs))}
+		jobs = append(jobs, &job)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// 暂时性 IO 错误按照重试策略重新写入，每次重试之前移除写了一半的 sst 文件
+			job.err = t.runBackground(backgroundJobCompaction, func() error {
+				output, err := t.writeCompactOutput(level, job.seq, chunk, inputs)
+				if err != nil {
+					t.discardSST(t.sstFile(level, job.seq))
+				}
+				job.output = output
+				return err
+			})
+			if job.err != nil {
+				failed.Store(true)
+			}
+		}()
+	}
+
+	// 每份数据的 key、value 总大小刚好超过阈值，与单个 sstWriter 依次写满的效果一致. 任意一份写入失败时不再继续归并
+	sstLimit := t.conf.SSTTargetFileSize * uint64(math.Pow10(level))
+	deeper := t.deeperKeySpans(level)
+	var (
+		chunk   []*KV
+		size    uint64
+		lastKey []byte
+		reclaim expiredReclaim
+	)
+	for ; iter.Valid() && !failed.Load(); iter.Next() {
+		// 相同 key 的记录中首条即为最新版本
+		if lastKey != nil && bytes.Equal(lastKey, iter.Key()) {
+			continue
+		}
+		lastKey = iter.Key()
+
+		// 更深层级中不存在老版本的墓碑记录直接丢弃，释放磁盘空间. 过期记录在改写或者丢弃之后计入回收的空间
+		now := time.Now().UnixNano()
+		value := t.compactValue(iter.Key(), iter.Value(), now)
+		expired := internalExpired(iter.Value(), now)
+		if droppableTombstone(value, iter.Key(), deeper) {
+			if expired {
+				reclaim.add(iter.Key(), iter.Value(), nil)
+			}
+			continue
+		}
+		if expired {
+			reclaim.add(iter.Key(), iter.Value(), value)
+		}
+		if size > sstLimit {
+			dispatch(chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, &KV{Key: iter.Key(), Value: value})
+		size += uint64(len(iter.Key()) + len(value))
+	}
+	err := iter.Err()
+	if err == nil && len(chunk) > 0 && !failed.Load() {
+		dispatch(chunk)
+	}
+	wg.Wait()
+
+	if err != nil {
+		t.handleBackgroundErr(backgroundJobCompaction, err)
+		return jobs, nil, err
+	}
+	for _, job := range jobs {
+		if job.err != nil {
+			return jobs, nil, job.err
+		}
+	}
+	return jobs, &reclaim, nil
+}
@@ -0,0 +1,75 @@
+package lsmart_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/testutil"
+)
+
+// compact 替换节点期间，并发的 Get 不能漏读已经存在的 key
+func TestCompactInstallNoFalseNegatives(t *testing.T) {
+	tree, _ := testutil.NewTree(t,
+		lsmart.WithSSTSize(4096),
+		lsmart.WithSSTDataBlockSize(512),
+		lsmart.WithSSTNumPerLevel(2),
+		lsmart.WithSSTTargetFileSize(1024),
+	)
+
+	// 偶数 key 写入后不再删除，用于检查漏读；奇数 key 随机写入、删除，驱动各层节点不断被替换
+	const keys = 4000
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	for i := 0; i < keys; i += 2 {
+		if err := tree.Put(key(i), key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		stop   atomic.Bool
+		missed atomic.Value
+		wg     sync.WaitGroup
+	)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for !stop.Load() {
+				i := rnd.Intn(keys/2) * 2
+				if _, ok, err := tree.Get(key(i)); err != nil || !ok {
+					missed.Store(fmt.Sprintf("key %s missing, err: %v", key(i), err))
+					return
+				}
+			}
+		}(int64(r))
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for round := 0; round < 5 && missed.Load() == nil; round++ {
+		for n := 0; n < 3000; n++ {
+			i := rnd.Intn(keys/2)*2 + 1
+			var err error
+			if rnd.Intn(3) == 0 {
+				err = tree.Delete(key(i))
+			} else {
+				err = tree.Put(key(i), key(i))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tree.CompactAllAndWait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+	if msg := missed.Load(); msg != nil {
+		t.Fatal(msg)
+	}
+}
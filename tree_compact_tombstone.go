@@ -0,0 +1,53 @@
+package lsmart
+
+import (
+	"bytes"
+	"sort"
+)
+
+// 更深层级中各节点 key 范围的快照，用于 compact 时判断墓碑记录能否回收. 按照起始 key 排序，
+// ends[i] 为前 i+1 个节点中最大的结束 key，各层以及同层节点之间存在重叠时同样适用
+type keySpans struct {
+	starts [][]byte
+	ends   [][]byte
+}
+
+// 获取 level 层之下各层节点 key 范围的快照. 在 compact 开始之前获取：并发执行的 compact 只会将更深层级的数据继续下沉，
+// 下沉之前所在节点的范围已经覆盖了这部分数据，因此快照之后不会出现快照未覆盖的老版本数据
+func (t *Tree) deeperKeySpans(level int) *keySpans {
+	type span struct{ start, end []byte }
+	var spans []span
+	for i := level + 1; i < len(t.nodes); i++ {
+		t.levelLocks[i].RLock()
+		for _, node := range t.nodes[i] {
+			spans = append(spans, span{start: node.Start(), end: node.End()})
+		}
+		t.levelLocks[i].RUnlock()
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return bytes.Compare(spans[i].start, spans[j].start) < 0
+	})
+
+	s := keySpans{starts: make([][]byte, len(spans)), ends: make([][]byte, len(spans))}
+	for i, span := range spans {
+		s.starts[i], s.ends[i] = span.start, span.end
+		if i > 0 && bytes.Compare(s.ends[i-1], span.end) > 0 {
+			s.ends[i] = s.ends[i-1]
+		}
+	}
+	return &s
+}
+
+// key 是否落在某个节点的范围之内，即更深层级中可能存在 key 的老版本数据
+func (s *keySpans) covers(key []byte) bool {
+	i := sort.Search(len(s.starts), func(i int) bool {
+		return bytes.Compare(s.starts[i], key) > 0
+	})
+	return i > 0 && bytes.Compare(s.ends[i-1], key) >= 0
+}
+
+// compact 时墓碑记录能否直接丢弃. 归并结果中每个 key 只保留最新版本，参与归并的老版本已经一并丢弃，
+// 更深层级中不存在该 key 的老版本时，墓碑记录不再遮蔽任何数据
+func droppableTombstone(internalValue []byte, key []byte, deeper *keySpans) bool {
+	return len(internalValue) > 0 && OpType(internalValue[0]) == OpDelete && !deeper.covers(key)
+}
@@ -0,0 +1,39 @@
+package lsmart
+
+import "time"
+
+// 将各层中存在过期记录的 sstable 与下一层中存在重叠的节点归并写入下一层，归并时清理过期记录. 最深一层的 sstable 归并之后写回本层.
+// 只在 compact 协程中调用，执行期间独占各层
+func (t *Tree) compactExpired() {
+	t.pendingCompactions.Add(1)
+	defer t.finishPendingCompaction()
+
+	for level := 0; level < len(t.nodes); level++ {
+		for {
+			pickedNodes := t.pickExpiredNodes(level, time.Now().UnixNano())
+			if len(pickedNodes) == 0 {
+				break
+			}
+			if err := t.compactNodes(level, pickedNodes); err != nil {
+				return
+			}
+		}
+		// 下沉的数据可能使得下一层超出阈值
+		t.tryTriggerCompact(t.outputLevel(level))
+	}
+}
+
+// 获取 level 层中首个在 now 时刻存在过期记录的节点，以及参与归并的各层中与之存在重叠的节点. 没有时返回空
+func (t *Tree) pickExpiredNodes(level int, now int64) []*Node {
+	// 与替换节点时一致，按照 level 从小到大的顺序加锁
+	for i := level; i <= t.outputLevel(level); i++ {
+		t.levelLocks[i].RLock()
+		defer t.levelLocks[i].RUnlock()
+	}
+	for _, node := range t.nodes[level] {
+		if expireAt := node.expireAt(); expireAt > 0 && expireAt <= now {
+			return t.pickNodesInRange(level, node.Start(), node.End())
+		}
+	}
+	return nil
+}
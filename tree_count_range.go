@@ -0,0 +1,15 @@
+package lsmart
+
+// CountRange 精确统计 [start, end) 范围内存在的 key 个数，start、end 为空时表示不设边界.
+// 通过多路归并迭代器遍历 memtable 以及与范围存在重叠的 sstable，每个 key 只判定最新版本是否有效，不拷贝 value.
+// 墓碑记录、已过期的记录以及命中按条件删除规则的记录不计入. 代价与一次范围扫描相当
+func (t *Tree) CountRange(start, end []byte) (uint64, error) {
+	it := t.NewIterator(start, end)
+	defer it.Close()
+
+	var count uint64
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	return count, it.Err()
+}
@@ -0,0 +1,219 @@
+package lsmart
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// 归并遍历时每处理多少条记录检查一次 ctx 是否被取消
+const deepVerifyCheckInterval = 1024
+
+// VerifyIssue 深度校验发现的一处问题
+type VerifyIssue struct {
+	Level int    `json:"level"`          // 问题所在的 level 层. 归并遍历阶段发现的问题为 -1
+	File  string `json:"file,omitempty"` // 问题所在的 sstable 文件名. 归并遍历阶段发现的问题为空
+	Key   []byte `json:"key,omitempty"`  // 出问题的存储 key
+	Err   string `json:"error"`          // 问题描述
+}
+
+// VerifyReport 深度校验的结果，可直接序列化为 json 供运维工具消费
+type VerifyReport struct {
+	Files   int            `json:"files"`   // 校验的 sstable 文件个数
+	Bytes   uint64         `json:"bytes"`   // 校验的 sstable 文件总大小，单位 byte
+	Blocks  int            `json:"blocks"`  // 校验的数据块个数
+	Records uint64         `json:"records"` // sstable 中的内部记录总数，包含老版本以及墓碑记录
+	Keys    uint64         `json:"keys"`    // 归并后仍然有效的 key 个数
+	Issues  []*VerifyIssue `json:"issues"`  // 发现的所有问题
+	Elapsed time.Duration  `json:"elapsed"` // 校验耗时
+}
+
+// OK 是否没有发现任何问题
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+// DeepVerify 深度校验整棵 lsm tree 的数据，回答"事故之后这个目录里的数据还能不能信任". 校验分为两个阶段：
+// 1 逐个读取 sstable 的每一个数据块，校验索引顺序、块内 key 的顺序以及所属范围、内部记录能否解码，并确认每个 key 都能通过所在数据块的过滤器
+// 2 通过多路归并迭代器遍历 memtable 以及所有 sstable，校验记录整体有序，且同一个 key 越新的版本位于越新的数据源中
+// 发现的问题记录在校验结果中，不会中断校验. progress 为按照 sstable 字节数计算的进度回调，可以为空.
+// 只有 ctx 被取消时才返回错误. 校验期间涉及的 sstable 不会被 compact 删除
+func (t *Tree) DeepVerify(ctx context.Context, progress func(verified, total uint64)) (*VerifyReport, error) {
+	start := time.Now()
+	var report VerifyReport
+
+	// 1 固定所有节点，阻止其在校验完成之前被删除
+	var nodes []*Node
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			node.readers.Add(1)
+			nodes = append(nodes, node)
+			report.Bytes += node.size
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.readers.Done()
+		}
+	}()
+
+	// 2 逐个校验 sstable
+	var verified uint64
+	for _, node := range nodes {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		t.deepVerifyNode(node, &report)
+		report.Files++
+		verified += node.size
+		if progress != nil {
+			progress(verified, report.Bytes)
+		}
+	}
+
+	// 3 归并遍历所有数据源
+	if err := t.deepVerifyMerged(ctx, &report); err != nil {
+		return nil, err
+	}
+	report.Elapsed = time.Since(start)
+	return &report, nil
+}
+
+// 校验单个 sstable 的所有数据块
+func (t *Tree) deepVerifyNode(node *Node, report *VerifyReport) {
+	issue := func(key []byte, format string, args ...interface{}) {
+		report.Issues = append(report.Issues, &VerifyIssue{
+			Level: node.level,
+			File:  node.file,
+			Key:   key,
+			Err:   fmt.Sprintf(format, args...),
+		})
+	}
+
+	// 索引按分区存放时需要读取全部分区
+	blocks, err := node.blockIndex()
+	if err != nil {
+		issue(nil, "read index partitions: %v", err)
+		return
+	}
+
+	// 第 i 个索引对应的是第 i - 1 个数据块，数据块的 key 范围为 (index[i-1].Key, index[i].Key]
+	var prevKey []byte
+	for i := 1; i < len(blocks); i++ {
+		if bytes.Compare(blocks[i-1].Key, blocks[i].Key) >= 0 {
+			issue(blocks[i].Key, "index keys out of order at %d", i)
+		}
+
+		index := blocks[i]
+		block, err := node.sstReader.ReadDataBlock(index.PrevBlockOffset, index.PrevBlockSize)
+		if err != nil {
+			issue(nil, "read block at %d: %v", index.PrevBlockOffset, err)
+			continue
+		}
+		kvs, err := node.sstReader.ReadBlockData(block)
+		if err != nil {
+			issue(nil, "decode block at %d: %v", index.PrevBlockOffset, err)
+			continue
+		}
+		report.Blocks++
+
+		for _, kv := range kvs {
+			report.Records++
+			if prevKey != nil && bytes.Compare(prevKey, kv.Key) >= 0 {
+				issue(kv.Key, "keys out of order")
+			}
+			if bytes.Compare(kv.Key, blocks[i-1].Key) <= 0 || bytes.Compare(kv.Key, index.Key) > 0 {
+				issue(kv.Key, "key outside of index range")
+			}
+			if _, _, _, err := DecodeInternalValue(kv.Value); err != nil {
+				issue(kv.Key, "decode internal value: %v", err)
+			}
+			if !node.mayContain(index, kv.Key) {
+				issue(kv.Key, "key is rejected by its block filter")
+			}
+			if !node.tableMayContain(kv.Key) {
+				issue(kv.Key, "key is rejected by the table filter")
+			}
+			prevKey = kv.Key
+		}
+	}
+}
+
+// 归并遍历 memtable 以及所有 sstable，校验记录整体的顺序以及多版本的排列
+func (t *Tree) deepVerifyMerged(ctx context.Context, report *VerifyReport) error {
+	iters, sources := t.sourceIterators(nil, nil)
+	iter := newMergeIterator(iters)
+	defer iter.Close()
+
+	issue := func(key []byte, format string, args ...interface{}) {
+		report.Issues = append(report.Issues, &VerifyIssue{
+			Level: -1,
+			Key:   append([]byte(nil), key...),
+			Err:   fmt.Sprintf(format, args...),
+		})
+	}
+
+	var (
+		prevKey    []byte
+		prevSource int
+		now        = time.Now().UnixNano()
+		n          int
+	)
+	for ; iter.Valid(); iter.Next() {
+		if n++; n%deepVerifyCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		key, value := iter.Key(), iter.Value()
+		op, seq, userValue, err := DecodeInternalValue(value)
+		if err != nil {
+			// sstable 中的问题已经在逐个校验时记录，这里只记录 memtable 中的问题
+			if sources[iter.Source()].Level < 0 {
+				issue(key, "decode internal value: %v", err)
+			}
+			continue
+		}
+
+		cmp := bytes.Compare(prevKey, key)
+		switch {
+		case n > 1 && cmp > 0:
+			issue(key, "merged records out of order after %q", prevKey)
+		case n > 1 && cmp == 0:
+			// 归并迭代器按照 seq 由新到老输出同一个 key 的多个版本，数据源由新到老排列，因此数据源的位置不应回退.
+			// 老版本文件中的记录 seq 均为 0，无法据此判定
+			if seq > 0 && iter.Source() < prevSource {
+				issue(key, "version with seq %d in %s is older than the version in %s", seq, sourceName(sources[iter.Source()]), sourceName(sources[prevSource]))
+			}
+		default:
+			// 每个 key 的首条记录即为最新版本
+			if op != OpDelete && !internalExpired(value, now) {
+				userKey, err := t.decodeKey(key)
+				if err != nil {
+					issue(key, "decode key: %v", err)
+				} else if !t.deletedByRule(userKey, seq, userValue) {
+					report.Keys++
+				}
+			}
+		}
+		prevKey, prevSource = append(prevKey[:0], key...), iter.Source()
+	}
+
+	// 读取失败的数据块已经在逐个校验时记录，遍历无法继续时同样作为问题记录
+	if err := iter.Err(); err != nil {
+		issue(prevKey, "merged iteration stopped: %v", err)
+	}
+	return nil
+}
+
+// 数据源的描述，memtable 中的记录没有文件名
+func sourceName(source *InternalRecord) string {
+	if source.Level < 0 {
+		return "memtable"
+	}
+	return source.File
+}
@@ -0,0 +1,243 @@
+package lsmart
+
+import (
+	"bytes"
+	"context"
+	"time"
+)
+
+// DeletePredicate 按条件删除时使用的判定函数，key、value 均为用户数据，返回 true 表示删除
+type DeletePredicate func(key, value []byte) bool
+
+// 一条按条件删除的规则
+type deleteRule struct {
+	keyRange  KeyRange        // 规则作用的用户 key 范围
+	predicate DeletePredicate // 判定函数
+	seq       uint64          // 注册规则时的 seq. 规则只作用于 seq 不大于该值的记录，之后写入的数据不受影响
+}
+
+// 每批写入的墓碑记录数量上限，避免长时间持有写锁
+const deleteWhereBatchSize = 256
+
+// DeleteWhere 删除 key 范围内所有满足 predicate 的数据，适用于大批量清理的场景. 规则只作用于调用之前写入的数据，之后写入的数据不受影响.
+// 首先注册规则，读取时立即过滤命中规则的记录；随后扫描 key 范围，为命中规则的 key 分批写入墓碑记录，返回时删除与 Delete 同样持久，重启后不会重新出现.
+// 墓碑记录写入完毕后规则随之移除. 返回错误时规则保留在内存中继续生效，尚未写入墓碑记录的数据在重启后可能重新出现
+func (t *Tree) DeleteWhere(keyRange KeyRange, predicate DeletePredicate) error {
+	t.dataLock.RLock()
+	seq := t.seq
+	t.dataLock.RUnlock()
+
+	rule := &deleteRule{
+		keyRange:  keyRange,
+		predicate: predicate,
+		seq:       seq,
+	}
+	t.deleteRulesLock.Lock()
+	t.deleteRules = append(t.deleteRules, rule)
+	t.deleteRulesLock.Unlock()
+
+	if err := t.writeDeleteRuleTombstones(rule); err != nil {
+		return err
+	}
+	t.removeDeleteRule(rule)
+	return nil
+}
+
+// 扫描规则的 key 范围，为最新版本命中规则的 key 写入墓碑记录. 配置了 key 变换器时存储 key 的顺序与用户 key 无关，需要扫描全部记录
+func (t *Tree) writeDeleteRuleTombstones(rule *deleteRule) error {
+	it := t.NewInternalIterator()
+	defer it.Close()
+	transformed := t.conf.KeyTransformer != nil
+	if !transformed && len(rule.keyRange.Start) > 0 {
+		it.Seek(rule.keyRange.Start)
+	}
+
+	var (
+		keys    [][]byte
+		lastKey []byte
+	)
+	for ; it.Valid(); it.Next() {
+		record := it.Record()
+		// 同一个 key 的多个版本按照由新到老的顺序排列，只需要判断最新的版本
+		if lastKey != nil && bytes.Equal(record.Key, lastKey) {
+			continue
+		}
+		lastKey = append(lastKey[:0], record.Key...)
+		if !rule.keyRange.contains(record.Key) {
+			if !transformed && len(rule.keyRange.End) > 0 && bytes.Compare(record.Key, rule.keyRange.End) > 0 {
+				break
+			}
+			continue
+		}
+		if record.Op == OpDelete || record.Seq > rule.seq || !rule.predicate(record.Key, record.Value) {
+			continue
+		}
+
+		keys = append(keys, append([]byte(nil), record.Key...))
+		if len(keys) < deleteWhereBatchSize {
+			continue
+		}
+		if err := t.deleteByRule(rule, keys); err != nil {
+			return err
+		}
+		keys = keys[:0]
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return t.deleteByRule(rule, keys)
+}
+
+// 为一批 key 写入墓碑记录. 扫描之后 key 可能已被重新写入，持有写锁重新读取最新的记录，仍然命中规则时才写入墓碑记录，
+// 读取、判断与写入期间与其他写入操作互斥，与 PutIf 一致
+func (t *Tree) deleteByRule(rule *deleteRule, keys [][]byte) error {
+	t.dataLock.Lock()
+	defer t.dataLock.Unlock()
+
+	now := time.Now().UnixNano()
+	entries := make([]*batchEntry, 0, len(keys))
+	for _, key := range keys {
+		storageKey := t.encodeKey(key)
+		internalValue, ok := t.getMemTableLocked(storageKey, nil)
+		if !ok {
+			var err error
+			if internalValue, ok, err = t.getSSTable(context.Background(), storageKey, nil); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		op, seq, value, err := DecodeInternalValue(internalValue)
+		if err != nil {
+			t.recordCorruption(err)
+			return err
+		}
+		if op == OpDelete || seq > rule.seq || internalExpired(internalValue, now) || !rule.predicate(key, value) {
+			continue
+		}
+		entries = append(entries, &batchEntry{op: OpDelete, key: storageKey})
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return t.writeLocked(entries)
+}
+
+// 移除一条规则. 规则可能已经被全量 compact 退役
+func (t *Tree) removeDeleteRule(rule *deleteRule) {
+	t.deleteRulesLock.Lock()
+	defer t.deleteRulesLock.Unlock()
+	for i := range t.deleteRules {
+		if t.deleteRules[i] == rule {
+			t.deleteRules = append(t.deleteRules[:i:i], t.deleteRules[i+1:]...)
+			return
+		}
+	}
+}
+
+// 获取当前已注册的规则
+func (t *Tree) registeredDeleteRules() []*deleteRule {
+	t.deleteRulesLock.RLock()
+	defer t.deleteRulesLock.RUnlock()
+	return append([]*deleteRule(nil), t.deleteRules...)
+}
+
+// 全量 compact 完成后退役规则. rules 为全量 compact 发起时已注册的规则，old 为全量 compact 开始之前已存在的节点.
+// 规则作用的数据在全量 compact 开始前均已落盘，参与归并的节点都已按规则改写，只有未参与归并的老节点中可能残留这些数据，
+// 因此规则范围内不存在老节点时即可退役. 配置了 key 变换器时存储 key 的顺序与用户 key 无关，需要所有老节点都已被替换
+func (t *Tree) retireDeleteRules(rules []*deleteRule, old map[*Node]struct{}) {
+	if len(rules) == 0 {
+		return
+	}
+
+	// 收集仍然存活的老节点的 key 范围
+	var remains []KeyRange
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			if _, ok := old[node]; ok {
+				remains = append(remains, KeyRange{Start: node.Start(), End: node.End()})
+			}
+		}
+		t.levelLocks[level].RUnlock()
+	}
+
+	retired := make(map[*deleteRule]struct{}, len(rules))
+	for _, rule := range rules {
+		if !rule.covers(remains, t.conf.KeyTransformer != nil) {
+			retired[rule] = struct{}{}
+		}
+	}
+	if len(retired) == 0 {
+		return
+	}
+
+	t.deleteRulesLock.Lock()
+	defer t.deleteRulesLock.Unlock()
+	kept := make([]*deleteRule, 0, len(t.deleteRules))
+	for _, rule := range t.deleteRules {
+		if _, ok := retired[rule]; !ok {
+			kept = append(kept, rule)
+		}
+	}
+	t.deleteRules = kept
+}
+
+// 规则范围是否与 ranges 中的存储 key 范围存在交集. 存储 key 经过变换时无法按范围判断，只要 ranges 不为空即视为存在交集
+func (r *deleteRule) covers(ranges []KeyRange, transformed bool) bool {
+	if transformed {
+		return len(ranges) > 0
+	}
+	for i := range ranges {
+		if r.keyRange.overlaps(ranges[i].Start, ranges[i].End) {
+			return true
+		}
+	}
+	return false
+}
+
+// 用户 key 对应的写入记录是否命中了按条件删除的规则
+func (t *Tree) deletedByRule(key []byte, seq uint64, value []byte) bool {
+	t.deleteRulesLock.RLock()
+	defer t.deleteRulesLock.RUnlock()
+	for _, rule := range t.deleteRules {
+		if seq <= rule.seq && rule.keyRange.contains(key) && rule.predicate(key, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// 溢写、compact 时对记录应用按条件删除的规则. 命中规则的写入记录改写为相同 seq 的墓碑记录，
+// 而不是直接丢弃，避免更深层级中的老版本数据重新可见
+func (t *Tree) applyDeleteRules(key, internalValue []byte) []byte {
+	t.deleteRulesLock.RLock()
+	noRules := len(t.deleteRules) == 0
+	t.deleteRulesLock.RUnlock()
+	if noRules {
+		return internalValue
+	}
+
+	op, seq, value, err := DecodeInternalValue(internalValue)
+	if err != nil || op == OpDelete {
+		return internalValue
+	}
+	userKey, err := t.decodeKey(key)
+	if err != nil || !t.deletedByRule(userKey, seq, value) {
+		return internalValue
+	}
+	return EncodeInternalValue(OpDelete, seq, nil)
+}
+
+// key 是否位于范围内
+func (r *KeyRange) contains(key []byte) bool {
+	if len(r.Start) > 0 && bytes.Compare(key, r.Start) < 0 {
+		return false
+	}
+	return len(r.End) == 0 || bytes.Compare(key, r.End) <= 0
+}
@@ -0,0 +1,51 @@
+package lsmart_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/testutil"
+)
+
+// DeleteWhere 返回之后删除已经持久化，重启后已落盘以及仍在 memtable 中的数据都不会重新出现，之后写入的数据不受影响
+func TestDeleteWhereSurvivesReopen(t *testing.T) {
+	opts := []lsmart.ConfigOption{lsmart.WithSSTSize(4096), lsmart.WithSSTDataBlockSize(512)}
+	tree, dir := testutil.NewTree(t, opts...)
+	want := make(map[string]string)
+	put := func(i int, value string) {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	// 前一半数据落盘到 sstable，后一半保留在 memtable 中
+	for i := 0; i < 1000; i++ {
+		put(i, fmt.Sprintf("value%05d", i))
+	}
+	if err := testutil.Step(tree); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1000; i < 2000; i++ {
+		put(i, fmt.Sprintf("value%05d", i))
+	}
+
+	keyRange := lsmart.KeyRange{Start: []byte("key00500"), End: []byte("key01499")}
+	if err := tree.DeleteWhere(keyRange, func(key, value []byte) bool {
+		return strings.HasSuffix(string(value), "7")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 500; i <= 1499; i++ {
+		if i%10 == 7 {
+			delete(want, fmt.Sprintf("key%05d", i))
+		}
+	}
+	put(507, "rewritten7")
+	testutil.AssertContents(t, tree, want)
+
+	tree = testutil.ReopenTree(t, tree, dir, opts...)
+	testutil.AssertContents(t, tree, want)
+}
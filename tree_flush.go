@@ -0,0 +1,102 @@
+package lsmart
+
+// Flush 将读写 memtable 切换为只读 memtable，并阻塞等待所有只读 memtable 溢写落盘.
+// 返回 nil 之后此前写入的数据均已落盘为 sstable，包括通过 WriteOptions.DisableWAL 跳过预写日志写入的数据.
+// 溢写在重试耗尽之后仍未成功或者读取到损坏的数据时不再等待，返回对应的错误；lsm tree 关闭时返回 ErrTreeClosed
+func (t *Tree) Flush() error {
+	t.dataLock.Lock()
+	if t.memTable.EntriesCnt() > 0 {
+		t.refreshMemTableLocked()
+	}
+	t.dataLock.Unlock()
+
+	return t.waitBackground(func() bool {
+		return t.pendingMemTables() == 0
+	}, backgroundJobFlush)
+}
+
+// WaitIdle 阻塞等待所有只读 memtable 溢写落盘，且已触发的 level 层 compact 全部执行完毕.
+// 溢写、compact 在重试耗尽之后仍未成功或者读取到损坏的数据时不再等待，返回对应的错误；lsm tree 关闭时返回 ErrTreeClosed
+func (t *Tree) WaitIdle() error {
+	return t.waitBackground(t.idle, backgroundJobFlush, backgroundJobCompaction)
+}
+
+// 关闭之前排空后台任务：溢写读写 memtable，并等待只读 memtable 溢写落盘、已触发的 compact 执行完毕.
+// 后台任务最终失败时不再等待，未落盘的数据仍保留在预写日志中，重启后回放
+func (t *Tree) drain() {
+	t.dataLock.Lock()
+	if t.memTable.EntriesCnt() > 0 {
+		t.refreshMemTableLocked()
+	}
+	t.dataLock.Unlock()
+
+	_ = t.waitBackground(t.idle, backgroundJobFlush, backgroundJobCompaction)
+}
+
+// 等待 done 条件成立. 每当后台任务有进展时重新检查，jobs 中的后台任务最终失败或者读取到损坏的数据时返回对应的错误
+func (t *Tree) waitBackground(done func() bool, jobs ...string) error {
+	for {
+		// 先取通知 chan 再检查条件，避免错过两者之间发生的进展
+		progress := t.progressC()
+		if done() {
+			return nil
+		}
+		if err := t.backgroundFailure(jobs...); err != nil {
+			return err
+		}
+
+		select {
+		case <-progress:
+		case <-t.stopc:
+			return ErrTreeClosed
+		}
+	}
+}
+
+// 所有只读 memtable 均已溢写落盘，且已触发的 compact 全部执行完毕
+func (t *Tree) idle() bool {
+	return t.pendingMemTables() == 0 && t.pendingCompactions.Load() == 0
+}
+
+// 等待溢写的只读 memtable 个数
+func (t *Tree) pendingMemTables() int {
+	t.dataLock.RLock()
+	defer t.dataLock.RUnlock()
+	return len(t.rOnlyMemTable)
+}
+
+// 后台任务最终失败的错误：读取到了损坏的数据，或者 jobs 中的后台任务在重试耗尽之后仍未恢复. 没有时返回 nil
+func (t *Tree) backgroundFailure(jobs ...string) error {
+	t.healthLock.Lock()
+	defer t.healthLock.Unlock()
+	if t.corruptErr != nil {
+		return t.corruptErr
+	}
+	for _, job := range jobs {
+		if err, ok := t.backgroundErrs[job]; ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// 一轮已触发的 compact 执行完毕
+func (t *Tree) finishPendingCompaction() {
+	t.pendingCompactions.Add(-1)
+	t.notifyProgress()
+}
+
+// 获取后台任务进展的通知 chan，有进展时被关闭
+func (t *Tree) progressC() <-chan struct{} {
+	t.progressLock.Lock()
+	defer t.progressLock.Unlock()
+	return t.progress
+}
+
+// 通知等待后台任务的调用方重新检查条件
+func (t *Tree) notifyProgress() {
+	t.progressLock.Lock()
+	close(t.progress)
+	t.progress = make(chan struct{})
+	t.progressLock.Unlock()
+}
@@ -0,0 +1,63 @@
+package lsmart_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/testutil"
+)
+
+// 溢写最终失败时 Flush、WaitIdle 返回错误而不是一直等待，故障排除后重新发起的溢写成功，Flush 随之返回 nil
+func TestFlushReturnsBackgroundError(t *testing.T) {
+	tree, dir := testutil.NewTree(t, lsmart.WithBackgroundRetry(lsmart.RetryPolicy{
+		MaxAttempts:    1,
+		InitialBackoff: 10 * time.Millisecond,
+	}))
+	if err := tree.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 以非空目录占用首个 level0 sstable 的路径，使得溢写无法创建文件，清理时也无法删除
+	blocker := filepath.Join(dir, "0_1.sst")
+	if err := os.MkdirAll(filepath.Join(blocker, "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tree.Flush()
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, lsmart.ErrBackground) {
+			t.Fatalf("flush: expect ErrBackground, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("flush hangs on a failed background job")
+	}
+	if err := tree.WaitIdle(); !errors.Is(err, lsmart.ErrBackground) {
+		t.Fatalf("wait idle: expect ErrBackground, got %v", err)
+	}
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := tree.Flush()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flush after recovery: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if value, ok, err := tree.Get([]byte("key")); err != nil || !ok || string(value) != "value" {
+		t.Fatalf("get: %q %v %v", value, ok, err)
+	}
+}
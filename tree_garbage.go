@@ -0,0 +1,102 @@
+package lsmart
+
+import (
+	"bytes"
+	"time"
+)
+
+// LevelGarbage 某个 level 层的空间占用情况
+type LevelGarbage struct {
+	Level        int    // level 层级
+	Files        int    // sstable 文件个数
+	Size         uint64 // sstable 文件总大小，单位 byte
+	LiveBytes    uint64 // 仍然有效的记录数据量，单位 byte
+	GarbageBytes uint64 // 已被覆盖或删除的记录数据量，单位 byte
+	ReclaimSize  uint64 // 预估 compact 后能够回收的磁盘空间，单位 byte
+}
+
+// GarbageReport 整棵 lsm tree 的空间回收报告
+type GarbageReport struct {
+	Levels       []*LevelGarbage // 各 level 层的空间占用情况，下标即 level 层级
+	Size         uint64          // 所有 sstable 文件总大小，单位 byte
+	LiveBytes    uint64          // 仍然有效的记录数据量，单位 byte
+	GarbageBytes uint64          // 已被覆盖或删除的记录数据量，单位 byte
+	ReclaimSize  uint64          // 预估 compact 后能够回收的磁盘空间，单位 byte
+}
+
+// GarbageReport 统计各 level 层 sstable 中有效数据与垃圾数据的占比，用于评估一次 compact 实际能够释放的磁盘空间.
+// 被更新版本覆盖的记录、以及最新版本为墓碑记录或已过期的 key 的所有记录（包括墓碑本身）均视为垃圾数据.
+// memtable 中的记录只参与覆盖判定，不计入统计. 统计需要遍历所有数据，代价与一次全量扫描相当
+func (t *Tree) GarbageReport() (*GarbageReport, error) {
+	iters, sources := t.sourceIterators(nil, nil)
+	iter := newMergeIterator(iters)
+	defer iter.Close()
+
+	report := GarbageReport{Levels: make([]*LevelGarbage, len(t.nodes))}
+	for level := range report.Levels {
+		report.Levels[level] = &LevelGarbage{Level: level}
+	}
+	files := make(map[string]struct{})
+
+	var (
+		prevKey   []byte
+		newestSeq uint64 // 当前 key 最新版本的 seq
+		deleted   bool   // 当前 key 的最新版本是否为墓碑记录或已过期
+		now       = time.Now().UnixNano()
+	)
+	for ; iter.Valid(); iter.Next() {
+		source := sources[iter.Source()]
+		op, seq, _, err := DecodeInternalValue(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		isNewest := prevKey == nil || !bytes.Equal(prevKey, iter.Key())
+		if isNewest {
+			prevKey, newestSeq, deleted = iter.Key(), seq, op == OpDelete || internalExpired(iter.Value(), now)
+		}
+		// 只读 memtable 溢写期间，最新版本可能同时存在于 memtable 和 level0 层中. 老版本文件中的记录 seq 均为 0，无法据此判定
+		if seq > 0 && seq == newestSeq {
+			isNewest = true
+		}
+
+		// memtable 中的记录不占用 sstable 空间
+		if source.Level < 0 {
+			continue
+		}
+		stat := report.Levels[source.Level]
+		if _, ok := files[source.File]; !ok {
+			files[source.File] = struct{}{}
+			stat.Files++
+		}
+
+		recordBytes := uint64(len(iter.Key()) + len(iter.Value()))
+		if isNewest && !deleted {
+			stat.LiveBytes += recordBytes
+			continue
+		}
+		stat.GarbageBytes += recordBytes
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	// 按照垃圾数据量的占比，从文件大小折算出能够回收的空间
+	for level, stat := range report.Levels {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			if _, ok := files[node.file]; ok {
+				stat.Size += node.size
+			}
+		}
+		t.levelLocks[level].RUnlock()
+
+		if total := stat.LiveBytes + stat.GarbageBytes; total > 0 {
+			stat.ReclaimSize = uint64(float64(stat.Size) * float64(stat.GarbageBytes) / float64(total))
+		}
+		report.Size += stat.Size
+		report.LiveBytes += stat.LiveBytes
+		report.GarbageBytes += stat.GarbageBytes
+		report.ReclaimSize += stat.ReclaimSize
+	}
+	return &report, nil
+}
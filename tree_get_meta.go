@@ -0,0 +1,89 @@
+package lsmart
+
+import (
+	"context"
+	"time"
+)
+
+// 记录来源的描述
+const (
+	memTableSource         = "memtable"           // 读写 memtable
+	readOnlyMemTableSource = "read-only memtable" // 等待溢写的只读 memtable
+)
+
+// GetMeta 一次读取的元数据，用于排查"写进去的 key 为什么读不到"一类的问题.
+// lsm tree 不记录写入时间，同一个 key 的新老版本可以通过 Seq 比较先后
+type GetMeta struct {
+	Found    bool      // 是否检索到了 key 的记录. 检索到墓碑、已过期或者命中删除规则的记录时同样为 true
+	Op       OpType    // 检索到的记录的操作类型
+	Seq      uint64    // 检索到的记录的序列号. 老版本文件中的记录为 0
+	ExpireAt time.Time // 检索到的记录的过期时间. 不带过期时间的记录为零值
+	Expired  bool      // 检索到的记录是否已过期
+	Deleted  bool      // 检索到的记录是否命中了按条件删除的规则
+
+	Source string // 提供记录的数据源：memtable、read-only memtable，或者 sstable 文件名
+	Level  int    // 提供记录的 sstable 所在的 level 层. 来自 memtable 时为 -1
+	File   string // 提供记录的 sstable 文件名. 来自 memtable 时为空
+
+	NodesProbed   int      // 检索过的 sstable 个数，不包含索引范围未覆盖 key 的 sstable
+	BlocksRead    int      // 读取过的数据块个数
+	FilteredFiles []string // 过滤器判定 key 不存在、因而跳过的 sstable 文件名
+}
+
+// GetWithMeta 根据 key 读取数据，同时返回本次读取的元数据：记录来自哪个 memtable 或者 sstable、
+// 记录的操作类型、序列号与过期时间，以及检索过程中有哪些 sstable 被过滤器跳过. 检索路径与 Get 完全一致
+func (t *Tree) GetWithMeta(key []byte) ([]byte, bool, *GetMeta, error) {
+	meta := GetMeta{Level: -1}
+	internalValue, ok, err := t.getInternal(context.Background(), t.encodeKey(key), &meta)
+	if err != nil || !ok {
+		return nil, false, &meta, err
+	}
+
+	op, seq, value, err := DecodeInternalValue(internalValue)
+	if err != nil {
+		t.recordCorruption(err)
+		return nil, false, &meta, err
+	}
+	meta.Found, meta.Op, meta.Seq = true, op, seq
+	if expireAt := internalExpireAt(internalValue); expireAt > 0 {
+		meta.ExpireAt = expireTime(expireAt)
+		meta.Expired = internalExpired(internalValue, time.Now().UnixNano())
+	}
+	if op == OpDelete || meta.Expired {
+		return nil, false, &meta, nil
+	}
+	if meta.Deleted = t.deletedByRule(key, seq, value); meta.Deleted {
+		return nil, false, &meta, nil
+	}
+	return value, true, &meta, nil
+}
+
+// 记录提供记录的数据源. meta 为空时不做记录
+func (m *GetMeta) servedBy(source string, level int, file string) {
+	if m == nil {
+		return
+	}
+	m.Source, m.Level, m.File = source, level, file
+}
+
+// 在节点中检索 key，并记录检索路径. meta 为空时不做记录
+func (m *GetMeta) probe(node *Node, key []byte) ([]byte, bool, error) {
+	value, result, err := node.probe(key)
+	if m == nil {
+		return value, result == probeHit, err
+	}
+
+	switch result {
+	case probeOutOfRange:
+		return value, false, err
+	case probeFiltered:
+		m.FilteredFiles = append(m.FilteredFiles, node.file)
+	case probeMiss, probeHit:
+		m.BlocksRead++
+	}
+	m.NodesProbed++
+	if result == probeHit {
+		m.servedBy(node.file, node.level, node.file)
+	}
+	return value, result == probeHit, err
+}
@@ -0,0 +1,123 @@
+package lsmart
+
+import "context"
+
+// 等待提交的一次写入. 由持有写锁的 leader 合并提交，提交完毕后关闭 done
+type commitRequest struct {
+	ctx        context.Context
+	entries    []*batchEntry
+	disableWAL bool // 是否跳过预写日志，只写入 memtable
+	err        error
+	done       chan struct{}
+}
+
+// 合并并发写入方的提交. 写入方先将请求加入等待队列，再竞争提交令牌：抢到令牌的写入方作为 leader 加写锁，
+// 将队列中全部的请求一并写入，所有请求的 wal 记录通过一次写操作写入预写日志，开启 SyncWrites 时共用一次 fsync；
+// 其余写入方在请求被提交后直接返回结果. leader 执行 IO 期间到达的请求在队列中积累，组成下一批提交.
+// 等待令牌以及写锁期间 ctx 失效时，请求仍在队列中则撤回并返回 ctx 的错误，已被 leader 取出时等待其提交完成
+func (t *Tree) commit(ctx context.Context, entries []*batchEntry, opts *WriteOptions) error {
+	// 只读 memtable 积压时等待溢写追上，避免内存无限增长
+	if err := t.waitWriteStall(ctx); err != nil {
+		return err
+	}
+
+	req := &commitRequest{ctx: ctx, entries: entries, done: make(chan struct{})}
+	if opts != nil {
+		req.disableWAL = opts.DisableWAL
+	}
+	t.commitLock.Lock()
+	t.commitQueue = append(t.commitQueue, req)
+	t.commitLock.Unlock()
+
+	// 1 等待提交令牌. 等待期间请求可能已被上一个 leader 提交
+	select {
+	case t.commitSem <- struct{}{}:
+	case <-req.done:
+		return req.err
+	case <-ctx.Done():
+		return t.abandonCommit(ctx, req)
+	}
+	select {
+	case <-req.done:
+		<-t.commitSem
+		return req.err
+	default:
+	}
+
+	// 2 成为 leader，加写锁. 写锁同样被溢写切换 memtable、PutIf 等操作持有，无法立即加锁时由协程等待，
+	// 等待期间 ctx 失效则撤回自身的请求，协程加锁之后代为提交队列中其余的请求
+	if t.dataLock.TryLock() {
+		t.commitQueueLocked()
+		return req.err
+	}
+	locked := make(chan struct{})
+	go func() {
+		t.dataLock.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.commitQueueLocked()
+		return req.err
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			t.commitQueueLocked()
+		}()
+		return t.abandonCommit(ctx, req)
+	}
+}
+
+// leader 在持有提交令牌以及写锁的情况下，取出队列中全部的请求一并写入，完成后释放写锁以及提交令牌
+func (t *Tree) commitQueueLocked() {
+	defer func() {
+		t.dataLock.Unlock()
+		<-t.commitSem
+	}()
+
+	t.commitLock.Lock()
+	queue := t.commitQueue
+	t.commitQueue = nil
+	t.commitLock.Unlock()
+
+	// 等待期间 ctx 失效的请求放弃写入，保证返回 ctx 的错误时数据没有写入
+	group := make([]*commitRequest, 0, len(queue))
+	for _, r := range queue {
+		if r.err = r.ctx.Err(); r.err != nil {
+			close(r.done)
+			continue
+		}
+		group = append(group, r)
+	}
+	if len(group) == 0 {
+		return
+	}
+
+	err := t.writeGroupLocked(group)
+	for _, r := range group {
+		r.err = err
+		close(r.done)
+	}
+}
+
+// ctx 失效时放弃提交. 请求仍在队列中时撤回并返回 ctx 的错误，已被 leader 取出时等待其提交完成并返回写入结果
+func (t *Tree) abandonCommit(ctx context.Context, req *commitRequest) error {
+	if t.withdrawCommit(req) {
+		return ctx.Err()
+	}
+	<-req.done
+	return req.err
+}
+
+// 将尚未被 leader 取出的请求从等待队列中撤回，返回是否撤回成功
+func (t *Tree) withdrawCommit(req *commitRequest) bool {
+	t.commitLock.Lock()
+	defer t.commitLock.Unlock()
+	for i, r := range t.commitQueue {
+		if r == req {
+			t.commitQueue = append(t.commitQueue[:i:i], t.commitQueue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
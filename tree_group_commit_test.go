@@ -0,0 +1,55 @@
+package lsmart_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/testutil"
+)
+
+// 写锁被长时间占用时，PutContext 在 ctx 超时后立即返回且数据没有写入；同时排队的写入在写锁释放后照常提交
+func TestPutContextCancelWhileWaitingForLock(t *testing.T) {
+	tree, _ := testutil.NewTree(t)
+	unlock := lsmart.LockData(tree)
+	locked := true
+	defer func() {
+		if locked {
+			unlock()
+		}
+	}()
+
+	queued := make(chan error, 1)
+	go func() {
+		queued <- tree.Put([]byte("queued"), []byte("value"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- tree.PutContext(ctx, []byte("cancelled"), []byte("value"))
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expect DeadlineExceeded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PutContext ignores ctx while waiting for the write lock")
+	}
+
+	unlock()
+	locked = false
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued put is never committed")
+	}
+	testutil.AssertContents(t, tree, map[string]string{"queued": "value"})
+}
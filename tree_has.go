@@ -0,0 +1,27 @@
+package lsmart
+
+import (
+	"context"
+	"time"
+)
+
+// Has 判断 key 是否存在，适用于大量成员探测的场景. 检索路径与 Get 一致：依次检索 memtable 以及各层 sstable，
+// sstable 只有在 key 落在节点以及数据块的索引范围内、且布隆过滤器判定可能存在时才会读取数据块，
+// 绝大多数不存在的 key 只需要访问内存中的索引与过滤器即可返回. 检索到记录后只解析操作类型，不返回 value
+func (t *Tree) Has(key []byte) (bool, error) {
+	internalValue, ok, err := t.getInternal(context.Background(), t.encodeKey(key), nil)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	op, seq, value, err := DecodeInternalValue(internalValue)
+	if err != nil {
+		t.recordCorruption(err)
+		return false, err
+	}
+	// 墓碑记录、已过期的记录以及命中按条件删除规则的记录视为不存在
+	if op == OpDelete || internalExpired(internalValue, time.Now().UnixNano()) || t.deletedByRule(key, seq, value) {
+		return false, nil
+	}
+	return true, nil
+}
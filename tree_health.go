@@ -0,0 +1,121 @@
+package lsmart
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// 等待溢写的只读 memtable 个数超过该值时，认为写入发生了阻塞
+const healthPendingMemTables = 4
+
+// HealthStatus lsm tree 的健康状态
+type HealthStatus string
+
+const (
+	HealthHealthy          HealthStatus = "healthy"            // 正常提供读写服务
+	HealthWALDisabled      HealthStatus = "wal-disabled"       // wal 创建失败，降级为不写 wal，宕机时丢失 memtable 中的数据
+	HealthDegradedReadOnly HealthStatus = "degraded-read-only" // 写入失败，只能提供读服务
+	HealthWriteStalled     HealthStatus = "write-stalled"      // 溢写跟不上写入，只读 memtable 大量积压
+	HealthBackgroundError  HealthStatus = "background-error"   // 溢写、compact 等后台任务重试耗尽之后仍然失败，等待稍后重新执行
+	HealthCorrupted        HealthStatus = "corrupted"          // 读取到了损坏的数据
+)
+
+// Health lsm tree 的健康检查结果
+type Health struct {
+	Status  HealthStatus // 健康状态. 同时满足多个状态时，取最严重的一个
+	Reasons []string     // 所有异常状态的原因
+}
+
+// Live 是否存活，用于存活探针. 数据损坏时需要人工介入，不应继续提供服务
+func (h *Health) Live() bool {
+	return h.Status != HealthCorrupted
+}
+
+// Ready 是否就绪，用于就绪探针. 数据损坏时不接收流量. NewTree 返回之前 wal 已经回放完毕，无需单独检查回放进度
+func (h *Health) Ready() bool {
+	return h.Status != HealthCorrupted
+}
+
+// Health 检查 lsm tree 的健康状态，适用于 kubernetes 等部署环境下的存活、就绪探针
+func (t *Tree) Health() *Health {
+	var (
+		health   = Health{Status: HealthHealthy}
+		severity = map[HealthStatus]int{
+			HealthHealthy:          0,
+			HealthWALDisabled:      1,
+			HealthWriteStalled:     2,
+			HealthBackgroundError:  3,
+			HealthDegradedReadOnly: 4,
+			HealthCorrupted:        5,
+		}
+	)
+	report := func(status HealthStatus, reason string) {
+		if severity[status] > severity[health.Status] {
+			health.Status = status
+		}
+		health.Reasons = append(health.Reasons, reason)
+	}
+
+	// 1 读取过程中遇到了损坏的数据
+	t.healthLock.Lock()
+	corruptErr, writeErr := t.corruptErr, t.writeErr
+	backgroundErrs := make([]*BackgroundError, 0, len(t.backgroundErrs))
+	for _, err := range t.backgroundErrs {
+		backgroundErrs = append(backgroundErrs, err)
+	}
+	t.healthLock.Unlock()
+	if corruptErr != nil {
+		report(HealthCorrupted, fmt.Sprintf("read corrupted data: %v", corruptErr))
+	}
+
+	// 2 最近一次写入失败
+	if writeErr != nil {
+		report(HealthDegradedReadOnly, fmt.Sprintf("write failed: %v", writeErr))
+	}
+
+	// 3 只读 memtable 积压
+	t.dataLock.RLock()
+	pending := len(t.rOnlyMemTable)
+	walErr := t.walErr
+	t.dataLock.RUnlock()
+	if pending > healthPendingMemTables || (t.conf.MaxReadOnlyMemTables > 0 && pending >= t.conf.MaxReadOnlyMemTables) {
+		report(HealthWriteStalled, fmt.Sprintf("%d memtables waiting for flush", pending))
+	}
+
+	// 4 wal 创建失败，降级为不写 wal
+	if walErr != nil && t.conf.WALFallback {
+		report(HealthWALDisabled, fmt.Sprintf("wal disabled: %v", walErr))
+	}
+
+	// 5 后台任务重试耗尽之后仍然失败
+	sort.Slice(backgroundErrs, func(i, j int) bool {
+		return backgroundErrs[i].Job < backgroundErrs[j].Job
+	})
+	for _, err := range backgroundErrs {
+		report(HealthBackgroundError, fmt.Sprintf("%s failed: %v", err.Job, err.Err))
+	}
+
+	return &health
+}
+
+// 记录最近一次写入的结果. 写入成功时清除此前记录的写入错误
+func (t *Tree) recordWriteErr(err error) {
+	t.healthLock.Lock()
+	t.writeErr = err
+	t.healthLock.Unlock()
+}
+
+// 记录读取到损坏数据的错误. 只保留首次遇到的错误. 暂时性 IO 错误、缺少密钥等并非数据损坏的错误不予记录，
+// 否则一次偶发的失败就会使存活探针永久失败
+func (t *Tree) recordCorruption(err error) {
+	if !errors.Is(err, ErrCorruption) {
+		return
+	}
+	t.healthLock.Lock()
+	if t.corruptErr == nil {
+		t.corruptErr = err
+	}
+	t.healthLock.Unlock()
+	t.notifyProgress()
+}
@@ -0,0 +1,240 @@
+package lsmart
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/cccccxxy/lsmart/memtable"
+)
+
+// ErrIngestOverlap 导入的 sstable 与已有数据，或者与同批导入的其他 sstable 之间 key 范围存在重叠
+var ErrIngestOverlap = errors.New("ingested sstable overlaps existing data")
+
+// 一个通过校验、等待导入的 sstable 文件
+type ingestFile struct {
+	path     string // 外部文件路径
+	smallest []byte // 文件中最小的 key
+	largest  []byte // 文件中最大的 key
+	maxSeq   uint64 // 文件中记录的最大 seq
+}
+
+// 一批导入任务，交由 compact 协程执行，与溢写、compact 串行. 执行结果通过 done 返回
+type ingestTask struct {
+	files []*ingestFile
+	done  chan error
+}
+
+// IngestSST 将外部构建好的 sstable 文件直接导入 lsm tree，不经过 memtable 以及 wal，适用于批量导入数据. 执行流程：
+// 1 逐个校验文件：格式可读，记录按 key 严格递增且均为合法的内部 value，抽样检索能够经由当前配置的过滤器与索引读到
+// 2 校验各文件之间，以及与 memtable、各层已有数据之间的 key 范围均不存在重叠，否则返回 ErrIngestOverlap
+// 3 将文件重命名到 lsm tree 目录下，期间不阻塞写入；再次校验与 memtable 不存在重叠后，注册为最深一层的节点
+// 文件需要通过 SSTWriter 写入 EncodeInternalValue 编码的 value，并与 lsm tree 目录位于同一文件系统.
+// 任意一步失败时放弃整批导入，已经重命名的文件会移回原路径. 导入完成后 lsm tree 的 seq 不小于文件中记录的最大 seq
+func (t *Tree) IngestSST(paths []string) error {
+	files := make([]*ingestFile, 0, len(paths))
+	for _, filePath := range paths {
+		file, err := t.checkIngestFile(filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	// 按照 key 范围排序后，相邻文件之间不能存在重叠
+	sort.Slice(files, func(i, j int) bool {
+		return bytes.Compare(files[i].smallest, files[j].smallest) < 0
+	})
+	for i := 1; i < len(files); i++ {
+		if bytes.Compare(files[i-1].largest, files[i].smallest) >= 0 {
+			return fmt.Errorf("%w: %s and %s", ErrIngestOverlap, files[i-1].path, files[i].path)
+		}
+	}
+
+	task := ingestTask{files: files, done: make(chan error, 1)}
+	select {
+	case t.ingestC <- &task:
+	case <-t.stopc:
+		return ErrTreeClosed
+	}
+
+	select {
+	case err := <-task.done:
+		return err
+	case <-t.stopc:
+		return ErrTreeClosed
+	}
+}
+
+// 校验待导入的 sstable，获取其 key 范围以及记录的最大 seq
+func (t *Tree) checkIngestFile(filePath string) (*ingestFile, error) {
+	sstReader, err := openSSTReader(filePath, t.conf)
+	if err != nil {
+		return nil, err
+	}
+	defer sstReader.Close()
+
+	file := ingestFile{path: filePath}
+	var entries int
+	iter := sstReader.NewIterator()
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		_, seq, _, err := DecodeInternalValue(iter.Value())
+		if err != nil {
+			return nil, fmt.Errorf("ingest sstable %s: key %q: %w", filePath, iter.Key(), err)
+		}
+		if file.smallest == nil {
+			file.smallest = iter.Key()
+		}
+		file.largest = iter.Key()
+		if seq > file.maxSeq {
+			file.maxSeq = seq
+		}
+		entries++
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("ingest sstable %s: %w", filePath, err)
+	}
+	if entries == 0 {
+		return nil, fmt.Errorf("ingest sstable %s: no records", filePath)
+	}
+
+	// 复用落盘校验流程，确认索引、数据块以及过滤器与当前配置兼容. 抽样检索期间缓存的数据块需要一并淘汰
+	err = t.verifySSTReader(filePath, sstReader, entries)
+	if t.conf.blockCache != nil {
+		t.conf.blockCache.EvictFile(filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// 在 compact 协程中将通过校验的 sstable 注册为最深一层的节点. 期间溢写、compact 均已暂停，各层节点保持不变，
+// 重命名、打开文件时无需阻塞写入；只有与 memtable 的重叠校验以及注册节点、推进 seq 时持有 dataLock，避免 memtable 中写入与之重叠的数据
+func (t *Tree) ingestFiles(files []*ingestFile) error {
+	// 1 校验与 memtable 以及各层已有数据之间不存在重叠，提前拒绝重叠的导入
+	t.dataLock.RLock()
+	err := t.checkIngestOverlap(files)
+	t.dataLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// 2 将文件重命名到最深一层，并打开对应的节点. 最深一层不会再向下 compact，导入的文件无需改写
+	level := len(t.nodes) - 1
+	baseSeq := t.levelToSeq[level].Load() + 1
+	nodes := make([]*Node, 0, len(files))
+	for i, file := range files {
+		name := t.sstFile(level, baseSeq+int32(i))
+		if err = os.Rename(file.path, path.Join(t.conf.Dir, name)); err != nil {
+			break
+		}
+		var node *Node
+		if node, err = t.openNode(name); err != nil {
+			_ = os.Rename(path.Join(t.conf.Dir, name), file.path)
+			break
+		}
+		nodes = append(nodes, node)
+	}
+	if err == nil {
+		err = syncDir(t.conf.Dir)
+	}
+
+	// 3 持有 dataLock 注册节点. 重命名期间 memtable 中可能写入了重叠的数据，需要重新校验
+	if err == nil {
+		err = t.installIngestedNodes(files, nodes)
+	}
+	// 任意一步失败时关闭已打开的节点，并将文件移回原路径
+	if err != nil {
+		for i, node := range nodes {
+			node.sstReader.Close()
+			_ = os.Rename(path.Join(t.conf.Dir, node.file), files[i].path)
+		}
+		return err
+	}
+	return nil
+}
+
+// 在持有 dataLock 的情况下校验导入的文件与 memtable 不存在重叠，写入 manifest 后注册节点，并推进 seq，保证后续写入的记录比导入的记录更新
+func (t *Tree) installIngestedNodes(files []*ingestFile, nodes []*Node) error {
+	t.dataLock.Lock()
+	defer t.dataLock.Unlock()
+	if err := t.checkMemTableOverlap(files); err != nil {
+		return err
+	}
+
+	// 写入 manifest 后导入的文件才生效
+	edit := manifestEdit{}
+	for _, node := range nodes {
+		edit.added = append(edit.added, &ManifestFile{Level: node.level, Seq: node.seq, Size: node.size})
+	}
+	if err := t.logManifest(&edit); err != nil {
+		return err
+	}
+	for i, node := range nodes {
+		t.registerNode(node)
+		if files[i].maxSeq > t.seq {
+			t.seq = files[i].maxSeq
+		}
+	}
+	return nil
+}
+
+// 校验待导入的文件与 memtable 以及各层已有数据之间不存在 key 范围的重叠. 需要在持有 dataLock 的情况下调用
+func (t *Tree) checkIngestOverlap(files []*ingestFile) error {
+	if err := t.checkMemTableOverlap(files); err != nil {
+		return err
+	}
+	for level := range t.nodes {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			for _, file := range files {
+				if bytes.Compare(file.largest, node.Start()) >= 0 && bytes.Compare(file.smallest, node.End()) <= 0 {
+					t.levelLocks[level].RUnlock()
+					return fmt.Errorf("%w: %s overlaps %s", ErrIngestOverlap, file.path, node.file)
+				}
+			}
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return nil
+}
+
+// 校验待导入的文件与 memtable 之间不存在 key 范围的重叠：各 memtable 定位到文件中最小的 key，首个不小于它的 key 不能落在文件的 key 范围内.
+// 需要在持有 dataLock 的情况下调用
+func (t *Tree) checkMemTableOverlap(files []*ingestFile) error {
+	memTables := []memtable.MemTable{t.memTable}
+	for _, item := range t.rOnlyMemTable {
+		memTables = append(memTables, item.memTable)
+	}
+	for _, memTable := range memTables {
+		for _, file := range files {
+			if kv, ok := seekMemTable(memTable, file.smallest); ok && bytes.Compare(kv.Key, file.largest) <= 0 {
+				return fmt.Errorf("%w: %s overlaps memtable", ErrIngestOverlap, file.path)
+			}
+		}
+	}
+	return nil
+}
+
+// 获取 memtable 中首个 key >= 目标 key 的 kv 对. memtable 没有实现 memtable.Seeker 时退化为在全部数据中二分查找
+func seekMemTable(memTable memtable.MemTable, key []byte) (*memtable.KV, bool) {
+	if seeker, ok := memTable.(memtable.Seeker); ok {
+		return seeker.Seek(key)
+	}
+	kvs := memTable.All()
+	i := sort.Search(len(kvs), func(i int) bool {
+		return bytes.Compare(kvs[i].Key, key) >= 0
+	})
+	if i == len(kvs) {
+		return nil, false
+	}
+	return kvs[i], true
+}
@@ -0,0 +1,131 @@
+package lsmart_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/testutil"
+)
+
+// 与已有数据重叠的导入被拒绝，文件保留在原路径；导入中途失败时已经重命名的文件移回原路径，故障排除后可以重新导入
+func TestIngestOverlapAndRollback(t *testing.T) {
+	tree, dir := testutil.NewTree(t, lsmart.WithSSTSize(4096))
+	ext := t.TempDir()
+	want := make(map[string]string)
+	put := func(i int) {
+		key, value := fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	// key00000 ~ key00999 落盘到 sstable，key05000 保留在 memtable 中
+	for i := 0; i < 1000; i++ {
+		put(i)
+	}
+	if err := testutil.Step(tree); err != nil {
+		t.Fatal(err)
+	}
+	put(5000)
+
+	overlapSST := buildIngestFile(t, ext, "overlap_sst.sst", 500, 600)
+	overlapMem := buildIngestFile(t, ext, "overlap_mem.sst", 4990, 5010)
+	for _, file := range []string{overlapSST, overlapMem} {
+		if err := tree.IngestSST([]string{file}); !errors.Is(err, lsmart.ErrIngestOverlap) {
+			t.Fatalf("ingest %s: expect ErrIngestOverlap, got %v", file, err)
+		}
+		assertExists(t, file)
+	}
+
+	// 以非空目录占用第二个文件的目标路径，第一个文件重命名之后导入失败
+	a := buildIngestFile(t, ext, "a.sst", 2000, 2100)
+	b := buildIngestFile(t, ext, "b.sst", 3000, 3100)
+	blocker := filepath.Join(dir, "6_2.sst")
+	if err := os.MkdirAll(filepath.Join(blocker, "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.IngestSST([]string{a, b}); err == nil {
+		t.Fatal("expect ingest to fail")
+	}
+	assertExists(t, a)
+	assertExists(t, b)
+	if _, err := os.Stat(filepath.Join(dir, "6_1.sst")); !os.IsNotExist(err) {
+		t.Fatalf("renamed sstable is not moved back: %v", err)
+	}
+	testutil.AssertContents(t, tree, want)
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.IngestSST([]string{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]int{{2000, 2100}, {3000, 3100}} {
+		for i := r[0]; i < r[1]; i++ {
+			want[fmt.Sprintf("key%05d", i)] = fmt.Sprintf("ingested%05d", i)
+		}
+	}
+	testutil.AssertContents(t, tree, want)
+}
+
+// 导入与并发写入交错执行时，写入要么使导入因重叠被拒绝，要么在导入之后生效，最新写入的数据始终可见
+func TestIngestConcurrentWrites(t *testing.T) {
+	tree, _ := testutil.NewTree(t)
+	ext := t.TempDir()
+	for round := 0; round < 20; round++ {
+		from := round * 100
+		file := buildIngestFile(t, ext, fmt.Sprintf("%d.sst", round), from, from+100)
+		key := []byte(fmt.Sprintf("key%05d", from+50))
+
+		done := make(chan error, 1)
+		go func() {
+			done <- tree.IngestSST([]string{file})
+		}()
+		if err := tree.Put(key, []byte("latest")); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; errors.Is(err, lsmart.ErrIngestOverlap) {
+			assertExists(t, file)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if value, ok, err := tree.Get(key); err != nil || !ok || string(value) != "latest" {
+			t.Fatalf("round %d: get %q %v %v", round, value, ok, err)
+		}
+	}
+}
+
+// 构造一个包含 [from, to) 范围内 key 的待导入 sstable
+func buildIngestFile(tb testing.TB, dir, name string, from, to int) string {
+	tb.Helper()
+	conf, err := lsmart.NewConfig(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	writer, err := lsmart.NewSSTWriter(name, conf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer writer.Close()
+	for i := from; i < to; i++ {
+		value := lsmart.EncodeInternalValue(lsmart.OpPut, 0, []byte(fmt.Sprintf("ingested%05d", i)))
+		if err := writer.Append([]byte(fmt.Sprintf("key%05d", i)), value); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if _, _, _, err := writer.Finish(); err != nil {
+		tb.Fatal(err)
+	}
+	return filepath.Join(dir, name)
+}
+
+func assertExists(tb testing.TB, file string) {
+	tb.Helper()
+	if _, err := os.Stat(file); err != nil {
+		tb.Fatalf("%s: %v", file, err)
+	}
+}
@@ -0,0 +1,136 @@
+package lsmart
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/cccccxxy/lsmart/util"
+)
+
+// Iterator 按照 key 升序遍历整棵 lsm tree 用户数据的迭代器. 同一个 key 只返回最新版本的数据，已删除的 key 不会被返回.
+// 迭代器基于构造时刻的 memtable 快照以及 sstable 节点集合，使用完毕后需要调用 Close 释放节点.
+// 配置了 key 变换器时，记录按照存储 key 的顺序返回，与用户 key 的顺序可能不一致，范围边界通过逐条过滤实现
+type Iterator struct {
+	tree       *Tree
+	iter       *mergeIterator
+	start, end []byte // 遍历范围 [start, end)，为空时表示不设边界
+	key, value []byte // 当前记录的用户 key、value
+	valid      bool
+	err        error
+	now        int64 // 构造迭代器的时刻，unix 纳秒. 在此之前过期的记录均不可见
+}
+
+// NewIterator 构造一个遍历 [start, end) 范围内用户数据的迭代器，初始指向范围内的首条记录. start、end 为空时表示不设边界
+func (t *Tree) NewIterator(start, end []byte) *Iterator {
+	// 未配置 key 变换器时，存储 key 与用户 key 的顺序一致，各数据源直接定位到 start，并跳过与范围没有重叠的 sstable.
+	// 否则范围内的记录可能分布在任意位置，需要从头开始遍历
+	var iters []recordIterator
+	if t.conf.KeyTransformer == nil {
+		iters, _ = t.sourceIterators(start, end)
+	} else {
+		iters, _ = t.sourceIterators(nil, nil)
+	}
+	it := Iterator{
+		tree:  t,
+		iter:  newMergeIterator(iters),
+		start: start,
+		end:   end,
+		now:   time.Now().UnixNano(),
+	}
+	it.findNext()
+	return &it
+}
+
+// Scan 构造一个遍历所有以 prefix 为前缀的 key 的迭代器. 与 prefix 没有重叠的 sstable 不会被读取
+func (t *Tree) Scan(prefix []byte) *Iterator {
+	return t.NewIterator(prefix, util.PrefixSuccessor(prefix))
+}
+
+// Seek 定位到首条 key >= 目标 key 的记录. 目标 key 小于 start 时定位到 start.
+// 配置了 key 变换器时，按照存储 key 的顺序定位
+func (it *Iterator) Seek(key []byte) {
+	if len(it.start) > 0 && bytes.Compare(key, it.start) < 0 {
+		key = it.start
+	}
+	it.iter.Seek(it.tree.encodeKey(key))
+	it.findNext()
+}
+
+// Valid 当前是否指向一条有效记录
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.valid
+}
+
+// Next 移动到下一条记录
+func (it *Iterator) Next() {
+	it.skipVersions()
+	it.findNext()
+}
+
+// Key 当前记录的用户 key
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value 当前记录的用户 value
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Err 迭代过程中遇到的错误
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close 关闭迭代器，释放持有的 sstable 节点
+func (it *Iterator) Close() {
+	it.iter.Close()
+}
+
+// 从多路归并迭代器当前位置开始，找到首个位于范围内且未被删除的 key. 多路归并迭代器中同一个 key 的首条记录即为最新版本
+func (it *Iterator) findNext() {
+	it.valid, it.key, it.value = false, nil, nil
+	for ; it.iter.Valid(); it.skipVersions() {
+		op, seq, value, err := DecodeInternalValue(it.iter.Value())
+		if err != nil {
+			it.err = err
+			return
+		}
+		key, err := it.tree.decodeKey(it.iter.Key())
+		if err != nil {
+			it.err = err
+			return
+		}
+
+		// 超出范围. 未配置 key 变换器时存储 key 与用户 key 顺序一致，后续记录均超出范围，可以提前终止
+		if len(it.end) > 0 && bytes.Compare(key, it.end) >= 0 {
+			if it.tree.conf.KeyTransformer == nil {
+				return
+			}
+			continue
+		}
+		if len(it.start) > 0 && bytes.Compare(key, it.start) < 0 {
+			continue
+		}
+
+		// 墓碑记录、已过期的记录以及命中按条件删除规则的记录均视为已被删除
+		if op == OpDelete || internalExpired(it.iter.Value(), it.now) || it.tree.deletedByRule(key, seq, value) {
+			continue
+		}
+		it.valid, it.key, it.value = true, key, value
+		return
+	}
+	it.err = it.iter.Err()
+}
+
+// 跳过当前 key 的所有版本，移动到下一个 key 的最新版本
+func (it *Iterator) skipVersions() {
+	if !it.iter.Valid() {
+		return
+	}
+	key := it.iter.Key()
+	it.iter.Next()
+	for it.iter.Valid() && bytes.Equal(it.iter.Key(), key) {
+		it.iter.Next()
+	}
+}
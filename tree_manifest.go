@@ -0,0 +1,147 @@
+package lsmart
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// manifest 文件超过该大小时，在追加下一条编辑记录之前改写为只包含当前状态的快照，避免文件无限增长
+const manifestRewriteSize = 4 << 20
+
+// 启动时按照 manifest 还原整棵树. 目录下还没有 manifest 时，例如由老版本创建的目录，按照 sst 文件名还原并写出 manifest.
+// 只有 manifest 中记录的 sstable 会被加载，其余 sstable 文件是 compact、溢写完成之前宕机或者删除失败时遗留的，加载完毕后一并删除
+func (t *Tree) loadManifest() error {
+	m, err := readDirManifest(t.conf.Dir)
+	if errors.Is(err, errManifestNotExist) {
+		return t.migrateManifest()
+	}
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]struct{}, len(m.Files))
+	for _, f := range m.Files {
+		live[t.sstFile(f.Level, f.Seq)] = struct{}{}
+		if f.Level < 0 || f.Level >= len(t.nodes) {
+			return fmt.Errorf("%w: manifest references sstable %s beyond max level %d", ErrCorruption, t.sstFile(f.Level, f.Seq), len(t.nodes))
+		}
+		node, err := t.openNode(t.sstFile(f.Level, f.Seq))
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: manifest references missing sstable %s", ErrCorruption, t.sstFile(f.Level, f.Seq))
+		}
+		if err != nil {
+			return err
+		}
+		t.registerNode(node)
+	}
+
+	// 已经被 compact 移除的文件同样占用过 seq，新文件的 seq 需要越过它们
+	for level, seq := range m.LevelSeqs {
+		if level < len(t.levelToSeq) && seq > t.levelToSeq[level].Load() {
+			t.levelToSeq[level].Store(seq)
+		}
+	}
+	if err = t.rewriteManifest(); err != nil {
+		return err
+	}
+	t.removeOrphanSSTFiles(live)
+	return nil
+}
+
+// 删除目录下 manifest 没有引用的 sstable 文件. 只处理符合 level_seq.sst 命名的文件，其余文件保持不变
+func (t *Tree) removeOrphanSSTFiles(live map[string]struct{}) {
+	entries, _ := os.ReadDir(t.conf.Dir)
+	for _, entry := range entries {
+		if entry.IsDir() || !isSSTFileName(entry.Name()) {
+			continue
+		}
+		if _, ok := live[entry.Name()]; !ok {
+			_ = os.Remove(path.Join(t.conf.Dir, entry.Name()))
+		}
+	}
+}
+
+// 文件名是否符合 sstable 的命名规则 level_seq.sst
+func isSSTFileName(name string) bool {
+	if !strings.HasSuffix(name, ".sst") {
+		return false
+	}
+	level, seq, ok := strings.Cut(strings.TrimSuffix(name, ".sst"), "_")
+	if !ok {
+		return false
+	}
+	if _, err := strconv.ParseUint(level, 10, 31); err != nil {
+		return false
+	}
+	_, err := strconv.ParseUint(seq, 10, 31)
+	return err == nil
+}
+
+// 按照 sst 文件名还原整棵树，并将结果写为 manifest，此后以 manifest 为准
+func (t *Tree) migrateManifest() error {
+	sstEntries, err := t.getSortedSSTEntries()
+	if err != nil {
+		return err
+	}
+	for _, sstEntry := range sstEntries {
+		if err = t.loadNode(sstEntry); err != nil {
+			return err
+		}
+	}
+	return t.rewriteManifest()
+}
+
+// 将当前已经注册的节点以及各层 seq 写为新的 manifest 文件，并重新打开追加写入口
+func (t *Tree) rewriteManifest() error {
+	if t.manifest != nil {
+		t.manifest.close()
+		t.manifest = nil
+	}
+
+	var m Manifest
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			m.Files = append(m.Files, &ManifestFile{Level: node.level, Seq: node.seq, Size: node.size})
+		}
+		t.levelLocks[level].RUnlock()
+		m.LevelSeqs = append(m.LevelSeqs, t.levelToSeq[level].Load())
+	}
+	sortManifestFiles(m.Files)
+
+	file := path.Join(t.conf.Dir, manifestFileName)
+	if err := WriteManifest(file, &m); err != nil {
+		return err
+	}
+	writer, err := openManifestWriter(file)
+	if err != nil {
+		return err
+	}
+	t.manifest = writer
+	return nil
+}
+
+// 持久化一条编辑记录，返回成功后才能变更内存中的节点. 启动阶段之外需要持有 manifestLock，直至节点变更完毕.
+// 追加失败时文件尾部可能残留写了一半的记录，立即改写为快照，丢弃这条没有生效的编辑记录
+func (t *Tree) logManifest(edit *manifestEdit) error {
+	if t.manifest == nil || t.manifest.size > manifestRewriteSize {
+		if err := t.rewriteManifest(); err != nil {
+			return fmt.Errorf("rewrite manifest: %w", err)
+		}
+	}
+	if err := t.manifest.append(edit); err != nil {
+		_ = t.rewriteManifest()
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	return nil
+}
+
+func (t *Tree) closeManifest() {
+	if t.manifest != nil {
+		t.manifest.close()
+	}
+}
@@ -0,0 +1,48 @@
+package lsmart_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/testutil"
+)
+
+// 重启时删除 manifest 没有引用的 sstable 文件，不符合 sstable 命名的文件保持不变
+func TestOpenRemovesOrphanSSTFiles(t *testing.T) {
+	opts := []lsmart.ConfigOption{lsmart.WithSSTSize(4096)}
+	tree, dir := testutil.NewTree(t, opts...)
+	want := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key, value := fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	if err := testutil.Step(tree); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CloseTree(tree)
+
+	// 模拟 compact 输出写完、manifest 尚未记录时宕机遗留的文件
+	orphan := filepath.Join(dir, "1_999.sst")
+	if err := os.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "notes.sst")
+	if err := os.WriteFile(other, []byte("not an sstable"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tree = testutil.OpenTree(t, dir, opts...)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("orphan sstable is kept: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("unrelated file is removed: %v", err)
+	}
+	testutil.AssertContents(t, tree, want)
+}
@@ -0,0 +1,149 @@
+package lsmart
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// MultiGet 中一个 key 的检索状态
+type multiGetLookup struct {
+	pos   int    // key 在入参中的位置
+	key   []byte // 存储 key
+	value []byte // 检索到的内部 value，为空时说明尚未检索到
+}
+
+// MultiGet 批量读取一组 key，返回各 key 对应的 value 以及是否存在，顺序与入参一致.
+// 所有 key 排序后依次检索 memtable 以及各层 sstable：memtable 只加一次读锁，每个 sstable 至多访问一次，
+// 落在同一个数据块中的相邻 key 只读取一次数据块，相比逐个调用 Get 摊薄了加锁以及读取数据块的开销
+func (t *Tree) MultiGet(keys [][]byte) ([][]byte, []bool, error) {
+	// 1 将用户 key 变换为存储 key 并排序
+	pending := make([]*multiGetLookup, 0, len(keys))
+	for i, key := range keys {
+		pending = append(pending, &multiGetLookup{pos: i, key: t.encodeKey(key)})
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return bytes.Compare(pending[i].key, pending[j].key) < 0
+	})
+	lookups := pending
+
+	// 2 在同一次持有读锁期间检索读写 memtable 以及只读 memtable. 只读 memtable 按照 index 倒序遍历
+	t.dataLock.RLock()
+	for _, lookup := range pending {
+		if value, ok := t.memTable.Get(lookup.key); ok {
+			lookup.value = value
+			continue
+		}
+		for i := len(t.rOnlyMemTable) - 1; i >= 0; i-- {
+			if value, ok := t.rOnlyMemTable[i].memTable.Get(lookup.key); ok {
+				lookup.value = value
+				break
+			}
+		}
+	}
+	t.dataLock.RUnlock()
+	pending = unresolvedLookups(pending)
+
+	// 3 检索 level0 层. 按照 index 倒序遍历，每个节点只检索 key 范围内尚未检索到的 key
+	t.levelLocks[0].RLock()
+	for i := len(t.nodes[0]) - 1; i >= 0 && len(pending) > 0; i-- {
+		node := t.nodes[0][i]
+		var batch []*multiGetLookup
+		for _, lookup := range pending {
+			if bytes.Compare(lookup.key, node.Start()) >= 0 && bytes.Compare(lookup.key, node.End()) <= 0 {
+				batch = append(batch, lookup)
+			}
+		}
+		if err := t.multiGetNode(node, batch); err != nil {
+			t.levelLocks[0].RUnlock()
+			return nil, nil, err
+		}
+		pending = unresolvedLookups(pending)
+	}
+	t.levelLocks[0].RUnlock()
+
+	// 4 依次检索 level 1 ~ k 层. 有序的 key 落在同一个节点中的部分总是相邻的，归为一批检索
+	for level := 1; level < len(t.nodes) && len(pending) > 0; level++ {
+		t.levelLocks[level].RLock()
+		var (
+			batch    []*multiGetLookup
+			prevNode *Node
+		)
+		for _, lookup := range pending {
+			node, ok := t.levelBinarySearch(level, lookup.key, 0, len(t.nodes[level])-1)
+			if !ok {
+				continue
+			}
+			if node != prevNode && len(batch) > 0 {
+				if err := t.multiGetNode(prevNode, batch); err != nil {
+					t.levelLocks[level].RUnlock()
+					return nil, nil, err
+				}
+				batch = batch[:0]
+			}
+			prevNode = node
+			batch = append(batch, lookup)
+		}
+		if len(batch) > 0 {
+			if err := t.multiGetNode(prevNode, batch); err != nil {
+				t.levelLocks[level].RUnlock()
+				return nil, nil, err
+			}
+		}
+		t.levelLocks[level].RUnlock()
+		pending = unresolvedLookups(pending)
+	}
+
+	// 5 将内部记录解码为用户 value. 墓碑记录、已过期的记录以及命中按条件删除规则的记录视为不存在
+	now := time.Now().UnixNano()
+	values := make([][]byte, len(keys))
+	found := make([]bool, len(keys))
+	for _, lookup := range lookups {
+		if lookup.value == nil {
+			continue
+		}
+		op, seq, value, err := DecodeInternalValue(lookup.value)
+		if err != nil {
+			t.recordCorruption(err)
+			return nil, nil, err
+		}
+		if op == OpDelete || internalExpired(lookup.value, now) || t.deletedByRule(keys[lookup.pos], seq, value) {
+			continue
+		}
+		values[lookup.pos], found[lookup.pos] = value, true
+	}
+	return values, found, nil
+}
+
+// 在一个节点中批量检索一组升序排列的 key
+func (t *Tree) multiGetNode(node *Node, batch []*multiGetLookup) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	keys := make([][]byte, 0, len(batch))
+	for _, lookup := range batch {
+		keys = append(keys, lookup.key)
+	}
+	values, found, err := node.multiGet(keys)
+	if err != nil {
+		t.recordCorruption(err)
+		return err
+	}
+	for i, lookup := range batch {
+		if found[i] {
+			lookup.value = values[i]
+		}
+	}
+	return nil
+}
+
+// 过滤出尚未检索到的 key
+func unresolvedLookups(lookups []*multiGetLookup) []*multiGetLookup {
+	pending := lookups[:0:0]
+	for _, lookup := range lookups {
+		if lookup.value == nil {
+			pending = append(pending, lookup)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,49 @@
+package lsmart
+
+import (
+	"bytes"
+	"context"
+)
+
+// PutIf 比较并写入：key 当前的 value 与 expectedOld 一致时才写入 value，返回是否写入成功，用于在 lsm tree 之上实现乐观并发控制.
+// expectedOld 为 nil 时要求 key 当前不存在，长度为 0 的非 nil 切片则要求 key 存在且 value 为空.
+// 读取、比较与写入期间全程持有写锁，与其他写入操作互斥
+func (t *Tree) PutIf(key, value, expectedOld []byte) (bool, error) {
+	if err := t.validateKey(key, OpPut); err != nil {
+		return false, err
+	}
+	storageKey := t.encodeKey(key)
+
+	t.dataLock.Lock()
+	defer t.dataLock.Unlock()
+
+	// 持有写锁期间 memtable 不会被溢写移除，从 memtable 读不到时再读 sstable，与 Get 的检索顺序一致
+	internalValue, ok := t.getMemTableLocked(storageKey, nil)
+	if !ok {
+		var err error
+		if internalValue, ok, err = t.getSSTable(context.Background(), storageKey, nil); err != nil {
+			return false, err
+		}
+	}
+
+	var current []byte
+	if ok {
+		var err error
+		if current, ok, err = t.userValue(key, internalValue); err != nil {
+			return false, err
+		}
+	}
+
+	if expectedOld == nil {
+		if ok {
+			return false, nil
+		}
+	} else if !ok || !bytes.Equal(current, expectedOld) {
+		return false, nil
+	}
+
+	if err := t.writeLocked([]*batchEntry{{op: OpPut, key: storageKey, value: value}}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,74 @@
+package lsmart
+
+import "bytes"
+
+// RangeOverlap level1 ~ levelk 层中 key 范围发生重叠的两个 sstable.
+// 这些层级中的 sstable 应当全局有序且互不重叠，否则 Get 只会检索其中一个 sstable，可能读不到数据
+type RangeOverlap struct {
+	Level      int      // 所在 level 层
+	Files      []string // 发生重叠的 sstable 文件名
+	Start, End []byte   // 重叠部分的 key 范围，闭区间
+}
+
+// RangeGap 同一 level 层中未被任何 sstable 覆盖的 key 范围. 属于正常现象，仅用于了解数据分布
+type RangeGap struct {
+	Level  int    // 所在 level 层
+	After  []byte // 之前所有 sstable 的最大 key，不含
+	Before []byte // 后一个 sstable 的最小 key，不含
+}
+
+// RangeReport 各 level 层 sstable key 范围的结构检查结果
+type RangeReport struct {
+	Overlaps []*RangeOverlap // 违反有序不重叠约束的 key 范围. 会在下一次涉及该范围的 compact 中自动修复
+	Gaps     []*RangeGap     // 未被任何 sstable 覆盖的 key 范围
+}
+
+// Healthy 是否不存在违反约束的 key 范围重叠
+func (r *RangeReport) Healthy() bool {
+	return len(r.Overlaps) == 0
+}
+
+// CheckRanges 检查 level1 ~ levelk 层中 sstable 的 key 范围，报告重叠以及未被覆盖的范围.
+// level0 层的 sstable 之间允许重叠，不参与检查. 检查需要读取每个 sstable 的首个数据块
+func (t *Tree) CheckRanges() *RangeReport {
+	var report RangeReport
+	for level := 1; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		nodes := t.nodes[level]
+		// 与之前所有 sstable 比较时只需关注最大 key 最大的那一个，仅与前一个比较会把被更早的 sstable 覆盖的范围误报为空洞
+		var widest *Node
+		for i, cur := range nodes {
+			if i == 0 {
+				widest = cur
+				continue
+			}
+			// 节点的 Start 是略小于其最小 key 的索引 key，需要读取真实的最小 key 进行比较
+			first := cur.firstKey()
+			if bytes.Compare(widest.End(), first) < 0 {
+				report.Gaps = append(report.Gaps, &RangeGap{
+					Level:  level,
+					After:  widest.End(),
+					Before: first,
+				})
+				widest = cur
+				continue
+			}
+
+			end := widest.End()
+			if bytes.Compare(cur.End(), end) < 0 {
+				end = cur.End()
+			}
+			report.Overlaps = append(report.Overlaps, &RangeOverlap{
+				Level: level,
+				Files: []string{widest.file, cur.file},
+				Start: first,
+				End:   end,
+			})
+			if bytes.Compare(cur.End(), widest.End()) > 0 {
+				widest = cur
+			}
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return &report
+}
@@ -0,0 +1,64 @@
+package lsmart_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/testutil"
+)
+
+// compact 安装新节点的过程中，level1 ~ levelk 层在任意时刻都保持有序且互不重叠
+func TestCheckRangesDuringCompact(t *testing.T) {
+	tree, _ := testutil.NewTree(t,
+		lsmart.WithSSTSize(2048),
+		lsmart.WithSSTDataBlockSize(256),
+		lsmart.WithSSTNumPerLevel(2),
+		lsmart.WithSSTTargetFileSize(512),
+	)
+
+	var (
+		wg      sync.WaitGroup
+		stop    = make(chan struct{})
+		overlap = make(chan *lsmart.RangeOverlap, 1)
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if report := tree.CheckRanges(); !report.Healthy() {
+				overlap <- report.Overlaps[0]
+				return
+			}
+		}
+	}()
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("key%05d", (i*7+round)%3000)
+			if err := tree.Put([]byte(key), []byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tree.CompactAllAndWait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	select {
+	case o := <-overlap:
+		t.Fatalf("level %d: %v overlap in [%s, %s]", o.Level, o.Files, o.Start, o.End)
+	default:
+	}
+	if report := tree.CheckRanges(); !report.Healthy() {
+		t.Fatalf("overlaps after compaction: %d", len(report.Overlaps))
+	}
+}
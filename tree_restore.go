@@ -1,6 +1,8 @@
 package lsmart
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
 	"path"
@@ -8,27 +10,57 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/cccccxxy/lsmart/format"
+	"github.com/cccccxxy/lsmart/memtable"
 	"github.com/cccccxxy/lsmart/wal"
 )
 
 // 读取 sst 文件，还原出整棵树
 func (t *Tree) constructTree() error {
-	// 读取 sst 文件目录下的 sst 文件列表
-	sstEntries, err := t.getSortedSSTEntries()
-	if err != nil {
+	// 清理宕机时遗留的、没有写完的 sstable 临时文件
+	t.removeSSTTempFiles()
+
+	// 按照 manifest 中记录的存活 sstable 逐个加载为 node，添加到 lsm tree 的 nodes 内存切片中
+	if err := t.loadManifest(); err != nil {
 		return err
 	}
 
-	// 遍历每个 sst 文件，将其加载为 node 添加 lsm tree 的 nodes 内存切片中
-	for _, sstEntry := range sstEntries {
-		if err = t.loadNode(sstEntry); err != nil {
-			return err
-		}
+	// 开启启动校验时，逐个校验所有 sst 文件，发现问题立即返回
+	if t.conf.ParanoidChecks {
+		return t.paranoidCheck()
 	}
+	return nil
+}
 
+// 逐个校验已加载的 sst 文件的属性块、过滤器、索引以及全部数据块，返回首个问题以及所在的文件名.
+// 内容校验未通过时返回的错误满足 errors.Is(err, ErrCorruption)
+func (t *Tree) paranoidCheck() error {
+	for level := 0; level < len(t.nodes); level++ {
+		for _, node := range t.nodes[level] {
+			if _, err := node.Properties(); err != nil {
+				return fmt.Errorf("paranoid check sstable %s: read properties: %w", node.file, err)
+			}
+			var report VerifyReport
+			t.deepVerifyNode(node, &report)
+			if !report.OK() {
+				issue := report.Issues[0]
+				return fmt.Errorf("%w: paranoid check sstable %s: %s (%d issues)", ErrCorruption, issue.File, issue.Err, len(report.Issues))
+			}
+		}
+	}
 	return nil
 }
 
+// 移除数据目录下写了一半的 sstable 临时文件
+func (t *Tree) removeSSTTempFiles() {
+	entries, _ := os.ReadDir(t.conf.Dir)
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".sst"+sstTempSuffix) {
+			_ = os.Remove(path.Join(t.conf.Dir, entry.Name()))
+		}
+	}
+}
+
 func (t *Tree) getSortedSSTEntries() ([]fs.DirEntry, error) {
 	allEntries, err := os.ReadDir(t.conf.Dir)
 	if err != nil {
@@ -61,35 +93,54 @@ func (t *Tree) getSortedSSTEntries() ([]fs.DirEntry, error) {
 
 // 将一个 sst 文件作为一个 node 加载进入 lsm tree 的拓扑结构中
 func (t *Tree) loadNode(sstEntry fs.DirEntry) error {
-	// 创建 sst 文件对应的 reader
-	sstReader, err := NewSSTReader(sstEntry.Name(), t.conf)
+	node, err := t.openNode(sstEntry.Name())
 	if err != nil {
 		return err
 	}
+	t.registerNode(node)
+	return nil
+}
 
-	// 读取各 block 块对应的 filter 信息
-	blockToFilter, err := sstReader.ReadFilter()
+// 打开 lsm tree 目录下的一个 sst 文件，构造出对应的 node，尚未插入到 lsm tree 中
+func (t *Tree) openNode(file string) (*Node, error) {
+	// 创建 sst 文件对应的 reader
+	sstReader, err := NewSSTReader(file, t.conf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// 读取 index 信息
-	index, err := sstReader.ReadIndex()
-	if err != nil {
-		return err
-	}
+	// 解析 sst 文件名，得知 sst 文件对应的 level 以及 seq 号
+	level, seq := getLevelSeqFromSSTFile(file)
 
 	// 获取 sst 文件的大小，单位 byte
 	size, err := sstReader.Size()
 	if err != nil {
-		return err
+		sstReader.Close()
+		return nil, err
 	}
 
-	// 解析 sst 文件名，得知 sst 文件对应的 level 以及 seq 号
-	level, seq := getLevelSeqFromSSTFile(sstEntry.Name())
-	// 将 sst 文件作为一个 node 插入到 lsm tree 中
-	t.insertNodeWithReader(sstReader, level, seq, size, blockToFilter, index)
-	return nil
+	// 开启延迟加载时，只读取属性块中记录的 key 范围，过滤器与索引在首次访问时读取.
+	// 早期写入的属性块中没有 key 范围，仍然在启动时读取
+	if t.conf.LazyMetadata {
+		if props, err := sstReader.ReadProperties(); err == nil && len(props.SmallestKey) > 0 {
+			return newLazyNode(t.conf, file, sstReader, level, seq, size, props.SmallestKey, props.LargestKey), nil
+		}
+	}
+
+	// 读取各 block 块对应的 filter 信息
+	blockToFilter, err := sstReader.ReadFilter()
+	if err != nil {
+		sstReader.Close()
+		return nil, err
+	}
+
+	// 读取常驻内存的 index 信息
+	index, err := sstReader.ReadPinnedIndex()
+	if err != nil {
+		sstReader.Close()
+		return nil, err
+	}
+	return NewNode(t.conf, file, sstReader, level, seq, size, blockToFilter, index), nil
 }
 
 func getLevelSeqFromSSTFile(file string) (level int, seq int32) {
@@ -102,8 +153,9 @@ func getLevelSeqFromSSTFile(file string) (level int, seq int32) {
 
 // 读取 wal 还原出 memtable
 func (t *Tree) constructMemtable() error {
-	// 1 读 wal 目录，获取所有的 wal 文件
+	// 1 读 wal 目录，获取所有的 wal 文件，并还原等待复用的 wal 文件
 	raw, _ := os.ReadDir(path.Join(t.conf.Dir, "walfile"))
+	t.restoreWALRecycle()
 
 	// 2 wal 文件除杂
 	var wals []fs.DirEntry
@@ -120,57 +172,209 @@ func (t *Tree) constructMemtable() error {
 		wals = append(wals, entry)
 	}
 
-	// 3 倘若 wal 目录不存在或者 wal 文件不存在，则构造一个新的 memtable
+	// 3 构造回放限速器，统计需要回放的 wal 文件总大小，用于汇报回放进度
+	t.replay = wal.NewReplayLimiter(t.conf.WALReplayRate, t.walReplaySize(wals), t.conf.WALReplayProgress)
+	defer t.replay.Finish()
+
+	// 共享 wal 模式下，独立 wal 文件与共享 wal 文件需要一并还原
+	if t.conf.SharedWAL {
+		return t.restoreSharedMemTable(wals)
+	}
+
+	// 倘若目录下遗留有共享 wal 文件，说明此前以共享 wal 模式运行，需要以相同模式打开，避免数据丢失
+	if len(t.listSharedWALSegments()) > 0 {
+		return errors.New("shared wal file exists, tree must be opened with WithSharedWAL")
+	}
+
+	// 4 倘若 wal 目录不存在或者 wal 文件不存在，则构造一个新的 memtable
 	if len(wals) == 0 {
-		t.newMemTable()
-		return nil
+		return t.newMemTable()
 	}
 
-	// 4 依次还原 memtable. 最晚一个 memtable 作为读写 memtable
+	// 5 依次还原 memtable. 最晚一个 memtable 作为读写 memtable
 	// 前置 memtable 作为只读 memtable，分别添加到内存 slice 和 channel 中.
 	return t.restoreMemTable(wals)
 }
 
 // 基于 wal 文件还原出一系列只读 memtable 和唯一一个读写 memtable
 func (t *Tree) restoreMemTable(wals []fs.DirEntry) error {
-	// 1 wal 排序，index 单调递增，数据实时性也随之单调递增
+	// 1 wal 按照 memtable index 分组，index 单调递增，数据实时性也随之单调递增
+	groups := t.groupWALFiles(wals)
+
+	// 2 依次还原 memtable，添加到内存和 channel. 同一 memtable 的分段依次回放到同一个 memtable 中
+	for i, group := range groups {
+		var (
+			memtable  = t.conf.MemTableConstructor()
+			walReader *wal.WALReader
+			err       error
+		)
+		for _, file := range group.files {
+			if walReader, err = t.restoreWALFile(file, memtable); err != nil {
+				return err
+			}
+		}
+
+		t.memTableIndex = group.index
+		last := len(group.files) - 1
+		file := group.files[last]
+		// 倘若是最后一个 memtable，且最后一个分段为当前格式版本，则 memtable 作为读写 memtable，继续追加写入该分段.
+		// 多路 wal 无法重新对应到各路写入口，跳过了异常记录的分段下次启动时仍会遇到异常记录，memtable 均作为只读 memtable 落盘
+		if i == len(groups)-1 && walReader.Version() == format.Current(format.KindWAL) &&
+			t.conf.WALStreams <= 1 && walFileToStream(file) == 0 && len(walReader.Skipped()) == 0 {
+			walWriter, err := t.reopenWAL(file, walReader)
+			if err == nil {
+				t.memTable = memtable
+				_, t.walSegment = walFileToSegment(path.Base(file))
+				t.walSegments = group.files[:last]
+				t.walWriter = walWriter
+				continue
+			}
+			// 无法继续追加写入时，开启 WALFallback 则作为只读 memtable 落盘，否则返回错误
+			if !t.conf.WALFallback {
+				return err
+			}
+		}
+
+		// memtable 作为只读 memtable，需要追加到只读 slice 以及 channel 中，继续推进完成溢写落盘流程.
+		// compact 协程此时已经启动，溢写完成后会并发地从只读 slice 中移除 memtable，追加时需要持有 dataLock
+		memTableCompactItem := memTableCompactItem{
+			walFile:       file,
+			walSegments:   group.files[:last],
+			memTableIndex: t.memTableIndex,
+			memTable:      memtable,
+		}
+		t.dataLock.Lock()
+		t.rOnlyMemTable = append(t.rOnlyMemTable, &memTableCompactItem)
+		t.dataLock.Unlock()
+		t.memCompactC <- &memTableCompactItem
+	}
+
+	// 最后一个 wal 文件不能继续追加写入时，需要构造一个新的读写 memtable
+	if t.memTable == nil {
+		t.memTableIndex++
+		return t.newMemTable()
+	}
+	return nil
+}
+
+// 以追加模式重新打开最后一个 wal 文件. 尾部存在写了一半的记录，或者回收的文件中存在上一代遗留的记录时先截断，
+// 否则后续追加的记录排在其后，无法被回放
+func (t *Tree) reopenWAL(file string, walReader *wal.WALReader) (*wal.WALWriter, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if walReader.Truncated() || info.Size() > walReader.ValidSize() {
+		if err = os.Truncate(file, walReader.ValidSize()); err != nil {
+			return nil, err
+		}
+	}
+	walWriter, err := wal.NewWALWriter(file)
+	if err != nil {
+		return nil, err
+	}
+	t.setupWAL(walWriter)
+	return walWriter, nil
+}
+
+// 同一 memtable 对应的独立 wal 文件，按照分段序号排列
+type walGroup struct {
+	index int
+	files []string
+}
+
+// 将独立 wal 文件按照 memtable index 分组，组间按照 index 递增排列. 组内首路 wal 的各个分段在前，其余各路在后
+func (t *Tree) groupWALFiles(wals []fs.DirEntry) []*walGroup {
 	sort.Slice(wals, func(i, j int) bool {
-		indexI := walFileToMemTableIndex(wals[i].Name())
-		indexJ := walFileToMemTableIndex(wals[j].Name())
-		return indexI < indexJ
+		indexI, segmentI := walFileToSegment(wals[i].Name())
+		indexJ, segmentJ := walFileToSegment(wals[j].Name())
+		if indexI != indexJ {
+			return indexI < indexJ
+		}
+		if streamI, streamJ := walFileToStream(wals[i].Name()), walFileToStream(wals[j].Name()); streamI != streamJ {
+			return streamI < streamJ
+		}
+		return segmentI < segmentJ
 	})
 
-	// 2 依次还原 memtable，添加到内存和 channel
-	for i := 0; i < len(wals); i++ {
-		name := wals[i].Name()
-		file := path.Join(t.conf.Dir, "walfile", name)
-
-		// 构建与 wal 文件对应的 walReader
-		walReader, err := wal.NewWALReader(file)
-		if err != nil {
-			return err
+	var groups []*walGroup
+	for _, entry := range wals {
+		index := walFileToMemTableIndex(entry.Name())
+		if len(groups) == 0 || groups[len(groups)-1].index != index {
+			groups = append(groups, &walGroup{index: index})
 		}
-		defer walReader.Close()
+		group := groups[len(groups)-1]
+		group.files = append(group.files, path.Join(t.conf.Dir, "walfile", entry.Name()))
+	}
+	return groups
+}
 
-		// 通过 reader 读取 wal 文件内容，将数据注入到 memtable 中
-		memtable := t.conf.MemTableConstructor()
-		if err = walReader.RestoreToMemtable(memtable); err != nil {
-			return err
+// 需要回放的 wal 文件总大小，单位 byte. 共享 wal 模式下包含共享 wal 的各个分段
+func (t *Tree) walReplaySize(wals []fs.DirEntry) int64 {
+	var size int64
+	for _, entry := range wals {
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
 		}
+	}
+	if t.conf.SharedWAL {
+		for _, segment := range t.listSharedWALSegments() {
+			if info, err := os.Stat(t.sharedWALSegmentFile(segment)); err == nil {
+				size += info.Size()
+			}
+		}
+	}
+	return size
+}
 
-		if i == len(wals)-1 { // 倘若是最后一个 wal 文件，则 memtable 作为读写 memtable
-			t.memTable = memtable
-			t.memTableIndex = walFileToMemTableIndex(name)
-			t.walWriter, _ = wal.NewWALWriter(file)
-		} else { // memtable 作为只读 memtable，需要追加到只读 slice 以及 channel 中，继续推进完成溢写落盘流程
-			memTableCompactItem := memTableCompactItem{
-				walFile:  file,
-				memTable: memtable,
+// ReplayProgress 启动时回放 wal 的进度，返回已回放的字节数以及需要回放的总字节数
+func (t *Tree) ReplayProgress() (replayed, total int64) {
+	return t.replay.Progress()
+}
+
+// 版本 1 的 wal 文件中存放的是用户 value，需要统一转换为内部记录的 value
+func upgradeLegacyMemTable(version format.Version, memTable memtable.MemTable) {
+	if version >= 2 {
+		return
+	}
+	for _, kv := range memTable.All() {
+		memTable.Put(kv.Key, EncodeInternalValue(OpPut, 0, kv.Value))
+	}
+}
+
+// 基于 memtable、sstable 以及 wal 检查点中记录的最大 seq，还原出 lsm tree 的 seq
+func (t *Tree) restoreSeq() error {
+	// 1 首先读取 memtable 中的记录. 只读 memtable 落盘后才会从 slice 中移除，因此需要先于 sstable 读取，避免遗漏
+	t.dataLock.Lock()
+	defer t.dataLock.Unlock()
+	if t.walRecovery.Checkpoint > t.seq {
+		t.seq = t.walRecovery.Checkpoint
+	}
+	memTables := []memtable.MemTable{t.memTable}
+	for _, item := range t.rOnlyMemTable {
+		memTables = append(memTables, item.memTable)
+	}
+	for _, memTable := range memTables {
+		for _, kv := range memTable.All() {
+			_, seq, _, err := DecodeInternalValue(kv.Value)
+			if err != nil {
+				return err
+			}
+			if seq > t.seq {
+				t.seq = seq
 			}
+		}
+	}
 
-			t.rOnlyMemTable = append(t.rOnlyMemTable, &memTableCompactItem)
-			t.memCompactC <- &memTableCompactItem
+	// 2 再读取各 sstable footer 中记录的最大 seq
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			if seq := node.sstReader.MaxSeq(); seq > t.seq {
+				t.seq = seq
+			}
 		}
+		t.levelLocks[level].RUnlock()
 	}
 	return nil
 }
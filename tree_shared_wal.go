@@ -0,0 +1,387 @@
+package lsmart
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cccccxxy/lsmart/format"
+	"github.com/cccccxxy/lsmart/memtable"
+	"github.com/cccccxxy/lsmart/wal"
+)
+
+// 共享 wal 分段的默认大小阈值相对于 sstable 大小的倍数，一个分段通常包含若干个 memtable 的记录
+const sharedWALSegmentMemTables = 4
+
+// 共享 wal 模式下已经写满的分段
+type sharedWALSegment struct {
+	segment   int // 分段序号
+	lastIndex int // 分段中记录所属 memtable 的最大 index. 截断水位超过该值时整个分段可以删除
+}
+
+// 共享 wal 模式下，标识只读 memtable 的记录位于共享 wal 中. 首个分段同样使用该文件名，兼容分段之前的版本
+func (t *Tree) sharedWALFile() string {
+	return path.Join(t.conf.Dir, "walfile", "shared.log")
+}
+
+// 共享 wal 的分段文件. 首个分段命名为 shared.log，后续分段命名为 shared_segment.log
+func (t *Tree) sharedWALSegmentFile(segment int) string {
+	if segment == 0 {
+		return t.sharedWALFile()
+	}
+	return path.Join(t.conf.Dir, "walfile", fmt.Sprintf("shared_%d.log", segment))
+}
+
+// 解析共享 wal 分段文件名中的分段序号
+func sharedWALSegmentOf(name string) (int, bool) {
+	if name == "shared.log" {
+		return 0, true
+	}
+	if !strings.HasPrefix(name, "shared_") || !strings.HasSuffix(name, ".log") {
+		return 0, false
+	}
+	segment, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "shared_"), ".log"))
+	if err != nil || segment <= 0 {
+		return 0, false
+	}
+	return segment, true
+}
+
+// 列出目录下所有共享 wal 分段的序号，按照升序排列
+func (t *Tree) listSharedWALSegments() []int {
+	entries, _ := os.ReadDir(path.Join(t.conf.Dir, "walfile"))
+	var segments []int
+	for _, entry := range entries {
+		if segment, ok := sharedWALSegmentOf(entry.Name()); ok && !entry.IsDir() {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+	return segments
+}
+
+// 共享 wal 分段的大小阈值
+func (t *Tree) sharedWALSegmentSize() int64 {
+	if t.conf.WALSegmentSize > 0 {
+		return t.conf.WALSegmentSize
+	}
+	return int64(t.conf.SSTSize) * sharedWALSegmentMemTables
+}
+
+// 共享 wal 模式下，当前分段写满时切换到新的分段继续写入. 写满的分段中可能包含读写 memtable 已经写入的记录，
+// 因此记录所属的最大 index 取切换时读写 memtable 的 index. 刷盘或者新分段创建失败时继续写入当前分段，下次写入时重试
+func (t *Tree) rollSharedWALLocked() {
+	if t.walWriter == nil || t.walWriter.Size() < t.sharedWALSegmentSize() {
+		return
+	}
+
+	// 切换之前先将写满的分段刷盘，保证 Sync 建立的持久化点覆盖此前所有的分段
+	if err := t.walWriter.Sync(); err != nil {
+		return
+	}
+	file := t.sharedWALSegmentFile(t.sharedSegment + 1)
+	walWriter, err := wal.NewSharedWALWriter(file, t.memTableIndex)
+	if err != nil {
+		return
+	}
+	if err = t.syncWALDir(); err != nil {
+		walWriter.Close()
+		_ = os.Remove(file)
+		return
+	}
+	t.setupWAL(walWriter)
+	t.walWriter.Close()
+	t.walWriter = walWriter
+
+	t.sharedSegmentsLock.Lock()
+	t.sharedSegments = append(t.sharedSegments, &sharedWALSegment{segment: t.sharedSegment, lastIndex: t.memTableIndex})
+	t.sharedSegmentsLock.Unlock()
+	t.sharedSegment++
+
+	// 老分段被删除之后检查点随之丢失，新分段开头重新写入
+	t.writeWALCheckpointLocked()
+}
+
+// 共享 wal 截断水位的持久化文件
+func (t *Tree) sharedWALMarkFile() string {
+	return path.Join(t.conf.Dir, "walfile", "shared.mark")
+}
+
+// 推进共享 wal 的截断水位，水位取仍未落盘的 memtable 中最小的 index. 水位持久化之后，删除记录全部位于水位之下的已写满分段，回收磁盘空间.
+// 只在 compact 协程中执行，计算水位时只需短暂持有读锁，删除分段不阻塞写入
+func (t *Tree) truncateSharedWAL() {
+	// 1 计算并持久化截断水位
+	t.dataLock.RLock()
+	watermark := t.memTableIndex
+	for _, item := range t.rOnlyMemTable {
+		if item.memTableIndex < watermark {
+			watermark = item.memTableIndex
+		}
+	}
+	t.dataLock.RUnlock()
+	if err := wal.WriteWatermark(t.sharedWALMarkFile(), watermark); err != nil {
+		return
+	}
+
+	// 2 删除记录全部位于水位之下的分段. 分段按照写入的先后顺序排列，其中记录所属的最大 index 单调递增
+	t.sharedSegmentsLock.Lock()
+	var removed []*sharedWALSegment
+	for len(t.sharedSegments) > 0 && t.sharedSegments[0].lastIndex < watermark {
+		removed = append(removed, t.sharedSegments[0])
+		t.sharedSegments = t.sharedSegments[1:]
+	}
+	t.sharedSegmentsLock.Unlock()
+	for _, segment := range removed {
+		_ = os.Remove(t.sharedWALSegmentFile(segment.segment))
+	}
+	if len(removed) > 0 {
+		_ = t.syncWALDir()
+	}
+}
+
+// 将共享 wal 重写为一个新的分段，只包含指定只读 memtable 以及读写 memtable 的记录，之后删除所有老分段.
+// 新分段先写入临时文件并 fsync，再重命名为正式的分段文件. 只在启动时调用
+func (t *Tree) rewriteSharedWALLocked(items []*memTableCompactItem, segments []int) error {
+	next := 0
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	file := t.sharedWALSegmentFile(next)
+	tmp := file + ".tmp"
+	_ = os.Remove(tmp)
+	walWriter, err := wal.NewSharedWALWriter(tmp, t.memTableIndex)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range append(items, &memTableCompactItem{memTableIndex: t.memTableIndex, memTable: t.memTable}) {
+		walWriter.Retag(item.memTableIndex)
+		for _, kv := range item.memTable.All() {
+			if err = walWriter.Write(kv.Key, kv.Value); err != nil {
+				walWriter.Close()
+				_ = os.Remove(tmp)
+				return err
+			}
+		}
+	}
+	// 被替换的老分段中可能包含已经 fsync 的记录，删除之前新分段同样需要 fsync，掉电时才不会丢失
+	if err = walWriter.Sync(); err != nil {
+		walWriter.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	walWriter.Close()
+	if err = os.Rename(tmp, file); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = t.syncWALDir(); err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		_ = os.Remove(t.sharedWALSegmentFile(segment))
+	}
+	t.sharedSegment, t.sharedSegments = next, nil
+	return t.openWALLocked()
+}
+
+// 共享 wal 模式下还原 memtable. 遗留的独立 wal 文件均作为只读 memtable 溢写落盘；
+// 共享 wal 各分段中水位之上的记录按照 memtable index 还原，最晚一个 memtable 作为读写 memtable
+func (t *Tree) restoreSharedMemTable(wals []fs.DirEntry) error {
+	var items []*memTableCompactItem
+
+	// 1 还原独立 wal 文件，index 单调递增，数据实时性也随之单调递增
+	for _, group := range t.groupWALFiles(wals) {
+		memTable := t.conf.MemTableConstructor()
+		for _, file := range group.files {
+			if _, err := t.restoreWALFile(file, memTable); err != nil {
+				return err
+			}
+		}
+
+		t.memTableIndex = group.index
+		last := len(group.files) - 1
+		items = append(items, &memTableCompactItem{
+			walFile:       group.files[last],
+			walSegments:   group.files[:last],
+			memTableIndex: t.memTableIndex,
+			memTable:      memTable,
+		})
+	}
+	if len(items) > 0 {
+		t.memTableIndex++
+	}
+
+	// 2 依次还原共享 wal 各分段中截断水位之上的记录
+	watermark, err := wal.ReadWatermark(t.sharedWALMarkFile())
+	if err != nil {
+		return err
+	}
+	indexes, memTables, segments, rewrite, err := t.readSharedWALSegments(watermark)
+	if err != nil {
+		return err
+	}
+	for i := range indexes {
+		// 最晚一个 memtable 作为读写 memtable
+		if i == len(indexes)-1 {
+			t.memTable = memTables[i]
+			if indexes[i] > t.memTableIndex {
+				t.memTableIndex = indexes[i]
+			}
+			continue
+		}
+
+		items = append(items, &memTableCompactItem{
+			walFile:       t.sharedWALFile(),
+			memTableIndex: indexes[i],
+			memTable:      memTables[i],
+		})
+	}
+	if t.memTable == nil {
+		t.memTable = t.conf.MemTableConstructor()
+	}
+
+	// 老版本的共享 wal 不能继续追加写入，需要以当前格式重写，跳过了异常记录的共享 wal 同样重写，剔除异常记录.
+	// 否则以追加模式打开最后一个分段继续写入
+	if rewrite {
+		var sharedItems []*memTableCompactItem
+		for _, item := range items {
+			if item.walFile == t.sharedWALFile() {
+				sharedItems = append(sharedItems, item)
+			}
+		}
+		if err = t.rewriteSharedWALLocked(sharedItems, t.listSharedWALSegments()); err != nil {
+			return err
+		}
+	} else {
+		if len(segments) > 0 {
+			t.sharedSegment = segments[len(segments)-1].segment
+			t.sharedSegments = segments[:len(segments)-1]
+		}
+		if err = t.openWALLocked(); err != nil && !t.conf.WALFallback {
+			return err
+		}
+	}
+
+	// 3 只读 memtable 追加到只读 slice 以及 channel 中，继续推进完成溢写落盘流程
+	t.rOnlyMemTable = append(t.rOnlyMemTable, items...)
+	for _, item := range items {
+		t.memCompactC <- item
+	}
+	return nil
+}
+
+// 按照分段序号依次读取共享 wal 的各个分段，还原出截断水位之上的一系列 memtable. 同一个 memtable 的记录可能跨越相邻的分段，按照写入顺序合并.
+// 同时返回保留的分段，以及是否需要以当前格式重写. 记录全部位于水位之下的写满分段直接删除；
+// 某个分段尾部存在写了一半的记录或者按时间点恢复提前停止时，之后的分段均是更晚写入的记录，一并删除
+func (t *Tree) readSharedWALSegments(watermark int) ([]int, []memtable.MemTable, []*sharedWALSegment, bool, error) {
+	var (
+		indexes   []int
+		memTables []memtable.MemTable
+		kept      []*sharedWALSegment
+		rewrite   bool
+	)
+	all := t.listSharedWALSegments()
+	for i, segment := range all {
+		file := t.sharedWALSegmentFile(segment)
+		segIndexes, segMemTables, version, skipped, ended, err := t.readSharedWAL(file, watermark)
+		if err != nil {
+			return nil, nil, nil, false, err
+		}
+		rewrite = rewrite || version < format.Current(format.KindSharedWAL) || skipped
+
+		lastIndex := watermark - 1
+		for j, index := range segIndexes {
+			lastIndex = index
+			if len(indexes) > 0 && indexes[len(indexes)-1] == index {
+				for _, kv := range segMemTables[j].All() {
+					memTables[len(memTables)-1].Put(kv.Key, kv.Value)
+				}
+				continue
+			}
+			indexes = append(indexes, index)
+			memTables = append(memTables, segMemTables[j])
+		}
+
+		last := i == len(all)-1 || ended
+		if len(segIndexes) == 0 && !last {
+			_ = os.Remove(file)
+		} else {
+			kept = append(kept, &sharedWALSegment{segment: segment, lastIndex: lastIndex})
+		}
+		if ended {
+			for _, later := range all[i+1:] {
+				_ = os.Remove(t.sharedWALSegmentFile(later))
+			}
+			break
+		}
+	}
+	return indexes, memTables, kept, rewrite, nil
+}
+
+// 读取一个独立 wal 文件，将其中的记录回放到 memtable 中. 返回的 reader 已经关闭，用于查询格式版本以及尾部截断情况
+func (t *Tree) restoreWALFile(file string, memTable memtable.MemTable) (*wal.WALReader, error) {
+	walReader, err := wal.NewWALReader(file)
+	if err != nil {
+		return nil, err
+	}
+	defer walReader.Close()
+	walReader.SetReplayLimiter(t.replay)
+	t.setupWALRecovery(walReader)
+
+	// 多路 wal 中除首路之外的各路与首路之间没有先后顺序，单独还原后按照 seq 合并
+	if walFileToStream(file) > 0 {
+		stream := t.conf.MemTableConstructor()
+		if err = walReader.RestoreToMemtable(stream); err != nil {
+			return nil, err
+		}
+		mergeMemTableBySeq(memTable, stream)
+		return walReader, t.recordWALRecovery(file, walReader, true)
+	}
+
+	if err = walReader.RestoreToMemtable(memTable); err != nil {
+		return nil, err
+	}
+	upgradeLegacyMemTable(walReader.Version(), memTable)
+	return walReader, t.recordWALRecovery(file, walReader, true)
+}
+
+// 读取共享 wal 的一个分段，还原出截断水位之上的一系列 memtable，并返回分段的格式版本、是否跳过了异常记录，
+// 以及回放是否在文件末尾之前结束. 分段不存在时返回空结果
+func (t *Tree) readSharedWAL(file string, watermark int) ([]int, []memtable.MemTable, format.Version, bool, bool, error) {
+	walReader, err := wal.NewSharedWALReader(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, format.Current(format.KindSharedWAL), false, false, nil
+	}
+	if err != nil {
+		return nil, nil, 0, false, false, err
+	}
+	defer walReader.Close()
+	walReader.SetReplayLimiter(t.replay)
+	t.setupWALRecovery(walReader)
+
+	indexes, memTables, err := walReader.RestoreToMemtables(watermark, t.conf.MemTableConstructor)
+	if err != nil {
+		return nil, nil, 0, false, false, err
+	}
+	// 当前格式版本的共享 wal 会被继续追加写入，尾部存在写了一半的记录，或者按时间点恢复提前停止时先截断
+	if err = t.recordWALRecovery(file, walReader, false); err != nil {
+		return nil, nil, 0, false, false, err
+	}
+	ended := walReader.Truncated() || walReader.Stopped()
+	if ended && walReader.Version() == format.Current(format.KindSharedWAL) {
+		if err = os.Truncate(file, walReader.ValidSize()); err != nil {
+			return nil, nil, 0, false, false, err
+		}
+	}
+	for _, memTable := range memTables {
+		upgradeLegacyMemTable(walReader.Version(), memTable)
+	}
+	return indexes, memTables, walReader.Version(), len(walReader.Skipped()) > 0, ended, nil
+}
@@ -0,0 +1,101 @@
+package lsmart_test
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cccccxxy/lsmart"
+	"github.com/cccccxxy/lsmart/testutil"
+)
+
+// 共享 wal 分段的记录全部落盘之后整个分段被删除，不会随着写入无限增长
+func TestSharedWALDropsFlushedSegments(t *testing.T) {
+	tree, dir := testutil.NewTree(t, lsmart.WithSharedWAL(), lsmart.WithSSTSize(4096), lsmart.WithWALSegmentSize(1024))
+	want := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key, value := fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	if err := testutil.Step(tree); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := sharedWALSegments(t, dir)
+	if len(segments) > 2 {
+		t.Fatalf("flushed segments are kept: %v", segments)
+	}
+	for _, segment := range segments {
+		if filepath.Base(segment) == "shared.log" {
+			t.Fatalf("the first segment is never dropped: %v", segments)
+		}
+	}
+
+	tree = testutil.ReopenTree(t, tree, dir, lsmart.WithSharedWAL(), lsmart.WithSSTSize(4096), lsmart.WithWALSegmentSize(1024))
+	testutil.AssertContents(t, tree, want)
+}
+
+// 崩溃之后，分布在多个分段中的 memtable 记录全部被回放
+func TestSharedWALReplaysAcrossSegments(t *testing.T) {
+	opts := []lsmart.ConfigOption{lsmart.WithSharedWAL(), lsmart.WithSSTSize(1 << 20), lsmart.WithWALSegmentSize(1024)}
+	tree, dir := testutil.NewTree(t, opts...)
+	want := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key, value := fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i)
+		if err := tree.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	if err := tree.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不关闭 lsm tree，直接复制目录模拟崩溃
+	crashed := t.TempDir()
+	copyDir(t, dir, crashed)
+	if segments := sharedWALSegments(t, crashed); len(segments) < 2 {
+		t.Fatalf("expect records spread over several segments, got %v", segments)
+	}
+
+	restored := testutil.OpenTree(t, crashed, opts...)
+	testutil.AssertContents(t, restored, want)
+}
+
+func sharedWALSegments(tb testing.TB, dir string) []string {
+	tb.Helper()
+	segments, err := filepath.Glob(filepath.Join(dir, "walfile", "shared*.log"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return segments
+}
+
+func copyDir(tb testing.TB, src, dst string) {
+	tb.Helper()
+	err := filepath.WalkDir(src, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
@@ -0,0 +1,32 @@
+package lsmart
+
+// SSTInfo 一个 sstable 文件的信息
+type SSTInfo struct {
+	Level      int            // 所在 level 层
+	File       string         // sstable 文件名
+	Size       uint64         // 文件大小，单位 byte
+	Properties *SSTProperties // 文件的属性. 老版本的 sstable 没有属性块，各字段均为零值
+}
+
+// SSTables 列出各 level 层的全部 sstable 文件及其属性，便于排查问题时还原每个文件的来历. 需要读取每个 sstable 的属性块
+func (t *Tree) SSTables() ([]*SSTInfo, error) {
+	var infos []*SSTInfo
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			props, err := node.Properties()
+			if err != nil {
+				t.levelLocks[level].RUnlock()
+				return nil, err
+			}
+			infos = append(infos, &SSTInfo{
+				Level:      level,
+				File:       node.file,
+				Size:       node.size,
+				Properties: props,
+			})
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return infos, nil
+}
@@ -0,0 +1,165 @@
+package lsmart
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cccccxxy/lsmart/filter"
+	"github.com/cccccxxy/lsmart/memtable"
+)
+
+// LevelStats 单个 level 层的统计信息
+type LevelStats struct {
+	Level      int    // level 层
+	Files      int    // sstable 文件个数
+	Size       uint64 // sstable 文件总大小，单位 byte
+	Entries    uint64 // 记录总数，包含墓碑记录以及被更新版本覆盖的记录
+	Tombstones uint64 // 墓碑记录个数
+
+	CompactionScore float64 // compact 得分，多个 level 层等待 compact 时得分高的优先执行. 最深一层为 0
+}
+
+// Stats lsm tree 的运行统计信息
+type Stats struct {
+	Levels    []*LevelStats // 各 level 层的统计信息
+	MemTables int           // memtable 个数，包含读写 memtable 以及尚未溢写的只读 memtable
+	Seq       uint64        // 最近一笔写入记录分配的 seq
+
+	PutsWritten        uint64 // 打开以来写入的记录个数，包含带过期时间的写入
+	DeletesWritten     uint64 // 打开以来写入的墓碑记录个数
+	MemTableEntries    uint64 // 所有 memtable 中的记录总数，包含墓碑记录
+	MemTableTombstones uint64 // 所有 memtable 中的墓碑记录个数
+	Entries            uint64 // memtable 以及各层 sstable 中的记录总数. 同一个 key 的多个版本分别计入
+	Tombstones         uint64 // memtable 以及各层 sstable 中的墓碑记录个数
+
+	ExpiredReclaimed      uint64 // 打开以来溢写、compact 时清理的过期记录个数
+	ExpiredBytesReclaimed uint64 // 打开以来清理过期记录释放的磁盘空间，单位 byte. 改写为墓碑记录时计入 value 的大小，整条丢弃时计入 key 与 value 的大小
+
+	WriteStalls    uint64        // 打开以来写入因只读 memtable 积压而阻塞的次数，包含直接返回 ErrWriteStall 的写入
+	WriteStallTime time.Duration // 打开以来写入因只读 memtable 积压而阻塞的累计耗时
+
+	FlushBytesWritten        uint64             // 打开以来溢写产出的 sstable 总大小，单位 byte
+	Compactions              uint64             // 打开以来完成的 compact 轮数，不包含溢写. 失败放弃的 compact 不计入
+	CompactionTime           time.Duration      // 打开以来各轮 compact 的累计耗时
+	CompactionOutputFiles    uint64             // 打开以来 compact 产出的 sstable 文件个数
+	CompactionBytesRead      uint64             // 打开以来 compact 读取的 sstable 总大小，单位 byte
+	CompactionBytesWritten   uint64             // 打开以来 compact 写入的 sstable 总大小，单位 byte
+	CompactionEntriesMerged  uint64             // 打开以来参与 compact 归并的记录个数
+	CompactionEntriesDropped uint64             // 打开以来 compact 归并之后不再写入的记录个数
+	RecentCompactions        []*CompactionStats // 最近若干轮 compact 的统计明细，按照完成的先后顺序排列
+
+	CompactionWorkers        int           // 单轮 compact 允许的 worker 个数
+	ActiveCompactionWorkers  int           // 当前正在执行溢写、compact 的 worker 个数
+	CompactionBusy           time.Duration // 所有 worker 执行溢写、compact 的累计耗时
+	CompactionUtilization    float64       // 当前后台溢写、compact 占用的 cpu 比例，即正在工作的 worker 个数占 GOMAXPROCS 的比例
+	AvgCompactionUtilization float64       // 启动以来后台溢写、compact 平均占用的 cpu 比例
+
+	WALBytesWritten   uint64        // 打开以来追加写入预写日志的字节数，包含记录头部
+	WALRecordsWritten uint64        // 打开以来写入预写日志的记录个数. 合并提交时每个写入方的一批数据计为一条记录
+	WALSyncs          uint64        // 打开以来预写日志的 fsync 次数
+	WALSyncTime       time.Duration // 预写日志 fsync 的累计耗时. 占用时间的比例持续偏高时，磁盘已经成为写入瓶颈
+	WALAvgSyncLatency time.Duration // 预写日志单次 fsync 的平均耗时
+	WALMaxSyncLatency time.Duration // 预写日志单次 fsync 的最大耗时
+}
+
+// WriteAmplification sstable 的写放大，即溢写与 compact 写入的 sstable 总大小与溢写写入总大小之比. 尚未溢写时返回 0
+func (s *Stats) WriteAmplification() float64 {
+	if s.FlushBytesWritten == 0 {
+		return 0
+	}
+	return float64(s.FlushBytesWritten+s.CompactionBytesWritten) / float64(s.FlushBytesWritten)
+}
+
+// Stats 获取 lsm tree 的运行统计信息. sstable 的记录个数取自属性块，
+// 早期写入的 sstable 没有记录个数，首次统计时需要遍历一次文件数据
+func (t *Tree) Stats() *Stats {
+	stats := Stats{
+		PutsWritten:             t.putsWritten.Load(),
+		DeletesWritten:          t.deletesWritten.Load(),
+		ExpiredReclaimed:        t.expiredReclaimed.Load(),
+		ExpiredBytesReclaimed:   t.expiredBytesReclaimed.Load(),
+		WriteStalls:             t.writeStalls.Load(),
+		WriteStallTime:          time.Duration(t.writeStallTime.Load()),
+		CompactionWorkers:       t.compactionWorkers(),
+		ActiveCompactionWorkers: int(t.activeCompactions.Load()),
+		CompactionBusy:          time.Duration(t.compactionBusy.Load()),
+	}
+	t.compactionMetrics.fill(&stats)
+	walMetrics := t.walMetrics.Snapshot()
+	stats.WALBytesWritten = walMetrics.BytesWritten
+	stats.WALRecordsWritten = walMetrics.RecordsWritten
+	stats.WALSyncs = walMetrics.Syncs
+	stats.WALSyncTime = walMetrics.SyncTime
+	stats.WALAvgSyncLatency = walMetrics.AvgSyncLatency()
+	stats.WALMaxSyncLatency = walMetrics.MaxSyncLatency
+
+	for level := 0; level < len(t.nodes); level++ {
+		levelStats := LevelStats{Level: level}
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			entries, tombstones := node.counts()
+			levelStats.Files++
+			levelStats.Size += node.size
+			levelStats.Entries += entries
+			levelStats.Tombstones += tombstones
+		}
+		levelStats.CompactionScore = t.compactScoreLocked(level)
+		t.levelLocks[level].RUnlock()
+		stats.Levels = append(stats.Levels, &levelStats)
+		stats.Entries += levelStats.Entries
+		stats.Tombstones += levelStats.Tombstones
+	}
+
+	t.dataLock.RLock()
+	stats.MemTables = len(t.rOnlyMemTable) + 1
+	stats.Seq = t.seq
+	memTables := []memtable.MemTable{t.memTable}
+	for _, item := range t.rOnlyMemTable {
+		memTables = append(memTables, item.memTable)
+	}
+	for _, memTable := range memTables {
+		for _, kv := range memTable.All() {
+			stats.MemTableEntries++
+			if len(kv.Value) > 0 && OpType(kv.Value[0]) == OpDelete {
+				stats.MemTableTombstones++
+			}
+		}
+	}
+	t.dataLock.RUnlock()
+	stats.Entries += stats.MemTableEntries
+	stats.Tombstones += stats.MemTableTombstones
+
+	procs := float64(runtime.GOMAXPROCS(0))
+	stats.CompactionUtilization = float64(stats.ActiveCompactionWorkers) / procs
+	if uptime := time.Since(t.startTime); uptime > 0 {
+		stats.AvgCompactionUtilization = float64(stats.CompactionBusy) / (float64(uptime) * procs)
+	}
+	return &stats
+}
+
+// 单轮 compact 允许并发写入 sst 文件的 worker 个数. 根据 GOMAXPROCS 以及 cpu 占用比例计算，至少为 1 个.
+// 过滤器不支持复制时，多个 sstWriter 无法共用同一个过滤器实例，只能使用 1 个 worker
+func (t *Tree) compactionWorkers() int {
+	if _, ok := t.conf.Filter.(filter.Cloner); !ok {
+		return 1
+	}
+
+	workers := int(float64(runtime.GOMAXPROCS(0)) * t.conf.CompactionCPUFraction)
+	if t.conf.MaxCompactionWorkers > 0 && workers > t.conf.MaxCompactionWorkers {
+		workers = t.conf.MaxCompactionWorkers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return workers
+}
+
+// 标记一个 worker 开始执行溢写、compact，返回的函数用于标记执行结束，并累计耗时
+func (t *Tree) compactionWork() func() {
+	start := time.Now()
+	t.activeCompactions.Add(1)
+	return func() {
+		t.activeCompactions.Add(-1)
+		t.compactionBusy.Add(int64(time.Since(start)))
+	}
+}
@@ -0,0 +1,66 @@
+package lsmart
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// ErrWALDisabled 预写日志创建失败，写入的数据只存在于 memtable 中，无法建立持久化点
+var ErrWALDisabled = errors.New("wal is disabled")
+
+// Sync 将当前预写日志 fsync 到磁盘. 返回之后，此前所有写入成功的记录在进程或者机器崩溃后都能通过回放预写日志恢复，
+// 无需关闭 lsm tree 即可获得一个明确的持久化点
+func (t *Tree) Sync() error {
+	// 写入以及切换预写日志均持有写锁，持有写锁执行 fsync，保证刷盘的是最新的预写日志，且包含此前所有写入
+	t.dataLock.Lock()
+	defer t.dataLock.Unlock()
+	// 此前切换 memtable 时老 wal 刷盘失败，其中的记录无法保证持久化
+	if err := t.walSyncErr; err != nil {
+		t.walSyncErr = nil
+		return err
+	}
+	if t.walWriter == nil {
+		return fmt.Errorf("%w: %v", ErrWALDisabled, t.walErr)
+	}
+	return t.syncWALLocked()
+}
+
+// FlushWAL 将预写日志写入缓冲区中的记录写到文件. 返回之后此前写入成功的记录在进程崩溃后能够恢复，
+// 但是不保证机器掉电后能够恢复. 没有开启 WALBufferSize 时无需调用
+func (t *Tree) FlushWAL() error {
+	t.dataLock.Lock()
+	defer t.dataLock.Unlock()
+	if t.walWriter == nil {
+		return fmt.Errorf("%w: %v", ErrWALDisabled, t.walErr)
+	}
+	return t.flushWALLocked()
+}
+
+// SyncDir 在 Sync 的基础上，额外 fsync 数据目录以及预写日志目录，保证新建的预写日志、sstable 文件的目录项同样落盘.
+// 适用于对机器掉电也有持久化要求的场景
+func (t *Tree) SyncDir() error {
+	if err := t.Sync(); err != nil {
+		return err
+	}
+	for _, dir := range []string{t.conf.Dir, path.Join(t.conf.Dir, "walfile")} {
+		if err := syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsync 目录，使得目录下文件的创建、删除落盘
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
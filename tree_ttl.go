@@ -0,0 +1,65 @@
+package lsmart
+
+import (
+	"context"
+	"time"
+)
+
+// PutWithTTL 写入一组带过期时间的 kv 对，过期时间为写入时刻加上 ttl，与数据一同持久化. ttl 小于等于 0 时等价于 Put.
+// 过期后读取时视为不存在，并在下一次溢写或 compact 时改写为墓碑记录，从磁盘上物理删除
+func (t *Tree) PutWithTTL(key, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return t.Put(key, value)
+	}
+	if err := t.validateKey(key, OpPutTTL); err != nil {
+		return err
+	}
+
+	return t.commit(context.Background(), []*batchEntry{{
+		op:       OpPutTTL,
+		key:      t.encodeKey(key),
+		value:    value,
+		expireAt: time.Now().Add(ttl).UnixNano(),
+	}}, nil)
+}
+
+// 溢写、compact 时丢弃在 now 时刻已过期记录的 value，改写为相同 seq 的墓碑记录. 与按条件删除一致，
+// 不直接丢弃记录，避免更深层级中的老版本数据重新可见. 更深层级中不存在老版本时，compact 会一并回收该墓碑记录
+func dropExpired(internalValue []byte, now int64) []byte {
+	if !internalExpired(internalValue, now) {
+		return internalValue
+	}
+	return EncodeInternalValue(OpDelete, internalSeq(internalValue), nil)
+}
+
+// 一轮溢写或者 compact 中清理的过期记录，sstable 生效之后才计入统计，失败重试时不会重复计入
+type expiredReclaim struct {
+	count uint64 // 清理的过期记录个数
+	bytes uint64 // 释放的字节数
+}
+
+// 记录一条过期记录的清理结果. value 为改写后写入 sstable 的 value，为空表示整条记录被丢弃
+func (r *expiredReclaim) add(key, expiredValue, value []byte) {
+	r.count++
+	if value == nil {
+		r.bytes += uint64(len(key) + len(expiredValue))
+		return
+	}
+	if len(expiredValue) > len(value) {
+		r.bytes += uint64(len(expiredValue) - len(value))
+	}
+}
+
+// 将清理过期记录的结果计入统计
+func (t *Tree) recordExpiredReclaim(r *expiredReclaim) {
+	t.expiredReclaimed.Add(r.count)
+	t.expiredBytesReclaimed.Add(r.bytes)
+}
+
+// 将过期时间转换为 time.Time，不带过期时间时返回零值
+func expireTime(expireAt int64) time.Time {
+	if expireAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, expireAt)
+}
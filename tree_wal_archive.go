@@ -0,0 +1,110 @@
+package lsmart
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WALArchive wal 归档策略. 开启归档后，memtable 落盘后不再删除对应的 wal 文件，而是移动到归档目录中保留，
+// 用于按时间点恢复或者由下游的复制链路消费. 归档文件命名为 归档时间戳-原文件名，按照文件名排序即为落盘的先后顺序
+type WALArchive struct {
+	Dir     string        // 归档目录. 为空时使用数据目录下的 walarchive 目录
+	MaxAge  time.Duration // 归档文件的最长保留时间. 为 0 时不按时间淘汰
+	MaxSize int64         // 归档文件的总大小上限，单位 byte，超出时从最早的归档文件开始淘汰. 为 0 时不按大小淘汰
+}
+
+// memtable 落盘后归档对应的 wal 文件，并按照保留策略淘汰过期的归档文件.
+// 归档失败时 wal 文件保留在原处，重启后重新回放落盘，再次尝试归档，归档数据不会丢失
+func (t *Tree) archiveWAL(item *memTableCompactItem) {
+	prefix := fmt.Sprintf("%019d-", time.Now().UnixNano())
+	files := append(append([]string(nil), item.walSegments...), item.walFile)
+	for _, file := range files {
+		if err := moveFile(file, path.Join(t.conf.WALArchive.Dir, prefix+path.Base(file))); err != nil {
+			t.handleBackgroundErr(backgroundJobWALArchive, err)
+			return
+		}
+	}
+	if err := t.pruneWALArchive(); err != nil {
+		t.handleBackgroundErr(backgroundJobWALArchive, err)
+		return
+	}
+	t.clearBackgroundErr(backgroundJobWALArchive)
+}
+
+// 按照保留时间以及总大小上限淘汰归档文件，从最早的归档文件开始淘汰
+func (t *Tree) pruneWALArchive() error {
+	archive := t.conf.WALArchive
+	if archive.MaxAge <= 0 && archive.MaxSize <= 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(archive.Dir)
+	if err != nil {
+		return err
+	}
+	var (
+		files []os.FileInfo
+		total int64
+	)
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".wal") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	deadline := time.Now().Add(-archive.MaxAge)
+	for _, info := range files {
+		expired := archive.MaxAge > 0 && info.ModTime().Before(deadline)
+		oversize := archive.MaxSize > 0 && total > archive.MaxSize
+		if !expired && !oversize {
+			break
+		}
+		if err = os.Remove(path.Join(archive.Dir, info.Name())); err != nil {
+			return err
+		}
+		total -= info.Size()
+	}
+	return nil
+}
+
+// 移动文件. 归档目录与 wal 目录位于不同的文件系统时无法 rename，退化为拷贝后删除
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,112 @@
+package lsmart
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cccccxxy/lsmart/wal"
+)
+
+// WALRecoveryMode 启动时回放 wal 遇到异常记录的处理方式. 版本 4 之前的 wal 没有校验和，异常记录一律视为写了一半的尾部
+type WALRecoveryMode int
+
+const (
+	// WALRecoveryTolerateTail 在首条不完整或者校验失败的记录处停止回放，视为宕机时写了一半的尾部. 默认方式
+	WALRecoveryTolerateTail WALRecoveryMode = iota
+	// WALRecoveryStrict 遇到任何不完整或者校验失败的记录时打开失败，返回的错误满足 errors.Is(err, wal.ErrCorruptWAL)
+	WALRecoveryStrict
+	// WALRecoveryPermissive 跳过校验失败的记录，继续回放之后的记录，跳过的记录在 WALRecoveryReport 中列出.
+	// 存在跳过记录的 wal 文件不再继续追加写入
+	WALRecoveryPermissive
+	// WALRecoveryPointInTime 只回放 seq 不超过 Config.WALRecoverySeq 的记录，在首条超出的记录处停止并截断 wal 文件
+	WALRecoveryPointInTime
+)
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case WALRecoveryTolerateTail:
+		return "tolerate_tail"
+	case WALRecoveryStrict:
+		return "strict"
+	case WALRecoveryPermissive:
+		return "permissive"
+	case WALRecoveryPointInTime:
+		return "point_in_time"
+	default:
+		return fmt.Sprintf("WALRecoveryMode(%d)", int(m))
+	}
+}
+
+// WALSkippedRecord 回放 wal 时跳过的一条记录
+type WALSkippedRecord struct {
+	File   string // wal 文件
+	Offset int64  // 记录在文件中的起始位置，单位 byte
+}
+
+// WALRecoveryReport 启动时回放 wal 的结果
+type WALRecoveryReport struct {
+	Mode      WALRecoveryMode     // 回放时使用的处理方式
+	Truncated []string            // 尾部存在不完整或者校验失败的记录，回放提前结束的 wal 文件
+	Skipped   []*WALSkippedRecord // WALRecoveryPermissive 模式下跳过的记录
+	Stopped   []string            // WALRecoveryPointInTime 模式下因为 seq 超出而停止回放的 wal 文件
+
+	Checkpoint uint64 // 回放的检查点记录中最大的 seq. 还原出的 seq 不小于该值
+}
+
+// WALRecoveryReport 获取启动时回放 wal 的结果
+func (t *Tree) WALRecoveryReport() *WALRecoveryReport {
+	report := t.walRecovery
+	report.Mode = t.conf.WALRecoveryMode
+	report.Truncated = append([]string(nil), report.Truncated...)
+	report.Skipped = append([]*WALSkippedRecord(nil), report.Skipped...)
+	report.Stopped = append([]string(nil), report.Stopped...)
+	return &report
+}
+
+// 按照配置的处理方式设置 walReader. 按时间点恢复时，版本 2 起的记录带有 seq，在首条 seq 超出的记录或者检查点处停止
+func (t *Tree) setupWALRecovery(walReader *wal.WALReader) {
+	switch t.conf.WALRecoveryMode {
+	case WALRecoveryStrict:
+		walReader.SetRecoveryMode(wal.RecoverStrict)
+	case WALRecoveryPermissive:
+		walReader.SetRecoveryMode(wal.RecoverSkipCorrupt)
+	case WALRecoveryPointInTime:
+		if walReader.Version() < 2 {
+			return
+		}
+		target := t.conf.WALRecoverySeq
+		walReader.SetStopAt(func(record *wal.Record) bool {
+			if record.Type == wal.RecordCheckpoint {
+				return record.Seq > target
+			}
+			for _, kv := range record.KVs {
+				if _, seq, _, err := DecodeInternalValue(kv.Value); err == nil && seq > target {
+					return true
+				}
+			}
+			return false
+		})
+	}
+}
+
+// 将一个 wal 文件的回放结果记录到回放报告中. 因为 seq 超出而停止回放的独立 wal 文件截断到停止的位置，
+// 避免下次启动时丢弃的记录重新生效
+func (t *Tree) recordWALRecovery(file string, walReader *wal.WALReader, truncate bool) error {
+	if walReader.Checkpoint() > t.walRecovery.Checkpoint {
+		t.walRecovery.Checkpoint = walReader.Checkpoint()
+	}
+	if walReader.Truncated() {
+		t.walRecovery.Truncated = append(t.walRecovery.Truncated, file)
+	}
+	for _, offset := range walReader.Skipped() {
+		t.walRecovery.Skipped = append(t.walRecovery.Skipped, &WALSkippedRecord{File: file, Offset: offset})
+	}
+	if !walReader.Stopped() {
+		return nil
+	}
+	t.walRecovery.Stopped = append(t.walRecovery.Stopped, file)
+	if !truncate {
+		return nil
+	}
+	return os.Truncate(file, walReader.ValidSize())
+}
@@ -0,0 +1,88 @@
+package lsmart
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/cccccxxy/lsmart/wal"
+)
+
+// 回收池中的 wal 文件命名为 seq.recycle，不以 .wal 结尾，启动时不会被回放
+const walRecycleSuffix = ".recycle"
+
+// 创建独立 wal 文件. 回收池中有可用的文件时优先回收，开启预分配时为文件预分配一个 memtable 的磁盘空间
+func (t *Tree) createWAL(file string) (*wal.WALWriter, error) {
+	var walWriter *wal.WALWriter
+	for walWriter == nil && len(t.walRecycle) > 0 {
+		old := t.walRecycle[len(t.walRecycle)-1]
+		t.walRecycle = t.walRecycle[:len(t.walRecycle)-1]
+		// 无法回收的文件，例如老版本格式的文件，直接删除
+		var err error
+		if walWriter, err = wal.RecycleWALWriter(old, file); err != nil {
+			_ = os.Remove(old)
+		}
+	}
+	if walWriter == nil {
+		var err error
+		if walWriter, err = wal.NewWALWriter(file); err != nil {
+			return nil, err
+		}
+	}
+	// 新建或者回收重命名得到的 wal 文件，目录项落盘之后才能写入
+	if err := t.syncWALDir(); err != nil {
+		walWriter.Close()
+		return nil, err
+	}
+
+	// 预分配失败不影响写入，只是退化为写入时分配磁盘空间
+	if t.conf.WALPreallocate {
+		size := int64(t.conf.SSTSize)
+		if t.conf.WALSegmentSize > 0 && t.conf.WALSegmentSize < size {
+			size = t.conf.WALSegmentSize
+		}
+		_ = walWriter.Preallocate(size)
+	}
+	t.setupWAL(walWriter)
+	return walWriter, nil
+}
+
+// 回收已落盘 memtable 的 wal 文件. 回收池未满时移入回收池等待下一次创建 wal 时复用，否则直接删除
+func (t *Tree) recycleWAL(file string) {
+	t.dataLock.Lock()
+	defer t.dataLock.Unlock()
+	if len(t.walRecycle) >= t.conf.WALRecycleFiles {
+		_ = os.Remove(file)
+		return
+	}
+
+	t.walRecycleSeq++
+	target := path.Join(t.conf.Dir, "walfile", fmt.Sprintf("%d%s", t.walRecycleSeq, walRecycleSuffix))
+	if err := os.Rename(file, target); err != nil {
+		_ = os.Remove(file)
+		return
+	}
+	t.walRecycle = append(t.walRecycle, target)
+}
+
+// 启动时还原回收池. 超出回收池容量的文件，或者关闭回收之后遗留的文件直接删除
+func (t *Tree) restoreWALRecycle() {
+	entries, _ := os.ReadDir(path.Join(t.conf.Dir, "walfile"))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walRecycleSuffix) {
+			continue
+		}
+		file := path.Join(t.conf.Dir, "walfile", name)
+		if len(t.walRecycle) >= t.conf.WALRecycleFiles {
+			_ = os.Remove(file)
+			continue
+		}
+		if seq, _ := strconv.Atoi(strings.TrimSuffix(name, walRecycleSuffix)); seq > t.walRecycleSeq {
+			t.walRecycleSeq = seq
+		}
+		t.walRecycle = append(t.walRecycle, file)
+	}
+}
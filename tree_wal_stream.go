@@ -0,0 +1,144 @@
+package lsmart
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spaolacci/murmur3"
+
+	"github.com/cccccxxy/lsmart/memtable"
+	"github.com/cccccxxy/lsmart/wal"
+)
+
+// 独立 wal 模式下开启多路 wal 时，除首路之外的 wal 文件命名为 index.s{stream}.wal，首路仍为 index.wal
+const walStreamInfix = ".s"
+
+// 读写 memtable 第 stream 路 wal 文件的路径. stream 从 1 开始，首路 wal 即 walFile
+func (t *Tree) walStreamFile(stream int) string {
+	return path.Join(t.conf.Dir, "walfile", fmt.Sprintf("%d%s%d.wal", t.memTableIndex, walStreamInfix, stream))
+}
+
+// 解析 wal 文件名中的路序号，首路 wal 以及分段文件返回 0
+func walFileToStream(walFile string) int {
+	name := strings.TrimSuffix(path.Base(walFile), ".wal")
+	i := strings.Index(name, walStreamInfix)
+	if i < 0 {
+		return 0
+	}
+	stream, _ := strconv.Atoi(name[i+len(walStreamInfix):])
+	return stream
+}
+
+// 为读写 memtable 创建除首路之外的各路 wal. 任意一路创建失败时关闭已经创建的各路并返回错误
+func (t *Tree) openWALStreamsLocked() error {
+	streams := make([]*wal.WALWriter, 0, t.conf.WALStreams-1)
+	for stream := 1; stream < t.conf.WALStreams; stream++ {
+		walWriter, err := t.createWAL(t.walStreamFile(stream))
+		if err != nil {
+			for _, walWriter := range streams {
+				walWriter.Close()
+			}
+			return err
+		}
+		streams = append(streams, walWriter)
+	}
+	t.walStreams = streams
+	return nil
+}
+
+// 关闭除首路之外的各路 wal
+func (t *Tree) closeWALStreams() {
+	for _, walWriter := range t.walStreams {
+		walWriter.Close()
+	}
+	t.walStreams = nil
+}
+
+// 读写 memtable 除首路之外的各路 wal 文件
+func (t *Tree) walStreamFiles() []string {
+	files := make([]string, 0, len(t.walStreams))
+	for stream := 1; stream <= len(t.walStreams); stream++ {
+		files = append(files, t.walStreamFile(stream))
+	}
+	return files
+}
+
+// 并发地对各路 wal 执行 fn，返回首个错误. 只有一路 wal 时直接执行
+func (t *Tree) eachWALStream(fn func(stream int, walWriter *wal.WALWriter) error) error {
+	if len(t.walStreams) == 0 {
+		return fn(0, t.walWriter)
+	}
+
+	writers := append([]*wal.WALWriter{t.walWriter}, t.walStreams...)
+	errs := make([]error, len(writers))
+	var wg sync.WaitGroup
+	for stream, walWriter := range writers {
+		wg.Add(1)
+		go func(stream int, walWriter *wal.WALWriter) {
+			defer wg.Done()
+			errs[stream] = fn(stream, walWriter)
+		}(stream, walWriter)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将多批记录写入预写日志. 开启多路 wal 时按照每批首个 key 的 hash 值分派到各路，各路并发写入，
+// 同一批记录只写入同一路，保持整批的原子性
+func (t *Tree) writeWALLocked(records [][]*memtable.KV) error {
+	if len(t.walStreams) == 0 {
+		return t.walWriter.WriteBatches(records)
+	}
+
+	parts := make([][][]*memtable.KV, len(t.walStreams)+1)
+	for _, kvs := range records {
+		var stream int
+		if len(kvs) > 0 {
+			stream = int(murmur3.Sum32(kvs[0].Key) % uint32(len(parts)))
+		}
+		parts[stream] = append(parts[stream], kvs)
+	}
+	return t.eachWALStream(func(stream int, walWriter *wal.WALWriter) error {
+		if len(parts[stream]) == 0 {
+			return nil
+		}
+		return walWriter.WriteBatches(parts[stream])
+	})
+}
+
+// 将各路 wal fsync 到磁盘
+func (t *Tree) syncWALLocked() error {
+	return t.eachWALStream(func(_ int, walWriter *wal.WALWriter) error {
+		return walWriter.Sync()
+	})
+}
+
+// 将各路 wal 写入缓冲区中的记录写到文件
+func (t *Tree) flushWALLocked() error {
+	return t.eachWALStream(func(_ int, walWriter *wal.WALWriter) error {
+		return walWriter.Flush()
+	})
+}
+
+// 将一路 wal 还原出的 memtable 按照 seq 合并到 memTable 中. 不同路之间的记录没有先后顺序，
+// 同一个 key 只保留 seq 最大的记录
+func mergeMemTableBySeq(memTable, stream memtable.MemTable) {
+	for _, kv := range stream.All() {
+		if existing, ok := memTable.Get(kv.Key); ok {
+			_, existingSeq, _, err1 := DecodeInternalValue(existing)
+			_, seq, _, err2 := DecodeInternalValue(kv.Value)
+			if err1 == nil && err2 == nil && existingSeq > seq {
+				continue
+			}
+		}
+		memTable.Put(kv.Key, kv.Value)
+	}
+}
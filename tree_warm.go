@@ -0,0 +1,75 @@
+package lsmart
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrBlockCacheDisabled 未开启数据块缓存
+var ErrBlockCacheDisabled = errors.New("block cache is disabled")
+
+// KeyRange key 范围，闭区间. Start 为空时表示不设下界，End 为空时表示不设上界
+type KeyRange struct {
+	Start, End []byte
+}
+
+// 是否与 [start,end] 范围存在交集
+func (r *KeyRange) overlaps(start, end []byte) bool {
+	if len(r.Start) > 0 && bytes.Compare(end, r.Start) < 0 {
+		return false
+	}
+	return len(r.End) == 0 || bytes.Compare(start, r.End) <= 0
+}
+
+// WarmCache 将指定 key 范围涉及的数据块预先读入数据块缓存，降低服务启动后热点 key 的冷读延迟.
+// 过滤器和索引在节点加载时已常驻内存，无需预热. 缓存写满后停止预热，返回预热的数据块个数.
+// 配置了 key 变换器时，范围针对的是变换后的存储 key
+func (t *Tree) WarmCache(ranges []KeyRange) (int, error) {
+	blockCache := t.conf.blockCache
+	if blockCache == nil {
+		return 0, ErrBlockCacheDisabled
+	}
+
+	var warmed int
+	for level := 0; level < len(t.nodes); level++ {
+		t.levelLocks[level].RLock()
+		for _, node := range t.nodes[level] {
+			if !overlapsAny(ranges, node.Start(), node.End()) {
+				continue
+			}
+
+			// 第 i 个索引对应第 i - 1 个数据块，数据块的 key 范围为 (index[i-1].Key, index[i].Key]
+			index, err := node.blockIndex()
+			if err != nil {
+				t.levelLocks[level].RUnlock()
+				return warmed, err
+			}
+			for i := 1; i < len(index); i++ {
+				if !overlapsAny(ranges, index[i-1].Key, index[i].Key) {
+					continue
+				}
+				if blockCache.Size()+int(index[i].PrevBlockSize) > blockCache.Capacity() {
+					t.levelLocks[level].RUnlock()
+					return warmed, nil
+				}
+				if _, err := node.readBlock(index[i]); err != nil {
+					t.levelLocks[level].RUnlock()
+					return warmed, err
+				}
+				warmed++
+			}
+		}
+		t.levelLocks[level].RUnlock()
+	}
+	return warmed, nil
+}
+
+// 是否存在与 [start,end] 范围有交集的 key 范围
+func overlapsAny(ranges []KeyRange, start, end []byte) bool {
+	for i := range ranges {
+		if ranges[i].overlaps(start, end) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package lsmart
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+
+	"github.com/cccccxxy/lsmart/memtable"
+)
+
+// 每个订阅者缓冲的变更通知个数
+const watchBufferSize = 1024
+
+// ErrWatchOverflow 订阅者消费过慢，缓冲的变更通知已满，订阅被终止
+var ErrWatchOverflow = errors.New("watch buffer overflow")
+
+// WatchEvent 一条变更通知
+type WatchEvent struct {
+	Op    OpType // 操作类型
+	Key   []byte // 用户 key
+	Value []byte // 用户 value，删除操作时为空
+	Seq   uint64 // 写入记录的 seq，同一订阅者收到的通知按照 seq 严格递增
+}
+
+// Watcher 对一段 key 范围的变更订阅. 通过 C 接收变更通知，不再使用时需要调用 Close
+type Watcher struct {
+	C <-chan *WatchEvent // 变更通知. 订阅被关闭或者终止时 chan 被关闭
+
+	tree  *Tree
+	match func(key []byte) bool // 判断 key 是否属于订阅范围
+
+	mu     sync.Mutex
+	c      chan *WatchEvent
+	err    error // 订阅被终止的原因
+	closed bool
+}
+
+// Watch 订阅 key 范围内的变更. 变更通知来自写入流程，在数据写入 wal 与 memtable 之后按照写入顺序投递，
+// 适用于配置中心、缓存失效等场景. 订阅者消费过慢导致缓冲已满时，订阅被终止，Err 返回 ErrWatchOverflow.
+// DeleteWhere 删除的数据在写入墓碑记录时产生变更通知
+func (t *Tree) Watch(keyRange KeyRange) *Watcher {
+	return t.watch(keyRange.contains)
+}
+
+// WatchPrefix 订阅以 prefix 为前缀的 key 的变更
+func (t *Tree) WatchPrefix(prefix []byte) *Watcher {
+	return t.watch(func(key []byte) bool {
+		return bytes.HasPrefix(key, prefix)
+	})
+}
+
+func (t *Tree) watch(match func(key []byte) bool) *Watcher {
+	c := make(chan *WatchEvent, watchBufferSize)
+	w := Watcher{
+		C:     c,
+		tree:  t,
+		match: match,
+		c:     c,
+	}
+
+	t.watchersLock.Lock()
+	defer t.watchersLock.Unlock()
+	t.watchers = append(t.watchers, &w)
+	return &w
+}
+
+// Err 订阅被终止的原因. 订阅仍然有效或者由调用方主动关闭时返回 nil
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close 关闭订阅
+func (w *Watcher) Close() {
+	w.stop(nil)
+
+	w.tree.watchersLock.Lock()
+	defer w.tree.watchersLock.Unlock()
+	for i, watcher := range w.tree.watchers {
+		if watcher == w {
+			w.tree.watchers = append(w.tree.watchers[:i], w.tree.watchers[i+1:]...)
+			return
+		}
+	}
+}
+
+// 终止订阅，关闭通知 chan
+func (w *Watcher) stop(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.err = err
+	close(w.c)
+}
+
+// 投递一条变更通知. 缓冲已满时不阻塞写入流程，直接终止订阅
+func (w *Watcher) send(event *WatchEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.c <- event:
+	default:
+		w.closed = true
+		w.err = ErrWatchOverflow
+		close(w.c)
+	}
+}
+
+// 在持有写锁的情况下，将一批写入成功的内部记录通知给订阅者
+func (t *Tree) notifyWatchers(kvs []*memtable.KV) {
+	t.watchersLock.RLock()
+	defer t.watchersLock.RUnlock()
+	if len(t.watchers) == 0 {
+		return
+	}
+
+	for _, kv := range kvs {
+		key, err := t.decodeKey(kv.Key)
+		if err != nil {
+			continue
+		}
+		op, seq, value, err := DecodeInternalValue(kv.Value)
+		if err != nil {
+			continue
+		}
+		for _, w := range t.watchers {
+			if !w.match(key) {
+				continue
+			}
+			// 调用方在写入返回后可能复用 key、value，需要拷贝
+			w.send(&WatchEvent{
+				Op:    op,
+				Key:   append([]byte(nil), key...),
+				Value: append([]byte(nil), value...),
+				Seq:   seq,
+			})
+		}
+	}
+}
+
+// 关闭所有订阅
+func (t *Tree) closeWatchers() {
+	t.watchersLock.Lock()
+	defer t.watchersLock.Unlock()
+	for _, w := range t.watchers {
+		w.stop(nil)
+	}
+	t.watchers = nil
+}
@@ -0,0 +1,56 @@
+package lsmart
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrWriteStall 等待溢写的只读 memtable 个数达到 MaxReadOnlyMemTables，且配置了不等待溢写. 可以通过 errors.Is 判断
+var ErrWriteStall = errors.New("write stall: too many memtables waiting for flush")
+
+// 写入之前检查只读 memtable 的积压. 个数达到 MaxReadOnlyMemTables 时等待溢写追上，直至低于上限、ctx 失效或者 lsm tree 关闭；
+// 配置了 WriteStallFailFast 时直接返回 ErrWriteStall. 上限为软限制，并发写入的请求可能使个数短暂超出上限
+func (t *Tree) waitWriteStall(ctx context.Context) error {
+	if t.conf.MaxReadOnlyMemTables <= 0 {
+		return nil
+	}
+
+	var start time.Time
+	defer func() {
+		if !start.IsZero() {
+			t.writeStallTime.Add(int64(time.Since(start)))
+		}
+	}()
+	for {
+		t.dataLock.RLock()
+		stalled := len(t.rOnlyMemTable) >= t.conf.MaxReadOnlyMemTables
+		flushed := t.memTableFlushed
+		t.dataLock.RUnlock()
+		if !stalled {
+			return nil
+		}
+		if start.IsZero() {
+			start = time.Now()
+			t.writeStalls.Add(1)
+		}
+		if t.conf.WriteStallFailFast {
+			return ErrWriteStall
+		}
+
+		select {
+		case <-flushed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.stopc:
+			return ErrTreeClosed
+		}
+	}
+}
+
+// 在持有 dataLock 写锁的情况下，通知等待溢写的写入请求有只读 memtable 落盘
+func (t *Tree) notifyMemTableFlushedLocked() {
+	close(t.memTableFlushed)
+	t.memTableFlushed = make(chan struct{})
+	t.notifyProgress()
+}
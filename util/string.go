@@ -10,15 +10,59 @@ func SharedPrefixLen(a, b []byte) int {
 	return i
 }
 
-// GetSeparatorBetween 返回结果 x，保证 a <= x < b. 使用方需要自行保证 a < b
+// GetSeparatorBetween 返回尽可能短的结果 x，保证 a <= x < b. 使用方需要自行保证 a <= b，a == b 时返回 a
 func GetSeparatorBetween(a, b []byte) []byte {
 	// 倘若 a 为空，则返回一个比 b 小的结果即可
 	if len(a) == 0 {
+		if len(b) == 0 {
+			return b
+		}
+		// 末尾字节为 0 时不能再减，直接去掉末尾字节得到的前缀同样小于 b
+		if b[len(b)-1] == 0 {
+			return append([]byte{}, b[:len(b)-1]...)
+		}
 		sepatator := make([]byte, len(b))
 		copy(sepatator, b)
-		return append(sepatator[:len(b)-1], sepatator[len(b)-1]-1)
+		sepatator[len(b)-1]--
+		return sepatator
+	}
+
+	// a 是 b 的前缀（包括 a == b）时，不存在比 a 更短的分隔 key
+	shared := SharedPrefixLen(a, b)
+	if shared >= len(a) || shared >= len(b) {
+		return a
+	}
+
+	// 公共前缀之后 a 的字节加一仍然小于 b 的对应字节，截断到该位置即可
+	if a[shared] < 0xff && a[shared]+1 < b[shared] {
+		separator := make([]byte, shared+1)
+		copy(separator, a)
+		separator[shared]++
+		return separator
 	}
 
-	// 返回 a 即可
+	// 否则保留 a[shared]（已经小于 b[shared]），在其后找到第一个可以加一的字节并截断，截断后不比 a 短时直接返回 a
+	for i := shared + 1; i < len(a)-1; i++ {
+		if a[i] < 0xff {
+			separator := make([]byte, i+1)
+			copy(separator, a)
+			separator[i]++
+			return separator
+		}
+	}
 	return a
 }
+
+// PrefixSuccessor 返回大于所有以 prefix 为前缀的 key 的最小 key. prefix 为空或者全部由 0xff 组成时不存在这样的 key，返回 nil
+func PrefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] == 0xff {
+			continue
+		}
+		successor := make([]byte, i+1)
+		copy(successor, prefix)
+		successor[i]++
+		return successor
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/cccccxxy/lsmart/format"
+)
+
+const (
+	// wal 文件头部的 magic number，对应 "LSMARTWL"
+	walMagic uint64 = 0x4c534d415254574c
+	// wal 文件头部大小. magic number 占 8 byte || version 占 4 byte
+	walHeaderSize = 12
+	// 版本 5 起文件头部追加 4 byte 的文件代数
+	walGenerationSize = 4
+	// 版本 4 起每条记录的头部大小. 校验和占 4 byte || 记录长度占 4 byte
+	recordHeaderSize = 8
+)
+
+// 文件头部的大小. 版本 1 没有头部，版本 5 起追加文件代数
+func headerSizeOf(version format.Version) int64 {
+	switch {
+	case version < 2:
+		return 0
+	case version < 5:
+		return walHeaderSize
+	default:
+		return walHeaderSize + walGenerationSize
+	}
+}
+
+// 记录头部的大小. 版本 5 起在记录长度之后追加 4 byte 的文件代数，回收的文件中上一代遗留的记录据此识别
+func recordHeaderSizeOf(version format.Version) int {
+	if version < 5 {
+		return recordHeaderSize
+	}
+	return recordHeaderSize + walGenerationSize
+}
+
+// 编码文件头部
+func encodeHeader(version format.Version, generation uint32) []byte {
+	header := make([]byte, headerSizeOf(version))
+	binary.LittleEndian.PutUint64(header[0:], walMagic)
+	binary.LittleEndian.PutUint32(header[8:], uint32(version))
+	if version >= 5 {
+		binary.LittleEndian.PutUint32(header[walHeaderSize:], generation)
+	}
+	return header
+}
+
+// 记录校验和使用 CRC32C，与 sstable 的块校验和一致
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// 倘若 wal 文件为新建的空文件，则写入文件头部. 返回后续追加记录时需要遵循的格式版本以及文件代数：
+// 新建的文件使用当前版本，代数为 1，已存在的文件沿用文件头部记录的版本与代数，老版本的 wal 文件没有头部，版本号视为 1
+func writeHeader(dest *os.File, kind format.Kind) (format.Version, uint32, error) {
+	stat, err := dest.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if stat.Size() > 0 {
+		return readFileHeader(dest)
+	}
+
+	version := format.Current(kind)
+	_, err = dest.Write(encodeHeader(version, 1))
+	return version, 1, err
+}
+
+// 读取已存在文件的头部，返回格式版本以及文件代数
+func readFileHeader(src *os.File) (format.Version, uint32, error) {
+	header := make([]byte, headerSizeOf(format.Version(^uint32(0))))
+	n, _ := src.ReadAt(header, 0)
+	if n < walHeaderSize || binary.LittleEndian.Uint64(header) != walMagic {
+		return 1, 0, nil
+	}
+	version := format.Version(binary.LittleEndian.Uint32(header[8:]))
+	if version < 5 {
+		return version, 0, nil
+	}
+	if int64(n) < headerSizeOf(version) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return version, binary.LittleEndian.Uint32(header[walHeaderSize:]), nil
+}
+
+// 读取 wal 文件头部，返回文件的格式版本以及文件代数. 老版本的 wal 文件没有头部，版本号视为 1
+func readHeader(reader *bufio.Reader) (format.Version, uint32, error) {
+	header, err := reader.Peek(walHeaderSize)
+	if err != nil || binary.LittleEndian.Uint64(header) != walMagic {
+		return 1, 0, nil
+	}
+
+	version := format.Version(binary.LittleEndian.Uint32(header[8:]))
+	if version < 5 {
+		_, err = reader.Discard(walHeaderSize)
+		return version, 0, err
+	}
+	if header, err = reader.Peek(int(headerSizeOf(version))); err != nil {
+		return 0, 0, err
+	}
+	generation := binary.LittleEndian.Uint32(header[walHeaderSize:])
+	_, err = reader.Discard(len(header))
+	return version, generation, err
+}
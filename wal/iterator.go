@@ -0,0 +1,133 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cccccxxy/lsmart/memtable"
+)
+
+// RecordType wal 记录的类型. 版本 6 起记录内容以 1 byte 的类型开头，之前的版本按照 kv 对个数推断为 RecordPut 或者 RecordBatch
+type RecordType byte
+
+const (
+	// RecordPut 单笔写入的 kv 对
+	RecordPut RecordType = iota + 1
+	// RecordDelete 单笔删除，kv 对的 value 为墓碑记录
+	RecordDelete
+	// RecordBatch 一次批量写入的全部 kv 对，整批作为一条记录写入，回放时要么全部还原，要么全部丢弃，
+	// 记录的首尾即批量写入的边界
+	RecordBatch
+	// RecordCheckpoint 检查点，记录写入时已经分配的最大 seq，不包含 kv 对
+	RecordCheckpoint
+)
+
+func (t RecordType) String() string {
+	switch t {
+	case RecordPut:
+		return "put"
+	case RecordDelete:
+		return "delete"
+	case RecordBatch:
+		return "batch"
+	case RecordCheckpoint:
+		return "checkpoint"
+	default:
+		return fmt.Sprintf("RecordType(%d)", byte(t))
+	}
+}
+
+// Record wal 中的一条记录. 版本 3 起一条记录包含一次批量写入的全部 kv 对，之前的版本每条记录只有一笔 kv 对
+type Record struct {
+	Offset int64          // 记录在文件中的起始位置，单位 byte
+	Type   RecordType     // 记录的类型
+	Tag    int            // 共享 wal 中记录所属 memtable 的 index，独立 wal 中为 0
+	KVs    []*memtable.KV // 记录中的 kv 对. 版本 2 起 value 为内部记录，可以通过 lsmart.DecodeInternalValue 解析出操作类型与 seq
+	Seq    uint64         // 检查点记录的 seq，其余类型的记录为 0
+}
+
+// RecordIterator wal 记录的迭代器，按照写入顺序逐条读取记录，不需要构造 memtable. 用于排查问题以及基于 wal 构建变更数据捕获
+type RecordIterator struct {
+	w      *WALReader
+	body   *bytes.Reader // wal 文件头部之后的全部内容，首次调用 Next 时读取
+	record *Record
+	err    error
+	done   bool
+}
+
+// NewIterator 构造 wal 记录的迭代器. 迭代器读取 reader 的剩余内容，与 RestoreToMemtable 不能混用
+func (w *WALReader) NewIterator() *RecordIterator {
+	return &RecordIterator{w: w}
+}
+
+// Next 读取下一条记录，读取完毕或者出错时返回 false. 尾部写了一半或者校验失败的记录不视为错误，迭代在此结束，
+// 可以通过 WALReader.Truncated 判断
+func (it *RecordIterator) Next() bool {
+	if it.done {
+		return false
+	}
+	if it.body == nil {
+		body, err := io.ReadAll(it.w.limiter.wrap(it.w.reader))
+		if err != nil {
+			return it.fail(err)
+		}
+		it.body = bytes.NewReader(body)
+	}
+
+	w := it.w
+	for {
+		offset := w.headerSize + it.body.Size() - int64(it.body.Len())
+		w.validSize = offset
+		record, err := w.nextRecord(it.body)
+		// 如果遇到 eof 错误说明文件内容已经读取完毕，终止流程
+		if errors.Is(err, io.EOF) {
+			return it.fail(nil)
+		}
+		// 版本 3 起一条记录可能包含一批 kv 对. 宕机时写了一半的尾部记录整条丢弃，保证批量写入的原子性.
+		// 版本 4 起校验失败的记录同样视为写了一半的记录，回放在此停止，不再导致整个 lsm tree 无法打开
+		if w.version >= 3 && errors.Is(err, io.ErrUnexpectedEOF) || w.version >= 4 && errors.Is(err, errCorruptRecord) {
+			switch {
+			case w.mode == RecoverStrict:
+				return it.fail(fmt.Errorf("%w: %s: record at offset %d: %v", ErrCorruptWAL, w.file, offset, err))
+			case w.mode == RecoverSkipCorrupt && errors.Is(err, errCorruptRecord):
+				// 校验失败的记录已经整条读出，跳过后从下一条记录继续
+				w.skipped = append(w.skipped, offset)
+				continue
+			}
+			w.truncated = true
+			return it.fail(nil)
+		}
+		if err != nil {
+			return it.fail(err)
+		}
+		record.Offset = offset
+		if w.stopAt != nil && w.stopAt(record) {
+			w.stopped = true
+			return it.fail(nil)
+		}
+		if record.Type == RecordCheckpoint && record.Seq > w.checkpoint {
+			w.checkpoint = record.Seq
+		}
+
+		it.record = record
+		return true
+	}
+}
+
+// 结束迭代并记录错误
+func (it *RecordIterator) fail(err error) bool {
+	it.record, it.err, it.done = nil, err, true
+	return false
+}
+
+// Record 当前记录. Next 返回 false 之后为空
+func (it *RecordIterator) Record() *Record {
+	return it.record
+}
+
+// Err 迭代过程中遇到的错误. 尾部不完整的记录不视为错误
+func (it *RecordIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,67 @@
+package wal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics wal 写入的累计统计. 多个 WALWriter 可以共用同一个 Metrics，lsm tree 借此跨越 memtable 切换以及分段累计统计
+type Metrics struct {
+	bytes   atomic.Uint64 // 追加写入的字节数
+	records atomic.Uint64 // 写入的记录个数
+	syncs   atomic.Uint64 // fsync 次数
+	syncDur atomic.Int64  // fsync 累计耗时，单位 ns
+	syncMax atomic.Int64  // 单次 fsync 的最大耗时，单位 ns
+}
+
+// MetricsSnapshot wal 写入统计的快照
+type MetricsSnapshot struct {
+	BytesWritten   uint64        // 追加写入的字节数，包含记录头部
+	RecordsWritten uint64        // 写入的记录个数. 一批 kv 对计为一条记录
+	Syncs          uint64        // fsync 次数
+	SyncTime       time.Duration // fsync 累计耗时
+	MaxSyncLatency time.Duration // 单次 fsync 的最大耗时
+}
+
+// Snapshot 读取当前的统计值
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		BytesWritten:   m.bytes.Load(),
+		RecordsWritten: m.records.Load(),
+		Syncs:          m.syncs.Load(),
+		SyncTime:       time.Duration(m.syncDur.Load()),
+		MaxSyncLatency: time.Duration(m.syncMax.Load()),
+	}
+}
+
+// AvgSyncLatency 单次 fsync 的平均耗时. 尚未 fsync 时返回 0
+func (s MetricsSnapshot) AvgSyncLatency() time.Duration {
+	if s.Syncs == 0 {
+		return 0
+	}
+	return s.SyncTime / time.Duration(s.Syncs)
+}
+
+// 记录一次追加写入
+func (m *Metrics) recordWrite(bytes, records int) {
+	if m == nil {
+		return
+	}
+	m.bytes.Add(uint64(bytes))
+	m.records.Add(uint64(records))
+}
+
+// 记录一次 fsync 的耗时
+func (m *Metrics) recordSync(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.syncs.Add(1)
+	m.syncDur.Add(int64(d))
+	for {
+		max := m.syncMax.Load()
+		if int64(d) <= max || m.syncMax.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE：只分配磁盘空间，不改变文件大小，回放时不会读到预分配的空间
+const fallocKeepSize = 0x1
+
+// 为文件预分配 size 大小的磁盘空间，后续写入不再需要分配数据块
+func preallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+}
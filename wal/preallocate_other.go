@@ -0,0 +1,10 @@
+//go:build !linux
+
+package wal
+
+import "os"
+
+// 当前平台不支持预分配磁盘空间，直接忽略
+func preallocate(f *os.File, size int64) error {
+	return nil
+}
@@ -5,19 +5,64 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 
+	"github.com/cccccxxy/lsmart/format"
 	"github.com/cccccxxy/lsmart/memtable"
 )
 
+func init() {
+	// 新版本必须能够读取全部老版本的 wal 文件
+	format.MustSupportAll(format.KindWAL, walReadable)
+	format.MustSupportAll(format.KindSharedWAL, walReadable)
+}
+
+// 当前代码能够读取的 wal 格式版本
+func walReadable(v format.Version) bool {
+	return v >= 1 && v <= 6
+}
+
 // WALReader wal 文件读取器
 type WALReader struct {
-	file   string        // 预写日志文件名，是包含了目录在内的绝对路径
-	src    *os.File      // 预写日志文件
-	reader *bufio.Reader // 基于 bufio reader 对日志文件的封装
+	file       string         // 预写日志文件名，是包含了目录在内的绝对路径
+	src        *os.File       // 预写日志文件
+	reader     *bufio.Reader  // 基于 bufio reader 对日志文件的封装
+	tagged     bool           // 是否为共享 wal. 共享 wal 中每条记录带有所属 memtable 的 index
+	version    format.Version // wal 文件的格式版本
+	generation uint32         // 版本 5 起的文件代数，代数不一致的记录是回收之前遗留的记录
+	limiter    *ReplayLimiter // 回放限速器，为空时不限速
+
+	headerSize int64 // 文件头部的大小，老版本的 wal 文件没有头部
+	validSize  int64 // 回放之后，最后一条完整记录在文件中的结束位置
+	truncated  bool  // 回放时是否在尾部遇到了不完整或者校验失败的记录
+
+	mode    RecoveryMode       // 遇到异常记录时的处理方式
+	stopAt  func(*Record) bool // 回放在首条满足条件的记录处停止. 为空时回放全部记录
+	stopped bool               // 回放是否因为 stopAt 停止
+	skipped []int64            // 跳过的异常记录在文件中的起始位置
+
+	checkpoint uint64 // 回放过程中遇到的检查点记录中最大的 seq
 }
 
+// RecoveryMode 回放 wal 时遇到不完整或者校验失败的记录的处理方式. 版本 4 之前的 wal 没有校验和，不区分处理方式
+type RecoveryMode int
+
+const (
+	// RecoverTolerateTail 在首条不完整或者校验失败的记录处停止，视为宕机时写了一半的尾部. 默认方式
+	RecoverTolerateTail RecoveryMode = iota
+	// RecoverStrict 遇到任何不完整或者校验失败的记录均返回 ErrCorruptWAL
+	RecoverStrict
+	// RecoverSkipCorrupt 跳过长度完整但是校验失败的记录，继续回放之后的记录，可以通过 Skipped 获取跳过的记录.
+	// 记录长度超出文件末尾时无法定位下一条记录，仍然在此停止
+	RecoverSkipCorrupt
+)
+
+// ErrCorruptWAL 严格模式下回放 wal 时遇到了不完整或者校验失败的记录. 可以通过 errors.Is 判断
+var ErrCorruptWAL = errors.New("corrupt wal")
+
 // NewWALReader 构造器函数.
 func NewWALReader(file string) (*WALReader, error) {
 	// 以只读模式打开 wal 文件，要求目标文件必须存在
@@ -26,17 +71,89 @@ func NewWALReader(file string) (*WALReader, error) {
 		return nil, err
 	}
 
+	reader := bufio.NewReader(src)
+	// 读取文件头部，获取 wal 文件的格式版本
+	version, generation, err := readHeader(reader)
+	if err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+	if !walReadable(version) {
+		_ = src.Close()
+		return nil, fmt.Errorf("%w: wal version %d, supported up to %d", format.ErrUnsupportedVersion, version, format.Current(format.KindWAL))
+	}
+
 	return &WALReader{
-		file:   file,
-		src:    src,
-		reader: bufio.NewReader(src),
+		file:       file,
+		src:        src,
+		reader:     reader,
+		version:    version,
+		generation: generation,
+		headerSize: headerSizeOf(version),
 	}, nil
 }
 
+// Version wal 文件的格式版本. 版本 1 的 wal 文件中存放的是用户 value，之后的版本中存放的是内部记录的 value
+func (w *WALReader) Version() format.Version {
+	return w.version
+}
+
+// Truncated 回放时是否在文件尾部遇到了不完整或者校验失败的记录，例如宕机时写了一半的记录. 回放在该记录之前停止，
+// 继续追加写入该文件之前需要截断到 ValidSize，否则后续的记录无法被回放
+func (w *WALReader) Truncated() bool {
+	return w.truncated
+}
+
+// ValidSize 回放之后，最后一条完整记录在文件中的结束位置，单位 byte
+func (w *WALReader) ValidSize() int64 {
+	return w.validSize
+}
+
+// SetRecoveryMode 设置回放时遇到异常记录的处理方式
+func (w *WALReader) SetRecoveryMode(mode RecoveryMode) {
+	w.mode = mode
+}
+
+// SetStopAt 回放在首条使得 stop 返回 true 的记录处停止，该记录以及之后的记录均不回放，ValidSize 为该记录的起始位置.
+// 用于按时间点恢复
+func (w *WALReader) SetStopAt(stop func(record *Record) bool) {
+	w.stopAt = stop
+}
+
+// Stopped 回放是否因为 SetStopAt 设置的条件而停止
+func (w *WALReader) Stopped() bool {
+	return w.stopped
+}
+
+// Checkpoint 回放过程中遇到的检查点记录中最大的 seq，没有检查点记录时为 0
+func (w *WALReader) Checkpoint() uint64 {
+	return w.checkpoint
+}
+
+// Skipped RecoverSkipCorrupt 模式下跳过的记录在文件中的起始位置
+func (w *WALReader) Skipped() []int64 {
+	return w.skipped
+}
+
+// SetReplayLimiter 设置回放 wal 时使用的限速器
+func (w *WALReader) SetReplayLimiter(limiter *ReplayLimiter) {
+	w.limiter = limiter
+}
+
+// NewSharedWALReader 共享 wal 读取器构造器.
+func NewSharedWALReader(file string) (*WALReader, error) {
+	r, err := NewWALReader(file)
+	if err != nil {
+		return nil, err
+	}
+	r.tagged = true
+	return r, nil
+}
+
 // RestoreToMemtable 读取 wal 文件，将所有内容注入到 memtable 中，以实现内存数据的复原
 func (w *WALReader) RestoreToMemtable(memTable memtable.MemTable) error {
 	// 读取 wal 文件全量内容
-	body, err := io.ReadAll(w.reader)
+	body, err := io.ReadAll(w.limiter.wrap(w.reader))
 	if err != nil {
 		return err
 	}
@@ -47,7 +164,7 @@ func (w *WALReader) RestoreToMemtable(memTable memtable.MemTable) error {
 	}()
 
 	// 将文件中读取到的内容解析成一系列 kv 对
-	kvs, err := w.readAll(bytes.NewReader(body))
+	_, kvs, err := w.readAll(bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -60,46 +177,203 @@ func (w *WALReader) RestoreToMemtable(memTable memtable.MemTable) error {
 	return nil
 }
 
-// 将文件中读到的原始内容解析成一系列 kv 对数据
-func (w *WALReader) readAll(reader *bytes.Reader) ([]*memtable.KV, error) {
-	var kvs []*memtable.KV
-	// 循环读取每组 kv 对，直到遇到 eof 错误才终止流程
-	for {
-		// 从 reader 中读取首个 uint64 作为 key 长度
-		keyLen, err := binary.ReadUvarint(reader)
-		// 如果遇到 eof 错误说明文件内容已经读取完毕，终止流程
-		if errors.Is(err, io.EOF) {
-			break
+// RestoreToMemtables 读取共享 wal 文件，按照记录所属 memtable 的 index 还原出一系列 memtable.
+// index 小于 watermark 的记录对应的 memtable 已经落盘，直接跳过. 返回结果按照 index 升序排列
+func (w *WALReader) RestoreToMemtables(watermark int, constructor memtable.MemTableConstructor) ([]int, []memtable.MemTable, error) {
+	// 读取 wal 文件全量内容
+	body, err := io.ReadAll(w.limiter.wrap(w.reader))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 兜底保证文件偏移量被重置到起始位置
+	defer func() {
+		_, _ = w.src.Seek(0, io.SeekStart)
+	}()
+
+	// 将文件中读取到的内容解析成一系列带 index 标识的 kv 对
+	tags, kvs, err := w.readAll(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 依次将 kv 数据注入到所属的 memtable 中. 同一个 memtable 的记录在文件中总是晚于更小 index 的记录写入
+	var (
+		indexes   []int
+		memTables []memtable.MemTable
+	)
+	for i, kv := range kvs {
+		if tags[i] < watermark {
+			continue
+		}
+		if len(indexes) == 0 || indexes[len(indexes)-1] != tags[i] {
+			indexes = append(indexes, tags[i])
+			memTables = append(memTables, constructor())
+		}
+		memTables[len(memTables)-1].Put(kv.Key, kv.Value)
+	}
+
+	return indexes, memTables, nil
+}
+
+// 将文件中读到的原始内容解析成一系列 kv 对数据. 共享 wal 模式下，同时返回每笔 kv 对所属 memtable 的 index
+func (w *WALReader) readAll(reader *bytes.Reader) ([]int, []*memtable.KV, error) {
+	var (
+		tags []int
+		kvs  []*memtable.KV
+	)
+	it := &RecordIterator{w: w, body: reader}
+	for it.Next() {
+		for _, kv := range it.Record().KVs {
+			if w.tagged {
+				tags = append(tags, it.Record().Tag)
+			}
+			kvs = append(kvs, kv)
 		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	return tags, kvs, nil
+}
+
+// errCorruptRecord 记录的校验和与内容不一致，或者通过校验的记录内容无法解析
+var errCorruptRecord = errors.New("corrupt wal record")
+
+// 读取下一条记录. 版本 4 起先校验记录头部的校验和与长度，再解析记录内容.
+// 版本 5 起文件代数与文件头部不一致的记录是回收之前遗留的记录，视为文件末尾
+func (w *WALReader) nextRecord(reader *bytes.Reader) (*Record, error) {
+	if w.version < 4 {
+		return w.readRecord(reader)
+	}
+
+	headerSize := recordHeaderSizeOf(w.version)
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[4:])
+	if int64(length) > int64(reader.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	record := make([]byte, headerSize-4+int(length))
+	copy(record, header[4:])
+	_, _ = io.ReadFull(reader, record[headerSize-4:])
+	if crc32.Checksum(record, castagnoliTable) != binary.LittleEndian.Uint32(header[:4]) {
+		return nil, errCorruptRecord
+	}
+	if w.version >= 5 && binary.LittleEndian.Uint32(header[recordHeaderSize:]) != w.generation {
+		return nil, io.EOF
+	}
+
+	body := bytes.NewReader(record[headerSize-4:])
+	r, err := w.readRecord(body)
+	if err != nil || body.Len() > 0 {
+		return nil, errCorruptRecord
+	}
+	return r, nil
+}
+
+// 读取一条记录. 版本 3 之前每条记录只有一笔 kv 对，之后的版本在 kv 对之前记录了个数.
+// 版本 6 起记录以类型开头，单笔写入、删除的记录不再记录个数，检查点记录只有 seq.
+// 文件内容恰好读取完毕时返回 io.EOF，记录不完整时返回 io.ErrUnexpectedEOF
+func (w *WALReader) readRecord(reader *bytes.Reader) (*Record, error) {
+	// 版本 6 起从 reader 中读取首个 byte 作为记录类型. 版本 6 的记录总是带有头部，读取失败视为记录损坏
+	record := Record{Type: RecordBatch}
+	if w.version >= 6 {
+		typ, err := reader.ReadByte()
 		if err != nil {
 			return nil, err
 		}
+		record.Type = RecordType(typ)
+		if record.Type < RecordPut || record.Type > RecordCheckpoint {
+			return nil, errCorruptRecord
+		}
+	}
 
-		// 从 reader 中读取下一个 uint64 作为 val 长度
-		valLen, err := binary.ReadUvarint(reader)
+	// 共享 wal 模式下，从 reader 中读取下一个 uint64 作为所属 memtable 的 index
+	if w.tagged {
+		tag, err := binary.ReadUvarint(reader)
 		if err != nil {
-			return nil, err
+			return nil, unexpectedEOF(err, w.version >= 6)
 		}
+		record.Tag = int(tag)
+	}
 
-		// 从 reader 中读取对应于 key 长度的字节数作为 key
-		keyBuf := make([]byte, keyLen)
-		if _, err = io.ReadFull(reader, keyBuf); err != nil {
-			return nil, err
+	// 检查点记录只有 seq
+	if record.Type == RecordCheckpoint {
+		seq, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, unexpectedEOF(err, true)
 		}
+		record.Seq = seq
+		return &record, nil
+	}
 
-		// 从 reader 中读取对应于 val 长度的字节数作为 val
-		valBuf := make([]byte, valLen)
-		if _, err = io.ReadFull(reader, valBuf); err != nil {
-			return nil, err
+	// 从 reader 中读取 kv 对个数. 单笔写入、删除的记录只有一笔 kv 对
+	cnt := uint64(1)
+	if w.version >= 3 && record.Type == RecordBatch {
+		var err error
+		if cnt, err = binary.ReadUvarint(reader); err != nil {
+			return nil, unexpectedEOF(err, w.tagged || w.version >= 6)
 		}
+	}
 
-		kvs = append(kvs, &memtable.KV{
-			Key:   keyBuf,
-			Value: valBuf,
-		})
+	record.KVs = make([]*memtable.KV, 0, cnt)
+	for i := uint64(0); i < cnt; i++ {
+		kv, err := readKV(reader)
+		if err != nil {
+			// 只有无标识、无个数的记录才可能在读取 key 长度时恰好遇到文件末尾
+			return nil, unexpectedEOF(err, w.tagged || w.version >= 3 || i > 0)
+		}
+		record.KVs = append(record.KVs, kv)
+	}
+	// 老版本的记录没有类型，按照 kv 对个数推断
+	if w.version < 6 && cnt == 1 {
+		record.Type = RecordPut
 	}
+	return &record, nil
+}
 
-	return kvs, nil
+// 读取一笔 kv 对
+func readKV(reader *bytes.Reader) (*memtable.KV, error) {
+	// 从 reader 中读取 uint64 作为 key 长度
+	keyLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// 从 reader 中读取下一个 uint64 作为 val 长度
+	valLen, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, unexpectedEOF(err, true)
+	}
+
+	// 从 reader 中读取对应于 key 长度的字节数作为 key
+	keyBuf := make([]byte, keyLen)
+	if _, err = io.ReadFull(reader, keyBuf); err != nil {
+		return nil, unexpectedEOF(err, true)
+	}
+
+	// 从 reader 中读取对应于 val 长度的字节数作为 val
+	valBuf := make([]byte, valLen)
+	if _, err = io.ReadFull(reader, valBuf); err != nil {
+		return nil, unexpectedEOF(err, true)
+	}
+
+	return &memtable.KV{
+		Key:   keyBuf,
+		Value: valBuf,
+	}, nil
+}
+
+// 记录已读取了一部分内容时，遇到文件末尾说明记录不完整
+func unexpectedEOF(err error, partial bool) error {
+	if partial && errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 func (w *WALReader) Close() {
@@ -0,0 +1,90 @@
+package wal
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// 回放 wal 时单次读取的最大字节数
+const replayChunkSize = 64 * 1024
+
+// ReplayLimiter wal 回放限速器. 限制启动阶段回放 wal 的读取速率，避免占满共享磁盘的 IO，并汇报回放进度.
+// 一次启动过程中回放的所有 wal 文件共用同一个 limiter
+type ReplayLimiter struct {
+	rate     int64                       // 每秒允许读取的字节数. 小于等于 0 时不限速
+	total    int64                       // 需要回放的 wal 文件总大小，单位 byte
+	replayed atomic.Int64                // 已经回放的字节数
+	start    time.Time                   // 开始回放的时间
+	progress func(replayed, total int64) // 进度回调，每读取一批数据调用一次. 可以为空
+}
+
+// NewReplayLimiter 构造器. rate 为每秒允许读取的字节数，total 为需要回放的 wal 文件总大小
+func NewReplayLimiter(rate, total int64, progress func(replayed, total int64)) *ReplayLimiter {
+	return &ReplayLimiter{
+		rate:     rate,
+		total:    total,
+		start:    time.Now(),
+		progress: progress,
+	}
+}
+
+// Progress 返回已经回放的字节数以及需要回放的总字节数
+func (l *ReplayLimiter) Progress() (replayed, total int64) {
+	return l.replayed.Load(), l.total
+}
+
+// Finish 标记回放完成. 文件头部等不经由限速器读取的数据也一并计入进度
+func (l *ReplayLimiter) Finish() {
+	l.replayed.Store(l.total)
+	if l.progress != nil {
+		l.progress(l.total, l.total)
+	}
+}
+
+// 将 reader 包装为受限速器约束的 reader
+func (l *ReplayLimiter) wrap(reader io.Reader) io.Reader {
+	if l == nil {
+		return reader
+	}
+	return &limitedReader{reader: reader, limiter: l}
+}
+
+// 登记读取了 n 个字节. 读取速度超出限制时，休眠至与速率相符的时间点
+func (l *ReplayLimiter) wait(n int) {
+	replayed := l.replayed.Add(int64(n))
+	if l.progress != nil {
+		l.progress(replayed, l.total)
+	}
+	if l.rate <= 0 {
+		return
+	}
+
+	expected := time.Duration(float64(replayed) / float64(l.rate) * float64(time.Second))
+	if elapsed := time.Since(l.start); elapsed < expected {
+		time.Sleep(expected - elapsed)
+	}
+}
+
+// 每次读取之后都经由限速器登记的 reader
+type limitedReader struct {
+	reader  io.Reader
+	limiter *ReplayLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// 限制单次读取的数据量，使得读取速率更加平滑
+	chunk := int64(replayChunkSize)
+	if r.limiter.rate > 0 && r.limiter.rate < chunk {
+		chunk = r.limiter.rate
+	}
+	if int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,37 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// ReadWatermark 读取共享 wal 的截断水位. 水位之下的 memtable 均已落盘，对应的日志记录无需还原. 水位文件不存在时返回 0
+func ReadWatermark(file string) (int, error) {
+	body, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	watermark, n := binary.Uvarint(body)
+	if n <= 0 {
+		return 0, errors.New("invalid wal watermark file")
+	}
+	return int(watermark), nil
+}
+
+// WriteWatermark 持久化共享 wal 的截断水位. 先写临时文件再重命名，保证水位文件不会出现写一半的情况
+func WriteWatermark(file string, watermark int) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[0:], uint64(watermark))
+
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, buf[:n], 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
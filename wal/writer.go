@@ -1,47 +1,318 @@
 package wal
 
 import (
+	"bufio"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"time"
+
+	"github.com/cccccxxy/lsmart/format"
+	"github.com/cccccxxy/lsmart/memtable"
 )
 
 // WALWriter 预写日志写入口
 type WALWriter struct {
-	file         string   // 预写日志文件名，是包含了目录在内的绝对路径
-	dest         *os.File // 预写日志文件
-	assistBuffer [30]byte // 辅助转移数据使用的临时缓冲区
+	file         string         // 预写日志文件名，是包含了目录在内的绝对路径
+	dest         *os.File       // 预写日志文件
+	version      format.Version // 追加记录时遵循的格式版本，与文件头部一致
+	generation   uint32         // 版本 5 起的文件代数，与文件头部一致，写入每条记录的头部
+	assistBuffer [30]byte       // 辅助转移数据使用的临时缓冲区
+	size         int64          // 已写入内容的大小，单位 byte. 回收的文件中不包含上一代遗留的内容
+
+	tagged bool   // 是否为共享 wal. 共享 wal 中每条记录需要带上所属 memtable 的 index
+	tag    uint64 // 共享 wal 模式下，当前写入记录所属 memtable 的 index
+
+	metrics *Metrics      // 写入统计. 为空时不统计
+	buf     *bufio.Writer // 写入缓冲区. 为空时每次写入直接写到文件
+
+	tombstone func(value []byte) bool // 判断 value 是否为墓碑记录. 为空时单笔记录均写为 RecordPut
 }
 
 // NewWALWriter 构造器
 func NewWALWriter(file string) (*WALWriter, error) {
-	// 打开 wal 文件，如果文件不存在则进行创建
-	dest, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY, 0644)
+	// 以追加模式打开 wal 文件，如果文件不存在则进行创建
+	dest, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, err
 	}
 
+	// 新建的 wal 文件需要写入文件头部，已存在的文件沿用其格式版本
+	version, generation, err := writeHeader(dest, format.KindWAL)
+	if err != nil {
+		_ = dest.Close()
+		return nil, err
+	}
+	info, err := dest.Stat()
+	if err != nil {
+		_ = dest.Close()
+		return nil, err
+	}
+
 	return &WALWriter{
-		file: file,
-		dest: dest,
+		file:       file,
+		dest:       dest,
+		version:    version,
+		generation: generation,
+		size:       info.Size(),
+	}, nil
+}
+
+// RecycleWALWriter 回收已经落盘的 wal 文件 old，重命名为 file 后从头覆盖写入，避免新建文件以及分配磁盘空间带来的元数据开销.
+// 文件代数加 1 并先于重命名落盘，上一代遗留的记录在回放时被识别并忽略. old 不是当前格式版本时无法回收，返回错误
+func RecycleWALWriter(old, file string) (*WALWriter, error) {
+	dest, err := os.OpenFile(old, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w, err := recycle(dest, old, file)
+	if err != nil {
+		_ = dest.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func recycle(dest *os.File, old, file string) (*WALWriter, error) {
+	version, generation, err := readFileHeader(dest)
+	if err != nil {
+		return nil, err
+	}
+	if current := format.Current(format.KindWAL); version != current {
+		return nil, fmt.Errorf("wal: cannot recycle %s of version %d, current version is %d", old, version, current)
+	}
+
+	// 新的文件代数落盘之后再重命名，宕机后重命名得到的文件中不会回放出上一代的记录
+	header := encodeHeader(version, generation+1)
+	if _, err = dest.WriteAt(header, 0); err != nil {
+		return nil, err
+	}
+	if err = dest.Sync(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(old, file); err != nil {
+		return nil, err
+	}
+	if _, err = dest.Seek(int64(len(header)), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &WALWriter{
+		file:       file,
+		dest:       dest,
+		version:    version,
+		generation: generation + 1,
+		size:       int64(len(header)),
+	}, nil
+}
+
+// NewSharedWALWriter 共享 wal 写入口构造器. 多个 memtable 的记录以追加的方式写入同一个文件，tag 为当前 memtable 的 index
+func NewSharedWALWriter(file string, tag int) (*WALWriter, error) {
+	// 以追加模式打开 wal 文件，如果文件不存在则进行创建
+	dest, err := os.OpenFile(file, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// 新建的 wal 文件需要写入文件头部，已存在的文件沿用其格式版本
+	version, generation, err := writeHeader(dest, format.KindSharedWAL)
+	if err != nil {
+		_ = dest.Close()
+		return nil, err
+	}
+	info, err := dest.Stat()
+	if err != nil {
+		_ = dest.Close()
+		return nil, err
+	}
+
+	return &WALWriter{
+		file:       file,
+		dest:       dest,
+		version:    version,
+		generation: generation,
+		size:       info.Size(),
+		tagged:     true,
+		tag:        uint64(tag),
 	}, nil
 }
 
 // 写入一笔 kv 对到 wal 文件中
 func (w *WALWriter) Write(key, value []byte) error {
-	// 首先将key 和 value 长度填充到临时缓冲区 assistBuffer 中
-	n := binary.PutUvarint(w.assistBuffer[0:], uint64(len(key)))
-	n += binary.PutUvarint(w.assistBuffer[n:], uint64(len(value)))
+	return w.WriteBatch([]*memtable.KV{{Key: key, Value: value}})
+}
+
+// WriteBatch 将一批 kv 对作为一条记录写入 wal 文件中. 回放时一条记录中的 kv 对要么全部还原，要么全部丢弃.
+// 版本 3 之前的 wal 文件不支持批量记录，只能逐笔写入，不保证原子性
+func (w *WALWriter) WriteBatch(kvs []*memtable.KV) error {
+	return w.WriteBatches([][]*memtable.KV{kvs})
+}
 
-	// 依次将 key 长度、val 长度、key、val 填充到 buf 中
+// WriteBatches 将多批 kv 对分别作为一条记录，通过一次写操作写入 wal 文件中，用于合并多个写入方的提交.
+// 每批 kv 对的原子性与 WriteBatch 一致. 版本 6 起只有一笔 kv 对的批次写为 RecordPut 或者 RecordDelete 记录
+func (w *WALWriter) WriteBatches(batches [][]*memtable.KV) error {
 	var buf []byte
+	for _, kvs := range batches {
+		buf = w.appendRecord(buf, kvs)
+	}
+	return w.write(buf, len(batches))
+}
+
+// WriteCheckpoint 写入一条检查点记录，记录当前已经分配的最大 seq. 版本 6 之前的 wal 文件不支持检查点，直接忽略
+func (w *WALWriter) WriteCheckpoint(seq uint64) error {
+	if w.version < 6 {
+		return nil
+	}
+	buf := make([]byte, recordHeaderSizeOf(w.version), recordHeaderSizeOf(w.version)+1+2*binary.MaxVarintLen64)
+	buf = append(buf, byte(RecordCheckpoint))
+	buf = w.appendTag(buf)
+	buf = binary.AppendUvarint(buf, seq)
+	w.frameRecord(buf)
+	return w.write(buf, 1)
+}
+
+// 将编码好的若干条记录通过一次写操作写入到 wal 文件中. 开启缓冲时写入缓冲区，缓冲区写满时才写到文件
+func (w *WALWriter) write(buf []byte, records int) error {
+	var dest io.Writer = w.dest
+	if w.buf != nil {
+		dest = w.buf
+	}
+	n, err := dest.Write(buf)
+	w.size += int64(n)
+	if err == nil {
+		w.metrics.recordWrite(n, records)
+	}
+	return err
+}
+
+// SetTombstoneFunc 设置墓碑记录的判断方式，版本 6 起 value 满足 isTombstone 的单笔记录写为 RecordDelete
+func (w *WALWriter) SetTombstoneFunc(isTombstone func(value []byte) bool) {
+	w.tombstone = isTombstone
+}
+
+// 将一批 kv 对编码为一条记录追加到 buf 中
+func (w *WALWriter) appendRecord(buf []byte, kvs []*memtable.KV) []byte {
+	if w.version < 3 {
+		for _, kv := range kvs {
+			buf = w.appendTag(buf)
+			buf = w.appendKV(buf, kv)
+		}
+		return buf
+	}
+
+	// [记录类型] || 共享 wal 模式下的 memtable index || kv 对个数 || 每笔 kv 对. 版本 4 起记录之前预留头部的位置.
+	// 版本 6 起以记录类型开头，单笔写入、删除的记录省略 kv 对个数
+	start := len(buf)
+	if w.version >= 4 {
+		buf = append(buf, make([]byte, recordHeaderSizeOf(w.version))...)
+	}
+	typ := RecordBatch
+	if w.version >= 6 {
+		if len(kvs) == 1 {
+			typ = RecordPut
+			if w.tombstone != nil && w.tombstone(kvs[0].Value) {
+				typ = RecordDelete
+			}
+		}
+		buf = append(buf, byte(typ))
+	}
+	buf = w.appendTag(buf)
+	if typ == RecordBatch {
+		n := binary.PutUvarint(w.assistBuffer[0:], uint64(len(kvs)))
+		buf = append(buf, w.assistBuffer[:n]...)
+	}
+	for _, kv := range kvs {
+		buf = w.appendKV(buf, kv)
+	}
+
+	// 版本 4 起记录之前写入校验和与记录长度，回放时据此识别不完整或者损坏的记录
+	if w.version >= 4 {
+		w.frameRecord(buf[start:])
+	}
+	return buf
+}
+
+// 在预留的头部写入校验和与记录长度：校验和 || 记录长度 || [文件代数] || 记录内容. 校验和覆盖校验和之后的全部内容
+func (w *WALWriter) frameRecord(framed []byte) {
+	headerSize := recordHeaderSizeOf(w.version)
+	binary.LittleEndian.PutUint32(framed[4:], uint32(len(framed)-headerSize))
+	if w.version >= 5 {
+		binary.LittleEndian.PutUint32(framed[recordHeaderSize:], w.generation)
+	}
+	binary.LittleEndian.PutUint32(framed[0:], crc32.Checksum(framed[4:], castagnoliTable))
+}
+
+// 共享 wal 模式下，将所属 memtable 的 index 追加到 buf 中
+func (w *WALWriter) appendTag(buf []byte) []byte {
+	if !w.tagged {
+		return buf
+	}
+	n := binary.PutUvarint(w.assistBuffer[0:], w.tag)
+	return append(buf, w.assistBuffer[:n]...)
+}
+
+// 依次将 key 长度、val 长度、key、val 追加到 buf 中
+func (w *WALWriter) appendKV(buf []byte, kv *memtable.KV) []byte {
+	n := binary.PutUvarint(w.assistBuffer[0:], uint64(len(kv.Key)))
+	n += binary.PutUvarint(w.assistBuffer[n:], uint64(len(kv.Value)))
 	buf = append(buf, w.assistBuffer[:n]...)
-	buf = append(buf, key...)
-	buf = append(buf, value...)
-	// 将以上内容写入到 wal 文件中
-	_, err := w.dest.Write(buf)
+	buf = append(buf, kv.Key...)
+	return append(buf, kv.Value...)
+}
+
+// Retag 共享 wal 模式下，切换后续写入记录所属 memtable 的 index
+func (w *WALWriter) Retag(tag int) {
+	w.tag = uint64(tag)
+}
+
+// Size wal 文件当前的大小，单位 byte
+func (w *WALWriter) Size() int64 {
+	return w.size
+}
+
+// Preallocate 为 wal 文件预分配 size 大小的磁盘空间，不改变文件大小. 后续写入不再需要分配数据块，
+// fsync 时需要落盘的元数据随之减少. 当前平台不支持时直接忽略
+func (w *WALWriter) Preallocate(size int64) error {
+	return preallocate(w.dest, size)
+}
+
+// SetMetrics 设置写入统计，后续的写入以及 fsync 计入 m
+func (w *WALWriter) SetMetrics(m *Metrics) {
+	w.metrics = m
+}
+
+// SetBufferSize 开启 size 大小的写入缓冲区，小批量的写入在缓冲区中积累，不必每次都执行一次写系统调用.
+// 缓冲区中的记录在 Flush 或者 Sync 之前尚未写到文件，进程崩溃时同样会丢失. size 小于等于 0 时不开启缓冲
+func (w *WALWriter) SetBufferSize(size int) {
+	if size <= 0 || w.buf != nil {
+		return
+	}
+	w.buf = bufio.NewWriterSize(w.dest, size)
+}
+
+// Flush 将缓冲区中的记录写到文件，此后进程崩溃不会丢失这些记录，但是不保证机器掉电后能够恢复
+func (w *WALWriter) Flush() error {
+	if w.buf == nil {
+		return nil
+	}
+	return w.buf.Flush()
+}
+
+// Sync 将缓冲区中的记录写到文件，并刷到磁盘
+func (w *WALWriter) Sync() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := w.dest.Sync()
+	w.metrics.recordSync(time.Since(start))
 	return err
 }
 
+// Close 将缓冲区中的记录写到文件，并关闭文件
 func (w *WALWriter) Close() {
+	_ = w.Flush()
 	_ = w.dest.Close()
 }
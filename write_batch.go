@@ -0,0 +1,109 @@
+package lsmart
+
+import (
+	"context"
+	"time"
+)
+
+// 批量写入中的一条记录
+type batchEntry struct {
+	op       OpType
+	key      []byte
+	value    []byte
+	expireAt int64 // 过期时间，unix 纳秒. 仅 OpPutTTL 记录使用
+}
+
+// 将记录编码为 seq 对应的内部记录 value
+func (e *batchEntry) internalValue(seq uint64) []byte {
+	if e.op == OpPutTTL {
+		return encodeTTLValue(seq, e.expireAt, e.value)
+	}
+	return EncodeInternalValue(e.op, seq, e.value)
+}
+
+// WriteBatch 批量写入. 累积一系列 Put、Delete 操作，通过 Tree.Write 一次性写入 lsm tree. 不保证并发安全
+type WriteBatch struct {
+	entries []*batchEntry
+	size    int // 累积的 key、value 总大小，单位 byte
+}
+
+// NewWriteBatch 构造一个空的批量写入
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put 追加一条写入操作
+func (b *WriteBatch) Put(key, value []byte) {
+	b.entries = append(b.entries, &batchEntry{op: OpPut, key: key, value: value})
+	b.size += len(key) + len(value)
+}
+
+// PutWithTTL 追加一条带过期时间的写入操作，过期时间自 Tree.Write 时刻起计算. ttl 小于等于 0 时等价于 Put
+func (b *WriteBatch) PutWithTTL(key, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		b.Put(key, value)
+		return
+	}
+	b.entries = append(b.entries, &batchEntry{op: OpPutTTL, key: key, value: value, expireAt: int64(ttl)})
+	b.size += len(key) + len(value)
+}
+
+// Delete 追加一条删除操作
+func (b *WriteBatch) Delete(key []byte) {
+	b.entries = append(b.entries, &batchEntry{op: OpDelete, key: key})
+	b.size += len(key)
+}
+
+// Len 累积的操作个数
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Size 累积的 key、value 总大小，单位 byte
+func (b *WriteBatch) Size() int {
+	return b.size
+}
+
+// Reset 清空累积的操作，以便复用
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+	b.size = 0
+}
+
+// WriteOptions 单次写入的选项
+type WriteOptions struct {
+	// DisableWAL 跳过预写日志，数据只写入 memtable. 适用于可以整体重做的批量导入：宕机时尚未落盘的 memtable
+	// 中跳过预写日志的数据全部丢失，Sync 也无法为其建立持久化点. 调用方可以在导入告一段落时调用 Flush，
+	// 待 memtable 溢写落盘后即获得持久化点
+	DisableWAL bool
+}
+
+// Write 原子地写入批量写入中的所有操作：整批操作作为一条 wal 记录落盘，并在一次写锁的持有期间写入 memtable.
+// 宕机重启后整批操作要么全部还原，要么全部丢弃，并发的读操作也不会看到写入了一半的批量写入
+func (t *Tree) Write(batch *WriteBatch) error {
+	return t.WriteWithOptions(batch, nil)
+}
+
+// WriteWithOptions 按照 opts 写入批量写入中的所有操作，opts 为空时与 Write 一致
+func (t *Tree) WriteWithOptions(batch *WriteBatch, opts *WriteOptions) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	// 写入之前校验所有的 key，任意一个 key 校验失败时整个批量写入均被拒绝
+	// 带过期时间的写入在批量写入中暂存的是 ttl，此处换算为过期时间
+	now := time.Now().UnixNano()
+	entries := make([]*batchEntry, 0, batch.Len())
+	for _, entry := range batch.entries {
+		if err := t.validateKey(entry.key, entry.op); err != nil {
+			return err
+		}
+		expireAt := entry.expireAt
+		if entry.op == OpPutTTL {
+			expireAt += now
+		}
+		entries = append(entries, &batchEntry{op: entry.op, key: t.encodeKey(entry.key), value: entry.value, expireAt: expireAt})
+	}
+
+	return t.commit(context.Background(), entries, opts)
+}